@@ -25,7 +25,9 @@ package analysis // import "kythe.io/kythe/go/platform/analysis"
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 
@@ -45,6 +47,23 @@ type CompilationAnalyzer interface {
 	Analyze(ctx context.Context, req *apb.AnalysisRequest, f OutputFunc) error
 }
 
+// A RetryAfter is an error reported by a CompilationAnalyzer that is
+// temporarily unable to handle requests, for example because it is
+// overloaded.  RetryAfter returns how long the caller should wait before
+// sending the request again.
+type RetryAfter interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// ErrStopDriver may be returned, or wrapped, by a CompilationAnalyzer to report
+// that the compilation was analyzed successfully and that the driver sending
+// it compilations should stop gracefully, because no further work is
+// meaningful, for example once it reaches a sentinel compilation marking the
+// end of a stream.  Unlike io.EOF or a queue's end, which are reported by the
+// source of compilations, the stop is requested by the analyzer.
+var ErrStopDriver = errors.New("analysis: stop driver")
+
 // EntryOutput returns an OutputFunc that unmarshals each output's value as an
 // Entry and calls f on it.
 func EntryOutput(f func(context.Context, *spb.Entry) error) OutputFunc {
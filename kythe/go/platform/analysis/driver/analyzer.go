@@ -0,0 +1,236 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A MultiAnalyzer is an analysis.CompilationAnalyzer that sends each request
+// to several analyzers concurrently, merging their outputs.  Calls to the
+// OutputFunc are serialized, but the outputs of different analyzers may be
+// interleaved.  Its AnalyzeDiagnosed method passes on the diagnostics of those
+// of its analyzers that are Diagnosers.
+type MultiAnalyzer struct {
+	Analyzers []analysis.CompilationAnalyzer
+
+	// If ContinueOnError is true, a failure by one analyzer does not affect the
+	// others, and Analyze reports an AnalyzerErrors value describing all the
+	// failures once every analyzer has finished.  Otherwise, the first failure
+	// cancels the remaining analyses and is returned.
+	ContinueOnError bool
+}
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (m *MultiAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	return m.AnalyzeDiagnosed(ctx, req, f, nil)
+}
+
+// AnalyzeDiagnosed implements the Diagnoser interface.
+func (m *MultiAnalyzer) AnalyzeDiagnosed(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc, diag DiagnosticFunc) error {
+	ctx, cancel := withCancelCause(ctx)
+	defer cancel(nil)
+
+	var outMu sync.Mutex
+	out := func(ctx context.Context, o *apb.AnalysisOutput) error {
+		outMu.Lock()
+		defer outMu.Unlock()
+		return f(ctx, o)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs AnalyzerErrors
+	)
+	for _, a := range m.Analyzers {
+		a := a
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := analyzeWith(ctx, a, req, out, diag); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				if !m.ContinueOnError {
+					cancel(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return nil
+	} else if !m.ContinueOnError {
+		return errs[0]
+	}
+	return errs
+}
+
+// AnalyzerErrors is the error reported by a MultiAnalyzer in ContinueOnError
+// mode when one or more of its analyzers fail.
+type AnalyzerErrors []error
+
+func (e AnalyzerErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d analyzers failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// A LanguageRouter is an analysis.CompilationAnalyzer that sends each request
+// to the analyzer registered for the language of the compilation's VName.  Its
+// AnalyzeDiagnosed method passes on the diagnostics of that analyzer, if it is
+// a Diagnoser.
+type LanguageRouter struct {
+	Analyzers map[string]analysis.CompilationAnalyzer // keyed by language
+
+	// If Default != nil, it receives the requests for languages having no
+	// analyzer in Analyzers.
+	Default analysis.CompilationAnalyzer
+
+	// If SkipUnknown is true, requests with no matching analyzer are ignored.
+	// Otherwise, Analyze reports an error for them.
+	SkipUnknown bool
+}
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (r *LanguageRouter) Analyze(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	return r.AnalyzeDiagnosed(ctx, req, f, nil)
+}
+
+// AnalyzeDiagnosed implements the Diagnoser interface.
+func (r *LanguageRouter) AnalyzeDiagnosed(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc, diag DiagnosticFunc) error {
+	lang := req.Compilation.GetVName().GetLanguage()
+	a, ok := r.Analyzers[lang]
+	if !ok {
+		a = r.Default
+	}
+	if a == nil {
+		if r.SkipUnknown {
+			return nil
+		}
+		return fmt.Errorf("driver: no analyzer for language %q", lang)
+	}
+	return analyzeWith(ctx, a, req, f, diag)
+}
+
+// LimitConcurrency returns an analysis.CompilationAnalyzer that passes each
+// request to inner, allowing at most max calls to inner to run at once.  This
+// bounds the use of a resource shared by the calls to inner independently of
+// the number of workers, for example for one of the analyzers of a
+// LanguageRouter.  A call waiting for its turn returns ctx.Err() if ctx ends
+// first.  The analyzer returned is a Diagnoser, which passes on the
+// diagnostics of inner if it is one.  LimitConcurrency panics if max <= 0.
+func LimitConcurrency(inner analysis.CompilationAnalyzer, max int) analysis.CompilationAnalyzer {
+	if max <= 0 {
+		panic(fmt.Sprintf("driver: invalid concurrency limit %d", max))
+	}
+	return &limitedAnalyzer{inner: inner, sem: make(chan struct{}, max)}
+}
+
+type limitedAnalyzer struct {
+	inner analysis.CompilationAnalyzer
+	sem   chan struct{} // holds a token for each call in progress
+}
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (l *limitedAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	return l.AnalyzeDiagnosed(ctx, req, f, nil)
+}
+
+// AnalyzeDiagnosed implements the Diagnoser interface.
+func (l *limitedAnalyzer) AnalyzeDiagnosed(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc, diag DiagnosticFunc) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case l.sem <- struct{}{}:
+	}
+	defer func() { <-l.sem }()
+	return analyzeWith(ctx, l.inner, req, f, diag)
+}
+
+// A CompareAnalyzer is an analysis.CompilationAnalyzer that analyzes each
+// request twice, against two file data services, and passes the outputs of
+// both analyses to Compare.  This supports comparing the behavior of an
+// analyzer across two revisions of its inputs.  Only the outputs of the
+// baseline analysis are passed on; they are forwarded as they are produced,
+// and the candidate analysis runs once the baseline analysis has succeeded.
+type CompareAnalyzer struct {
+	Analyzer analysis.CompilationAnalyzer
+
+	// Baseline and Candidate are the addresses of the file data services to
+	// analyze against.  If Baseline is "", the service named by the request is
+	// used.
+	Baseline, Candidate string
+
+	// Compare is called with the outputs of both analyses of each compilation
+	// for which both succeed.  An error from Compare fails the analysis.
+	// Analyze reports an error without analyzing anything if Analyzer or
+	// Compare is nil.
+	Compare func(ctx context.Context, unit *apb.CompilationUnit, baseline, candidate []*apb.AnalysisOutput) error
+}
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (c *CompareAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	if c.Analyzer == nil {
+		return errors.New("driver: CompareAnalyzer has no Analyzer")
+	} else if c.Compare == nil {
+		return errors.New("driver: CompareAnalyzer has no Compare function")
+	}
+	baseline := c.Baseline
+	if baseline == "" {
+		baseline = req.FileDataService
+	}
+	var base, cand []*apb.AnalysisOutput
+	if err := c.Analyzer.Analyze(ctx, withFileDataService(req, baseline), func(ctx context.Context, out *apb.AnalysisOutput) error {
+		base = append(base, proto.Clone(out).(*apb.AnalysisOutput))
+		return f(ctx, out)
+	}); err != nil {
+		return err
+	}
+	if err := c.Analyzer.Analyze(ctx, withFileDataService(req, c.Candidate), func(_ context.Context, out *apb.AnalysisOutput) error {
+		cand = append(cand, proto.Clone(out).(*apb.AnalysisOutput))
+		return nil
+	}); err != nil {
+		return errors.WithMessage(err, "driver: candidate analysis")
+	}
+	return c.Compare(ctx, req.Compilation, base, cand)
+}
+
+// withFileDataService returns a shallow copy of req directed at the file data
+// service fds.
+func withFileDataService(req *apb.AnalysisRequest, fds string) *apb.AnalysisRequest {
+	cp := *req
+	cp.FileDataService = fds
+	return &cp
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// emitter returns an analyzer that emits the given values, then returns err.
+func emitter(err error, vals ...string) analysis.CompilationAnalyzer {
+	return analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, out analysis.OutputFunc) error {
+		for _, o := range outs(vals...) {
+			if err := out(ctx, o); err != nil {
+				return err
+			}
+		}
+		return err
+	})
+}
+
+// collect returns an OutputFunc that appends each output value to *vals.
+func collect(vals *[]string) analysis.OutputFunc {
+	return func(_ context.Context, out *apb.AnalysisOutput) error {
+		*vals = append(*vals, string(out.Value))
+		return nil
+	}
+}
+
+func TestMultiAnalyzer(t *testing.T) {
+	m := &MultiAnalyzer{Analyzers: []analysis.CompilationAnalyzer{
+		emitter(nil, "a", "b"),
+		emitter(nil, "c"),
+	}}
+	var got []string
+	if err := m.Analyze(context.Background(), &apb.AnalysisRequest{}, collect(&got)); err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	sort.Strings(got)
+	checkSigs(t, got, "a", "b", "c")
+}
+
+func TestMultiAnalyzerErrors(t *testing.T) {
+	errA, errB := errors.New("A failed"), errors.New("B failed")
+	blocker := analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	// Fail-fast mode cancels the remaining analyzers.
+	m := &MultiAnalyzer{Analyzers: []analysis.CompilationAnalyzer{emitter(errA), blocker}}
+	var got []string
+	if err := m.Analyze(context.Background(), &apb.AnalysisRequest{}, collect(&got)); err != errA {
+		t.Errorf("Expected error %v; found %v", errA, err)
+	}
+
+	// Continue mode lets every analyzer finish.
+	m = &MultiAnalyzer{
+		Analyzers:       []analysis.CompilationAnalyzer{emitter(errA), emitter(nil, "ok"), emitter(errB)},
+		ContinueOnError: true,
+	}
+	err := m.Analyze(context.Background(), &apb.AnalysisRequest{}, collect(&got))
+	errs, ok := err.(AnalyzerErrors)
+	if !ok || len(errs) != 2 {
+		t.Errorf("Expected 2 AnalyzerErrors; found %v", err)
+	}
+	checkSigs(t, got, "ok")
+}
+
+func TestLanguageRouter(t *testing.T) {
+	req := func(lang string) *apb.AnalysisRequest {
+		return &apb.AnalysisRequest{Compilation: &apb.CompilationUnit{VName: &spb.VName{Language: lang}}}
+	}
+	r := &LanguageRouter{Analyzers: map[string]analysis.CompilationAnalyzer{
+		"go":   emitter(nil, "go"),
+		"java": emitter(nil, "java"),
+	}}
+
+	var got []string
+	for _, lang := range []string{"java", "go"} {
+		if err := r.Analyze(context.Background(), req(lang), collect(&got)); err != nil {
+			t.Errorf("Analyze(%q) failed: %v", lang, err)
+		}
+	}
+	checkSigs(t, got, "java", "go")
+
+	if err := r.Analyze(context.Background(), req("c++"), collect(&got)); err == nil {
+		t.Error("Expected error for unknown language")
+	}
+	r.SkipUnknown = true
+	if err := r.Analyze(context.Background(), req("c++"), collect(&got)); err != nil {
+		t.Errorf("Unexpected error for skipped language: %v", err)
+	}
+	r.Default = emitter(nil, "default")
+	got = nil
+	if err := r.Analyze(context.Background(), req("c++"), collect(&got)); err != nil {
+		t.Errorf("Unexpected error for default language: %v", err)
+	}
+	checkSigs(t, got, "default")
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		active, max int
+	)
+	inner := analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+		mu.Lock()
+		active++
+		if active > max {
+			max = active
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return nil
+	})
+	d := &Driver{Analyzer: LimitConcurrency(inner, 2), Concurrency: 6}
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d", "e", "f", "g", "h")}); err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	if max > 2 {
+		t.Errorf("Got %d concurrent calls, want at most 2", max)
+	}
+}
+
+func TestLimitConcurrencyCancel(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	a := LimitConcurrency(analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+		close(started)
+		<-release
+		return nil
+	}), 1)
+	done := make(chan error)
+	go func() { done <- a.Analyze(context.Background(), &apb.AnalysisRequest{}, nil) }()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := a.Analyze(ctx, &apb.AnalysisRequest{}, nil); err != context.DeadlineExceeded {
+		t.Errorf("Waiting Analyze: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("First Analyze failed: %v", err)
+	}
+}
+
+func TestCompareAnalyzer(t *testing.T) {
+	var services []string
+	c := &CompareAnalyzer{
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			services = append(services, req.FileDataService)
+			return out(ctx, &apb.AnalysisOutput{Value: []byte(req.FileDataService)})
+		}),
+		Candidate: "new",
+		Compare: func(_ context.Context, unit *apb.CompilationUnit, base, cand []*apb.AnalysisOutput) error {
+			if len(base) != 1 || len(cand) != 1 || string(base[0].Value) == string(cand[0].Value) {
+				t.Errorf("Compare(%v, %v): want one distinct output each", base, cand)
+			}
+			return errors.New("outputs differ")
+		},
+	}
+	req := &apb.AnalysisRequest{Compilation: &apb.CompilationUnit{}, FileDataService: "old"}
+	var got []string
+	err := c.Analyze(context.Background(), req, func(_ context.Context, out *apb.AnalysisOutput) error {
+		got = append(got, string(out.Value))
+		return nil
+	})
+	if err == nil || err.Error() != "outputs differ" {
+		t.Errorf("Analyze: got error %v, want the error from Compare", err)
+	}
+	if len(got) != 1 || got[0] != "old" {
+		t.Errorf("Forwarded outputs: got %q, want [old]", got)
+	}
+	if len(services) != 2 || services[0] != "old" || services[1] != "new" {
+		t.Errorf("Services analyzed: got %q, want [old new]", services)
+	}
+	if req.FileDataService != "old" {
+		t.Errorf("Request was modified: FileDataService = %q", req.FileDataService)
+	}
+}
+
+func TestCompareAnalyzerIncomplete(t *testing.T) {
+	var calls int
+	a := analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+		calls++
+		return nil
+	})
+	compare := func(context.Context, *apb.CompilationUnit, []*apb.AnalysisOutput, []*apb.AnalysisOutput) error {
+		return nil
+	}
+	req := &apb.AnalysisRequest{Compilation: &apb.CompilationUnit{}}
+	discard := func(context.Context, *apb.AnalysisOutput) error { return nil }
+	for _, c := range []*CompareAnalyzer{
+		{Compare: compare},
+		{Analyzer: a},
+	} {
+		if err := c.Analyze(context.Background(), req, discard); err == nil {
+			t.Errorf("Analyze with Analyzer=%v, Compare=%v: succeeded, want an error", c.Analyzer != nil, c.Compare != nil)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("Analyzer was called %d times, want 0", calls)
+	}
+}
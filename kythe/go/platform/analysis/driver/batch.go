@@ -0,0 +1,200 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A BatchAnalyzer is an analysis.CompilationAnalyzer that can also analyze
+// several compilations in a single call, to amortize a high fixed cost per
+// call.  A Driver whose BatchSize is > 1 sends its requests to AnalyzeBatch;
+// otherwise, or if the analyzer does not implement BatchAnalyzer, each
+// request is passed to Analyze on its own.
+type BatchAnalyzer interface {
+	analysis.CompilationAnalyzer
+
+	// AnalyzeBatch analyzes each of reqs, passing each output to out along
+	// with the index in reqs of the request that produced it.  If it returns
+	// a BatchError with one entry per request, each entry is the result of the
+	// corresponding request; any other error fails every request.
+	AnalyzeBatch(ctx context.Context, reqs []*apb.AnalysisRequest, out BatchOutputFunc) error
+}
+
+// A BatchOutputFunc handles a single output of the request at index in an
+// AnalyzeBatch call.
+type BatchOutputFunc func(ctx context.Context, index int, out *apb.AnalysisOutput) error
+
+// A BatchError reports the results of the individual requests of a batch, in
+// the order of the requests.  A nil entry means the request succeeded.
+type BatchError []error
+
+func (e BatchError) Error() string {
+	var n int
+	var first error
+	for _, err := range e {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	if n == 1 {
+		return first.Error()
+	}
+	return fmt.Sprintf("%d of %d requests failed; first: %v", n, len(e), first)
+}
+
+// defaultBatchDelay is the batch delay used if none is set.
+const defaultBatchDelay = 10 * time.Millisecond
+
+// A batcher is an analysis.CompilationAnalyzer that gathers concurrent
+// requests into batches for a BatchAnalyzer.  Each call to Analyze blocks
+// until the batch containing its request has been analyzed.
+type batcher struct {
+	analyzer BatchAnalyzer
+	size     int           // the maximum number of requests in a batch
+	delay    time.Duration // the longest a request waits for its batch to fill
+
+	mu      sync.Mutex
+	pending *batch // the batch being filled, or nil
+}
+
+// A batch is a group of requests analyzed together.
+type batch struct {
+	items []*batchItem
+	timer *time.Timer // flushes the batch when the delay expires
+}
+
+// A batchItem is a single request in a batch.
+type batchItem struct {
+	ctx  context.Context
+	req  *apb.AnalysisRequest
+	out  analysis.OutputFunc
+	done chan error // receives the result of the request
+
+	mu        sync.Mutex
+	abandoned bool // whether the caller of Analyze has returned
+}
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (b *batcher) Analyze(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+	item := &batchItem{ctx: ctx, req: req, out: out, done: make(chan error, 1)}
+	b.add(item)
+	select {
+	case err := <-item.done:
+		return err
+	case <-ctx.Done():
+		item.mu.Lock()
+		item.abandoned = true
+		item.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// add adds item to the pending batch, starting a new one if necessary, and
+// dispatches the batch if it is full.
+func (b *batcher) add(item *batchItem) {
+	b.mu.Lock()
+	p := b.pending
+	if p == nil {
+		p = new(batch)
+		b.pending = p
+		p.timer = time.AfterFunc(b.delay, func() { b.flush(p) })
+	}
+	p.items = append(p.items, item)
+	full := len(p.items) >= b.size
+	b.mu.Unlock()
+	if full {
+		b.flush(p)
+	}
+}
+
+// flush dispatches p, unless it has already been dispatched.
+func (b *batcher) flush(p *batch) {
+	b.mu.Lock()
+	if b.pending != p {
+		b.mu.Unlock()
+		return
+	}
+	b.pending = nil
+	b.mu.Unlock()
+	p.timer.Stop()
+	go b.dispatch(p)
+}
+
+// dispatch analyzes the requests of p and delivers their results.  The batch
+// is canceled if every request in it is abandoned.
+func (b *batcher) dispatch(p *batch) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live := make(chan struct{}, len(p.items))
+	reqs := make([]*apb.AnalysisRequest, len(p.items))
+	for i, item := range p.items {
+		reqs[i] = item.req
+		go func(item *batchItem) {
+			select {
+			case <-item.ctx.Done():
+			case <-ctx.Done():
+			}
+			live <- struct{}{}
+		}(item)
+	}
+	go func() {
+		for range p.items {
+			<-live
+		}
+		cancel()
+	}()
+
+	err := catch(func() error {
+		return b.analyzer.AnalyzeBatch(ctx, reqs, func(_ context.Context, i int, out *apb.AnalysisOutput) error {
+			if i < 0 || i >= len(p.items) {
+				return fmt.Errorf("driver: output for request %d of a batch of %d", i, len(p.items))
+			}
+			return p.items[i].write(out)
+		})
+	})
+	berr, perItem := err.(BatchError)
+	perItem = perItem && len(berr) == len(p.items)
+	for i, item := range p.items {
+		if perItem {
+			item.done <- berr[i]
+		} else {
+			item.done <- err
+		}
+	}
+}
+
+// write passes out to the OutputFunc of the request, with the context of its
+// call to Analyze.  Outputs for an abandoned request are rejected.
+func (item *batchItem) write(out *apb.AnalysisOutput) error {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	if item.abandoned {
+		return context.Canceled
+	}
+	return item.out(item.ctx, out)
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A batchAnalyzer is a BatchAnalyzer that writes the signature of each
+// request as its only output, and records the size of each batch.
+type batchAnalyzer struct {
+	mu      sync.Mutex
+	sizes   []int
+	single  int
+	failSig string // if set, the request with this signature fails
+}
+
+var errBatchFailure = errors.New("batch failure")
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (b *batchAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+	b.mu.Lock()
+	b.single++
+	b.mu.Unlock()
+	return out(ctx, &apb.AnalysisOutput{Value: []byte(req.Compilation.VName.Signature)})
+}
+
+// AnalyzeBatch implements the BatchAnalyzer interface.
+func (b *batchAnalyzer) AnalyzeBatch(ctx context.Context, reqs []*apb.AnalysisRequest, out BatchOutputFunc) error {
+	b.mu.Lock()
+	b.sizes = append(b.sizes, len(reqs))
+	b.mu.Unlock()
+	errs := make(BatchError, len(reqs))
+	var failed bool
+	for i, req := range reqs {
+		sig := req.Compilation.VName.Signature
+		if sig == b.failSig {
+			errs[i], failed = errBatchFailure, true
+			continue
+		}
+		if err := out(ctx, i, &apb.AnalysisOutput{Value: []byte(sig)}); err != nil {
+			errs[i], failed = err, true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// attributed returns a WriteOutput function that records each output under
+// the signature of the compilation it is attributed to.
+func attributed(t *testing.T, mu *sync.Mutex, got map[string]string) analysis.OutputFunc {
+	return func(ctx context.Context, out *apb.AnalysisOutput) error {
+		unit := CompilationFromContext(ctx)
+		if unit == nil {
+			t.Errorf("Output %q has no compilation in its context", out.Value)
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got[unit.VName.Signature] = string(out.Value)
+		return nil
+	}
+}
+
+func TestDriverBatch(t *testing.T) {
+	a := new(batchAnalyzer)
+	var mu sync.Mutex
+	got := make(map[string]string)
+	d := &Driver{
+		Analyzer:           a,
+		Concurrency:        3,
+		BatchSize:          3,
+		BatchDelay:         time.Second,
+		CompilationContext: true,
+		WriteOutput:        attributed(t, &mu, got),
+	}
+	sigs := []string{"a", "b", "c", "d", "e", "f"}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps(sigs...)}))
+
+	if err := testutil.DeepEqual([]int{3, 3}, a.sizes); err != nil {
+		t.Errorf("Batch sizes: %v", err)
+	}
+	if a.single != 0 {
+		t.Errorf("Analyze was called %d times, want 0", a.single)
+	}
+	want := make(map[string]string)
+	for _, sig := range sigs {
+		want[sig] = sig
+	}
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("Outputs: %v", err)
+	}
+}
+
+func TestDriverBatchDelay(t *testing.T) {
+	a := new(batchAnalyzer)
+	d := &Driver{
+		Analyzer:    a,
+		Concurrency: 2,
+		BatchSize:   4,
+		BatchDelay:  time.Millisecond,
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}))
+
+	var total int
+	for _, n := range a.sizes {
+		if n > 2 {
+			t.Errorf("Batch of %d requests, want at most Concurrency (2)", n)
+		}
+		total += n
+	}
+	if total != 3 {
+		t.Errorf("Batches held %d requests, want 3", total)
+	}
+}
+
+func TestDriverBatchError(t *testing.T) {
+	a := &batchAnalyzer{failSig: "b"}
+	var mu sync.Mutex
+	got := make(map[string]string)
+	var failed []string
+	d := &Driver{
+		Analyzer:           a,
+		Concurrency:        3,
+		BatchSize:          3,
+		BatchDelay:         time.Second,
+		ContinueOnError:    true,
+		CompilationContext: true,
+		WriteOutput:        attributed(t, &mu, got),
+		Context: testContext{
+			analysisError: func(_ context.Context, cu Compilation, err error) error {
+				if !errors.Is(err, errBatchFailure) {
+					t.Errorf("AnalysisError(%q): got %v, want %v", cu.Unit.VName.Signature, err, errBatchFailure)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				failed = append(failed, cu.Unit.VName.Signature)
+				return err
+			},
+		},
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}); err == nil {
+		t.Error("Driver succeeded, want a failure")
+	}
+	sort.Strings(failed)
+	if err := testutil.DeepEqual([]string{"b"}, failed); err != nil {
+		t.Errorf("Failed compilations: %v", err)
+	}
+	if err := testutil.DeepEqual(map[string]string{"a": "a", "c": "c"}, got); err != nil {
+		t.Errorf("Outputs: %v", err)
+	}
+}
+
+func TestDriverBatchUnsupported(t *testing.T) {
+	var n int
+	d := &Driver{
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			n++
+			return nil
+		}),
+		Concurrency: 1,
+		BatchSize:   3,
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}))
+	if n != 3 {
+		t.Errorf("Analyze was called %d times, want 3", n)
+	}
+}
+
+// A holdingBatchAnalyzer writes an output for each request and then, after
+// its callers may have returned, checks that its requests are unchanged.
+type holdingBatchAnalyzer struct {
+	batchAnalyzer
+	t *testing.T
+}
+
+// AnalyzeBatch implements the BatchAnalyzer interface.
+func (h *holdingBatchAnalyzer) AnalyzeBatch(ctx context.Context, reqs []*apb.AnalysisRequest, out BatchOutputFunc) error {
+	sigs := make([]string, len(reqs))
+	for i, req := range reqs {
+		sigs[i] = req.Compilation.VName.Signature
+		out(ctx, i, &apb.AnalysisOutput{Value: []byte(sigs[i])})
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i, req := range reqs {
+		if sig := req.Compilation.GetVName().GetSignature(); sig != sigs[i] {
+			h.t.Errorf("Request %d of a batch changed from %q to %q", i, sigs[i], sig)
+		}
+	}
+	return nil
+}
+
+func TestDriverBatchAbandoned(t *testing.T) {
+	// Each output stops its analysis, so the workers abandon their requests
+	// while the batch still holds them.
+	d := &Driver{
+		Analyzer:        &holdingBatchAnalyzer{t: t},
+		Concurrency:     2,
+		BatchSize:       2,
+		OutputPredicate: func(*apb.AnalysisOutput) bool { return true },
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d", "e", "f")}))
+}
+
+// A diagnosingBatchAnalyzer is a batchAnalyzer that is also a Diagnoser.
+type diagnosingBatchAnalyzer struct{ batchAnalyzer }
+
+// AnalyzeDiagnosed implements the Diagnoser interface.
+func (d *diagnosingBatchAnalyzer) AnalyzeDiagnosed(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc, _ DiagnosticFunc) error {
+	return d.Analyze(ctx, req, out)
+}
+
+func TestDriverBatchDiagnoser(t *testing.T) {
+	d := &Driver{Analyzer: new(diagnosingBatchAnalyzer), Concurrency: 2, BatchSize: 2}
+	if err := d.Validate(); err == nil {
+		t.Error("Validate accepted batching for a Diagnoser")
+	}
+	d.BatchSize = 0
+	testutil.FatalOnErrT(t, "Validate: %v", d.Validate())
+}
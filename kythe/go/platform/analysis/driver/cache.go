@@ -0,0 +1,191 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/platform/delimited"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// An OutputCache stores the outputs of previous analyses, under the keys
+// assigned to the analyzed compilations by a CachingAnalyzer's Keyer.  Keys
+// are arbitrary strings.  An OutputCache must be safe for concurrent use.
+type OutputCache interface {
+	// Load returns the outputs stored for key.  It reports false, with no
+	// error, if nothing is stored for key.
+	Load(key string) ([]*apb.AnalysisOutput, bool, error)
+
+	// Store records outs as the outputs for key, replacing any already stored.
+	Store(key string, outs []*apb.AnalysisOutput) error
+}
+
+// A CachingAnalyzer is an analysis.CompilationAnalyzer that reuses the outputs
+// of earlier analyses of the same compilation, as identified by Keyer.  Since
+// the default key covers the inputs (including their digests), arguments, and
+// VName of a compilation, a change to any of them causes the compilation to be
+// analyzed again.
+//
+// On a cache hit the stored outputs are replayed in their original order and
+// Analyzer is not called.  On a miss the request is passed to Analyzer, whose
+// outputs are forwarded as they are produced and stored once it succeeds.
+// Nothing is stored for a failed analysis.
+type CachingAnalyzer struct {
+	Analyzer analysis.CompilationAnalyzer
+	Cache    OutputCache
+
+	// If Bypass != nil, requests for which it returns true are passed to
+	// Analyzer without consulting the cache, and their outputs are stored,
+	// replacing any earlier entry.  Use it to force re-analysis.
+	Bypass func(*apb.AnalysisRequest) bool
+
+	// Keyer identifies the compilations in the cache.  If nil, KeyOf is used.
+	Keyer Keyer
+}
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (c *CachingAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	return c.AnalyzeDiagnosed(ctx, req, f, nil)
+}
+
+// AnalyzeDiagnosed implements the Diagnoser interface.  The diagnostics of
+// Analyzer are passed on if it is a Diagnoser; they are not cached, so a
+// request answered from the cache reports none.
+func (c *CachingAnalyzer) AnalyzeDiagnosed(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc, diag DiagnosticFunc) error {
+	key := KeyOf
+	if c.Keyer != nil {
+		key = c.Keyer
+	}
+	if c.Bypass == nil || !c.Bypass(req) {
+		outs, ok, err := c.Cache.Load(key(req.Compilation))
+		if err != nil {
+			return errors.WithMessage(err, "driver: reading analysis cache")
+		} else if ok {
+			for _, out := range outs {
+				if err := f(ctx, out); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	var outs []*apb.AnalysisOutput
+	if err := analyzeWith(ctx, c.Analyzer, req, func(ctx context.Context, out *apb.AnalysisOutput) error {
+		// The analyzer may reuse out once f returns, so keep a copy.
+		outs = append(outs, proto.Clone(out).(*apb.AnalysisOutput))
+		return f(ctx, out)
+	}, diag); err != nil {
+		return err
+	}
+	return errors.WithMessage(c.Cache.Store(key(req.Compilation), outs), "driver: writing analysis cache")
+}
+
+// A FileCache is an OutputCache that stores the outputs for each key in a
+// separate file in a directory, as a stream of delimited AnalysisOutput
+// messages.  Each file is named by the SHA-256 digest of its key, so a key
+// need not be a valid file name.
+type FileCache struct {
+	Dir string
+}
+
+// NewFileCache returns a FileCache storing its entries in dir, creating the
+// directory if necessary.
+func NewFileCache(dir string) (*FileCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.WithMessage(err, "driver: creating cache directory")
+	}
+	return &FileCache{Dir: dir}, nil
+}
+
+// cacheName returns the base name of the file holding the entry for key.
+func cacheName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *FileCache) path(key string) string { return filepath.Join(c.Dir, cacheName(key)+".outputs") }
+
+// Load implements the OutputCache interface.
+func (c *FileCache) Load(key string) ([]*apb.AnalysisOutput, bool, error) {
+	f, err := os.Open(c.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	outs := []*apb.AnalysisOutput{}
+	rd := delimited.NewReader(f)
+	for {
+		var out apb.AnalysisOutput
+		if err := rd.NextProto(&out); err == io.EOF {
+			return outs, true, nil
+		} else if err != nil {
+			return nil, false, errors.WithMessagef(err, "cache entry %s", key)
+		}
+		outs = append(outs, &out)
+	}
+}
+
+// Store implements the OutputCache interface.  The entry is written to a
+// temporary file and renamed into place, so a concurrent or interrupted Store
+// never leaves a partial entry visible to Load.
+func (c *FileCache) Store(key string, outs []*apb.AnalysisOutput) error {
+	tmp, err := ioutil.TempFile(c.Dir, cacheName(key)+".tmp")
+	if err != nil {
+		return err
+	}
+	wr := delimited.NewWriter(tmp)
+	for _, out := range outs {
+		if err = wr.PutProto(out); err != nil {
+			break
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Invalidate removes the entry for key, if any, so that the next analysis of
+// the compilation is not served from the cache.
+func (c *FileCache) Invalidate(key string) error {
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestCachingAnalyzer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	testutil.FatalOnErrT(t, "Creating temp dir: %v", err)
+	defer os.RemoveAll(dir)
+	cache, err := NewFileCache(dir)
+	testutil.FatalOnErrT(t, "NewFileCache error: %v", err)
+
+	var calls int
+	fail := false
+	bypass := false
+	c := &CachingAnalyzer{
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			calls++
+			sig := req.Compilation.VName.Signature
+			for _, v := range []string{sig + "1", sig + "2"} {
+				if err := out(ctx, &apb.AnalysisOutput{Value: []byte(v)}); err != nil {
+					return err
+				}
+			}
+			if fail {
+				return errors.New("analysis failed")
+			}
+			return nil
+		}),
+		Cache:  cache,
+		Bypass: func(*apb.AnalysisRequest) bool { return bypass },
+	}
+	analyze := func(sig string) []string {
+		t.Helper()
+		var got []string
+		err := c.Analyze(context.Background(), &apb.AnalysisRequest{Compilation: comps(sig)[0].Unit},
+			func(_ context.Context, out *apb.AnalysisOutput) error {
+				got = append(got, string(out.Value))
+				return nil
+			})
+		if err != nil && !fail {
+			t.Fatalf("Analyze(%q) error: %v", sig, err)
+		}
+		return got
+	}
+	check := func(sig string, want []string, wantCalls int) {
+		t.Helper()
+		if err := testutil.DeepEqual(want, analyze(sig)); err != nil {
+			t.Errorf("Analyze(%q) outputs: %v", sig, err)
+		}
+		if calls != wantCalls {
+			t.Errorf("Analyze(%q): analyzer called %d times, want %d", sig, calls, wantCalls)
+		}
+	}
+
+	check("a", []string{"a1", "a2"}, 1) // miss
+	check("a", []string{"a1", "a2"}, 1) // hit
+	check("b", []string{"b1", "b2"}, 2) // a different compilation misses
+
+	bypass = true
+	check("a", []string{"a1", "a2"}, 3)
+	bypass = false
+
+	key, err := CompilationKey(comps("a")[0].Unit)
+	testutil.FatalOnErrT(t, "CompilationKey error: %v", err)
+	testutil.FatalOnErrT(t, "Invalidate error: %v", cache.Invalidate(key))
+	check("a", []string{"a1", "a2"}, 4)
+	check("a", []string{"a1", "a2"}, 4)
+
+	// Failed analyses are not cached.
+	fail = true
+	analyze("c")
+	fail = false
+	check("c", []string{"c1", "c2"}, 6)
+}
+
+func TestFileCacheEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	testutil.FatalOnErrT(t, "Creating temp dir: %v", err)
+	defer os.RemoveAll(dir)
+	cache, err := NewFileCache(dir)
+	testutil.FatalOnErrT(t, "NewFileCache error: %v", err)
+
+	if _, ok, err := cache.Load("k"); ok || err != nil {
+		t.Errorf("Load of missing key: got (%v, %v), want (false, nil)", ok, err)
+	}
+	testutil.FatalOnErrT(t, "Store error: %v", cache.Store("k", nil))
+	if outs, ok, err := cache.Load("k"); !ok || err != nil || len(outs) != 0 {
+		t.Errorf("Load of empty entry: got (%v, %v, %v), want ([], true, nil)", outs, ok, err)
+	}
+}
+
+func TestFileCacheKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	testutil.FatalOnErrT(t, "Creating temp dir: %v", err)
+	defer os.RemoveAll(dir)
+	cacheDir := filepath.Join(dir, "cache")
+	cache, err := NewFileCache(cacheDir)
+	testutil.FatalOnErrT(t, "NewFileCache error: %v", err)
+
+	keys := []string{"a/b", "../escape", "/abs", "a\x00b", strings.Repeat("k", 1000)}
+	for _, key := range keys {
+		testutil.FatalOnErrT(t, "Store error: %v", cache.Store(key, []*apb.AnalysisOutput{{Value: []byte(key)}}))
+	}
+	for _, key := range keys {
+		outs, ok, err := cache.Load(key)
+		if !ok || err != nil || len(outs) != 1 || string(outs[0].Value) != key {
+			t.Errorf("Load(%q): got (%v, %v, %v), want its stored output", key, outs, ok, err)
+		}
+	}
+
+	// Every entry stays directly inside the cache directory.
+	fis, err := ioutil.ReadDir(dir)
+	testutil.FatalOnErrT(t, "ReadDir error: %v", err)
+	if len(fis) != 1 || fis[0].Name() != "cache" {
+		t.Errorf("Cache wrote outside of its directory: %v", fis)
+	}
+	fis, err = ioutil.ReadDir(cacheDir)
+	testutil.FatalOnErrT(t, "ReadDir error: %v", err)
+	for _, fi := range fis {
+		if fi.IsDir() {
+			t.Errorf("Unexpected cache subdirectory %q", fi.Name())
+		}
+	}
+	if len(fis) != len(keys) {
+		t.Errorf("Got %d cache files, want %d", len(fis), len(keys))
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A Checkpoint records which compilations have been analyzed successfully, so
+// that an interrupted run can be resumed without repeating completed work.
+// Compilations are identified by the keys returned by the driver's Keyer,
+// KeyOf by default.
+//
+// A Checkpoint must be safe for concurrent use.
+type Checkpoint interface {
+	// Record marks the compilation with the given key as completed.
+	Record(cuKey string) error
+
+	// Completed reports whether the compilation with the given key has been
+	// recorded as completed.
+	Completed(cuKey string) bool
+}
+
+// CompilationKey returns KeyOf(unit).  It never reports an error.
+//
+// Deprecated: Use KeyOf.
+func CompilationKey(unit *apb.CompilationUnit) (string, error) { return KeyOf(unit), nil }
+
+// A FileCheckpoint is a Checkpoint that appends the key of each completed
+// compilation to a file, one per line.
+type FileCheckpoint struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]bool
+}
+
+// NewFileCheckpoint opens a FileCheckpoint backed by the file at path,
+// creating it if necessary.  Keys already present in the file are treated as
+// completed.  The caller must Close the checkpoint when finished.
+func NewFileCheckpoint(path string) (*FileCheckpoint, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.WithMessage(err, "driver: opening checkpoint")
+	}
+	done := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if key := strings.TrimSpace(s.Text()); key != "" {
+			done[key] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, errors.WithMessage(err, "driver: reading checkpoint")
+	}
+	return &FileCheckpoint{f: f, done: done}, nil
+}
+
+// Record implements part of the Checkpoint interface.  Each key is written to
+// the file before Record returns.  Record reports an error for a key that
+// would not be read back intact: one that is empty, contains a line break, or
+// has leading or trailing space.
+func (c *FileCheckpoint) Record(cuKey string) error {
+	if cuKey == "" || strings.ContainsAny(cuKey, "\r\n") || strings.TrimSpace(cuKey) != cuKey {
+		return errors.Errorf("driver: invalid checkpoint key %q", cuKey)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done[cuKey] {
+		return nil
+	}
+	if _, err := c.f.WriteString(cuKey + "\n"); err != nil {
+		return errors.WithMessage(err, "driver: writing checkpoint")
+	}
+	c.done[cuKey] = true
+	return nil
+}
+
+// Completed implements part of the Checkpoint interface.
+func (c *FileCheckpoint) Completed(cuKey string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[cuKey]
+}
+
+// Len reports the number of compilations recorded as completed.
+func (c *FileCheckpoint) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.done)
+}
+
+// Close closes the underlying file.
+func (c *FileCheckpoint) Close() error { return c.f.Close() }
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestCompilationKey(t *testing.T) {
+	a, b := comps("a")[0].Unit, comps("b")[0].Unit
+	ka, err := CompilationKey(a)
+	testutil.FatalOnErrT(t, "CompilationKey error: %v", err)
+	kb, err := CompilationKey(b)
+	testutil.FatalOnErrT(t, "CompilationKey error: %v", err)
+	if ka == kb {
+		t.Errorf("CompilationKey(a) == CompilationKey(b) == %q", ka)
+	}
+	if again, _ := CompilationKey(comps("a")[0].Unit); again != ka {
+		t.Errorf("CompilationKey(a) is unstable: %q != %q", again, ka)
+	}
+}
+
+func TestFileCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	testutil.FatalOnErrT(t, "Creating temp dir: %v", err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "done")
+
+	c, err := NewFileCheckpoint(path)
+	testutil.FatalOnErrT(t, "NewFileCheckpoint error: %v", err)
+	for _, key := range []string{"a", "b", "a"} {
+		testutil.FatalOnErrT(t, "Record error: %v", c.Record(key))
+	}
+	testutil.FatalOnErrT(t, "Close error: %v", c.Close())
+
+	c, err = NewFileCheckpoint(path)
+	testutil.FatalOnErrT(t, "Reopening checkpoint: %v", err)
+	defer c.Close()
+	if !c.Completed("a") || !c.Completed("b") || c.Completed("c") {
+		t.Errorf("Reopened checkpoint has wrong contents: a=%v b=%v c=%v",
+			c.Completed("a"), c.Completed("b"), c.Completed("c"))
+	}
+	if got := c.Len(); got != 2 {
+		t.Errorf("Len: got %d, want 2", got)
+	}
+}
+
+func TestFileCheckpointBadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	testutil.FatalOnErrT(t, "Creating temp dir: %v", err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "done")
+
+	c, err := NewFileCheckpoint(path)
+	testutil.FatalOnErrT(t, "NewFileCheckpoint error: %v", err)
+	for _, key := range []string{"", "a\nb", "a\r", " a", "a\t"} {
+		if err := c.Record(key); err == nil {
+			t.Errorf("Record(%q): got nil error, want an error", key)
+		}
+		if c.Completed(key) {
+			t.Errorf("Completed(%q) after a rejected Record", key)
+		}
+	}
+	testutil.FatalOnErrT(t, "Record error: %v", c.Record("a"))
+	testutil.FatalOnErrT(t, "Close error: %v", c.Close())
+
+	c, err = NewFileCheckpoint(path)
+	testutil.FatalOnErrT(t, "Reopening checkpoint: %v", err)
+	defer c.Close()
+	if got := c.Len(); got != 1 || !c.Completed("a") {
+		t.Errorf("Reopened checkpoint: got %d keys, want only \"a\"", got)
+	}
+}
+
+// memCheckpoint is an in-memory Checkpoint for testing.
+type memCheckpoint struct {
+	mu   sync.Mutex
+	done map[string]bool
+}
+
+func (c *memCheckpoint) Record(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done[key] = true
+	return nil
+}
+
+func (c *memCheckpoint) Completed(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[key]
+}
+
+func TestDriverCheckpoint(t *testing.T) {
+	cp := &memCheckpoint{done: make(map[string]bool)}
+	var analyzed []string
+	d := &Driver{
+		Checkpoint:      cp,
+		ContinueOnError: true,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			sig := req.Compilation.VName.Signature
+			analyzed = append(analyzed, sig)
+			if sig == "b" {
+				return errFromAnalysis
+			}
+			return nil
+		}),
+	}
+
+	// The first run records the successful compilations, a and c.
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}); err == nil {
+		t.Error("First run: expected an error for b")
+	}
+	// The second run analyzes only the compilations not yet completed.
+	analyzed = nil
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d")})
+	if err == nil {
+		t.Error("Second run: expected an error for b")
+	}
+	if err := testutil.DeepEqual([]string{"b", "d"}, analyzed); err != nil {
+		t.Errorf("Second run analyzed the wrong compilations: %v", err)
+	}
+	if stats.Skipped != 2 {
+		t.Errorf("Second run: got %d skipped, want 2", stats.Skipped)
+	}
+}
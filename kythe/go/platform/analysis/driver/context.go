@@ -0,0 +1,421 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A unitScope carries the state of a single compilation through the context
+// passed to its Setup, Analyze, and Teardown phases, and from there to any
+// OutputFunc to which the analyzer passes its context.  The scope, and any
+// state it holds, is discarded once the compilation is finished.
+type unitScope struct {
+	unit  *apb.CompilationUnit
+	id    string // the request ID of the compilation
+	index int    // the position of the compilation in the run
+
+	mu      sync.Mutex
+	values  map[interface{}]interface{}
+	elapsed time.Duration // total time spent in Analyze
+	outputs int           // outputs written
+	fetches int           // fetches through the driver's FetchTracker
+	fetched int64         // bytes returned by those fetches
+	stopped bool          // whether the output reported context.Canceled
+	fds     string        // the file data service set by SetFileDataService
+	retries int           // analyses retried in place
+	normed  bool          // whether the compilation's VNames were normalized
+
+	buf  *outputBuffer // if outputs are ordered; set before the scope is shared
+	wait time.Duration // time spent in Queue.Next; set before the scope is shared
+
+	holds    int32 // atomically counts holds on the scope; see hold
+	finished int32 // set atomically once Teardown has returned
+}
+
+type scopeKey struct{}
+
+var (
+	// requestPrefix distinguishes the request IDs of this process from those
+	// of other processes.
+	requestPrefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+	requestSeq    uint64 // the number of request IDs issued
+)
+
+// withScope returns a child of ctx carrying a new scope for unit, with a new
+// request ID and the given index.
+func withScope(ctx context.Context, unit *apb.CompilationUnit, index int) context.Context {
+	id := fmt.Sprintf("%s-%d", requestPrefix, atomic.AddUint64(&requestSeq, 1))
+	return context.WithValue(ctx, scopeKey{}, &unitScope{unit: unit, id: id, index: index})
+}
+
+// RequestIDFromContext returns the request ID the driver assigned to the
+// compilation whose Setup, Analyze, or Teardown phase ctx was passed to, or ""
+// if ctx does not belong to a compilation.  Each compilation processed by a
+// Driver is assigned a distinct ID, shared by all its phases and by any
+// OutputFunc to which the analyzer passes its context.
+func RequestIDFromContext(ctx context.Context) string {
+	if s := scopeFrom(ctx); s != nil {
+		return s.id
+	}
+	return ""
+}
+
+// IndexFromContext returns the position, counting from 0, of the compilation
+// whose Setup, Analyze, or Teardown phase ctx was passed to among those
+// received from the queue by its run, and reports whether ctx belongs to a
+// compilation.  Every compilation received is numbered, including those
+// later skipped, so indices are unique within a run, and follow the order in
+// which the queue delivered compilations to the driver's workers even when
+// they are analyzed concurrently.  Unlike the request ID, the index is only
+// unique within a run; a requeued compilation receives a new index when it
+// is delivered again.
+func IndexFromContext(ctx context.Context) (int, bool) {
+	if s := scopeFrom(ctx); s != nil {
+		return s.index, true
+	}
+	return 0, false
+}
+
+// CompilationFromContext returns the compilation, as received from the queue,
+// whose Setup, Analyze, or Teardown phase ctx was passed to, or nil if ctx does
+// not belong to a compilation or the compilation has been finished.  Like the
+// request ID, it is available to any OutputFunc to which the analyzer passes
+// its context; see also WithCompilationContext.
+func CompilationFromContext(ctx context.Context) *apb.CompilationUnit {
+	if s := scopeFrom(ctx); s != nil && atomic.LoadInt32(&s.finished) == 0 {
+		return s.unit
+	}
+	return nil
+}
+
+// SetFileDataService directs the analysis of the compilation to which ctx
+// belongs to the file data service at addr, overriding the service the driver
+// would otherwise choose.  It is meant to be called from Setup, and has no
+// effect on requests already sent to the analyzer.  It reports false, and does
+// nothing, if ctx does not belong to a compilation.
+//
+// The address set here takes precedence over any set by the driver's
+// RequestHook, which in turn takes precedence over FileDataServiceFor and
+// FileDataService.  Setting addr to "" removes the override.
+func SetFileDataService(ctx context.Context, addr string) bool {
+	s := scopeFrom(ctx)
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fds = addr
+	return true
+}
+
+// FileDataServiceFromContext returns the file data service set by
+// SetFileDataService for the compilation to which ctx belongs, or "" if none
+// has been set.
+func FileDataServiceFromContext(ctx context.Context) string {
+	s := scopeFrom(ctx)
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fds
+}
+
+type abortKey struct{}
+
+// An abortState records the error that caused a run to cancel its workers.
+type abortState struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (a *abortState) set(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.err = err
+}
+
+// AbortedBy returns the error that caused a run with several workers to
+// cancel ctx, or nil if ctx was not canceled for that reason.  When one
+// worker fails, the driver cancels the contexts of the compilations in
+// progress on the others; AbortedBy lets Teardown, AnalysisError, or the
+// analyzer distinguish that from the cancellation of the context passed to
+// Run, for which it returns nil.
+func AbortedBy(ctx context.Context) error {
+	a, ok := ctx.Value(abortKey{}).(*abortState)
+	if !ok || ctx.Err() == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+type causeKey struct{}
+
+// A causeState records why the driver canceled a context it derived from one
+// carrying parent, if any.
+type causeState struct {
+	parent  *causeState
+	expired func() error // if not nil, reports a deadline's cause; set before the state is shared
+
+	mu  sync.Mutex
+	err error
+}
+
+// set records cause as the reason the context was canceled, unless a reason
+// has already been recorded or ctx, the context from which it was derived,
+// has ended, which would then be the reason.
+func (c *causeState) set(ctx context.Context, cause error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil && ctx.Err() == nil {
+		c.err = cause
+	}
+}
+
+func (c *causeState) cause() error {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err == nil && c.expired != nil {
+		return c.expired()
+	}
+	return err
+}
+
+// newCause returns a child of ctx carrying a new causeState.
+func newCause(ctx context.Context) (context.Context, *causeState) {
+	parent, _ := ctx.Value(causeKey{}).(*causeState)
+	c := &causeState{parent: parent}
+	return context.WithValue(ctx, causeKey{}, c), c
+}
+
+// withCancelCause returns a child of ctx, and a function that cancels it,
+// recording the cause it is passed, if not nil, for CancelCause to report.
+func withCancelCause(ctx context.Context) (context.Context, func(cause error)) {
+	vctx, c := newCause(ctx)
+	cctx, cancel := context.WithCancel(vctx)
+	return cctx, func(cause error) {
+		if cause != nil {
+			c.set(ctx, cause)
+		}
+		cancel()
+	}
+}
+
+// withTimeoutCause returns a child of ctx whose deadline is d from now, and a
+// function that releases it.  If the deadline is reached, CancelCause reports
+// cause, unless the deadline of ctx comes first.
+func withTimeoutCause(ctx context.Context, d time.Duration, cause error) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(d)
+	if dl, ok := ctx.Deadline(); ok && !deadline.Before(dl) {
+		return context.WithDeadline(ctx, deadline)
+	}
+	vctx, c := newCause(ctx)
+	tctx, cancel := context.WithDeadline(vctx, deadline)
+	c.expired = func() error {
+		if tctx.Err() == context.DeadlineExceeded {
+			return cause
+		}
+		return nil
+	}
+	return tctx, cancel
+}
+
+// CancelCause reports why ctx, a context the driver passed to an analyzer, or
+// from there to an OutputFunc, was canceled, or nil if ctx has not ended.
+// The driver reports ErrAnalysisTimeout, ErrStoppedEarly, or ErrDrainExpired
+// when it ended the analysis for that reason, the error that caused the run to
+// stop its workers (see AbortedBy), or the error of the first analyzer of a
+// MultiAnalyzer to fail; otherwise it reports ctx.Err(), for example when the
+// context passed to Run has ended.  An OutputFunc may use CancelCause to tell
+// whether the outputs it received for a compilation are complete.
+func CancelCause(ctx context.Context) error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	for c, _ := ctx.Value(causeKey{}).(*causeState); c != nil; c = c.parent {
+		if cause := c.cause(); cause != nil {
+			return cause
+		}
+	}
+	if cause := AbortedBy(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+// hold defers finishing s until finish has been called once more, so that the
+// scope outlives the compilation's worker.
+func (s *unitScope) hold() { atomic.AddInt32(&s.holds, 1) }
+
+// finish marks the compilation of s as finished, or releases a hold on s.
+func (s *unitScope) finish() {
+	if atomic.AddInt32(&s.holds, -1) < 0 {
+		atomic.StoreInt32(&s.finished, 1)
+	}
+}
+
+// scopedOutput returns an OutputFunc that calls write with a context carrying
+// s, if the context it is passed does not already do so.
+func scopedOutput(s *unitScope, write analysis.OutputFunc) analysis.OutputFunc {
+	return func(ctx context.Context, out *apb.AnalysisOutput) error {
+		if scopeFrom(ctx) != s {
+			ctx = context.WithValue(ctx, scopeKey{}, s)
+		}
+		return write(ctx, out)
+	}
+}
+
+// scopeFrom returns the compilation scope carried by ctx, or nil.
+func scopeFrom(ctx context.Context) *unitScope {
+	s, _ := ctx.Value(scopeKey{}).(*unitScope)
+	return s
+}
+
+// value returns the value associated with key in s, first setting it to the
+// result of init if it is not already present.
+func (s *unitScope) value(key interface{}, init func() interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		if s.values == nil {
+			s.values = make(map[interface{}]interface{})
+		}
+		v = init()
+		s.values[key] = v
+	}
+	return v
+}
+
+// addAnalyzeTime adds d to the time spent analyzing the compilation.
+func (s *unitScope) addAnalyzeTime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.elapsed += d
+}
+
+// analyzeTime returns the total time spent analyzing the compilation.
+func (s *unitScope) analyzeTime() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.elapsed
+}
+
+// addOutput counts an output written for the compilation.
+func (s *unitScope) addOutput() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outputs++
+}
+
+// outputCount returns the number of outputs written for the compilation.
+func (s *unitScope) outputCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.outputs
+}
+
+// setFetches records the fetches made for the compilation.
+func (s *unitScope) setFetches(n int, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches, s.fetched = n, size
+}
+
+// fetchCounts returns the number of fetches made for the compilation, and the
+// number of bytes they returned.
+func (s *unitScope) fetchCounts() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches, s.fetched
+}
+
+// addRetry counts a retry of the compilation's analysis.
+func (s *unitScope) addRetry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries++
+}
+
+// retryCount returns the number of times the compilation's analysis was
+// retried.
+func (s *unitScope) retryCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.retries
+}
+
+// markNormalized records that the compilation's VNames were normalized,
+// reporting whether this is the first time.
+func (s *unitScope) markNormalized() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := !s.normed
+	s.normed = true
+	return first
+}
+
+// stopOutput records that the output reported context.Canceled for the
+// compilation.
+func (s *unitScope) stopOutput() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+}
+
+// outputStopped reports whether stopOutput has been called.
+func (s *unitScope) outputStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// detach returns a context carrying the values of ctx, but not its deadline
+// or cancellation.
+func detach(ctx context.Context) context.Context { return detachedContext{ctx} }
+
+type detachedContext struct{ parent context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+// withValues returns a context with the deadline and cancellation of ctx, but
+// the values of vctx.
+func withValues(ctx, vctx context.Context) context.Context { return valuesContext{ctx, vctx} }
+
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (v valuesContext) Value(key interface{}) interface{} { return v.values.Value(key) }
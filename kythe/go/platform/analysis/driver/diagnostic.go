@@ -0,0 +1,99 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A Severity classifies a Diagnostic.
+type Severity int
+
+// The severities of a Diagnostic, in increasing order of severity.
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+var severityNames = [...]string{"info", "warning", "error"}
+
+func (s Severity) String() string {
+	if s >= 0 && int(s) < len(severityNames) {
+		return severityNames[s]
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// A Diagnostic is a message about a compilation that is not part of its
+// analysis output, such as an unresolved import or a version mismatch.
+// Diagnostics do not affect whether the analysis of a compilation succeeds.
+type Diagnostic struct {
+	Severity Severity
+	Message  string
+	Details  string // further detail, which need not be shown immediately
+	Path     string // the input to which the diagnostic applies, or ""
+}
+
+// A DiagnosticFunc handles a single diagnostic.
+type DiagnosticFunc func(context.Context, Diagnostic)
+
+// A Diagnoser is an analysis.CompilationAnalyzer that can report diagnostics
+// about the compilations it analyzes separately from its outputs.  A Driver
+// whose analyzer implements Diagnoser calls AnalyzeDiagnosed in place of
+// Analyze, and passes each diagnostic to its Diagnostics hook.
+type Diagnoser interface {
+	analysis.CompilationAnalyzer
+
+	// AnalyzeDiagnosed behaves as Analyze, and additionally passes any
+	// diagnostics about the compilation of req to diag.
+	AnalyzeDiagnosed(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc, diag DiagnosticFunc) error
+}
+
+// callAnalyzer sends req to the driver's analyzer, passing the diagnostics of
+// a Diagnoser to diag.
+func (r *runner) callAnalyzer(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc, diag DiagnosticFunc) error {
+	return analyzeWith(ctx, r.analyzer, req, out, diag)
+}
+
+// analyzeWith sends req to a, passing its diagnostics to diag if a is a
+// Diagnoser and diag != nil.  The analyzers of this package that wrap others
+// use it to pass on the diagnostics of those they wrap.
+func analyzeWith(ctx context.Context, a analysis.CompilationAnalyzer, req *apb.AnalysisRequest, out analysis.OutputFunc, diag DiagnosticFunc) error {
+	if dg, ok := a.(Diagnoser); ok && diag != nil {
+		return dg.AnalyzeDiagnosed(ctx, req, out, diag)
+	}
+	return a.Analyze(ctx, req, out)
+}
+
+// diagnose records a diagnostic about unit, and passes it to d.Diagnostics.
+func (r *runner) diagnose(ctx context.Context, unit *apb.CompilationUnit, diag Diagnostic) {
+	r.mu.Lock()
+	if r.stats.Diagnostics == nil {
+		r.stats.Diagnostics = make(map[string]int)
+	}
+	r.stats.Diagnostics[diag.Severity.String()]++
+	r.mu.Unlock()
+	if r.Diagnostics != nil {
+		r.Diagnostics(ctx, unit, diag)
+	}
+}
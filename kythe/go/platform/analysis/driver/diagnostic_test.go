@@ -0,0 +1,145 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A diagnoser is a Diagnoser that reports a warning for each compilation and
+// an error for the compilation with signature "bad", and writes one output.
+type diagnoser struct{}
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (diagnoser) Analyze(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+	return out(ctx, &apb.AnalysisOutput{Value: []byte(req.Compilation.VName.Signature)})
+}
+
+// AnalyzeDiagnosed implements the Diagnoser interface.
+func (d diagnoser) AnalyzeDiagnosed(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc, diag DiagnosticFunc) error {
+	sig := req.Compilation.VName.Signature
+	diag(ctx, Diagnostic{Severity: SeverityWarning, Message: "warning for " + sig})
+	if sig == "bad" {
+		diag(ctx, Diagnostic{Severity: SeverityError, Message: "unresolved import", Path: "bad.go"})
+	}
+	return d.Analyze(ctx, req, out)
+}
+
+func TestDriverDiagnostics(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		var (
+			mu      sync.Mutex
+			got     = make(map[string][]Diagnostic)
+			outputs int
+		)
+		d := &Driver{
+			Analyzer:    diagnoser{},
+			Timeout:     timeout,
+			Concurrency: 2,
+			Diagnostics: func(ctx context.Context, unit *apb.CompilationUnit, diag Diagnostic) {
+				if RequestIDFromContext(ctx) == "" {
+					t.Errorf("Diagnostic %+v has no compilation context", diag)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				got[unit.VName.Signature] = append(got[unit.VName.Signature], diag)
+			},
+			WriteOutput: func(context.Context, *apb.AnalysisOutput) error {
+				mu.Lock()
+				defer mu.Unlock()
+				outputs++
+				return nil
+			},
+		}
+		stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "bad")})
+		testutil.FatalOnErrT(t, "Driver error: %v", err)
+		want := map[string][]Diagnostic{
+			"a": {{Severity: SeverityWarning, Message: "warning for a"}},
+			"bad": {
+				{Severity: SeverityWarning, Message: "warning for bad"},
+				{Severity: SeverityError, Message: "unresolved import", Path: "bad.go"},
+			},
+		}
+		if err := testutil.DeepEqual(want, got); err != nil {
+			t.Errorf("Timeout %v: diagnostics: %v", timeout, err)
+		}
+		if err := testutil.DeepEqual(map[string]int{"warning": 2, "error": 1}, stats.Diagnostics); err != nil {
+			t.Errorf("Timeout %v: diagnostic counts: %v", timeout, err)
+		}
+		if outputs != 2 || stats.Outputs != 2 {
+			t.Errorf("Timeout %v: got %d outputs (stats %d), want 2", timeout, outputs, stats.Outputs)
+		}
+	}
+}
+
+func TestWrappedDiagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diagnostics")
+	testutil.FatalOnErrT(t, "Creating temp directory: %v", err)
+	defer os.RemoveAll(dir)
+	cache, err := NewFileCache(dir)
+	testutil.FatalOnErrT(t, "NewFileCache error: %v", err)
+
+	var (
+		mu  sync.Mutex
+		got = make(map[string]int)
+	)
+	d := &Driver{
+		Analyzer: LimitConcurrency(&LanguageRouter{
+			Default: &MultiAnalyzer{Analyzers: []analysis.CompilationAnalyzer{
+				&CachingAnalyzer{Analyzer: diagnoser{}, Cache: cache},
+			}},
+		}, 1),
+		Concurrency: 2,
+		Diagnostics: func(ctx context.Context, unit *apb.CompilationUnit, diag Diagnostic) {
+			mu.Lock()
+			defer mu.Unlock()
+			got[unit.VName.Signature]++
+		},
+		WriteOutput: func(context.Context, *apb.AnalysisOutput) error { return nil },
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "bad")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	if err := testutil.DeepEqual(map[string]int{"a": 1, "bad": 2}, got); err != nil {
+		t.Errorf("Diagnostics: %v", err)
+	}
+	if err := testutil.DeepEqual(map[string]int{"warning": 2, "error": 1}, stats.Diagnostics); err != nil {
+		t.Errorf("Diagnostic counts: %v", err)
+	}
+}
+
+func TestSeverityString(t *testing.T) {
+	for s, want := range map[Severity]string{
+		SeverityInfo:    "info",
+		SeverityWarning: "warning",
+		SeverityError:   "error",
+		Severity(7):     "Severity(7)",
+	} {
+		if got := s.String(); got != want {
+			t.Errorf("Severity(%d).String(): got %q, want %q", int(s), got, want)
+		}
+	}
+}
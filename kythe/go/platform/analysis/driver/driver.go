@@ -20,8 +20,14 @@ package driver // import "kythe.io/kythe/go/platform/analysis/driver"
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	goerrors "errors"
-	"log"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"kythe.io/kythe/go/platform/analysis"
 
@@ -49,11 +55,58 @@ type Queue interface {
 	Next(_ context.Context, f CompilationFunc) error
 }
 
+// A Peeker is a Queue that can report its next compilation without consuming
+// it.  A call to Peek followed by a call to Next must deliver the same
+// compilation, unless another call to Next intervenes.
+type Peeker interface {
+	Queue
+
+	// Peek returns the next available compilation without removing it from
+	// the queue.  If no further values are available, Peek must return
+	// ErrEndOfQueue.
+	Peek(context.Context) (Compilation, error)
+}
+
+// A Sizer is a Queue that can report how many compilations it has left to
+// deliver.
+type Sizer interface {
+	Queue
+
+	// Remaining reports the number of compilations remaining in the queue, and
+	// whether that number is known.
+	Remaining() (int, bool)
+}
+
+// A Requeuer is a Queue that can take back a compilation it has delivered, to
+// deliver it again later; see RetryPolicy.Requeue.  Requeue may be called from
+// within the CompilationFunc passed to Next.
+type Requeuer interface {
+	Queue
+
+	// Requeue adds cu back to the queue.
+	Requeue(ctx context.Context, cu Compilation) error
+}
+
+// A Transformer is a Context that can replace the compilation unit sent to the
+// analyzer.  If a Driver's Context is a Transformer, Transform is invoked after
+// Setup succeeds.  Rather than relying on Setup to modify the unit in place, a
+// Context should use Transform to normalize or rewrite it.
+type Transformer interface {
+	Context
+
+	// Transform returns the compilation unit to analyze in place of the one
+	// in unit.  Returning nil means the unit is analyzed as-is.  The unit
+	// returned is also passed to Teardown and AnalysisError.  If Transform
+	// reports an error, analysis is aborted and Teardown is invoked.
+	Transform(ctx context.Context, unit Compilation) (*apb.CompilationUnit, error)
+}
+
 // A Context packages callbacks invoked during analysis.
 type Context interface {
 	// Setup is invoked after a compilation has been fetched from a Queue but
 	// before it is sent to the analyzer.  If Setup reports an error, analysis
-	// is aborted.
+	// is aborted.  If the error wraps ErrSkipCompilation, the compilation is
+	// skipped rather than failed.
 	Setup(context.Context, Compilation) error
 
 	// Teardown is invoked after a analysis has completed for the compilation.
@@ -70,22 +123,556 @@ type Context interface {
 	AnalysisError(context.Context, Compilation, error) error
 }
 
+// A TimeoutPolicy determines what becomes of the outputs of an analysis that
+// times out.
+type TimeoutPolicy int
+
+const (
+	// TimeoutDiscard buffers the outputs of each analysis subject to a
+	// timeout, and writes them only if the analysis completes in time.  A
+	// compilation that times out fails and produces no output.  This is the
+	// default.
+	TimeoutDiscard TimeoutPolicy = iota
+
+	// TimeoutPartial writes outputs as they are produced.  A compilation that
+	// times out keeps the outputs written before its deadline, is treated as
+	// having succeeded, and is counted in RunStats.Partial.
+	TimeoutPartial
+)
+
+// A TeardownPolicy determines whether Teardown is invoked for a skipped
+// compilation.
+type TeardownPolicy int
+
+const (
+	// TeardownIfSetUp invokes Teardown for a compilation skipped once Setup
+	// has run.  This is the default.
+	TeardownIfSetUp TeardownPolicy = iota
+
+	// TeardownNever does not invoke Teardown for skipped compilations; Setup
+	// must release any resources it acquired before asking to skip.
+	TeardownNever
+)
+
 var (
 	// ErrRetry can be returned from a Driver's AnalysisError function to signal
 	// that the driver should retry the analysis immediately.
 	ErrRetry = goerrors.New("retry analysis")
 
+	// ErrTooManyOutputs is wrapped by the error reported for a compilation
+	// that exceeds a Driver's MaxOutputEntries.
+	ErrTooManyOutputs = goerrors.New("too many output entries")
+
 	// ErrEndOfQueue can be returned from a Queue to signal there are no
 	// compilations left to analyze.
 	ErrEndOfQueue = goerrors.New("end of queue")
+
+	// ErrSkipCompilation can be returned by Setup, or by a Transformer, to
+	// signal that a compilation should be skipped without analysis.  The
+	// compilation is counted in RunStats.Skipped rather than as a failure, is
+	// not reported to DeadLetter or recorded in a Checkpoint, and does not
+	// count toward the driver's Limit.
+	ErrSkipCompilation = goerrors.New("skip compilation")
+
+	// ErrEmptyQueue is returned by a Driver with ErrorOnEmpty set when its
+	// queue yields no compilations.
+	ErrEmptyQueue = goerrors.New("driver: queue yielded no compilations")
+
+	// ErrRunning is returned by Run if it is called while another call to Run
+	// on the same Driver is in progress.
+	ErrRunning = goerrors.New("driver: already running")
+
+	// ErrAnalysisTimeout is reported by CancelCause for the context of an
+	// analysis that exceeded the driver's Timeout.
+	ErrAnalysisTimeout = goerrors.New("driver: analysis timed out")
+
+	// ErrStoppedEarly is reported by CancelCause for the context of an
+	// analysis stopped once the driver's OutputPredicate accepted an output.
+	ErrStoppedEarly = goerrors.New("driver: analysis stopped by the output predicate")
+
+	// ErrDrainExpired is reported by CancelCause for the context of a
+	// compilation still in progress once the driver's DrainTimeout expired.
+	ErrDrainExpired = goerrors.New("driver: drain timeout expired")
 )
 
-// Driver sends compilations sequentially from a queue to an analyzer.
+// Driver sends compilations from a queue to an analyzer.  The driver may reuse
+// the AnalysisRequest passed to the analyzer once Analyze returns, so the
+// analyzer must not retain it.
+//
+// An error returned by WriteOutput is reported to the analyzer, which normally
+// fails the compilation with it.  As an exception, if WriteOutput returns an
+// error wrapping context.Canceled while the run's context is still live, the
+// driver treats it as a request to stop: the compilation is torn down but not
+// recorded as a failure, no further compilations are taken from the queue,
+// those already in progress are allowed to finish, and Run returns
+// context.Canceled once they have.
 type Driver struct {
 	Analyzer        analysis.CompilationAnalyzer
 	FileDataService string
 	Context         Context             // if nil, callbacks are no-ops
 	WriteOutput     analysis.OutputFunc // if nil, output is discarded
+	Compilations    Queue               // the queue used if Run is given none
+
+	// If FileDataServiceFor != nil, it is called to choose the file data
+	// service for each compilation; if it returns "", FileDataService is used.
+	// Setup may override either for a single compilation; see
+	// SetFileDataService.
+	FileDataServiceFor func(*apb.CompilationUnit) string
+
+	// If RequestHook != nil, it is called with each request before it is sent
+	// to the analyzer, to populate fields the driver does not set.  The hook
+	// runs after the driver has set its own fields, so it may also override
+	// them, except for a file data service set by SetFileDataService.  A
+	// retried analysis reuses the same request.
+	RequestHook func(context.Context, *apb.AnalysisRequest)
+
+	// TeardownOnSkip determines whether Teardown is invoked for a compilation
+	// skipped by ErrSkipCompilation from Setup or a Transformer, to release
+	// what Setup acquired.  Teardown is never invoked for compilations skipped
+	// before Setup, by Filter or a Checkpoint.
+	TeardownOnSkip TeardownPolicy
+
+	// If NormalizeVNames != nil, it normalizes the VNames of each compilation
+	// unit, and of its required inputs, before the unit is sent to the
+	// analyzer.  It is applied after Transform, if the Context is a
+	// Transformer, and the normalized unit is also the one passed to Teardown
+	// and AnalysisError.  Compilations whose VNames it changes are counted in
+	// RunStats.Normalized.
+	NormalizeVNames *VNameNormalizer
+
+	// If AsyncTeardown is true, Teardown is invoked for each analyzed
+	// compilation in a background goroutine, and the worker proceeds to the
+	// next compilation without waiting for it to return.  Run waits for all
+	// outstanding teardowns before it returns.  The teardown's context carries
+	// the values of the compilation's context, but is canceled only with the
+	// context passed to Run.
+	//
+	// Since the result of the compilation has already been reported, a
+	// Teardown error does not fail it.  If its analysis succeeded, the error is
+	// logged, counted in RunStats.TeardownFailed, and reported by Run as a
+	// *CompilationError wrapping a *TeardownError: among the other failures if
+	// ContinueOnError is true, and otherwise in place of success.  Either way
+	// the run carries on.  Teardowns invoked after a failed Setup, for skipped
+	// compilations, or between retry attempts are not affected.
+	//
+	// Note that teardowns are no longer ordered with respect to the rest of
+	// the run: outputs may be written for compilation N+1, and its Setup
+	// invoked, before the Teardown of compilation N has returned, and the
+	// teardowns of several compilations may run at once.
+	AsyncTeardown bool
+
+	// If ErrorOnEmpty is true, a run whose queue yields no compilations at
+	// all reports ErrEmptyQueue rather than succeeding, so that an
+	// unexpectedly empty input can be detected.  Compilations skipped by
+	// Filter or validation still count as received from the queue.
+	ErrorOnEmpty bool
+
+	// If CompilationContext is true, the context passed to WriteOutput always
+	// belongs to the compilation that produced the output, even if the
+	// analyzer does not pass its own context to the OutputFunc, so that the
+	// output can be attributed with CompilationFromContext.
+	CompilationContext bool
+
+	// If WriteOutput is nil, the analyzer is still passed a valid OutputFunc,
+	// which discards its output; this allows a driver to be run purely for
+	// the side effects of analysis, for example to warm a cache.  If
+	// RequireOutput is true, a nil WriteOutput is instead reported as an error
+	// by Validate.
+	RequireOutput bool
+
+	// Concurrency is the number of compilations that may be analyzed in
+	// parallel.  If Concurrency <= 1, compilations are analyzed sequentially.
+	// With more than one worker, the outputs of each compilation are
+	// buffered and passed to WriteOutput together once its analysis ends,
+	// before its Teardown, so that the outputs of different compilations are
+	// not interleaved; OrderedOutput additionally puts them in queue order.
+	Concurrency int
+
+	// If ContinueOnError is true, a compilation whose setup, analysis, or
+	// teardown fails is logged and recorded, and the driver proceeds to the
+	// next compilation.  Errors reported by the Queue itself remain fatal.
+	ContinueOnError bool
+
+	// If MaxConsecutiveFailures > 0, the run is aborted with an
+	// *UnhealthyError once that many compilations in a row have failed,
+	// whether or not ContinueOnError is true, since a run of failures usually
+	// means the analyzer or its backend is broken rather than the inputs.  A
+	// compilation that succeeds resets the count; skipped compilations do not
+	// affect it.  When compilations are analyzed concurrently, they are
+	// counted in the order they finish.
+	MaxConsecutiveFailures int
+
+	// If Golden != nil, the driver compares the outputs of each compilation
+	// with those Golden expects, and reports the differences, instead of
+	// passing the outputs to WriteOutput.  The outputs are still counted in
+	// RunStats, and compilations whose outputs differ are counted in
+	// RunStats.GoldenDiffs.  A difference does not fail the compilation.
+	Golden *GoldenCompare
+
+	// If DryRun is true, each compilation is taken from the queue, set up,
+	// transformed, and torn down as usual, and its request to the analyzer is
+	// prepared, but the request is not sent and nothing is written to
+	// WriteOutput.  This exercises the queue, the choice of file data service,
+	// and the driver's Context without the expense of analysis.  The
+	// compilations that would have been analyzed are counted as succeeded,
+	// and RunStats.DryRun is set, but nothing is recorded in the Checkpoint
+	// or Manifest.
+	DryRun bool
+
+	// If Timeout > 0, each call to Analyze is abandoned if it has not
+	// completed within this duration.  The timeout does not apply to Setup or
+	// Teardown.  The error reported for a timed-out analysis wraps
+	// context.DeadlineExceeded.
+	Timeout time.Duration
+
+	// OnTimeout determines what becomes of the outputs of an analysis that
+	// times out.  By default (TimeoutDiscard) they are buffered and discarded
+	// along with the failed compilation; TimeoutPartial instead keeps them and
+	// treats the compilation as a partial success.
+	OnTimeout TimeoutPolicy
+
+	// If Retry != nil, analyses that fail with a transient error are retried
+	// according to the policy.
+	Retry *RetryPolicy
+
+	// An analysis that fails with an analysis.RetryAfter error is retried
+	// once the requested delay has passed, up to MaxRetryAfter times per
+	// compilation (10 if MaxRetryAfter is 0), independently of Retry.  During
+	// the delay no worker sends a request to the analyzer, so all workers
+	// back off together.  Unless Retry is set, the outputs of an attempt are
+	// not buffered, so an analyzer should report RetryAfter before producing
+	// any output.  Such retries are counted in RunStats.RetriedAfter.
+	MaxRetryAfter int
+
+	// If Progress != nil, it is invoked after each compilation is finished,
+	// whether or not it succeeded, with the cumulative number of compilations
+	// done and the number of those that failed.  The total is the number of
+	// compilations the run expects to process (see RunStats.Total), or 0 if
+	// that is not known.  Calls to Progress are serialized, even when
+	// compilations are analyzed concurrently.
+	Progress func(done, failed, total int, cu *apb.CompilationUnit)
+
+	// If Filter != nil, compilations for which it returns false are skipped:
+	// they are not passed to Setup, Analyze, or Teardown, and produce no
+	// output.  Skipped compilations are counted separately in RunStats.
+	Filter func(*apb.CompilationUnit) bool
+
+	// If Prefetch > 0, a background goroutine reads up to this many
+	// compilations ahead from the queue while earlier ones are analyzed.  The
+	// queue is then read by a single goroutine regardless of Concurrency, but
+	// its CompilationFunc returns as soon as each compilation is buffered, so
+	// prefetching is unsuitable for queues that depend on the outcome of the
+	// analysis or that expose state tied to the current compilation (such as
+	// an analysis.Fetcher).  Errors from the queue are reported once the
+	// compilations buffered before the error have been analyzed.
+	Prefetch int
+
+	// If PanicAsError is true, a panic in Setup or Analyze is reported as a
+	// *PanicError for the compilation, which is then handled like any other
+	// failure of that compilation: with ContinueOnError the other workers
+	// carry on, and otherwise the run stops.  Either way the error belongs to
+	// the compilation, and unlike a *QueueError it does not imply a problem
+	// with the queue.  If PanicAsError is false, the panic is propagated once
+	// Teardown has been invoked.  When compilations are analyzed
+	// concurrently, a panic in any worker, whether or not it comes from
+	// analysis, is propagated from the goroutine that called Run once the
+	// other workers have stopped, rather than crashing the process from the
+	// worker's goroutine.
+	PanicAsError bool
+
+	// Logger receives the driver's log messages.  If nil, StdLogger is used.
+	Logger Logger
+
+	// If TeardownWarnInterval > 0, at most one warning is logged in each
+	// interval of this length for teardowns that fail after the setup or
+	// analysis of their compilation has already failed, so that a systemic
+	// failure does not flood the log.  The warnings not logged are counted,
+	// and the count is logged with the next warning and once the run ends.
+	TeardownWarnInterval time.Duration
+
+	// If SlowThreshold > 0, a warning is logged for each compilation whose
+	// analysis takes longer than this duration.
+	SlowThreshold time.Duration
+
+	// If Diagnostics != nil, it is called with each diagnostic reported by an
+	// analyzer that implements Diagnoser, along with the compilation it
+	// concerns.  It may be called concurrently for different compilations.
+	// Diagnostics are reported as they occur, including those from attempts
+	// that are later retried, and are counted by severity in
+	// RunStats.Diagnostics whether or not this is set.
+	Diagnostics func(context.Context, *apb.CompilationUnit, Diagnostic)
+
+	// If WarnOnEmptyOutput is true, a warning is logged for each compilation
+	// that is analyzed successfully without writing any outputs, which often
+	// indicates a misconfigured analyzer or extractor.  Such compilations are
+	// counted in RunStats.EmptyOutput whether or not this is set.
+	WarnOnEmptyOutput bool
+
+	// DrainTimeout controls what happens to the compilations in flight when
+	// the context passed to Run ends.  If DrainTimeout > 0, their analysis is
+	// allowed to continue for up to this duration before its context is
+	// canceled.  Otherwise, their context is canceled with the context passed
+	// to Run.  Either way, Teardown is invoked for each compilation in flight,
+	// no further compilations are read from the queue, and Run reports the
+	// error from the context.
+	DrainTimeout time.Duration
+
+	// If Limit > 0, the run ends successfully once this many compilations have
+	// been read from the queue and processed, and no further compilations are
+	// read.  Compilations skipped by Filter do not count toward the limit.
+	// When prefetching, up to Prefetch more compilations may have been read
+	// ahead from the queue; these are discarded.
+	Limit int
+
+	// If 0 < Sample < 1, each compilation is analyzed with probability
+	// Sample, and is otherwise skipped before Setup and counted in
+	// RunStats.SampledOut.  Sampled-out compilations do not count toward
+	// Limit, so the two together select a sample of a fixed size spread over
+	// the whole queue.  The choice is a pseudo-random function of SampleSeed
+	// and the key of each compilation, so a seed selects the same compilations
+	// however they are ordered in the queue or spread across workers.  If
+	// SampleSeed is 0, a seed is chosen for each run and reported in
+	// RunStats.SampleSeed.
+	Sample     float64
+	SampleSeed int64
+
+	// If MinRemainingForNext > 0 and the context passed to Run has a
+	// deadline, no further compilations are read from the queue once less
+	// than this duration remains before the deadline.  The compilations in
+	// flight are finished and torn down as usual, and the run ends without
+	// error, with RunStats.OutOfBudget set.  This bounds the length of a run
+	// without abandoning a compilation part way through, as reaching the
+	// deadline itself would.
+	MinRemainingForNext time.Duration
+
+	// If RateLimit != nil, requests to the analyzer are limited to the given
+	// rate across all workers.
+	RateLimit *RateLimit
+
+	// If MinInterval > 0, at least this much time elapses between the starts
+	// of successive requests to the analyzer, across all workers, so that a
+	// background run does not monopolize the machine.  No delay is added once
+	// the interval has already passed, for example because the previous
+	// analysis took longer.  This is a best-effort measure, applied in
+	// addition to RateLimit.
+	MinInterval time.Duration
+
+	// If Checkpoint != nil, compilations it reports as completed are skipped
+	// without analysis, and each compilation analyzed successfully is recorded
+	// in it.  This allows an interrupted run to be resumed.
+	Checkpoint Checkpoint
+
+	// Keyer identifies compilations for the Checkpoint and SkipDuplicates.
+	// If nil, KeyOf is used.  Changing the Keyer invalidates the keys already
+	// recorded.
+	Keyer Keyer
+
+	// If Manifest != nil, a line is written to it as each compilation
+	// analyzed successfully finishes, giving the compilation's key according
+	// to the Keyer, the language of its VName, and the number of outputs it
+	// wrote, separated by tabs.  Lines are written whole and one at a time,
+	// even when compilations are analyzed concurrently, so that an
+	// interrupted run leaves a manifest of the compilations it completed.  If
+	// a write fails, no further lines are written, and Run reports the error
+	// once the run is otherwise complete.
+	Manifest io.Writer
+
+	// If SkipDuplicates is true, a compilation whose key has already been
+	// seen in the same run is skipped without analysis, even if the earlier
+	// one failed, and counted in RunStats.Duplicates.  The run remembers a
+	// fixed-size hash of each key, not the key itself, so its memory use is
+	// independent of the length of the keys.  Duplicates are not detected
+	// across runs; use a Checkpoint for that.
+	SkipDuplicates bool
+
+	// If TracerProvider != nil, each compilation is recorded as a span, with
+	// child spans for its Setup, Analyze, and Teardown phases.
+	TracerProvider TracerProvider
+
+	// If MaxOutputEntries > 0, an analysis may write at most that many outputs
+	// for a single compilation.  Further outputs are dropped, and the
+	// compilation fails with an error wrapping ErrTooManyOutputs.
+	MaxOutputEntries int
+
+	// If OnComplete != nil, it is invoked once after the run has processed
+	// every compilation it will, with the statistics for the run.  It is not
+	// invoked if the run stops early because of an error, although in
+	// ContinueOnError mode the compilations that failed do not prevent it.  An
+	// error from OnComplete is returned by Run.
+	OnComplete func(context.Context, RunStats) error
+
+	// ResultsBuffer is the capacity of the channel returned by Results.  If it
+	// is 0, DefaultResultsBuffer is used.
+	ResultsBuffer int
+
+	// If DeadLetter != nil, it is invoked with each compilation that fails,
+	// after any retries, and the error it failed with, for example to save
+	// the compilation for reprocessing.  An error from DeadLetter is logged,
+	// but does not affect the run.
+	DeadLetter func(context.Context, *apb.CompilationUnit, error) error
+
+	// If PreValidate is true, each compilation is checked with ValidateUnit
+	// before Setup.  In ContinueOnError mode an invalid compilation is logged
+	// and skipped; otherwise it fails with a *ValidationError.
+	PreValidate bool
+
+	// If Metrics != nil, it receives measurements of the driver's work.
+	Metrics Metrics
+
+	// If OrderedOutput is true, the outputs of each compilation are buffered
+	// and passed to WriteOutput only once the compilation is finished and the
+	// outputs of every compilation received from the queue before it have been
+	// written, so that outputs are grouped by compilation in queue order even
+	// when compilations are analyzed concurrently.  The outputs of a
+	// compilation are held until all earlier ones finish, so a single slow
+	// compilation can cause the outputs of many others to accumulate; use
+	// OrderedSpillBytes to bound the memory this requires.  An error from
+	// WriteOutput in this mode is not attributed to any one compilation and
+	// stops the run.
+	OrderedOutput bool
+
+	// If OrderedSpillBytes > 0, a compilation whose buffered outputs exceed
+	// this many bytes has them moved to a temporary file until they can be
+	// written.  It applies to the outputs buffered for OrderedOutput, or with
+	// Concurrency > 1 to group them by compilation.
+	OrderedSpillBytes int
+
+	// If BatchSize > 1 and the Analyzer is a BatchAnalyzer, requests from
+	// workers analyzing concurrently are gathered into batches of up to
+	// BatchSize requests, each sent in a single call to AnalyzeBatch.  Since
+	// each worker contributes one request, a batch holds at most Concurrency
+	// requests.  A request waits at most BatchDelay (10ms if BatchDelay is 0)
+	// for its batch to fill before the batch is sent as it is.  Every
+	// compilation in a batch is still set up, torn down, and recorded
+	// individually, and its outputs are written with its own context.  Since
+	// a batch has no way to report diagnostics, Validate rejects batching for
+	// an Analyzer that is also a Diagnoser.
+	BatchSize  int
+	BatchDelay time.Duration
+
+	// If Heartbeat != nil, it is called periodically while each compilation
+	// is being analyzed, with the time elapsed since its analysis began, for
+	// example to signal that a long analysis is still alive.  It is called
+	// every HeartbeatInterval, or every 30 seconds if HeartbeatInterval is 0,
+	// and not at all for analyses that complete sooner.  No calls are made for
+	// a compilation once its Analyze call has returned.  Heartbeat should
+	// return promptly; calls for concurrent compilations are not serialized.
+	Heartbeat         func(context.Context, *apb.CompilationUnit, time.Duration)
+	HeartbeatInterval time.Duration
+
+	// If TrackInputs != nil, the driver records the files fetched through it
+	// during the analysis of each compilation.  Once a compilation has been
+	// analyzed successfully, its required inputs that were not fetched are
+	// counted in RunStats and, if UnreadInputs != nil, passed to UnreadInputs.
+	// The number of fetches and bytes fetched is reported for each
+	// compilation in its CompilationResult, and for the run in RunStats.
+	// See FetchTracker for the limits of this tracking.
+	TrackInputs  *FetchTracker
+	UnreadInputs func(context.Context, *apb.CompilationUnit, []*apb.CompilationUnit_FileInput)
+
+	// If OutputPredicate != nil, it is called with each output as it is
+	// produced.  Once it returns true for an output, that output is written,
+	// the context of the analysis is canceled, and any further outputs the
+	// analyzer produces are rejected.  The compilation is then treated as
+	// having succeeded, whatever error the analyzer returns, and is counted
+	// in RunStats.StoppedEarly.  Other compilations are not affected.
+	OutputPredicate func(*apb.AnalysisOutput) bool
+
+	resultsMu sync.Mutex
+	results   *resultStream // prepared by Results for the next run
+
+	pauseMu sync.Mutex
+	resume  chan struct{} // non-nil while paused; closed by Resume
+
+	activeMu sync.Mutex
+	active   map[*unitScope]int // compilations in progress, with their trackers
+
+	running int32 // set atomically while Run is in progress
+}
+
+// InProgress returns a snapshot of the compilations currently being processed
+// by the current run of d, in no particular order.  A compilation is included
+// from the time its Setup begins until its Teardown has returned, so there is
+// at most one entry per worker unless d.AsyncTeardown is true.  InProgress is
+// safe to call concurrently with Run, and does not delay the processing of
+// compilations.
+func (d *Driver) InProgress() []*apb.CompilationUnit {
+	d.activeMu.Lock()
+	defer d.activeMu.Unlock()
+	units := make([]*apb.CompilationUnit, 0, len(d.active))
+	for s := range d.active {
+		units = append(units, s.unit)
+	}
+	return units
+}
+
+// track records that the compilation of s is in progress, until the returned
+// function is called.  A compilation tracked more than once remains in
+// progress until each of its untrack functions has been called.
+func (d *Driver) track(s *unitScope) (untrack func()) {
+	d.activeMu.Lock()
+	defer d.activeMu.Unlock()
+	if d.active == nil {
+		d.active = make(map[*unitScope]int)
+	}
+	d.active[s]++
+	return func() {
+		d.activeMu.Lock()
+		defer d.activeMu.Unlock()
+		if d.active[s]--; d.active[s] <= 0 {
+			delete(d.active, s)
+		}
+	}
+}
+
+// Pause causes the workers of any current or later run to stop taking
+// compilations from the queue until Resume is called.  Compilations already
+// in progress are finished, and their outputs written.  When prefetching, the
+// prefetcher may continue to read until its buffer is full.  A paused run
+// still ends promptly if its context ends.  Pause is safe to call
+// concurrently with Run, and has no effect if d is already paused.
+func (d *Driver) Pause() {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	if d.resume == nil {
+		d.resume = make(chan struct{})
+	}
+}
+
+// Resume undoes the effect of Pause, allowing paused workers to continue with
+// the next compilation in the queue.  It has no effect if d is not paused.
+func (d *Driver) Resume() {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	if d.resume != nil {
+		close(d.resume)
+		d.resume = nil
+	}
+}
+
+// Paused reports whether d is currently paused.
+func (d *Driver) Paused() bool {
+	d.pauseMu.Lock()
+	defer d.pauseMu.Unlock()
+	return d.resume != nil
+}
+
+// waitResumed blocks while d is paused, returning ctx.Err() if ctx ends first.
+func (d *Driver) waitResumed(ctx context.Context) error {
+	for {
+		d.pauseMu.Lock()
+		resume := d.resume
+		d.pauseMu.Unlock()
+		if resume == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resume:
+			// Check again, in case d was paused again in the meantime.
+		}
+	}
 }
 
 func (d *Driver) writeOutput(ctx context.Context, out *apb.AnalysisOutput) error {
@@ -95,6 +682,55 @@ func (d *Driver) writeOutput(ctx context.Context, out *apb.AnalysisOutput) error
 	return nil
 }
 
+// batchesDiagnoser reports whether d.Analyzer is both a BatchAnalyzer and a
+// Diagnoser, whose diagnostics batching would discard.
+func (d *Driver) batchesDiagnoser() bool {
+	_, batch := d.Analyzer.(BatchAnalyzer)
+	_, diag := d.Analyzer.(Diagnoser)
+	return batch && diag
+}
+
+// batcher returns the analyzer to which requests are sent: a batcher for
+// d.Analyzer if batching is enabled, and otherwise d.Analyzer itself.
+func (d *Driver) batcher() analysis.CompilationAnalyzer {
+	ba, ok := d.Analyzer.(BatchAnalyzer)
+	size := d.BatchSize
+	if d.Concurrency < size {
+		size = d.Concurrency
+	}
+	if !ok || size <= 1 {
+		return d.Analyzer
+	}
+	delay := d.BatchDelay
+	if delay == 0 {
+		delay = defaultBatchDelay
+	}
+	return &batcher{analyzer: ba, size: size, delay: delay}
+}
+
+func (d *Driver) fileDataService(unit *apb.CompilationUnit) string {
+	if d.FileDataServiceFor != nil {
+		if fds := d.FileDataServiceFor(unit); fds != "" {
+			return fds
+		}
+	}
+	return d.FileDataService
+}
+
+func (d *Driver) logger() Logger {
+	if d.Logger != nil {
+		return d.Logger
+	}
+	return StdLogger{}
+}
+
+func (d *Driver) metrics() Metrics {
+	if d.Metrics != nil {
+		return d.Metrics
+	}
+	return NopMetrics{}
+}
+
 func (d *Driver) setup(ctx context.Context, unit Compilation) error {
 	if c := d.Context; c != nil {
 		return c.Setup(ctx, unit)
@@ -102,6 +738,22 @@ func (d *Driver) setup(ctx context.Context, unit Compilation) error {
 	return nil
 }
 
+// transform returns unit as modified by the driver's Context, if it is a
+// Transformer.
+func (d *Driver) transform(ctx context.Context, unit Compilation) (Compilation, error) {
+	t, ok := d.Context.(Transformer)
+	if !ok {
+		return unit, nil
+	}
+	next, err := t.Transform(ctx, unit)
+	if err != nil {
+		return unit, err
+	} else if next != nil {
+		unit.Unit = next
+	}
+	return unit, nil
+}
+
 func (d *Driver) teardown(ctx context.Context, unit Compilation) error {
 	if c := d.Context; c != nil {
 		return c.Teardown(ctx, unit)
@@ -116,39 +768,1435 @@ func (d *Driver) analysisError(ctx context.Context, unit Compilation, err error)
 	return err
 }
 
+// Validate reports an error if the driver is not correctly configured.  It is
+// called automatically by Run.
+func (d *Driver) Validate() error {
+	switch {
+	case d.Analyzer == nil:
+		return errors.New("driver: no Analyzer has been specified")
+	case d.RequireOutput && d.WriteOutput == nil:
+		return errors.New("driver: no WriteOutput has been specified")
+	case d.Concurrency < 0:
+		return errors.Errorf("driver: invalid Concurrency %d", d.Concurrency)
+	case d.Prefetch < 0:
+		return errors.Errorf("driver: invalid Prefetch %d", d.Prefetch)
+	case d.Limit < 0:
+		return errors.Errorf("driver: invalid Limit %d", d.Limit)
+	case !(d.Sample >= 0 && d.Sample <= 1):
+		return errors.Errorf("driver: invalid Sample %v", d.Sample)
+	case d.MaxOutputEntries < 0:
+		return errors.Errorf("driver: invalid MaxOutputEntries %d", d.MaxOutputEntries)
+	case d.BatchSize < 0:
+		return errors.Errorf("driver: invalid BatchSize %d", d.BatchSize)
+	case d.BatchSize > 1 && d.batchesDiagnoser():
+		return errors.New("driver: BatchSize > 1 would drop the diagnostics of a Diagnoser")
+	case d.BatchDelay < 0:
+		return errors.Errorf("driver: invalid BatchDelay %v", d.BatchDelay)
+	case d.OrderedSpillBytes < 0:
+		return errors.Errorf("driver: invalid OrderedSpillBytes %d", d.OrderedSpillBytes)
+	case d.Timeout < 0:
+		return errors.Errorf("driver: invalid Timeout %v", d.Timeout)
+	case d.OnTimeout < TimeoutDiscard || d.OnTimeout > TimeoutPartial:
+		return errors.Errorf("driver: invalid OnTimeout %d", d.OnTimeout)
+	case d.TeardownOnSkip < TeardownIfSetUp || d.TeardownOnSkip > TeardownNever:
+		return errors.Errorf("driver: invalid TeardownOnSkip %d", d.TeardownOnSkip)
+	case d.ResultsBuffer < 0:
+		return errors.Errorf("driver: invalid ResultsBuffer %d", d.ResultsBuffer)
+	case d.MaxRetryAfter < 0:
+		return errors.Errorf("driver: invalid MaxRetryAfter %d", d.MaxRetryAfter)
+	case d.MinRemainingForNext < 0:
+		return errors.Errorf("driver: invalid MinRemainingForNext %v", d.MinRemainingForNext)
+	case d.MinInterval < 0:
+		return errors.Errorf("driver: invalid MinInterval %v", d.MinInterval)
+	case d.HeartbeatInterval < 0:
+		return errors.Errorf("driver: invalid HeartbeatInterval %v", d.HeartbeatInterval)
+	case d.TeardownWarnInterval < 0:
+		return errors.Errorf("driver: invalid TeardownWarnInterval %v", d.TeardownWarnInterval)
+	case d.MaxConsecutiveFailures < 0:
+		return errors.Errorf("driver: invalid MaxConsecutiveFailures %d", d.MaxConsecutiveFailures)
+	}
+	if p := d.Retry; p != nil {
+		switch {
+		case p.MaxAttempts < 0:
+			return errors.Errorf("driver: invalid Retry.MaxAttempts %d", p.MaxAttempts)
+		case p.BaseDelay < 0 || p.MaxDelay < 0:
+			return errors.New("driver: negative Retry delay")
+		case p.MaxAttempts > 1 && p.Retryable == nil:
+			return errors.New("driver: no Retry.Retryable predicate has been specified")
+		}
+	}
+	if g := d.Golden; g != nil && g.Expected == nil {
+		return errors.New("driver: no Golden.Expected function has been specified")
+	}
+	if r := d.RateLimit; r != nil && r.PerSecond <= 0 {
+		return errors.Errorf("driver: invalid RateLimit.PerSecond %v", r.PerSecond)
+	}
+	return nil
+}
+
 // Run sends each compilation received from the driver's Queue to the driver's
 // Analyzer.  All outputs are passed to Output in turn.  An error is immediately
-// returned if the Analyzer, Output, or Compilations fields are unset.
+// returned if the driver is invalid (see Validate) or no queue is available.
+//
+// If queue == nil, compilations are read from d.Compilations.
+//
+// If d.Concurrency > 1, that many workers concurrently pull compilations from
+// queue, which must therefore be safe for concurrent use.  Setup, Analyze, and
+// Teardown are still called in order for each compilation, and calls to
+// WriteOutput are serialized, with the outputs of each compilation written
+// together.  The first worker to fail cancels the others; Run waits for all
+// in-flight compilations to finish before returning the first error reported,
+// in the order the failures occurred rather than the order of the queue.  The
+// contexts of the compilations canceled as a result report that error from
+// AbortedBy, which distinguishes them from compilations canceled with the
+// context passed to Run.
+//
+// Unless d.ContinueOnError is true, the failure of a compilation is reported
+// as a *CompilationError naming the compilation and its key, and wrapping the
+// error reported for it.
+//
+// If d.ContinueOnError is true and any compilations failed, Run returns a
+// MultiError describing each failure once the queue is exhausted.
+//
+// If the analyzer returns an error wrapping analysis.ErrStopDriver, the
+// compilation is treated as a success, and no further compilations are taken
+// from the queue.  Compilations already in progress are finished, and Run
+// returns as if the queue had been exhausted, recording the error in
+// RunStats.StopReason.
+//
+// Run may be called again once it has returned, whether or not it reported an
+// error.  Each run starts afresh: its statistics, the keys seen by
+// SkipDuplicates, and the counts kept for retries and requeues are not carried
+// over from earlier runs.  Only the driver's configuration, its pause state,
+// and a channel prepared by Results persist between runs.  A Driver runs one
+// queue at a time; a call to Run while another is in progress returns
+// ErrRunning without reading from its queue.
 func (d *Driver) Run(ctx context.Context, queue Queue) error {
-	if d.Analyzer == nil {
-		return errors.New("no analyzer has been specified")
+	_, err := d.RunWithStats(ctx, queue)
+	return err
+}
+
+// RunWithStats behaves as Run, but also returns statistics about the run.
+// The statistics are populated even if an error is reported.
+func (d *Driver) RunWithStats(ctx context.Context, queue Queue) (RunStats, error) {
+	return d.runWith(ctx, queue, (*runner).run)
+}
+
+// runWith implements RunWithStats, using run to process the compilations of
+// the queue.
+func (d *Driver) runWith(ctx context.Context, queue Queue, run func(*runner, context.Context) error) (RunStats, error) {
+	if !atomic.CompareAndSwapInt32(&d.running, 0, 1) {
+		return RunStats{}, ErrRunning
+	}
+	defer atomic.StoreInt32(&d.running, 0)
+	results := d.takeResults()
+	if err := d.Validate(); err != nil {
+		results.close()
+		return RunStats{}, err
+	}
+	if queue == nil {
+		queue = d.Compilations
+	}
+	if queue == nil {
+		results.close()
+		return RunStats{}, errors.New("driver: no Compilations queue has been specified")
+	}
+	r := &runner{
+		Driver:  d,
+		queue:   queue,
+		stats:   RunStats{Total: d.total(queue), DryRun: d.DryRun, Languages: make(map[string]LanguageStats)},
+		limiter: newLimiter(d.RateLimit),
+		spacer:  newSpacer(d.MinInterval),
+	}
+	if d.TracerProvider != nil {
+		r.tracer = d.TracerProvider.Tracer(TracerName)
+	}
+	if d.OrderedOutput {
+		r.order = newOrderer(d.OrderedSpillBytes, r.emit)
+	}
+	if d.sampling() {
+		r.stats.SampleSeed = d.SampleSeed
+		if r.stats.SampleSeed == 0 {
+			r.stats.SampleSeed = time.Now().UnixNano()
+		}
 	}
+	r.analyzer = d.batcher()
+	r.requeuer, _ = queue.(Requeuer)
+	r.results = results
+	r.runCtx = ctx
+	fetches, fetched := d.TrackInputs.totals()
+	start := time.Now()
+	err := run(r, ctx)
+	r.teardowns.Wait()
+	if r.teardownPanic != nil {
+		panic(r.teardownPanic)
+	}
+	if r.quietWarns > 0 {
+		r.logger().Warn(ctx, "analysis teardown failures not logged", "count", r.quietWarns)
+	}
+	r.stats.ResultsDropped = r.results.close()
+	if d.TrackInputs != nil {
+		n, size := d.TrackInputs.totals()
+		r.stats.Fetches, r.stats.FetchBytes = n-fetches, size-fetched
+	}
+	if err == nil && r.Prefetch == 0 {
+		r.noteLimit(ctx)
+	}
+	r.stats.WallTime = time.Since(start)
+	if atomic.LoadInt32(&r.overBudget) != 0 {
+		r.stats.OutOfBudget = true
+		if n := r.stats.Total - r.stats.received(); n > 0 {
+			r.stats.Unstarted = n
+		}
+	}
+	if err == nil && r.outputStopped() {
+		return r.stats, context.Canceled
+	}
+	if err == nil && d.ErrorOnEmpty && r.stats.received() == 0 {
+		return r.stats, ErrEmptyQueue
+	}
+	if err == nil && len(r.teardownErrs) != 0 {
+		if d.ContinueOnError {
+			r.failures = append(r.failures, r.teardownErrs...)
+		} else {
+			err = r.teardownErrs[0]
+		}
+	}
+	if err == nil && r.manifestErr != nil {
+		return r.stats, errors.WithMessage(r.manifestErr, "driver: manifest")
+	}
+	if err == nil && d.OnComplete != nil {
+		if cerr := d.OnComplete(ctx, r.stats); cerr != nil {
+			return r.stats, errors.WithMessage(cerr, "driver: completion")
+		}
+	}
+	if err == nil && len(r.failures) != 0 {
+		err = r.failures
+	}
+	return r.stats, err
+}
+
+// total returns the number of compilations a run will process from queue, or 0
+// if queue is not a Sizer or does not know its size.
+func (d *Driver) total(queue Queue) int {
+	s, ok := queue.(Sizer)
+	if !ok {
+		return 0
+	}
+	n, ok := s.Remaining()
+	if !ok {
+		return 0
+	}
+	if d.Limit > 0 && n > d.Limit {
+		return d.Limit
+	}
+	return n
+}
+
+// A runner carries the state of a single call to Run.
+type runner struct {
+	*Driver
+	queue Queue
+
+	outMu   sync.Mutex // serializes calls to WriteOutput
+	groupMu sync.Mutex // serializes the writing of grouped outputs
+
+	mu       sync.Mutex
+	stats    RunStats
+	failures MultiError
+	reserved int               // compilations reserved for analysis; see reserve
+	received int               // compilations received from the queue
+	seen     map[[16]byte]bool // hashes of the keys seen, if skipping duplicates
+	requeues map[string]int    // the number of times each key was requeued
+	requeuer Requeuer          // the queue, if it is a Requeuer
+
+	manifestMu  sync.Mutex // serializes writes to the Manifest
+	manifestErr error      // the first error writing the Manifest
+
+	consecutive int             // compilations failed since the last success
+	unhealthy   *UnhealthyError // set once MaxConsecutiveFailures is reached
+
+	runCtx        context.Context // the context passed to Run
+	teardowns     sync.WaitGroup  // outstanding asynchronous teardowns
+	teardownErrs  MultiError      // errors from asynchronous teardowns
+	teardownPanic interface{}     // the first panic in an asynchronous teardown
+	teardownWarn  time.Time       // when a teardown warning was last logged
+	quietWarns    int             // teardown warnings not logged since then
+
+	limiter *limiter // nil if requests are not rate limited
+	spacer  *spacer  // nil if requests are not spaced
+	tracer  Tracer   // nil if tracing is disabled
+	order   *orderer // nil unless outputs are ordered
+
+	analyzer analysis.CompilationAnalyzer // the Analyzer, or a batcher for it
+	results  *resultStream                // nil if results are not published
+
+	backoffMu    sync.Mutex
+	backoffUntil time.Time // no requests are sent to the analyzer before this time
 
+	stopped    int32 // set atomically when the output reports context.Canceled
+	halted     int32 // set atomically when the analyzer returns analysis.ErrStopDriver
+	overBudget int32 // set atomically when the run's time budget is exhausted
+}
+
+// prefetch starts prefetching compilations from the queue, if d.Prefetch > 0,
+// and returns a function that stops the prefetcher and waits for it to exit.
+func (r *runner) prefetch(ctx context.Context) (stop func()) {
+	if r.Prefetch <= 0 {
+		return func() {}
+	}
+	pctx, cancel := context.WithCancel(ctx)
+	pq := newPrefetchQueue(pctx, r.queue, r.Prefetch)
+	r.queue = pq
+	return func() {
+		cancel()
+		pq.wait()
+	}
+}
+
+// run pulls compilations from the queue using d.Concurrency workers.
+func (r *runner) run(ctx context.Context) error {
+	defer r.prefetch(ctx)()
+	if r.Concurrency <= 1 {
+		return r.work(ctx)
+	}
+
+	abort := new(abortState)
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, abortKey{}, abort))
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+		panicked interface{} // the first value recovered from a worker panic
+	)
+	for i := 0; i < r.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if v := recover(); v != nil {
+					errMu.Lock()
+					if panicked == nil {
+						panicked = v
+					}
+					errMu.Unlock()
+					cancel()
+				}
+			}()
+			if err := r.work(ctx); err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					if err != ctx.Err() {
+						abort.set(err)
+					}
+				}
+				errMu.Unlock()
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+	return firstErr
+}
+
+// work analyzes compilations from the queue until it is exhausted or an
+// error occurs.
+func (r *runner) work(ctx context.Context) error {
+	req := r.newRequest()
 	for {
-		if err := queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
-			if err := d.setup(ctx, cu); err != nil {
-				return errors.WithMessage(err, "driver: analysis setup")
+		if err := ctx.Err(); err != nil {
+			return err // stop reading from the queue
+		} else if err := r.waitResumed(ctx); err != nil {
+			return err
+		} else if r.outputStopped() || r.stopRequested() || r.budgetExhausted(ctx) {
+			return nil
+		}
+		if !r.reserve() {
+			return nil // the limit has been reached
+		}
+		var (
+			called bool        // whether the queue delivered a compilation
+			used   bool        // whether the reservation was used
+			ferr   error       // the error reported for the compilation
+			unit   Compilation // the compilation delivered
+		)
+		start := time.Now()
+		err := r.queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
+			called, unit = true, cu
+			used, ferr = r.handle(ctx, cu, req, time.Since(start))
+			return ferr
+		})
+		if !used {
+			r.release()
+		}
+		switch {
+		case err == ErrEndOfQueue:
+			return nil
+		case err == nil:
+			if uerr := r.tripped(); uerr != nil {
+				return uerr
 			}
-			err := ErrRetry
-			for err == ErrRetry {
-				err = d.analysisError(ctx, cu, d.Analyzer.Analyze(ctx, &apb.AnalysisRequest{
-					Compilation:     cu.Unit,
-					FileDataService: d.FileDataService,
-					Revision:        cu.Revision,
-					BuildId:         cu.BuildID,
-				}, d.writeOutput))
+		case err == ctx.Err():
+			return err
+		case called && err == ferr:
+			return &CompilationError{Unit: unit.Unit, Key: r.key(unit.Unit), Err: err}
+		default:
+			return &QueueError{Err: err}
+		}
+	}
+}
+
+// newRequest returns a request for a worker to reuse for each compilation it
+// analyzes, or nil if requests cannot be reused.  Requests are not reused when
+// d.Timeout > 0, since an analysis abandoned after timing out may still hold
+// its request, nor when requests are batched, since a batch already sent to
+// the analyzer may still hold the request of a worker whose context ended.
+func (r *runner) newRequest() *apb.AnalysisRequest {
+	if _, batched := r.analyzer.(*batcher); batched || r.Timeout > 0 {
+		return nil
+	}
+	return new(apb.AnalysisRequest)
+}
+
+// handle processes a single compilation delivered by the queue after a wait
+// of the given duration in its Next method, reporting whether it was analyzed
+// rather than skipped, and the error to return from the queue's callback.  If
+// req != nil, it is reused for the analysis.
+func (r *runner) handle(ctx context.Context, cu Compilation, req *apb.AnalysisRequest, wait time.Duration) (used bool, err error) {
+	ctx, cancel := r.drainContext(ctx)
+	defer cancel()
+	r.mu.Lock()
+	index := r.received
+	r.received++
+	r.stats.QueueWaitTime += wait
+	r.mu.Unlock()
+	ctx = withScope(ctx, cu.Unit, index)
+	scopeFrom(ctx).wait = wait
+	if r.order == nil {
+		defer scopeFrom(ctx).finish()
+	} else {
+		// The scope is finished once its outputs have been written.
+		b := r.order.start()
+		scopeFrom(ctx).buf = b
+		defer func() {
+			if ferr := r.order.finish(ctx, ctx, b); ferr != nil && err == nil && !r.outputStopped() {
+				err = ferr
 			}
-			if terr := d.teardown(ctx, cu); terr != nil {
-				if err == nil {
-					return errors.WithMessage(terr, "driver: analysis teardown")
-				}
-				log.Printf("WARNING: analysis teardown failed: %v (analysis error: %v)", terr, err)
+		}()
+	}
+	if r.Filter != nil && !r.Filter(cu.Unit) {
+		r.skip(cu)
+		return false, nil
+	}
+	if r.PreValidate {
+		if err := ValidateUnit(cu.Unit); err != nil {
+			verr := &ValidationError{Unit: cu.Unit, Err: err}
+			if r.ContinueOnError {
+				r.logger().Warn(ctx, "invalid compilation", "compilation", unitName(cu.Unit), "error", err)
+				r.invalid(cu)
+				return false, nil
 			}
+			r.finish(ctx, cu, verr)
+			return true, verr
+		}
+	}
+	key, done := r.checkpointed(cu)
+	if done {
+		r.skip(cu)
+		return false, nil
+	}
+	if r.duplicate(cu, key) {
+		r.skip(cu)
+		r.mu.Lock()
+		r.stats.Duplicates++
+		r.mu.Unlock()
+		return false, nil
+	}
+	if r.sampledOut(cu, key) {
+		r.skip(cu)
+		r.mu.Lock()
+		r.stats.SampledOut++
+		r.mu.Unlock()
+		return false, nil
+	}
+	r.metrics().IncStarted(cu.Unit.GetVName().GetLanguage())
+	ctx, end := r.traceUnit(ctx, cu)
+	fetched := r.TrackInputs.begin()
+	untrack := r.track(scopeFrom(ctx))
+	err = r.analyze(ctx, cu, req)
+	untrack()
+	fetched.end()
+	if s := scopeFrom(ctx); s != nil && fetched != nil {
+		s.setFetches(fetched.counts())
+	}
+	if goerrors.Is(err, ErrSkipCompilation) {
+		end(nil)
+		r.skip(cu)
+		return false, nil
+	}
+	if goerrors.Is(err, errRequeued) {
+		end(nil)
+		r.mu.Lock()
+		r.stats.Requeued++
+		r.mu.Unlock()
+		return false, nil
+	}
+	if s := scopeFrom(ctx); s != nil && s.outputStopped() {
+		// The output has asked the run to stop; abandon this compilation.
+		end(context.Canceled)
+		return true, nil
+	}
+	if err == nil && r.Golden != nil && !r.DryRun {
+		err = r.compareGolden(ctx, cu)
+	}
+	if err == nil && !r.DryRun {
+		err = r.record(key)
+	}
+	if err == nil && fetched != nil && !r.DryRun {
+		r.unread(ctx, cu, fetched.unread(cu.Unit))
+	}
+	r.finish(ctx, cu, err)
+	end(err)
+	if r.ContinueOnError {
+		return true, nil
+	}
+	return true, err
+}
+
+// reserve reserves the right to analyze one more compilation, reporting false
+// if d.Limit compilations have already been reserved.
+func (r *runner) reserve() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Limit > 0 && r.reserved >= r.Limit {
+		return false
+	}
+	r.reserved++
+	return true
+}
+
+// release releases an unused reservation.
+func (r *runner) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reserved--
+}
+
+// noteLimit logs the next compilation remaining in the queue, if the run was
+// stopped by d.Limit and the queue is a Peeker.
+func (r *runner) noteLimit(ctx context.Context) {
+	p, ok := r.queue.(Peeker)
+	if !ok || r.Limit <= 0 || r.reserved < r.Limit {
+		return
+	}
+	if cu, err := p.Peek(ctx); err == nil {
+		r.logger().Info(ctx, "compilation limit reached", "limit", r.Limit, "next", unitName(cu.Unit))
+	}
+}
+
+// drainContext returns the context in which to process a compilation while
+// ctx is active.  If d.DrainTimeout > 0, the result outlives ctx by up to that
+// duration.  The caller must call the cancel function when the compilation is
+// finished.
+func (r *runner) drainContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.DrainTimeout <= 0 {
+		return ctx, func() {}
+	}
+	dctx, cancel := withCancelCause(detach(ctx))
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			t := time.NewTimer(r.DrainTimeout)
+			defer t.Stop()
+			select {
+			case <-t.C:
+				cancel(ErrDrainExpired)
+			case <-finished:
+			}
+		case <-finished:
+		}
+	}()
+	return dctx, func() {
+		close(finished)
+		cancel(nil)
+	}
+}
+
+// checkpointed reports the checkpoint key for cu, and whether the checkpoint
+// records cu as completed.  If there is no checkpoint, the key is empty.
+func (r *runner) checkpointed(cu Compilation) (string, bool) {
+	if r.Checkpoint == nil {
+		return "", false
+	}
+	key := r.key(cu.Unit)
+	return key, r.Checkpoint.Completed(key)
+}
+
+// sampling reports whether d analyzes only a sample of its compilations.
+func (d *Driver) sampling() bool { return d.Sample > 0 && d.Sample < 1 }
+
+// sampledOut reports whether cu is excluded from the sample of compilations
+// analyzed by the run.  If key is not empty, it is the key of cu.  It reports
+// false unless d.Sample selects a sample.
+func (r *runner) sampledOut(cu Compilation, key string) bool {
+	if !r.sampling() {
+		return false
+	}
+	if key == "" {
+		key = r.key(cu.Unit)
+	}
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, r.stats.SampleSeed) // writes to a hash do not fail
+	io.WriteString(h, key)
+	x := binary.BigEndian.Uint64(h.Sum(nil))
+	return float64(x>>11)/(1<<53) >= r.Sample // uniform in [0, 1)
+}
+
+// duplicate reports whether a compilation with the same key as cu has already
+// been seen in this run, and otherwise records its key.  If key is not empty,
+// it is the key of cu.  It reports false unless d.SkipDuplicates is set.
+func (r *runner) duplicate(cu Compilation, key string) bool {
+	if !r.SkipDuplicates {
+		return false
+	}
+	if key == "" {
+		key = r.key(cu.Unit)
+	}
+	sum := sha256.Sum256([]byte(key))
+	var id [16]byte
+	copy(id[:], sum[:])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen[id] {
+		return true
+	}
+	if r.seen == nil {
+		r.seen = make(map[[16]byte]bool)
+	}
+	r.seen[id] = true
+	return false
+}
+
+// record marks the compilation with the given key as completed in the
+// checkpoint, if there is one.
+func (r *runner) record(key string) error {
+	if r.Checkpoint == nil {
+		return nil
+	}
+	return errors.WithMessage(r.Checkpoint.Record(key), "driver: checkpoint")
+}
+
+// finish records the result of analyzing cu.
+func (r *runner) finish(ctx context.Context, cu Compilation, err error) {
+	if err != nil && r.ContinueOnError {
+		r.logger().Warn(ctx, "analysis failed", "compilation", unitName(cu.Unit), "error", err)
+	}
+	var (
+		elapsed    time.Duration
+		outputs    int
+		fetches    int
+		fetchBytes int64
+		retries    int
+		wait       time.Duration
+	)
+	if s := scopeFrom(ctx); s != nil {
+		elapsed, outputs = s.analyzeTime(), s.outputCount()
+		fetches, fetchBytes = s.fetchCounts()
+		retries = s.retryCount()
+		wait = s.wait
+	}
+	if r.SlowThreshold > 0 && elapsed > r.SlowThreshold {
+		r.logger().Warn(ctx, "slow analysis", "compilation", unitName(cu.Unit), "elapsed", elapsed)
+	}
+	empty := err == nil && outputs == 0 && !r.DryRun
+	if empty && r.WarnOnEmptyOutput {
+		r.logger().Warn(ctx, "analysis produced no outputs", "compilation", unitName(cu.Unit))
+	}
+	if lang := cu.Unit.GetVName().GetLanguage(); err == nil {
+		r.metrics().IncSucceeded(lang)
+	} else {
+		r.metrics().IncFailed(lang)
+	}
+	if err != nil && r.DeadLetter != nil {
+		if derr := r.DeadLetter(ctx, cu.Unit, err); derr != nil {
+			r.logger().Warn(ctx, "dead letter failed", "compilation", unitName(cu.Unit), "error", derr)
+		}
+	}
+	if r.results != nil {
+		r.results.publish(CompilationResult{
+			Unit:     cu.Unit,
+			Key:      r.key(cu.Unit),
+			Err:      err,
+			Duration: elapsed,
+			Outputs:  outputs,
+			Empty:    empty,
+			Retries:  retries,
+
+			QueueWait: wait,
+
+			Fetches:    fetches,
+			FetchBytes: fetchBytes,
+		})
+	}
+
+	if err == nil && !r.DryRun {
+		r.writeManifest(ctx, cu, outputs)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.add(cu.Unit, r.key(cu.Unit), err)
+	r.stats.addTime(cu.Unit, elapsed)
+	if goerrors.Is(err, ErrTooManyOutputs) {
+		r.stats.OutputLimited++
+	}
+	if empty {
+		r.stats.EmptyOutput++
+	}
+	if err != nil && r.ContinueOnError {
+		r.failures = append(r.failures, &CompilationError{Unit: cu.Unit, Key: r.key(cu.Unit), Err: err})
+	}
+	if err == nil {
+		r.consecutive = 0
+	} else if r.consecutive++; r.MaxConsecutiveFailures > 0 && r.consecutive >= r.MaxConsecutiveFailures && r.unhealthy == nil {
+		r.unhealthy = &UnhealthyError{
+			Failures: r.consecutive,
+			Last:     &CompilationError{Unit: cu.Unit, Key: r.key(cu.Unit), Err: err},
+		}
+	}
+	if r.Progress != nil {
+		r.Progress(r.stats.Compilations, r.stats.Failed, r.stats.Total, cu.Unit)
+	}
+}
+
+// writeManifest writes the manifest line for cu, which wrote the given number
+// of outputs, if d.Manifest is set and has not failed.
+func (r *runner) writeManifest(ctx context.Context, cu Compilation, outputs int) {
+	if r.Manifest == nil {
+		return
+	}
+	line := fmt.Sprintf("%s\t%s\t%d\n", r.key(cu.Unit), cu.Unit.GetVName().GetLanguage(), outputs)
+	r.manifestMu.Lock()
+	defer r.manifestMu.Unlock()
+	if r.manifestErr != nil {
+		return
+	}
+	if _, err := io.WriteString(r.Manifest, line); err != nil {
+		r.logger().Warn(ctx, "writing manifest failed", "error", err)
+		r.manifestErr = err
+	}
+}
+
+// tripped returns the error that aborts the run once d.MaxConsecutiveFailures
+// has been reached, or nil.
+func (r *runner) tripped() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.unhealthy == nil {
+		return nil // avoid returning a typed nil
+	}
+	return r.unhealthy
+}
+
+// invalid records that cu was skipped because it failed validation.
+func (r *runner) invalid(cu Compilation) {
+	r.metrics().IncSkipped(cu.Unit.GetVName().GetLanguage())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Invalid++
+}
+
+// unread records that the inputs of cu were not fetched during its analysis.
+func (r *runner) unread(ctx context.Context, cu Compilation, inputs []*apb.CompilationUnit_FileInput) {
+	if len(inputs) == 0 {
+		return
+	}
+	r.mu.Lock()
+	r.stats.UnreadInputs += len(inputs)
+	r.mu.Unlock()
+	if r.UnreadInputs != nil {
+		r.UnreadInputs(ctx, cu.Unit, inputs)
+	}
+}
+
+// outputStopped reports whether the output has asked the run to stop.
+func (r *runner) outputStopped() bool { return atomic.LoadInt32(&r.stopped) != 0 }
+
+// requestStop records that the analysis of cu asked the run to stop, with an
+// error wrapping analysis.ErrStopDriver.
+func (r *runner) requestStop(ctx context.Context, cu Compilation, err error) {
+	if !atomic.CompareAndSwapInt32(&r.halted, 0, 1) {
+		return
+	}
+	r.logger().Info(ctx, "analyzer stopped the run", "compilation", unitName(cu.Unit), "reason", err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.StopReason = err.Error()
+}
+
+// stopRequested reports whether requestStop has been called.
+func (r *runner) stopRequested() bool { return atomic.LoadInt32(&r.halted) != 0 }
+
+// budgetExhausted reports whether too little time remains before the
+// deadline of ctx to start another compilation; see d.MinRemainingForNext.
+func (r *runner) budgetExhausted(ctx context.Context) bool {
+	if r.MinRemainingForNext <= 0 {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) >= r.MinRemainingForNext {
+		return false
+	}
+	atomic.StoreInt32(&r.overBudget, 1)
+	return true
+}
+
+// skip records that cu was skipped without analysis.
+func (r *runner) skip(cu Compilation) {
+	r.metrics().IncSkipped(cu.Unit.GetVName().GetLanguage())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Skipped++
+}
+
+func (r *runner) writeOutput(ctx context.Context, out *apb.AnalysisOutput) error {
+	if s := scopeFrom(ctx); s != nil && r.Golden != nil {
+		collectGolden(s, out)
+	} else if s != nil && s.buf != nil {
+		if err := s.buf.add(out); err != nil {
 			return err
-		}); err == ErrEndOfQueue {
+		}
+	} else if err := r.emit(ctx, out); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.stats.Outputs++
+	r.stats.OutputBytes += int64(len(out.Value))
+	r.mu.Unlock()
+	lang := ""
+	if s := scopeFrom(ctx); s != nil {
+		s.addOutput()
+		lang = s.unit.GetVName().GetLanguage()
+	}
+	r.metrics().AddOutputs(lang, 1)
+	return nil
+}
+
+// emit passes out to the Driver's output.  Calls to emit are serialized.
+func (r *runner) emit(ctx context.Context, out *apb.AnalysisOutput) error {
+	r.outMu.Lock()
+	defer r.outMu.Unlock()
+	err := r.Driver.writeOutput(ctx, out)
+	if goerrors.Is(err, context.Canceled) && ctx.Err() == nil {
+		atomic.StoreInt32(&r.stopped, 1)
+		if s := scopeFrom(ctx); s != nil {
+			s.stopOutput()
+		}
+	}
+	return err
+}
+
+// analyze runs the Setup, Analyze, and Teardown phases for a single
+// compilation.  If Setup or Analyze panics, Teardown is still invoked; the
+// panic is then reported as a *PanicError if d.PanicAsError is true, and
+// otherwise propagated.
+func (r *runner) analyze(ctx context.Context, cu Compilation, req *apb.AnalysisRequest) error {
+	err := r.process(ctx, cu, req)
+	var perr *PanicError
+	if !r.PanicAsError && goerrors.As(err, &perr) {
+		panic(perr)
+	}
+	return err
+}
+
+// process implements analyze, with panics in Setup and Analyze converted to
+// errors.
+func (r *runner) process(ctx context.Context, orig Compilation, req *apb.AnalysisRequest) error {
+	cu, err := r.setupUnit(ctx, orig)
+	if err != nil {
+		return err
+	}
+	for attempt, waits := 1, 0; ; attempt++ {
+		err = r.attempt(ctx, cu, req)
+		if delay, ok := retryAfter(err); ok && waits < r.maxRetryAfter() {
+			waits++
+			attempt-- // a requested retry does not count against r.Retry
+			r.logger().Warn(ctx, "analyzer requested a retry", "delay", delay, "error", err)
+			r.mu.Lock()
+			r.stats.RetriedAfter++
+			r.mu.Unlock()
+			r.backOff(delay)
+			if err = r.waitBackoff(ctx); err != nil {
+				break
+			}
+			continue
+		}
+		if r.requeuing() {
+			if ok, rerr := r.requeue(ctx, orig, err); rerr != nil {
+				err = rerr
+			} else if ok {
+				err = errRequeued
+			}
+			break
+		}
+		if !r.Retry.retryable(attempt, err) {
+			break
+		}
+		delay := r.Retry.Delay(attempt)
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) < delay {
+			break // no time remains for another attempt
+		}
+		if r.Retry.OnRetry != nil {
+			if herr := r.Retry.OnRetry(ctx, cu.Unit, attempt, err, delay); herr != nil {
+				err = herr
+				break
+			}
+		}
+		if s := scopeFrom(ctx); s != nil {
+			s.addRetry()
+		}
+		r.logger().Warn(ctx, "analysis attempt failed; retrying", "attempt", attempt, "delay", delay, "error", err)
+		r.metrics().IncRetried(cu.Unit.GetVName().GetLanguage())
+		if r.Retry.TeardownBetweenAttempts {
+			if terr := r.teardownSpan(ctx, cu); terr != nil {
+				r.warnTeardown(ctx, cu, terr, "analysis_error", err)
+			}
+		}
+		if serr := sleep(ctx, delay); serr != nil {
+			if r.Retry.TeardownBetweenAttempts {
+				return &AnalyzeError{Unit: cu.Unit, Err: serr}
+			}
+			err = serr
+			break
+		}
+		if r.Retry.TeardownBetweenAttempts {
+			var serr error
+			if cu, serr = r.setupUnit(ctx, orig); serr != nil {
+				return serr
+			}
+		}
+	}
+	if err != nil {
+		err = &AnalyzeError{Unit: cu.Unit, Err: err}
+	}
+	if r.AsyncTeardown {
+		r.teardownAsync(ctx, cu, err)
+		return err
+	}
+	if terr := r.teardownSpan(ctx, cu); terr != nil {
+		if err == nil {
+			return &TeardownError{Unit: cu.Unit, Err: terr}
+		}
+		r.warnTeardown(ctx, cu, terr, "analysis_error", err)
+	}
+	return err
+}
+
+// teardownAsync invokes Teardown for cu in the background, after its analysis
+// finished with err.  The compilation's scope remains live, and the
+// compilation in progress, until Teardown has returned.  A panic in Teardown
+// is reported as a *PanicError if d.PanicAsError is true, and is otherwise
+// propagated from Run once all teardowns have returned.
+func (r *runner) teardownAsync(ctx context.Context, cu Compilation, err error) {
+	s := scopeFrom(ctx)
+	s.hold()
+	untrack := r.track(s)
+	tctx := withValues(r.runCtx, ctx)
+	r.teardowns.Add(1)
+	go func() {
+		defer r.teardowns.Done()
+		defer s.finish()
+		defer untrack()
+		terr := catch(func() error { return r.teardownSpan(tctx, cu) })
+		if terr == nil {
+			return
+		}
+		if perr, ok := terr.(*PanicError); ok && !r.PanicAsError {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.teardownPanic == nil {
+				r.teardownPanic = perr
+			}
+			return
+		}
+		if err != nil {
+			r.warnTeardown(tctx, cu, terr, "analysis_error", err)
+			return
+		}
+		r.logger().Warn(tctx, "analysis teardown failed", "compilation", unitName(cu.Unit), "error", terr)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.stats.TeardownFailed++
+		r.teardownErrs = append(r.teardownErrs, &CompilationError{
+			Unit: cu.Unit,
+			Key:  r.key(cu.Unit),
+			Err:  &TeardownError{Unit: cu.Unit, Err: terr},
+		})
+	}()
+}
+
+// warnTeardown logs a warning that the teardown of cu failed with terr after
+// its setup or analysis failed with err, which is logged under the given field,
+// unless d.TeardownWarnInterval calls for the warning to be suppressed.
+func (r *runner) warnTeardown(ctx context.Context, cu Compilation, terr error, field string, err error) {
+	var quiet int
+	if r.TeardownWarnInterval > 0 {
+		now := time.Now()
+		r.mu.Lock()
+		if !r.teardownWarn.IsZero() && now.Sub(r.teardownWarn) < r.TeardownWarnInterval {
+			r.quietWarns++
+			r.mu.Unlock()
+			return
+		}
+		r.teardownWarn = now
+		quiet, r.quietWarns = r.quietWarns, 0
+		r.mu.Unlock()
+	}
+	kvs := []interface{}{"compilation", unitName(cu.Unit), "key", r.key(cu.Unit), "error", terr, field, err}
+	if quiet > 0 {
+		kvs = append(kvs, "not_logged", quiet)
+	}
+	r.logger().Warn(ctx, "analysis teardown failed", kvs...)
+}
+
+// errRequeued is reported for a compilation handed back to the queue.
+var errRequeued = goerrors.New("compilation requeued")
+
+// requeuing reports whether failed compilations are requeued rather than
+// retried in place.
+func (r *runner) requeuing() bool {
+	return r.requeuer != nil && r.Retry != nil && r.Retry.Requeue
+}
+
+// requeue hands cu back to the queue after it failed with err, if err is
+// retryable and cu has been requeued fewer than d.Retry.MaxAttempts-1 times in
+// this run.  It reports whether cu was requeued.
+func (r *runner) requeue(ctx context.Context, cu Compilation, err error) (bool, error) {
+	if !r.Retry.retryable(1, err) {
+		return false, nil
+	}
+	key := r.key(cu.Unit)
+	r.mu.Lock()
+	n := r.requeues[key]
+	if n+1 >= r.Retry.MaxAttempts {
+		r.mu.Unlock()
+		return false, nil // no attempts remain
+	}
+	if r.requeues == nil {
+		r.requeues = make(map[string]int)
+	}
+	r.requeues[key] = n + 1
+	r.mu.Unlock()
+	if rerr := r.requeuer.Requeue(ctx, cu); rerr != nil {
+		return false, errors.WithMessagef(rerr, "driver: requeuing compilation after %v", err)
+	}
+	r.logger().Warn(ctx, "analysis failed; requeued", "error", err, "requeues", n+1)
+	return true, nil
+}
+
+// defaultMaxRetryAfter is the retry limit used if d.MaxRetryAfter is 0.
+const defaultMaxRetryAfter = 10
+
+func (d *Driver) maxRetryAfter() int {
+	if d.MaxRetryAfter == 0 {
+		return defaultMaxRetryAfter
+	}
+	return d.MaxRetryAfter
+}
+
+// retryAfter reports the delay requested by err, if it is or wraps an
+// analysis.RetryAfter error.
+func retryAfter(err error) (time.Duration, bool) {
+	var ra analysis.RetryAfter
+	if err == nil || !goerrors.As(err, &ra) {
+		return 0, false
+	}
+	return ra.RetryAfter(), true
+}
+
+// backOff stops requests to the analyzer from all workers for at least d.
+func (r *runner) backOff(d time.Duration) {
+	r.backoffMu.Lock()
+	defer r.backoffMu.Unlock()
+	if until := time.Now().Add(d); until.After(r.backoffUntil) {
+		r.backoffUntil = until
+	}
+}
+
+// waitBackoff blocks until no backoff is in effect, or ctx ends.
+func (r *runner) waitBackoff(ctx context.Context) error {
+	for {
+		r.backoffMu.Lock()
+		d := time.Until(r.backoffUntil)
+		r.backoffMu.Unlock()
+		if d <= 0 {
+			return ctx.Err()
+		}
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// setupUnit invokes Setup and then any Transform for cu, returning the
+// compilation to analyze with its VNames normalized.  If Setup panics, or
+// Transform fails after Setup has succeeded, Teardown is invoked before the
+// error is reported.  If either asks to skip the compilation, Teardown is
+// invoked according to d.TeardownOnSkip.
+func (r *runner) setupUnit(ctx context.Context, cu Compilation) (Compilation, error) {
+	err := catch(func() error { return r.setupSpan(ctx, cu) })
+	_, teardown := err.(*PanicError)
+	if err == nil {
+		var next Compilation
+		err = catch(func() (err error) {
+			if next, err = r.transform(ctx, cu); err == nil {
+				next = r.normalize(ctx, next)
+			}
+			return err
+		})
+		if err == nil {
+			return next, nil
+		}
+		teardown = true // Setup succeeded, so Teardown is required
+	}
+	if goerrors.Is(err, ErrSkipCompilation) {
+		teardown = r.TeardownOnSkip != TeardownNever
+	}
+	if teardown {
+		if terr := r.teardownSpan(ctx, cu); terr != nil {
+			r.warnTeardown(ctx, cu, terr, "setup_error", err)
+		}
+	}
+	return cu, &SetupError{Unit: cu.Unit, Err: err}
+}
+
+// attempt makes a single attempt to analyze cu.  If retries are enabled, or
+// if timed-out analyses are discarded, the outputs of the attempt are buffered
+// and only written if it succeeds.  If
+// req != nil, it is reset and reused for the request to the analyzer.
+func (r *runner) attempt(ctx context.Context, cu Compilation, req *apb.AnalysisRequest) (err error) {
+	if req == nil {
+		req = new(apb.AnalysisRequest)
+	} else {
+		defer func() { *req = apb.AnalysisRequest{} }() // do not retain the compilation
+	}
+	*req = apb.AnalysisRequest{
+		Compilation:     cu.Unit,
+		FileDataService: r.fileDataService(cu.Unit),
+		Revision:        cu.Revision,
+		BuildId:         cu.BuildID,
+	}
+	if r.RequestHook != nil {
+		r.RequestHook(ctx, req)
+	}
+	if fds := FileDataServiceFromContext(ctx); fds != "" {
+		req.FileDataService = fds
+	}
+	if r.DryRun {
+		return nil // the request is ready, but is not sent
+	}
+
+	var out analysis.OutputFunc = r.writeOutput
+	if r.grouping() {
+		group := &outputBuffer{spill: r.OrderedSpillBytes}
+		defer func() {
+			if gerr := r.writeGroup(ctx, group); err == nil {
+				err = gerr
+			}
+		}()
+		out = func(_ context.Context, o *apb.AnalysisOutput) error { return group.add(o) }
+	}
+	writeBuf := out
+	if r.CompilationContext || r.Golden != nil {
+		out = scopedOutput(scopeFrom(ctx), out)
+	}
+	var buf []*apb.AnalysisOutput
+	if r.Retry.enabled() || (r.Timeout > 0 && r.OnTimeout == TimeoutDiscard) {
+		out = func(_ context.Context, o *apb.AnalysisOutput) error {
+			buf = append(buf, o)
 			return nil
-		} else if err != nil {
+		}
+	}
+
+	limit := outputLimit{write: out, max: r.MaxOutputEntries}
+	if limit.max > 0 {
+		out = limit.writeOutput
+	}
+	stop := outputStop{write: out, stop: r.OutputPredicate}
+	if stop.stop != nil {
+		out = stop.writeOutput
+	}
+
+	err = ErrRetry
+	for err == ErrRetry {
+		buf = nil
+		limit.reset()
+		actx, cancel := stop.start(ctx)
+		err = r.analyzeSpan(actx, req, out)
+		if goerrors.Is(err, analysis.ErrStopDriver) {
+			r.requestStop(ctx, cu, err)
+			err = nil
+		}
+		partial := r.OnTimeout == TimeoutPartial && r.timedOut(ctx, err)
+		if partial {
+			err = nil
+		}
+		err = r.analysisError(ctx, cu, err)
+		cancel()
+		if stop.stopped() {
+			err = nil
+			r.mu.Lock()
+			r.stats.StoppedEarly++
+			r.mu.Unlock()
+		} else if partial && err == nil {
+			r.mu.Lock()
+			r.stats.Partial++
+			r.mu.Unlock()
+		}
+	}
+	if limit.exceeded() {
+		return errors.WithMessagef(ErrTooManyOutputs, "driver: compilation %s exceeded the limit of %d outputs",
+			unitName(cu.Unit), r.MaxOutputEntries)
+	}
+	if err != nil {
+		return err
+	}
+	for _, o := range buf {
+		if err := writeBuf(ctx, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grouping reports whether the outputs of each compilation are buffered by
+// attempt so that WriteOutput receives them together.  This is needed only
+// when compilations may write outputs concurrently, and not in ordered mode,
+// which groups them itself.
+func (r *runner) grouping() bool { return r.Concurrency > 1 && r.order == nil }
+
+// writeGroup writes the outputs buffered in group, holding off the groups of
+// other compilations until it is done.  Outputs added to group afterward, by
+// an analysis that was abandoned, are rejected.
+func (r *runner) writeGroup(ctx context.Context, group *outputBuffer) error {
+	r.groupMu.Lock()
+	defer r.groupMu.Unlock()
+	group.close(ctx)
+	defer group.discard()
+	return group.flush(ctx, r.writeOutput)
+}
+
+// timedOut reports whether err reports that an analysis under ctx exceeded
+// d.Timeout, as opposed to ctx itself ending.
+func (r *runner) timedOut(ctx context.Context, err error) bool {
+	return r.Timeout > 0 && err != nil && ctx.Err() == nil && goerrors.Is(err, context.DeadlineExceeded)
+}
+
+// An outputLimit bounds the number of outputs passed to write.
+type outputLimit struct {
+	write analysis.OutputFunc
+	max   int
+
+	mu      sync.Mutex
+	n       int  // outputs written
+	dropped bool // whether any outputs were dropped
+}
+
+// writeOutput passes out to l.write, unless the limit has been reached.
+func (l *outputLimit) writeOutput(ctx context.Context, out *apb.AnalysisOutput) error {
+	l.mu.Lock()
+	if l.n >= l.max {
+		l.dropped = true
+		l.mu.Unlock()
+		return ErrTooManyOutputs
+	}
+	l.n++
+	l.mu.Unlock()
+	return l.write(ctx, out)
+}
+
+// reset resets the count of outputs for a new attempt.
+func (l *outputLimit) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.n, l.dropped = 0, false
+}
+
+// exceeded reports whether any outputs were dropped.
+func (l *outputLimit) exceeded() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+// An outputStop cancels an analysis once its predicate accepts an output.
+type outputStop struct {
+	write analysis.OutputFunc
+	stop  func(*apb.AnalysisOutput) bool
+
+	mu     sync.Mutex
+	cancel func(cause error) // cancels the current attempt
+	done   bool              // whether the predicate has accepted an output
+}
+
+// start begins a new attempt, returning its context and a function to release
+// it.  If there is no predicate, ctx is returned unchanged.
+func (s *outputStop) start(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.stop == nil {
+		return ctx, func() {}
+	}
+	ctx, cancel := withCancelCause(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancel, s.done = cancel, false
+	return ctx, func() { cancel(nil) }
+}
+
+func (s *outputStop) writeOutput(ctx context.Context, out *apb.AnalysisOutput) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return context.Canceled
+	}
+	if err := s.write(ctx, out); err != nil {
+		return err
+	}
+	if s.stop(out) {
+		s.done = true
+		s.cancel(ErrStoppedEarly)
+	}
+	return nil
+}
+
+// stopped reports whether the current attempt was stopped by the predicate.
+func (s *outputStop) stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done
+}
+
+// heartbeat starts calling d.Heartbeat periodically for unit, whose analysis
+// began at start.  It returns a function that stops the calls and waits for
+// any call in progress to return.
+func (r *runner) heartbeat(ctx context.Context, unit *apb.CompilationUnit, start time.Time) (stop func()) {
+	if r.Heartbeat == nil {
+		return func() {}
+	}
+	interval := r.HeartbeatInterval
+	if interval == 0 {
+		interval = defaultHeartbeatInterval
+	}
+	t := time.NewTicker(interval)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case now := <-t.C:
+				select {
+				case <-quit:
+					return // prefer stopping to a late beat
+				default:
+					r.Heartbeat(ctx, unit, now.Sub(start))
+				}
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// defaultHeartbeatInterval is the heartbeat interval used if none is set.
+const defaultHeartbeatInterval = 30 * time.Second
+
+// analyzeUnit sends req to the analyzer, subject to d.Timeout.
+func (r *runner) analyzeUnit(ctx context.Context, req *apb.AnalysisRequest, write analysis.OutputFunc) error {
+	if waited, err := r.limiter.wait(ctx); err != nil {
+		return err
+	} else if waited {
+		r.mu.Lock()
+		r.stats.RateLimitWaits++
+		r.mu.Unlock()
+	}
+	if err := r.spacer.wait(ctx); err != nil {
+		return err
+	}
+	if err := r.waitBackoff(ctx); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	defer r.heartbeat(ctx, req.Compilation, start)()
+	defer func() {
+		elapsed := time.Since(start)
+		if s := scopeFrom(ctx); s != nil {
+			s.addAnalyzeTime(elapsed)
+		}
+		r.metrics().ObserveAnalyzeDuration(req.Compilation.GetVName().GetLanguage(), elapsed)
+		r.mu.Lock()
+		r.stats.AnalyzeTime += elapsed
+		r.mu.Unlock()
+	}()
+	diag := func(ctx context.Context, d Diagnostic) { r.diagnose(ctx, req.Compilation, d) }
+	if r.Timeout <= 0 {
+		return catch(func() error { return r.callAnalyzer(ctx, req, write, diag) })
+	}
+
+	tctx, cancel := withTimeoutCause(ctx, r.Timeout, ErrAnalysisTimeout)
+	defer cancel()
+
+	// Run the analysis in the background so that an analyzer that ignores
+	// its context can still be abandoned.  Once that happens, any further
+	// outputs or diagnostics it produces are discarded.
+	var (
+		mu        sync.Mutex
+		abandoned bool
+	)
+	out := func(ctx context.Context, o *apb.AnalysisOutput) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if abandoned {
+			return context.DeadlineExceeded
+		}
+		return write(ctx, o)
+	}
+	tdiag := func(ctx context.Context, d Diagnostic) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !abandoned {
+			diag(ctx, d)
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- catch(func() error { return r.callAnalyzer(tctx, req, out, tdiag) }) }()
+
+	select {
+	case err := <-done:
+		if err != nil && tctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return errors.WithMessagef(context.DeadlineExceeded, "driver: analysis timed out after %v", r.Timeout)
+		}
+		return err
+	case <-tctx.Done():
+		mu.Lock()
+		abandoned = true
+		mu.Unlock()
+		if err := ctx.Err(); err != nil {
 			return err
 		}
+		return errors.WithMessagef(context.DeadlineExceeded, "driver: analysis timed out after %v", r.Timeout)
 	}
 }
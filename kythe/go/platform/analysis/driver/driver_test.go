@@ -21,8 +21,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"kythe.io/kythe/go/platform/analysis"
 	"kythe.io/kythe/go/test/testutil"
@@ -127,6 +131,40 @@ func TestDriverInvalid(t *testing.T) {
 	}
 }
 
+func TestDriverValidate(t *testing.T) {
+	m := &mock{t: t}
+	tests := []struct {
+		d    *Driver
+		want string // substring of the expected error, or "" for none
+	}{
+		{&Driver{}, "Analyzer"},
+		{&Driver{Analyzer: m}, ""},
+		{&Driver{Analyzer: m, Concurrency: -1}, "Concurrency"},
+		{&Driver{Analyzer: m, Prefetch: -1}, "Prefetch"},
+		{&Driver{Analyzer: m, Timeout: -time.Second}, "Timeout"},
+		{&Driver{Analyzer: m, Retry: &RetryPolicy{MaxAttempts: 3}}, "Retryable"},
+		{&Driver{Analyzer: m, RequireOutput: true}, "WriteOutput"},
+		{&Driver{Analyzer: m, Sample: 1.5}, "Sample"},
+		{&Driver{Analyzer: m, MaxConsecutiveFailures: -1}, "MaxConsecutiveFailures"},
+	}
+	for _, test := range tests {
+		err := test.d.Validate()
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("Validate(%+v): unexpected error: %v", test.d, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Validate(%+v): got %v, want error mentioning %q", test.d, err, test.want)
+		}
+	}
+
+	// The queue is required by Run, but not Validate.
+	d := &Driver{Analyzer: m}
+	if err := d.Run(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "Compilations") {
+		t.Errorf("Run with no queue: got %v, want error mentioning Compilations", err)
+	}
+}
+
 func TestDriverEmpty(t *testing.T) {
 	m := &mock{t: t}
 	d := &Driver{
@@ -193,7 +231,7 @@ func TestDriverAnalyzeError(t *testing.T) {
 		Analyzer:    m,
 		WriteOutput: m.out(),
 	}
-	if err := d.Run(context.Background(), m); err != errFromAnalysis {
+	if err := d.Run(context.Background(), m); !errors.Is(err, errFromAnalysis) {
 		t.Errorf("Expected AnalysisError: %v; found: %v", errFromAnalysis, err)
 	}
 	if len(m.Requests) != 1 { // we didn't analyze the second
@@ -228,86 +266,2328 @@ func TestDriverErrorHandler(t *testing.T) {
 	}
 }
 
-func TestDriverSetup(t *testing.T) {
-	m := &mock{
-		t:            t,
-		Outputs:      outs("a", "b", "c"),
-		Compilations: comps("target1", "target2"),
-	}
-	var setupIdx int
+func TestDriverContinueOnError(t *testing.T) {
+	errFromSetup := errors.New("some random setup error")
+	var teardowns int
 	d := &Driver{
-		Analyzer:    m,
-		WriteOutput: m.out(),
+		ContinueOnError: true,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			if req.Compilation.VName.Signature == "b" {
+				return errFromAnalysis
+			}
+			return nil
+		}),
 		Context: testContext{
 			setup: func(_ context.Context, cu Compilation) error {
-				setupIdx++
-				var missing []string
-				if cu.UnitDigest == "" {
-					missing = append(missing, "unit digest")
-				}
-				if cu.Revision == "" {
-					missing = append(missing, "revision marker")
+				if cu.Unit.VName.Signature == "d" {
+					return errFromSetup
 				}
-				if cu.BuildID == "" {
-					missing = append(missing, "build ID")
+				return nil
+			},
+			teardown: func(context.Context, Compilation) error {
+				teardowns++
+				return nil
+			},
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	q := &syncQueue{comps: comps("a", "b", "c", "d", "e")}
+	err := d.Run(context.Background(), q)
+	merr, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("Expected MultiError; found %T: %v", err, err)
+	}
+	if len(merr) != 2 {
+		t.Fatalf("Expected 2 failures; found %d: %v", len(merr), merr)
+	}
+	if got := merr[0].Unit.VName.Signature; got != "b" || !errors.Is(merr[0], errFromAnalysis) {
+		t.Errorf("Expected analysis failure for %q; found %q: %v", "b", got, merr[0])
+	}
+	if got := merr[1].Unit.VName.Signature; got != "d" || !errors.Is(merr[1], errFromSetup) {
+		t.Errorf("Expected setup failure for %q; found %q: %v", "d", got, merr[1])
+	}
+	if !strings.Contains(merr[0].Error(), "#b") {
+		t.Errorf("Error %q does not name the compilation VName", merr[0])
+	}
+	if teardowns != 4 { // every compilation whose setup succeeded
+		t.Errorf("Expected 4 calls to Teardown; found %d", teardowns)
+	}
+}
+
+func TestDriverMaxConsecutiveFailures(t *testing.T) {
+	var analyzed []string
+	d := &Driver{
+		ContinueOnError:        true,
+		MaxConsecutiveFailures: 3,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			sig := req.Compilation.VName.Signature
+			analyzed = append(analyzed, sig)
+			if sig != "ok" {
+				return errFromAnalysis
+			}
+			return nil
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	// A success resets the count, so the run stops after f3.
+	q := &syncQueue{comps: comps("a1", "a2", "ok", "f1", "f2", "f3", "f4", "ok")}
+	err := d.Run(context.Background(), q)
+	var uerr *UnhealthyError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("Run: got error %v, want an *UnhealthyError", err)
+	}
+	if uerr.Failures != 3 || uerr.Last.Unit.VName.Signature != "f3" || !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Run: got %d failures ending with %v, want 3 ending with f3", uerr.Failures, uerr.Last)
+	}
+	if err := testutil.DeepEqual([]string{"a1", "a2", "ok", "f1", "f2", "f3"}, analyzed); err != nil {
+		t.Errorf("Analyzed: %v", err)
+	}
+}
+
+// errWriter is an io.Writer that always fails.
+type errWriter struct{ err error }
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestDriverManifest(t *testing.T) {
+	var manifest bytes.Buffer
+	d := &Driver{
+		Concurrency:     4,
+		ContinueOnError: true,
+		Manifest:        &manifest,
+		Keyer:           func(cu *apb.CompilationUnit) string { return "key-" + cu.VName.Signature },
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			sig := req.Compilation.VName.Signature
+			if sig == "bad" {
+				return errFromAnalysis
+			}
+			for i := 0; i < len(sig); i++ {
+				if err := out(ctx, &apb.AnalysisOutput{Value: []byte(sig)}); err != nil {
+					return err
 				}
-				if len(missing) != 0 {
-					return fmt.Errorf("missing %s: %v", strings.Join(missing, ", "), cu)
+			}
+			return nil
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	cs := comps("a", "bb", "bad", "ccc")
+	for _, cu := range cs {
+		cu.Unit.VName.Language = "go"
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: cs}); err == nil {
+		t.Error("Run succeeded despite the failure of bad")
+	}
+	lines := strings.Split(strings.TrimSuffix(manifest.String(), "\n"), "\n")
+	sort.Strings(lines)
+	want := []string{"key-a\tgo\t1", "key-bb\tgo\t2", "key-ccc\tgo\t3"}
+	if err := testutil.DeepEqual(want, lines); err != nil {
+		t.Errorf("Manifest: %v", err)
+	}
+
+	// A manifest that cannot be written fails the run.
+	errWrite := errors.New("disk full")
+	d.Manifest = errWriter{errWrite}
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a", "bb")}); !errors.Is(err, errWrite) {
+		t.Errorf("Run with a failing manifest: got %v, want %v", err, errWrite)
+	}
+}
+
+func TestDriverContinueOnQueueError(t *testing.T) {
+	errFromQueue := errors.New("some random queue error")
+	d := &Driver{
+		ContinueOnError: true,
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			return nil
+		}),
+	}
+	q := queueFunc(func(context.Context, CompilationFunc) error { return errFromQueue })
+	if err := d.Run(context.Background(), q); !errors.Is(err, errFromQueue) {
+		t.Errorf("Expected queue error: %v; found: %v", errFromQueue, err)
+	}
+}
+
+func TestDriverTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	tests := []struct {
+		desc     string
+		analyzer analysis.CompilationAnalyzer
+	}{
+		{"honors context", analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})},
+		{"ignores context", analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			<-release
+			return nil
+		})},
+	}
+	for _, test := range tests {
+		var teardownCtxErr error
+		d := &Driver{
+			Analyzer: test.analyzer,
+			Timeout:  10 * time.Millisecond,
+			Context: testContext{
+				teardown: func(ctx context.Context, _ Compilation) error {
+					teardownCtxErr = ctx.Err()
+					return nil
+				},
+				analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+			},
+		}
+		err := d.Run(context.Background(), &syncQueue{comps: comps("slow")})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: Expected timeout error; found: %v", test.desc, err)
+		}
+		if teardownCtxErr != nil {
+			t.Errorf("%s: Teardown context unexpectedly done: %v", test.desc, teardownCtxErr)
+		}
+	}
+}
+
+func TestDriverOnTimeout(t *testing.T) {
+	tests := []struct {
+		policy      TimeoutPolicy
+		wantErr     bool
+		wantOutputs []string
+		wantPartial int
+	}{
+		{TimeoutDiscard, true, nil, 0},
+		{TimeoutPartial, false, []string{"before"}, 1},
+	}
+	for _, test := range tests {
+		var got []string
+		d := &Driver{
+			Analyzer: analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, out analysis.OutputFunc) error {
+				if err := out(ctx, &apb.AnalysisOutput{Value: []byte("before")}); err != nil {
+					return err
 				}
+				<-ctx.Done()
+				return ctx.Err()
+			}),
+			Timeout:   10 * time.Millisecond,
+			OnTimeout: test.policy,
+			WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+				got = append(got, string(out.Value))
+				return nil
+			},
+			Context: testContext{
+				analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+			},
+		}
+		stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("slow")})
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("OnTimeout %d: got error %v, want error %v", test.policy, err, test.wantErr)
+		}
+		if err := testutil.DeepEqual(test.wantOutputs, got); err != nil {
+			t.Errorf("OnTimeout %d: outputs: %v", test.policy, err)
+		}
+		if stats.Partial != test.wantPartial {
+			t.Errorf("OnTimeout %d: got %d partial, want %d", test.policy, stats.Partial, test.wantPartial)
+		}
+	}
+}
+
+func TestDriverMinRemainingForNext(t *testing.T) {
+	var teardowns int
+	d := &Driver{
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			time.Sleep(30 * time.Millisecond)
+			return nil
+		}),
+		MinRemainingForNext: 150 * time.Millisecond,
+		Context: testContext{
+			teardown: func(context.Context, Compilation) error {
+				teardowns++
 				return nil
 			},
 		},
 	}
-	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
-	if len(m.Requests) != len(m.Compilations) {
-		t.Errorf("Expected %d AnalysisRequests; found %v", len(m.Compilations), m.Requests)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	stats, err := d.RunWithStats(ctx, &syncQueue{comps: comps("a", "b", "c", "d", "e", "f", "g", "h")})
+	if err != nil {
+		t.Fatalf("Driver error: %v", err)
 	}
-	if setupIdx != len(m.Compilations) {
-		t.Errorf("Expected %d calls to Setup; found %d", len(m.Compilations), setupIdx)
+	if !stats.OutOfBudget {
+		t.Error("Run did not report running out of budget")
+	}
+	if stats.Succeeded == 0 || stats.Succeeded == 8 {
+		t.Errorf("Got %d compilations analyzed, want some but not all", stats.Succeeded)
+	}
+	if got := stats.Succeeded + stats.Unstarted; got != 8 {
+		t.Errorf("Got %d analyzed + %d unstarted, want 8", stats.Succeeded, stats.Unstarted)
+	}
+	if teardowns != stats.Succeeded {
+		t.Errorf("Got %d teardowns, want %d", teardowns, stats.Succeeded)
 	}
 }
 
-func TestDriverTeardown(t *testing.T) {
-	m := &mock{
-		t:            t,
-		Outputs:      outs("a", "b", "c"),
-		Compilations: comps("target1", "target2"),
+func TestDriverProgress(t *testing.T) {
+	type report struct {
+		Done, Failed, Total int
+		Signature           string
 	}
-	var teardownIdx int
+	var reports []report
 	d := &Driver{
-		Analyzer:    m,
-		WriteOutput: m.out(),
+		ContinueOnError: true,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			if req.Compilation.VName.Signature == "b" {
+				return errFromAnalysis
+			}
+			return nil
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+		Progress: func(done, failed, total int, cu *apb.CompilationUnit) {
+			reports = append(reports, report{done, failed, total, cu.VName.Signature})
+		},
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}); err == nil {
+		t.Error("Expected error from Run but got none")
+	}
+	want := []report{{1, 0, 3, "a"}, {2, 1, 3, "b"}, {3, 1, 3, "c"}}
+	if err := testutil.DeepEqual(want, reports); err != nil {
+		t.Errorf("Unexpected progress reports: %v", err)
+	}
+
+	// The total is unknown for a queue that is not a Sizer.
+	reports = nil
+	d.Limit = 1
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), queueFunc((&syncQueue{comps: comps("a", "b")}).Next)))
+	want = []report{{1, 0, 0, "a"}}
+	if err := testutil.DeepEqual(want, reports); err != nil {
+		t.Errorf("Unexpected progress reports without total: %v", err)
+	}
+
+	reports = nil
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{}))
+	if len(reports) != 0 {
+		t.Errorf("Unexpected progress reports for empty queue: %v", reports)
+	}
+}
+
+func TestDriverRunWithStats(t *testing.T) {
+	cs := comps("a", "b", "c")
+	cs[2].Unit.VName.Language = "go"
+	d := &Driver{
+		ContinueOnError: true,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			time.Sleep(time.Millisecond)
+			if req.Compilation.VName.Signature == "b" {
+				return errFromAnalysis
+			}
+			return nil
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: cs})
+	if err == nil {
+		t.Error("Expected error from RunWithStats but got none")
+	}
+	if stats.Compilations != 3 || stats.Succeeded != 2 || stats.Failed != 1 {
+		t.Errorf("Unexpected counts: %+v", stats)
+	}
+	if stats.AnalyzeTime < 3*time.Millisecond || stats.WallTime < stats.AnalyzeTime {
+		t.Errorf("Unexpected times: analyze %v, wall %v", stats.AnalyzeTime, stats.WallTime)
+	}
+	want := map[string]LanguageStats{
+		"":   {Compilations: 2, Succeeded: 1, Failed: 1},
+		"go": {Compilations: 1, Succeeded: 1},
+	}
+	if stats.Outputs != 0 || stats.OutputBytes != 0 {
+		t.Errorf("Unexpected outputs: %+v", stats)
+	}
+	if err := testutil.DeepEqual(want, stats.Languages); err != nil {
+		t.Errorf("Unexpected language stats: %v", err)
+	}
+
+	stats, err = d.RunWithStats(context.Background(), &syncQueue{})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	if stats.Compilations != 0 {
+		t.Errorf("Unexpected compilations for empty queue: %+v", stats)
+	}
+}
+
+func TestDriverRerun(t *testing.T) {
+	errFromQueue := errors.New("broken queue")
+	var analyzed []string
+	d := &Driver{
+		SkipDuplicates: true,
+		Retry:          &RetryPolicy{MaxAttempts: 2, Retryable: isTransient},
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			analyzed = append(analyzed, req.Compilation.VName.Signature)
+			return nil
+		}),
+	}
+
+	// The first run fails partway through the queue.
+	good := &syncQueue{comps: comps("a", "a")}
+	broken := queueFunc(func(ctx context.Context, f CompilationFunc) error {
+		if len(good.comps) == 0 {
+			return errFromQueue
+		}
+		return good.Next(ctx, f)
+	})
+	stats, err := d.RunWithStats(context.Background(), broken)
+	if !errors.Is(err, errFromQueue) {
+		t.Fatalf("First run: got error %v, want %v", err, errFromQueue)
+	}
+	if stats.Compilations != 1 || stats.Duplicates != 1 {
+		t.Errorf("First run: unexpected stats: %+v", stats)
+	}
+
+	// The second run sees none of the state of the first.
+	analyzed = nil
+	stats, err = d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b")})
+	testutil.FatalOnErrT(t, "Second run: %v", err)
+	if err := testutil.DeepEqual([]string{"a", "b"}, analyzed); err != nil {
+		t.Errorf("Second run: analyzed: %v", err)
+	}
+	want := RunStats{
+		Compilations: 2,
+		Succeeded:    2,
+		Total:        2,
+		EmptyOutput:  2,
+		Languages:    map[string]LanguageStats{"": {Compilations: 2, Succeeded: 2}},
+	}
+	stats.WallTime, stats.AnalyzeTime, stats.QueueWaitTime, stats.Slowest = 0, 0, 0, nil
+	if err := testutil.DeepEqual(want, stats); err != nil {
+		t.Errorf("Second run: stats: %v", err)
+	}
+}
+
+func TestDriverRunning(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	d := &Driver{
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			close(started)
+			<-release
+			return nil
+		}),
+	}
+	done := make(chan error, 1)
+	go func() { done <- d.Run(context.Background(), &syncQueue{comps: comps("a")}) }()
+	<-started
+
+	q := &syncQueue{comps: comps("b")}
+	if err := d.Run(context.Background(), q); err != ErrRunning {
+		t.Errorf("Concurrent run: got error %v, want %v", err, ErrRunning)
+	}
+	if len(q.comps) != 1 {
+		t.Error("Concurrent run read from its queue")
+	}
+	close(release)
+	testutil.FatalOnErrT(t, "Driver error: %v", <-done)
+}
+
+func TestDriverFilter(t *testing.T) {
+	var analyzed, setups, outputs int
+	d := &Driver{
+		Analyzer: analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			analyzed++
+			return out(ctx, &apb.AnalysisOutput{})
+		}),
+		WriteOutput: func(context.Context, *apb.AnalysisOutput) error { outputs++; return nil },
+		Context: testContext{
+			setup: func(context.Context, Compilation) error { setups++; return nil },
+		},
+		Filter: func(cu *apb.CompilationUnit) bool { return cu.VName.Signature != "skip" },
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "skip", "b", "skip")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	if analyzed != 2 || setups != 2 || outputs != 2 {
+		t.Errorf("Expected 2 analyses, setups, and outputs; found %d, %d, %d", analyzed, setups, outputs)
+	}
+	if stats.Compilations != 2 || stats.Skipped != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestDriverPrefetch(t *testing.T) {
+	for _, workers := range []int{1, 3} {
+		m := &mock{
+			t:            t,
+			Compilations: comps("a", "b", "c", "d"),
+		}
+		var mu sync.Mutex
+		var analyzed []string
+		d := &Driver{
+			Prefetch:    2,
+			Concurrency: workers,
+			Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+				mu.Lock()
+				defer mu.Unlock()
+				analyzed = append(analyzed, req.Compilation.VName.Signature)
+				return nil
+			}),
+		}
+		// The mock queue is not safe for concurrent use, but with prefetching
+		// it is only read by one goroutine.
+		testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+		if len(analyzed) != len(m.Compilations) {
+			t.Errorf("Concurrency %d: expected %d compilations analyzed; found %q", workers, len(m.Compilations), analyzed)
+		}
+	}
+}
+
+func TestDriverPanic(t *testing.T) {
+	tests := []struct {
+		desc      string
+		setup     func(context.Context, Compilation) error
+		analyzer  analysis.CompilationAnalyzer
+		timeout   time.Duration
+		wantPhase string
+	}{{
+		desc:      "analyze",
+		analyzer:  analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error { panic("analyze") }),
+		wantPhase: "analyze",
+	}, {
+		desc:      "analyze with timeout",
+		analyzer:  analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error { panic("analyze") }),
+		timeout:   time.Minute,
+		wantPhase: "analyze",
+	}, {
+		desc:      "setup",
+		setup:     func(context.Context, Compilation) error { panic("setup") },
+		analyzer:  analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error { return nil }),
+		wantPhase: "setup",
+	}}
+	for _, test := range tests {
+		for _, asError := range []bool{true, false} {
+			var teardowns int
+			d := &Driver{
+				Analyzer:     test.analyzer,
+				Timeout:      test.timeout,
+				PanicAsError: asError,
+				Context: testContext{
+					setup:         test.setup,
+					teardown:      func(context.Context, Compilation) error { teardowns++; return nil },
+					analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+				},
+			}
+			var err error
+			recovered := func() (v interface{}) {
+				defer func() { v = recover() }()
+				err = d.Run(context.Background(), &syncQueue{comps: comps("a")})
+				return nil
+			}()
+
+			var perr *PanicError
+			if asError {
+				if !errors.As(err, &perr) || perr.Value != test.wantPhase {
+					t.Errorf("%s: expected PanicError for %q; found %v", test.desc, test.wantPhase, err)
+				}
+			} else if p, ok := recovered.(*PanicError); !ok || p.Value != test.wantPhase {
+				t.Errorf("%s: expected propagated panic for %q; found %v", test.desc, test.wantPhase, recovered)
+			}
+			if teardowns != 1 {
+				t.Errorf("%s: expected 1 call to Teardown; found %d", test.desc, teardowns)
+			}
+		}
+	}
+}
+
+// A testLogger records the messages logged at each level.
+type testLogger struct {
+	mu                   sync.Mutex
+	debugs, infos, warns []string
+}
+
+func (l *testLogger) Debug(_ context.Context, msg string, kvs ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.debugs = append(l.debugs, formatLog(msg, kvs))
+}
+
+func (l *testLogger) Info(_ context.Context, msg string, kvs ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.infos = append(l.infos, formatLog(msg, kvs))
+}
+
+func (l *testLogger) Warn(_ context.Context, msg string, kvs ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warns = append(l.warns, formatLog(msg, kvs))
+}
+
+func TestDriverLogger(t *testing.T) {
+	logger := new(testLogger)
+	d := &Driver{
+		ContinueOnError: true,
+		Logger:          logger,
+		Analyzer:        emitter(nil),
 		Context: testContext{
 			teardown: func(_ context.Context, cu Compilation) error {
-				teardownIdx++
+				if cu.Unit.VName.Signature == "b" {
+					return errors.New("teardown failed")
+				}
 				return nil
 			},
 		},
 	}
-	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
-	if len(m.Requests) != len(m.Compilations) {
-		t.Errorf("Expected %d AnalysisRequests; found %v", len(m.Compilations), m.Requests)
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}); err == nil {
+		t.Error("Expected error from Run but got none")
 	}
-	if teardownIdx != len(m.Compilations) {
-		t.Errorf("Expected %d calls to Teardown; found %d", len(m.Compilations), teardownIdx)
+	if len(logger.warns) != 1 || !strings.Contains(logger.warns[0], "teardown failed") || !strings.Contains(logger.warns[0], "#b") {
+		t.Errorf("Unexpected warnings: %q", logger.warns)
+	}
+
+	// A successful run logs no warnings.
+	logger.warns = nil
+	d.Context = nil
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a")}))
+	if len(logger.warns) != 0 {
+		t.Errorf("Unexpected warnings: %q", logger.warns)
 	}
 }
 
-func outs(vals ...string) (as []*apb.AnalysisOutput) {
-	for _, val := range vals {
-		as = append(as, &apb.AnalysisOutput{Value: []byte(val)})
+func TestDriverTeardownWarnInterval(t *testing.T) {
+	logger := new(testLogger)
+	d := &Driver{
+		ContinueOnError:      true,
+		Logger:               logger,
+		TeardownWarnInterval: time.Hour,
+		Analyzer:             analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error { return errFromAnalysis }),
+		Context: testContext{
+			teardown:      func(context.Context, Compilation) error { return errors.New("teardown failed") },
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}); err == nil {
+		t.Error("Expected error from Run but got none")
+	}
+	var teardowns []string
+	for _, w := range logger.warns {
+		if strings.Contains(w, "teardown") {
+			teardowns = append(teardowns, w)
+		}
+	}
+	if len(teardowns) != 2 {
+		t.Fatalf("Got teardown warnings %q, want 2", teardowns)
+	}
+	if w := teardowns[0]; !strings.Contains(w, "#a") || !strings.Contains(w, "key=") || !strings.Contains(w, "analysis_error=") {
+		t.Errorf("Unexpected warning: %q", w)
+	}
+	if w := teardowns[1]; !strings.Contains(w, "not logged") || !strings.Contains(w, "count=2") {
+		t.Errorf("Unexpected summary: %q", w)
 	}
-	return
 }
 
-func comps(sigs ...string) (cs []Compilation) {
-	for _, sig := range sigs {
-		cs = append(cs, Compilation{
-			Unit:       &apb.CompilationUnit{VName: &spb.VName{Signature: sig}},
-			Revision:   "12345",
-			UnitDigest: "digest:" + sig,
-			BuildID:    buildID,
-		})
+func TestDriverSlowThreshold(t *testing.T) {
+	logger := new(testLogger)
+	d := &Driver{
+		Logger:        logger,
+		SlowThreshold: 5 * time.Millisecond,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			if req.Compilation.VName.Signature == "slow" {
+				time.Sleep(10 * time.Millisecond)
+			}
+			return nil
+		}),
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("fast", "slow", "fast")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	if len(logger.warns) != 1 || !strings.Contains(logger.warns[0], "#slow") {
+		t.Errorf("Unexpected warnings: %q", logger.warns)
+	}
+	if len(stats.Slowest) != 3 || stats.Slowest[0].Unit.VName.Signature != "slow" {
+		t.Errorf("Unexpected slowest compilations: %+v", stats.Slowest)
+	}
+}
+
+func TestDriverWarnOnEmptyOutput(t *testing.T) {
+	logger := new(testLogger)
+	d := &Driver{
+		Logger:            logger,
+		WarnOnEmptyOutput: true,
+		ContinueOnError:   true,
+		Filter: func(unit *apb.CompilationUnit) bool {
+			return unit.VName.Signature != "filtered"
+		},
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			switch req.Compilation.VName.Signature {
+			case "full":
+				return out(ctx, &apb.AnalysisOutput{Value: []byte("x")})
+			case "failed":
+				return errFromAnalysis
+			}
+			return nil
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	results := d.Results()
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("full", "empty", "failed", "filtered")})
+	if err == nil {
+		t.Error("Driver succeeded, want an error for failed")
+	}
+	if stats.EmptyOutput != 1 {
+		t.Errorf("EmptyOutput: got %d, want 1", stats.EmptyOutput)
+	}
+	var empty []string
+	for res := range results {
+		if res.Empty {
+			empty = append(empty, res.Unit.VName.Signature)
+		}
+	}
+	if err := testutil.DeepEqual([]string{"empty"}, empty); err != nil {
+		t.Errorf("Empty results: %v", err)
+	}
+	var warned int
+	for _, w := range logger.warns {
+		if strings.Contains(w, "no outputs") {
+			warned++
+			if !strings.Contains(w, "#empty") {
+				t.Errorf("Unexpected warning: %q", w)
+			}
+		}
+	}
+	if warned != 1 {
+		t.Errorf("Got %d empty-output warnings, want 1: %q", warned, logger.warns)
+	}
+}
+
+func TestFormatLog(t *testing.T) {
+	tests := []struct {
+		msg  string
+		kvs  []interface{}
+		want string
+	}{
+		{"hello", nil, "hello"},
+		{"hello", []interface{}{"a", 1, "b", "two"}, "hello a=1 b=two"},
+		{"odd", []interface{}{"a", 1, "extra"}, "odd a=1 extra"},
+	}
+	for _, test := range tests {
+		if got := formatLog(test.msg, test.kvs); got != test.want {
+			t.Errorf("formatLog(%q, %v): got %q, want %q", test.msg, test.kvs, got, test.want)
+		}
+	}
+}
+
+func TestDriverDrain(t *testing.T) {
+	for _, drain := range []time.Duration{0, time.Minute} {
+		ctx, cancel := context.WithCancel(context.Background())
+		var analyzed, teardowns int
+		var analysisErr error
+		d := &Driver{
+			DrainTimeout: drain,
+			Analyzer: analyzerFunc(func(actx context.Context, _ *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+				analyzed++
+				cancel() // shut down during the first analysis
+				analysisErr = actx.Err()
+				return analysisErr
+			}),
+			Context: testContext{
+				teardown:      func(context.Context, Compilation) error { teardowns++; return nil },
+				analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+			},
+		}
+		// The mock queue does not itself honor cancellation.
+		m := &mock{t: t, Compilations: comps("a", "b")}
+		if err := d.Run(ctx, m); !errors.Is(err, context.Canceled) {
+			t.Errorf("Drain %v: expected %v; found %v", drain, context.Canceled, err)
+		}
+		if analyzed != 1 || teardowns != 1 {
+			t.Errorf("Drain %v: expected 1 analysis and teardown; found %d, %d", drain, analyzed, teardowns)
+		}
+		if wantCanceled := drain == 0; (analysisErr != nil) != wantCanceled {
+			t.Errorf("Drain %v: in-flight analysis context error: %v", drain, analysisErr)
+		}
+	}
+}
+
+func TestDriverDrainTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Driver{
+		DrainTimeout: 10 * time.Millisecond,
+		Analyzer: analyzerFunc(func(actx context.Context, _ *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			cancel()
+			<-actx.Done() // stuck until the drain timeout expires
+			return actx.Err()
+		}),
+	}
+	if err := d.Run(ctx, &syncQueue{comps: comps("a", "b")}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v; found %v", context.Canceled, err)
+	}
+}
+
+func TestDriverLimit(t *testing.T) {
+	for _, workers := range []int{1, 3} {
+		q := &syncQueue{comps: comps("a", "skip", "b", "c", "d", "e")}
+		d := &Driver{
+			Limit:       3,
+			Concurrency: workers,
+			Analyzer:    emitter(nil),
+			Filter:      func(cu *apb.CompilationUnit) bool { return cu.VName.Signature != "skip" },
+		}
+		stats, err := d.RunWithStats(context.Background(), q)
+		testutil.FatalOnErrT(t, "Driver error: %v", err)
+		if stats.Compilations != 3 || stats.Skipped != 1 {
+			t.Errorf("Concurrency %d: unexpected stats: %+v", workers, stats)
+		}
+		if len(q.comps) != 2 {
+			t.Errorf("Concurrency %d: expected 2 compilations left in the queue; found %d", workers, len(q.comps))
+		}
+	}
+}
+
+func TestDriverSample(t *testing.T) {
+	var sigs []string
+	for i := 0; i < 1000; i++ {
+		sigs = append(sigs, strconv.Itoa(i))
+	}
+	run := func(workers int, seed int64, limit int) ([]string, RunStats) {
+		var (
+			mu  sync.Mutex
+			got []string
+		)
+		d := &Driver{
+			Sample:      0.1,
+			SampleSeed:  seed,
+			Limit:       limit,
+			Concurrency: workers,
+			Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, req.Compilation.VName.Signature)
+				return nil
+			}),
+		}
+		stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps(sigs...)})
+		testutil.FatalOnErrT(t, "Driver error: %v", err)
+		sort.Strings(got)
+		return got, stats
+	}
+
+	want, stats := run(1, 17, 0)
+	if n := len(want); n < 50 || n > 150 {
+		t.Errorf("Sampled %d of %d compilations, want about 100", n, len(sigs))
+	}
+	if stats.SampledOut != len(sigs)-len(want) || stats.Skipped != stats.SampledOut || stats.SampleSeed != 17 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if got, _ := run(4, 17, 0); testutil.DeepEqual(want, got) != nil {
+		t.Errorf("Seed 17 with 4 workers: got %q, want %q", got, want)
+	}
+	if got, _ := run(1, 18, 0); testutil.DeepEqual(want, got) == nil {
+		t.Errorf("Seeds 17 and 18 chose the same sample: %q", got)
+	}
+	if _, stats := run(1, 0, 0); stats.SampleSeed == 0 {
+		t.Error("No sample seed was chosen")
+	}
+
+	// Sampled-out compilations do not count toward the limit.
+	got, stats := run(1, 17, 5)
+	if stats.Compilations != 5 || stats.SampledOut == 0 {
+		t.Errorf("Limit 5: unexpected stats: %+v", stats)
+	}
+	for _, sig := range got {
+		if i := sort.SearchStrings(want, sig); i == len(want) || want[i] != sig {
+			t.Errorf("Limit 5: analyzed %q, which is not in the sample", sig)
+		}
+	}
+}
+
+func TestDriverLimitPeek(t *testing.T) {
+	logger := new(testLogger)
+	d := &Driver{
+		Limit:    2,
+		Analyzer: emitter(nil),
+		Logger:   logger,
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), Peekable(&syncQueue{comps: comps("a", "b", "c")})))
+	if len(logger.infos) != 1 || !strings.Contains(logger.infos[0], "next=kythe:#c") {
+		t.Errorf("Expected a log of the next compilation; got %q", logger.infos)
+	}
+}
+
+func TestDriverRequestID(t *testing.T) {
+	type phase struct{ Name, ID string }
+	var phases []phase
+	note := func(ctx context.Context, name string) {
+		phases = append(phases, phase{name, RequestIDFromContext(ctx)})
+	}
+	d := &Driver{
+		Analyzer: analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			note(ctx, "analyze")
+			return out(ctx, &apb.AnalysisOutput{Value: []byte("v")})
+		}),
+		WriteOutput: func(ctx context.Context, _ *apb.AnalysisOutput) error {
+			note(ctx, "output")
+			return nil
+		},
+		Context: testContext{
+			setup: func(ctx context.Context, _ Compilation) error {
+				note(ctx, "setup")
+				return nil
+			},
+			teardown: func(ctx context.Context, _ Compilation) error {
+				note(ctx, "teardown")
+				return nil
+			},
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b")}))
+
+	if id := RequestIDFromContext(context.Background()); id != "" {
+		t.Errorf("Unexpected request ID outside a compilation: %q", id)
+	}
+	if len(phases) != 8 {
+		t.Fatalf("Got %d phases, want 8: %v", len(phases), phases)
+	}
+	for i, p := range phases {
+		if first := phases[i/4*4].ID; p.ID == "" || p.ID != first {
+			t.Errorf("Phase %d (%s): got request ID %q, want %q", i, p.Name, p.ID, first)
+		}
+	}
+	if phases[0].ID == phases[4].ID {
+		t.Errorf("Compilations share request ID %q", phases[0].ID)
+	}
+}
+
+func TestDriverIndex(t *testing.T) {
+	var sigs []string
+	for i := 0; i < 20; i++ {
+		sigs = append(sigs, strconv.Itoa(i))
+	}
+	var (
+		mu      sync.Mutex
+		indices = make(map[int]string)
+	)
+	d := &Driver{
+		Concurrency: 4,
+		Filter:      func(cu *apb.CompilationUnit) bool { return cu.VName.Signature != "3" },
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			i, ok := IndexFromContext(ctx)
+			if !ok {
+				t.Errorf("No index for %q", req.Compilation.VName.Signature)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if prev, ok := indices[i]; ok {
+				t.Errorf("Index %d assigned to both %q and %q", i, prev, req.Compilation.VName.Signature)
+			}
+			indices[i] = req.Compilation.VName.Signature
+			return nil
+		}),
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps(sigs...)}))
+	if len(indices) != len(sigs)-1 {
+		t.Errorf("Got %d indices, want %d", len(indices), len(sigs)-1)
+	}
+	for i := range indices {
+		if i < 0 || i >= len(sigs) {
+			t.Errorf("Index %d out of range", i)
+		}
+	}
+	if _, ok := IndexFromContext(context.Background()); ok {
+		t.Error("IndexFromContext reported an index outside a compilation")
+	}
+
+	// With a single worker, indices follow the queue, counting skipped
+	// compilations too.
+	var got []int
+	d = &Driver{
+		Filter: func(cu *apb.CompilationUnit) bool { return cu.VName.Signature != "b" },
+		Analyzer: analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			i, _ := IndexFromContext(ctx)
+			got = append(got, i)
+			return nil
+		}),
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}))
+	if err := testutil.DeepEqual([]int{0, 2}, got); err != nil {
+		t.Errorf("Indices: %v", err)
+	}
+}
+
+func TestDriverMaxOutputEntries(t *testing.T) {
+	var got []string
+	d := &Driver{
+		MaxOutputEntries: 2,
+		ContinueOnError:  true,
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			n := 1
+			if req.Compilation.VName.Signature == "big" {
+				n = 5
+			}
+			for i := 0; i < n; i++ {
+				out(ctx, &apb.AnalysisOutput{Value: []byte(req.Compilation.VName.Signature)}) // errors deliberately ignored
+			}
+			return nil
+		}),
+		WriteOutput: collect(&got),
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "big", "b")})
+	if merr, ok := err.(MultiError); !ok || len(merr) != 1 || !errors.Is(merr[0], ErrTooManyOutputs) {
+		t.Errorf("Run: got error %v, want %v", err, ErrTooManyOutputs)
+	} else if !strings.Contains(err.Error(), "kythe:#big") {
+		t.Errorf("Run: error %q does not name the compilation", err)
+	}
+	if err := testutil.DeepEqual([]string{"a", "big", "big", "b"}, got); err != nil {
+		t.Errorf("Unexpected outputs: %v", err)
+	}
+	if stats.OutputLimited != 1 || stats.Failed != 1 || stats.Succeeded != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestDriverOnComplete(t *testing.T) {
+	var calls []RunStats
+	d := &Driver{
+		Analyzer: emitter(nil),
+		OnComplete: func(_ context.Context, stats RunStats) error {
+			calls = append(calls, stats)
+			return nil
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b")}))
+	if len(calls) != 1 || calls[0].Succeeded != 2 {
+		t.Errorf("Unexpected OnComplete calls: %+v", calls)
+	}
+
+	// OnComplete is not invoked when the run fails.
+	calls = nil
+	d.Analyzer = emitter(errFromAnalysis)
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a", "b")}); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Run: got error %v, want %v", err, errFromAnalysis)
+	}
+	if len(calls) != 0 {
+		t.Errorf("OnComplete unexpectedly called after failure: %+v", calls)
+	}
+
+	// An error from OnComplete is returned by Run.
+	errFromComplete := errors.New("finalization failed")
+	d.Analyzer = emitter(nil)
+	d.OnComplete = func(context.Context, RunStats) error { return errFromComplete }
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a")}); !errors.Is(err, errFromComplete) {
+		t.Errorf("Run: got error %v, want %v", err, errFromComplete)
+	}
+}
+
+func TestDriverDeadLetter(t *testing.T) {
+	logger := new(testLogger)
+	var dead []string
+	d := &Driver{
+		ContinueOnError: true,
+		Logger:          logger,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			if sig := req.Compilation.VName.Signature; sig != "a" {
+				return fmt.Errorf("bad %s", sig)
+			}
+			return nil
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+		DeadLetter: func(_ context.Context, unit *apb.CompilationUnit, err error) error {
+			dead = append(dead, unit.VName.Signature+": "+err.Error())
+			if unit.VName.Signature == "c" {
+				return errors.New("dead letter full")
+			}
+			return nil
+		},
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d")}); err == nil {
+		t.Error("Expected error from Run but got none")
+	}
+	if err := testutil.DeepEqual([]string{"b: bad b", "c: bad c", "d: bad d"}, dead); err != nil {
+		t.Errorf("Unexpected dead letters: %v", err)
+	}
+	var found bool
+	for _, w := range logger.warns {
+		found = found || strings.HasPrefix(w, "dead letter failed compilation=kythe:#c")
+	}
+	if !found {
+		t.Errorf("Dead letter failure was not logged: %q", logger.warns)
+	}
+}
+
+func TestDriverErrorTypes(t *testing.T) {
+	errFromPhase := errors.New("phase failed")
+	fail := func(phase string) func(context.Context, Compilation) error {
+		return func(_ context.Context, cu Compilation) error {
+			if cu.Unit.VName.Signature == phase {
+				return errFromPhase
+			}
+			return nil
+		}
+	}
+	d := &Driver{
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			return fail("analyze")(ctx, Compilation{Unit: req.Compilation})
+		}),
+		Context: testContext{
+			setup:         fail("setup"),
+			teardown:      fail("teardown"),
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	check := func(phase string, err error, target interface{}, unit func() *apb.CompilationUnit) {
+		t.Helper()
+		if !errors.As(err, target) {
+			t.Errorf("%s: got error %T (%v), want %T", phase, err, err, target)
+		} else if !errors.Is(err, errFromPhase) {
+			t.Errorf("%s: error %v does not wrap %v", phase, err, errFromPhase)
+		} else if unit != nil && unit().GetVName().GetSignature() != phase {
+			t.Errorf("%s: error names the wrong compilation: %v", phase, unit())
+		}
+	}
+
+	var serr *SetupError
+	check("setup", d.Run(context.Background(), &syncQueue{comps: comps("setup")}), &serr,
+		func() *apb.CompilationUnit { return serr.Unit })
+	var aerr *AnalyzeError
+	check("analyze", d.Run(context.Background(), &syncQueue{comps: comps("analyze")}), &aerr,
+		func() *apb.CompilationUnit { return aerr.Unit })
+	var terr *TeardownError
+	check("teardown", d.Run(context.Background(), &syncQueue{comps: comps("teardown")}), &terr,
+		func() *apb.CompilationUnit { return terr.Unit })
+	var qerr *QueueError
+	check("queue", d.Run(context.Background(), queueFunc(func(context.Context, CompilationFunc) error { return errFromPhase })), &qerr, nil)
+}
+
+func TestDriverRequestReuse(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		var (
+			mu   sync.Mutex
+			seen = make(map[string]bool)
+			reqs = make(map[*apb.AnalysisRequest]bool)
+			held []*apb.AnalysisRequest
+		)
+		d := &Driver{
+			Concurrency: 2,
+			Timeout:     timeout,
+			Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+				mu.Lock()
+				defer mu.Unlock()
+				sig := req.Compilation.VName.Signature
+				if seen[sig] {
+					t.Errorf("Timeout %v: compilation %q analyzed twice", timeout, sig)
+				}
+				seen[sig] = true
+				reqs[req] = true
+				held = append(held, req)
+				return nil
+			}),
+		}
+		testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d", "e")}))
+
+		if len(seen) != 5 {
+			t.Errorf("Timeout %v: analyzed %d compilations, want 5", timeout, len(seen))
+		}
+		// Without a timeout, each worker reuses its request; with one, each
+		// analysis gets its own.
+		if timeout == 0 && len(reqs) > d.Concurrency {
+			t.Errorf("Timeout %v: got %d distinct requests, want at most %d", timeout, len(reqs), d.Concurrency)
+		} else if timeout > 0 && len(reqs) != 5 {
+			t.Errorf("Timeout %v: got %d distinct requests, want 5", timeout, len(reqs))
+		}
+		// Reused requests do not retain their last compilation, but requests
+		// that are not reused are left intact.
+		for _, req := range held {
+			if timeout == 0 && req.Compilation != nil {
+				t.Errorf("Timeout %v: request retains compilation %v", timeout, req.Compilation)
+			} else if timeout > 0 && req.Compilation == nil {
+				t.Errorf("Timeout %v: request was reset after analysis", timeout)
+			}
+		}
+	}
+}
+
+func TestDriverOutputCanceled(t *testing.T) {
+	var torndown, failed []string
+	q := &syncQueue{comps: comps("a", "b", "c", "d")}
+	d := &Driver{
+		ContinueOnError: true,
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			for i := 0; i < 3; i++ {
+				if err := out(ctx, &apb.AnalysisOutput{Value: []byte(req.Compilation.VName.Signature)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+		Context: testContext{
+			teardown: func(_ context.Context, cu Compilation) error {
+				torndown = append(torndown, cu.Unit.VName.Signature)
+				return nil
+			},
+		},
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			if string(out.Value) == "b" {
+				return context.Canceled // the sink is shutting down mid-compilation
+			}
+			return nil
+		},
+		DeadLetter: func(_ context.Context, cu *apb.CompilationUnit, _ error) error {
+			failed = append(failed, cu.VName.Signature)
+			return nil
+		},
+	}
+	stats, err := d.RunWithStats(context.Background(), q)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Driver error: got %v, want %v", err, context.Canceled)
+	}
+	if err := testutil.DeepEqual([]string{"a", "b"}, torndown); err != nil {
+		t.Errorf("Torn down compilations: %v", err)
+	}
+	if len(failed) != 0 || stats.Failed != 0 {
+		t.Errorf("Canceled compilation recorded as a failure: %v (%d failed)", failed, stats.Failed)
+	}
+	if stats.Succeeded != 1 {
+		t.Errorf("Succeeded: got %d, want 1", stats.Succeeded)
+	}
+	if n, _ := q.Remaining(); n != 2 {
+		t.Errorf("Remaining compilations: got %d, want 2", n)
+	}
+}
+
+func TestDriverOrderedOutput(t *testing.T) {
+	for _, spill := range []int{0, 1} {
+		var (
+			mu       sync.Mutex
+			finished = make(map[string]bool)
+			got      []string
+		)
+		d := &Driver{
+			Concurrency:       3,
+			OrderedOutput:     true,
+			OrderedSpillBytes: spill,
+			Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+				sig := req.Compilation.VName.Signature
+				if sig == "a" {
+					// Hold the first compilation until the others are done, so
+					// that its outputs are produced last.
+					for {
+						mu.Lock()
+						n := len(finished)
+						mu.Unlock()
+						if n == 2 {
+							break
+						}
+						time.Sleep(time.Millisecond)
+					}
+				}
+				for i := 1; i <= 3; i++ {
+					if err := out(ctx, &apb.AnalysisOutput{Value: []byte(fmt.Sprint(sig, i))}); err != nil {
+						return err
+					}
+				}
+				mu.Lock()
+				finished[sig] = true
+				mu.Unlock()
+				return nil
+			}),
+			WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+				got = append(got, string(out.Value))
+				return nil
+			},
+		}
+		stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b", "c")})
+		testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+		want := []string{"a1", "a2", "a3", "b1", "b2", "b3", "c1", "c2", "c3"}
+		if err := testutil.DeepEqual(want, got); err != nil {
+			t.Errorf("OrderedSpillBytes %d: outputs: %v", spill, err)
+		}
+		if stats.Outputs != len(want) {
+			t.Errorf("OrderedSpillBytes %d: got %d outputs, want %d", spill, stats.Outputs, len(want))
+		}
+	}
+}
+
+func TestDriverPause(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		analyzed []string
+		paused   = make(chan struct{})
+	)
+	d := new(Driver)
+	d.Analyzer = analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+		sig := req.Compilation.VName.Signature
+		mu.Lock()
+		analyzed = append(analyzed, sig)
+		mu.Unlock()
+		if sig == "a" {
+			d.Pause()
+			close(paused)
+		}
+		return nil
+	})
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(analyzed)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}) }()
+	<-paused
+	time.Sleep(20 * time.Millisecond)
+	if n := count(); n != 1 || !d.Paused() {
+		t.Errorf("While paused: analyzed %d compilations (paused=%v), want 1 (true)", n, d.Paused())
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned while paused: %v", err)
+	default:
+	}
+
+	d.Resume()
+	testutil.FatalOnErrT(t, "Driver error: %v", <-done)
+	if err := testutil.DeepEqual([]string{"a", "b", "c"}, analyzed); err != nil {
+		t.Errorf("Analyzed compilations: %v", err)
+	}
+}
+
+func TestDriverPauseCancel(t *testing.T) {
+	d := &Driver{
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			t.Error("Analyze called while paused")
+			return nil
+		}),
+	}
+	d.Pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := d.Run(ctx, &syncQueue{comps: comps("a")}); err != context.Canceled {
+		t.Errorf("Run while paused: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDriverHeartbeat(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		beats = make(map[string]int)
+	)
+	d := &Driver{
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			if req.Compilation.VName.Signature == "slow" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			return nil
+		}),
+		Heartbeat: func(_ context.Context, cu *apb.CompilationUnit, elapsed time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			beats[cu.VName.Signature]++
+			if elapsed <= 0 {
+				t.Errorf("Heartbeat for %q: elapsed time %v <= 0", cu.VName.Signature, elapsed)
+			}
+		},
+		HeartbeatInterval: 5 * time.Millisecond,
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("fast", "slow")}))
+
+	mu.Lock()
+	after := beats["slow"]
+	if beats["fast"] != 0 {
+		t.Errorf("Got %d heartbeats for an instant analysis, want 0", beats["fast"])
+	}
+	if after == 0 {
+		t.Error("Got no heartbeats for a slow analysis")
+	}
+	mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if beats["slow"] != after {
+		t.Errorf("Heartbeats continued after analysis: %d > %d", beats["slow"], after)
+	}
+}
+
+func TestDriverNilOutput(t *testing.T) {
+	var analyzed int
+	d := &Driver{
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			analyzed++
+			if out == nil {
+				t.Fatal("Analyzer was passed a nil OutputFunc")
+			}
+			return out(ctx, &apb.AnalysisOutput{Value: []byte(req.Compilation.VName.Signature)})
+		}),
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	if analyzed != 2 || stats.Outputs != 2 {
+		t.Errorf("Analyzed %d compilations with %d outputs, want 2 and 2", analyzed, stats.Outputs)
+	}
+
+	d.RequireOutput = true
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a")}); err == nil || !strings.Contains(err.Error(), "WriteOutput") {
+		t.Errorf("Run with RequireOutput: got %v, want error mentioning WriteOutput", err)
+	}
+	if analyzed != 2 {
+		t.Errorf("Analyzed %d compilations despite a validation error, want 2", analyzed)
+	}
+}
+
+func TestDriverFileDataServiceFor(t *testing.T) {
+	got := make(map[string]string)
+	d := &Driver{
+		FileDataService: "default",
+		FileDataServiceFor: func(cu *apb.CompilationUnit) string {
+			if cu.VName.Signature == "b" {
+				return "other"
+			}
+			return ""
+		},
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			got[req.Compilation.VName.Signature] = req.FileDataService
+			return nil
+		}),
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b")}))
+	if err := testutil.DeepEqual(map[string]string{"a": "default", "b": "other"}, got); err != nil {
+		t.Errorf("File data services: %v", err)
+	}
+}
+
+func TestSetFileDataService(t *testing.T) {
+	got := make(map[string]string)
+	d := &Driver{
+		FileDataService: "default",
+		RequestHook: func(_ context.Context, req *apb.AnalysisRequest) {
+			if sig := req.Compilation.VName.Signature; sig == "hook" || sig == "both" {
+				req.FileDataService = "hook"
+			}
+		},
+		Context: testContext{
+			setup: func(ctx context.Context, cu Compilation) error {
+				if sig := cu.Unit.VName.Signature; sig == "setup" || sig == "both" {
+					if !SetFileDataService(ctx, "setup") {
+						t.Errorf("SetFileDataService(%q) failed", sig)
+					}
+				}
+				return nil
+			},
+		},
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			got[req.Compilation.VName.Signature] = req.FileDataService
+			return nil
+		}),
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "hook", "setup", "both")}))
+	want := map[string]string{"a": "default", "hook": "hook", "setup": "setup", "both": "setup"}
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("File data services: %v", err)
+	}
+
+	if SetFileDataService(context.Background(), "x") {
+		t.Error("SetFileDataService succeeded outside a compilation")
+	}
+	if fds := FileDataServiceFromContext(context.Background()); fds != "" {
+		t.Errorf("FileDataServiceFromContext outside a compilation: got %q, want \"\"", fds)
+	}
+}
+
+func TestDriverStopDriver(t *testing.T) {
+	var analyzed, written, torn []string
+	d := &Driver{
+		// Outputs are buffered while retries are enabled; the stopping
+		// compilation's outputs must still be written.
+		Retry: &RetryPolicy{MaxAttempts: 2, Retryable: isTransient},
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			sig := req.Compilation.VName.Signature
+			analyzed = append(analyzed, sig)
+			if err := out(ctx, &apb.AnalysisOutput{Value: []byte(sig)}); err != nil {
+				return err
+			}
+			if sig == "sentinel" {
+				return fmt.Errorf("end of stream: %w", analysis.ErrStopDriver)
+			}
+			return nil
+		}),
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			written = append(written, string(out.Value))
+			return nil
+		},
+		Context: testContext{
+			teardown: func(_ context.Context, cu Compilation) error {
+				torn = append(torn, cu.Unit.VName.Signature)
+				return nil
+			},
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "sentinel", "b")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	want := []string{"a", "sentinel"}
+	if err := testutil.DeepEqual(want, analyzed); err != nil {
+		t.Errorf("Analyzed: %v", err)
+	}
+	if err := testutil.DeepEqual(want, written); err != nil {
+		t.Errorf("Outputs: %v", err)
+	}
+	if err := testutil.DeepEqual(want, torn); err != nil {
+		t.Errorf("Torn down: %v", err)
+	}
+	if stats.Succeeded != 2 || !strings.Contains(stats.StopReason, "end of stream") {
+		t.Errorf("Stats: got %d succeeded with stop reason %q, want 2 and the analyzer's error", stats.Succeeded, stats.StopReason)
+	}
+}
+
+func TestDriverDryRun(t *testing.T) {
+	var setups, teardowns []string
+	var services []string
+	cp := &memCheckpoint{done: make(map[string]bool)}
+	d := &Driver{
+		DryRun:          true,
+		Checkpoint:      cp,
+		FileDataService: "fds:1234",
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			t.Error("Analyzer called in a dry run")
+			return nil
+		}),
+		WriteOutput: func(context.Context, *apb.AnalysisOutput) error {
+			t.Error("Output written in a dry run")
+			return nil
+		},
+		RequestHook: func(_ context.Context, req *apb.AnalysisRequest) {
+			services = append(services, req.FileDataService)
+		},
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				setups = append(setups, cu.Unit.VName.Signature)
+				return nil
+			},
+			teardown: func(_ context.Context, cu Compilation) error {
+				teardowns = append(teardowns, cu.Unit.VName.Signature)
+				return nil
+			},
+		},
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	want := []string{"a", "b"}
+	if err := testutil.DeepEqual(want, setups); err != nil {
+		t.Errorf("Setup: %v", err)
+	}
+	if err := testutil.DeepEqual(want, teardowns); err != nil {
+		t.Errorf("Teardown: %v", err)
+	}
+	if err := testutil.DeepEqual([]string{"fds:1234", "fds:1234"}, services); err != nil {
+		t.Errorf("File data services: %v", err)
+	}
+	if !stats.DryRun || stats.Succeeded != 2 || stats.EmptyOutput != 0 {
+		t.Errorf("Stats: got dry run %v, %d succeeded, %d empty; want true, 2, 0", stats.DryRun, stats.Succeeded, stats.EmptyOutput)
+	}
+	if len(cp.done) != 0 {
+		t.Errorf("A dry run recorded checkpoints: %v", cp.done)
+	}
+}
+
+func TestDriverOutputPredicate(t *testing.T) {
+	var got []string
+	d := &Driver{
+		Concurrency: 1,
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			sig := req.Compilation.VName.Signature
+			for i := 0; i < 5; i++ {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := out(ctx, &apb.AnalysisOutput{Value: []byte(fmt.Sprint(sig, i))}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+		OutputPredicate: func(out *apb.AnalysisOutput) bool { return string(out.Value) == "a1" },
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			got = append(got, string(out.Value))
+			return nil
+		},
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+	if err := testutil.DeepEqual([]string{"a0", "a1", "b0", "b1", "b2", "b3", "b4"}, got); err != nil {
+		t.Errorf("Outputs: %v", err)
+	}
+	if stats.StoppedEarly != 1 || stats.Succeeded != 2 {
+		t.Errorf("Stats: got %d stopped early and %d succeeded, want 1 and 2", stats.StoppedEarly, stats.Succeeded)
+	}
+}
+
+func TestCancelCause(t *testing.T) {
+	errBad := errors.New("bad analyzer")
+	waitCause := func(causes chan<- error) analysis.CompilationAnalyzer {
+		return analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			<-ctx.Done()
+			causes <- CancelCause(ctx)
+			return ctx.Err()
+		})
+	}
+	tests := []struct {
+		desc  string
+		setup func(d *Driver, causes chan<- error, cancel context.CancelFunc)
+		want  error
+	}{
+		{"timeout", func(d *Driver, causes chan<- error, _ context.CancelFunc) {
+			d.Timeout = 10 * time.Millisecond
+			d.Analyzer = waitCause(causes)
+		}, ErrAnalysisTimeout},
+		{"run canceled", func(d *Driver, causes chan<- error, cancel context.CancelFunc) {
+			d.Timeout = time.Hour
+			wait := waitCause(causes)
+			d.Analyzer = analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+				cancel()
+				return wait.Analyze(ctx, req, out)
+			})
+		}, context.Canceled},
+		{"drain expired", func(d *Driver, causes chan<- error, cancel context.CancelFunc) {
+			d.DrainTimeout = 10 * time.Millisecond
+			wait := waitCause(causes)
+			d.Analyzer = analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+				cancel()
+				return wait.Analyze(ctx, req, out)
+			})
+		}, ErrDrainExpired},
+		{"stopped early", func(d *Driver, causes chan<- error, _ context.CancelFunc) {
+			d.OutputPredicate = func(*apb.AnalysisOutput) bool { return true }
+			d.Analyzer = analyzerFunc(func(ctx context.Context, _ *apb.AnalysisRequest, out analysis.OutputFunc) error {
+				if err := out(ctx, &apb.AnalysisOutput{Value: []byte("x")}); err != nil {
+					return err
+				}
+				causes <- CancelCause(ctx)
+				return nil
+			})
+		}, ErrStoppedEarly},
+		{"analyzer failed", func(d *Driver, causes chan<- error, _ context.CancelFunc) {
+			d.Analyzer = &MultiAnalyzer{Analyzers: []analysis.CompilationAnalyzer{
+				waitCause(causes),
+				analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error { return errBad }),
+			}}
+		}, errBad},
+	}
+	for _, test := range tests {
+		causes := make(chan error, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		d := new(Driver)
+		test.setup(d, causes, cancel)
+		d.Run(ctx, &syncQueue{comps: comps("a")})
+		cancel()
+		// An analysis that timed out may report after Run has returned.
+		if cause := <-causes; cause != test.want {
+			t.Errorf("%s: CancelCause: got %v, want %v", test.desc, cause, test.want)
+		}
+	}
+	if err := CancelCause(context.Background()); err != nil {
+		t.Errorf("CancelCause of a live context: got %v, want nil", err)
+	}
+}
+
+func TestDriverInProgress(t *testing.T) {
+	var d *Driver
+	check := func(phase string, cu Compilation) {
+		t.Helper()
+		units := d.InProgress()
+		if len(units) != 1 || units[0] != cu.Unit {
+			t.Errorf("InProgress during %s of %q: got %v, want [%v]", phase, cu.Unit.VName.Signature, units, cu.Unit)
+		}
+	}
+	d = &Driver{
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			check("analysis", Compilation{Unit: req.Compilation})
+			return nil
+		}),
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				check("setup", cu)
+				return nil
+			},
+			teardown: func(_ context.Context, cu Compilation) error {
+				check("teardown", cu)
+				return nil
+			},
+		},
+	}
+	if units := d.InProgress(); len(units) != 0 {
+		t.Errorf("InProgress before Run: got %v, want none", units)
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b")}))
+	if units := d.InProgress(); len(units) != 0 {
+		t.Errorf("InProgress after Run: got %v, want none", units)
+	}
+}
+
+func TestDriverErrorOnEmpty(t *testing.T) {
+	d := &Driver{Analyzer: emitter(nil)}
+	if err := d.Run(context.Background(), &syncQueue{}); err != nil {
+		t.Errorf("Empty queue: got %v, want nil", err)
+	}
+
+	d.ErrorOnEmpty = true
+	if err := d.Run(context.Background(), &syncQueue{}); err != ErrEmptyQueue {
+		t.Errorf("Empty queue with ErrorOnEmpty: got %v, want %v", err, ErrEmptyQueue)
+	}
+	d.Filter = func(*apb.CompilationUnit) bool { return false }
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a")}); err != nil {
+		t.Errorf("Filtered queue with ErrorOnEmpty: got %v, want nil", err)
+	}
+}
+
+func TestDriverConcurrentPanic(t *testing.T) {
+	newDriver := func(asError bool) (*Driver, *[]string, *[]string) {
+		var (
+			mu        sync.Mutex
+			outputs   []string
+			teardowns []string
+		)
+		return &Driver{
+			Concurrency:     3,
+			ContinueOnError: true,
+			PanicAsError:    asError,
+			Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+				sig := req.Compilation.VName.Signature
+				if sig == "bad" {
+					panic("bad compilation")
+				}
+				return out(ctx, &apb.AnalysisOutput{Value: []byte(sig)})
+			}),
+			Context: testContext{
+				teardown: func(_ context.Context, cu Compilation) error {
+					mu.Lock()
+					defer mu.Unlock()
+					teardowns = append(teardowns, cu.Unit.VName.Signature)
+					return nil
+				},
+				analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+			},
+			WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+				mu.Lock()
+				defer mu.Unlock()
+				outputs = append(outputs, string(out.Value))
+				return nil
+			},
+		}, &outputs, &teardowns
+	}
+
+	// As errors, the panic fails only its own compilation.
+	d, outputs, teardowns := newDriver(true)
+	err := d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "bad", "c", "d", "e")})
+	var perr *PanicError
+	if merr, ok := err.(MultiError); !ok || len(merr) != 1 || !errors.As(merr[0], &perr) {
+		t.Errorf("Driver error: got %v, want one *PanicError", err)
+	} else if len(perr.Stack) == 0 {
+		t.Error("PanicError has no stack trace")
+	}
+	sort.Strings(*outputs)
+	if err := testutil.DeepEqual([]string{"a", "b", "c", "d", "e"}, *outputs); err != nil {
+		t.Errorf("Outputs of the other compilations: %v", err)
+	}
+	if len(*teardowns) != 6 {
+		t.Errorf("Got %d teardowns, want 6: %v", len(*teardowns), *teardowns)
+	}
+
+	// Propagated, the panic reaches the caller of Run after Teardown.
+	d, _, teardowns = newDriver(false)
+	recovered := func() (v interface{}) {
+		defer func() { v = recover() }()
+		d.Run(context.Background(), &syncQueue{comps: comps("a", "bad", "c")})
+		return nil
+	}()
+	if !errors.As(asError(recovered), &perr) || perr.Value != "bad compilation" {
+		t.Errorf("Recovered %v, want a *PanicError for the bad compilation", recovered)
+	}
+	found := false
+	for _, sig := range *teardowns {
+		found = found || sig == "bad"
+	}
+	if !found {
+		t.Errorf("Teardowns %v do not include the panicking compilation", *teardowns)
+	}
+}
+
+// asError returns v as an error, or nil if it is not one.
+func asError(v interface{}) error {
+	err, _ := v.(error)
+	return err
+}
+
+func TestDriverSkipCompilation(t *testing.T) {
+	var analyzed, dead []string
+	d := &Driver{
+		Limit: 2,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			analyzed = append(analyzed, req.Compilation.VName.Signature)
+			return nil
+		}),
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				if strings.HasPrefix(cu.Unit.VName.Signature, "gen") {
+					return fmt.Errorf("%s is generated: %w", cu.Unit.VName.Signature, ErrSkipCompilation)
+				}
+				return nil
+			},
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+		DeadLetter: func(_ context.Context, cu *apb.CompilationUnit, _ error) error {
+			dead = append(dead, cu.VName.Signature)
+			return nil
+		},
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "gen1", "gen2", "b", "c")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+	if err := testutil.DeepEqual([]string{"a", "b"}, analyzed); err != nil {
+		t.Errorf("Analyzed compilations: %v", err)
+	}
+	if stats.Skipped != 2 || stats.Failed != 0 || stats.Succeeded != 2 {
+		t.Errorf("Stats: got %d skipped, %d failed, %d succeeded; want 2, 0, 2", stats.Skipped, stats.Failed, stats.Succeeded)
+	}
+	if len(dead) != 0 {
+		t.Errorf("Skipped compilations sent to DeadLetter: %v", dead)
+	}
+}
+
+func TestDriverTeardownOnSkip(t *testing.T) {
+	tests := []struct {
+		sig          string // "filtered" and "skip" are skipped before and by Setup
+		policy       TeardownPolicy
+		wantSetup    bool
+		wantTeardown bool
+	}{
+		{"filtered", TeardownIfSetUp, false, false},
+		{"filtered", TeardownNever, false, false},
+		{"skip", TeardownIfSetUp, true, true},
+		{"skip", TeardownNever, true, false},
+		{"ok", TeardownIfSetUp, true, true},
+		{"ok", TeardownNever, true, true},
+	}
+	for _, test := range tests {
+		var setup, teardown bool
+		d := &Driver{
+			Analyzer:       emitter(nil),
+			Filter:         func(cu *apb.CompilationUnit) bool { return cu.VName.Signature != "filtered" },
+			TeardownOnSkip: test.policy,
+			Context: testContext{
+				setup: func(_ context.Context, cu Compilation) error {
+					setup = true
+					if cu.Unit.VName.Signature == "skip" {
+						return ErrSkipCompilation
+					}
+					return nil
+				},
+				teardown: func(context.Context, Compilation) error { teardown = true; return nil },
+			},
+		}
+		stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps(test.sig)})
+		testutil.FatalOnErrT(t, "Driver error: %v", err)
+		if setup != test.wantSetup || teardown != test.wantTeardown {
+			t.Errorf("%s with policy %d: got setup=%v teardown=%v, want %v and %v",
+				test.sig, test.policy, setup, teardown, test.wantSetup, test.wantTeardown)
+		}
+		if wantSkipped := test.sig != "ok"; (stats.Skipped == 1) != wantSkipped {
+			t.Errorf("%s with policy %d: got %d skipped", test.sig, test.policy, stats.Skipped)
+		}
+	}
+}
+
+func TestDriverCompilationContext(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		var (
+			mu       sync.Mutex
+			got      = make(map[string]string)
+			retained []context.Context
+		)
+		d := &Driver{
+			Concurrency:        2,
+			OrderedOutput:      ordered,
+			CompilationContext: true,
+			Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+				// Pass an unrelated context to the output.
+				return out(context.Background(), &apb.AnalysisOutput{Value: []byte(req.Compilation.VName.Signature)})
+			}),
+			WriteOutput: func(ctx context.Context, out *apb.AnalysisOutput) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got[string(out.Value)] = CompilationFromContext(ctx).GetVName().GetSignature()
+				retained = append(retained, ctx)
+				return nil
+			},
+		}
+		testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}))
+
+		if err := testutil.DeepEqual(map[string]string{"a": "a", "b": "b", "c": "c"}, got); err != nil {
+			t.Errorf("Ordered %v: compilations seen by output: %v", ordered, err)
+		}
+		for _, ctx := range retained {
+			if cu := CompilationFromContext(ctx); cu != nil {
+				t.Errorf("Ordered %v: compilation %v still in context after the run", ordered, cu)
+			}
+		}
+	}
+}
+
+func TestDriverRequestHook(t *testing.T) {
+	var got []*apb.AnalysisRequest
+	d := &Driver{
+		FileDataService: "default:1234",
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			got = append(got, &apb.AnalysisRequest{
+				FileDataService: req.FileDataService,
+				Revision:        req.Revision,
+				BuildId:         req.BuildId,
+			})
+			return nil
+		}),
+		RequestHook: func(ctx context.Context, req *apb.AnalysisRequest) {
+			if RequestIDFromContext(ctx) == "" {
+				t.Error("RequestHook context has no request ID")
+			}
+			if req.FileDataService != "default:1234" || req.Revision != "12345" {
+				t.Errorf("RequestHook called before the driver set its fields: %+v", req)
+			}
+			req.FileDataService = "hook:" + req.Compilation.VName.Signature
+			req.BuildId = "hooked"
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b")}))
+
+	want := []*apb.AnalysisRequest{
+		{FileDataService: "hook:a", Revision: "12345", BuildId: "hooked"},
+		{FileDataService: "hook:b", Revision: "12345", BuildId: "hooked"},
+	}
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("Requests: %v", err)
+	}
+}
+
+func TestDriverSetup(t *testing.T) {
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a", "b", "c"),
+		Compilations: comps("target1", "target2"),
+	}
+	var setupIdx int
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		Context: testContext{
+			setup: func(_ context.Context, cu Compilation) error {
+				setupIdx++
+				var missing []string
+				if cu.UnitDigest == "" {
+					missing = append(missing, "unit digest")
+				}
+				if cu.Revision == "" {
+					missing = append(missing, "revision marker")
+				}
+				if cu.BuildID == "" {
+					missing = append(missing, "build ID")
+				}
+				if len(missing) != 0 {
+					return fmt.Errorf("missing %s: %v", strings.Join(missing, ", "), cu)
+				}
+				return nil
+			},
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+	if len(m.Requests) != len(m.Compilations) {
+		t.Errorf("Expected %d AnalysisRequests; found %v", len(m.Compilations), m.Requests)
+	}
+	if setupIdx != len(m.Compilations) {
+		t.Errorf("Expected %d calls to Setup; found %d", len(m.Compilations), setupIdx)
+	}
+}
+
+func TestDriverTeardown(t *testing.T) {
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a", "b", "c"),
+		Compilations: comps("target1", "target2"),
+	}
+	var teardownIdx int
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		Context: testContext{
+			teardown: func(_ context.Context, cu Compilation) error {
+				teardownIdx++
+				return nil
+			},
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), m))
+	if len(m.Requests) != len(m.Compilations) {
+		t.Errorf("Expected %d AnalysisRequests; found %v", len(m.Compilations), m.Requests)
+	}
+	if teardownIdx != len(m.Compilations) {
+		t.Errorf("Expected %d calls to Teardown; found %d", len(m.Compilations), teardownIdx)
+	}
+}
+
+// A syncQueue is a concurrency-safe Queue over a fixed list of compilations.
+type syncQueue struct {
+	mu    sync.Mutex
+	comps []Compilation
+}
+
+// Next implements the Queue interface.
+func (q *syncQueue) Next(ctx context.Context, f CompilationFunc) error {
+	q.mu.Lock()
+	if len(q.comps) == 0 {
+		q.mu.Unlock()
+		return ErrEndOfQueue
+	}
+	cu := q.comps[0]
+	q.comps = q.comps[1:]
+	q.mu.Unlock()
+	return f(ctx, cu)
+}
+
+// Remaining implements the Sizer interface.
+func (q *syncQueue) Remaining() (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.comps), true
+}
+
+// An analyzerFunc implements analysis.CompilationAnalyzer with a function.
+type analyzerFunc func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error
+
+func (f analyzerFunc) Analyze(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+	return f(ctx, req, out)
+}
+
+// A queueFunc implements the Queue interface with a function.
+type queueFunc func(context.Context, CompilationFunc) error
+
+func (f queueFunc) Next(ctx context.Context, g CompilationFunc) error { return f(ctx, g) }
+
+func TestDriverConcurrency(t *testing.T) {
+	const workers = 4
+	q := &syncQueue{comps: comps("a", "b", "c", "d", "e", "f", "g", "h")}
+
+	var (
+		mu        sync.Mutex
+		active    int
+		maxActive int
+		writing   bool
+		outputs   int
+	)
+	ready := make(chan struct{})
+	var readyOnce sync.Once
+	d := &Driver{
+		Concurrency: workers,
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			if active == workers {
+				readyOnce.Do(func() { close(ready) })
+			}
+			mu.Unlock()
+			<-ready // wait until all workers are busy at once
+
+			for _, o := range outs("x", "y") {
+				if err := out(ctx, o); err != nil {
+					return err
+				}
+			}
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return nil
+		}),
+		WriteOutput: func(context.Context, *apb.AnalysisOutput) error {
+			mu.Lock()
+			if writing {
+				t.Error("Concurrent call to WriteOutput")
+			}
+			writing = true
+			mu.Unlock()
+
+			mu.Lock()
+			writing = false
+			outputs++
+			mu.Unlock()
+			return nil
+		},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), q))
+	if maxActive != workers {
+		t.Errorf("Expected %d concurrent analyses; found %d", workers, maxActive)
+	}
+	if want := 2 * 8; outputs != want {
+		t.Errorf("Expected %d outputs; found %d", want, outputs)
+	}
+}
+
+func TestDriverConcurrencyGrouped(t *testing.T) {
+	const workers = 3
+	for _, spill := range []int{0, 1} {
+		var (
+			mu     sync.Mutex
+			events []string
+		)
+		ready := make(chan struct{})
+		var started int
+		d := &Driver{
+			Concurrency:       workers,
+			OrderedSpillBytes: spill,
+			Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+				mu.Lock()
+				if started++; started == workers {
+					close(ready)
+				}
+				mu.Unlock()
+				<-ready // all the analyses produce their outputs at once
+
+				sig := req.Compilation.VName.Signature
+				for i := 1; i <= 3; i++ {
+					if err := out(ctx, &apb.AnalysisOutput{Value: []byte(fmt.Sprint(sig, i))}); err != nil {
+						return err
+					}
+					time.Sleep(time.Millisecond)
+				}
+				return nil
+			}),
+			Context: testContext{
+				teardown: func(_ context.Context, cu Compilation) error {
+					mu.Lock()
+					defer mu.Unlock()
+					events = append(events, "teardown "+cu.Unit.VName.Signature)
+					return nil
+				},
+			},
+			WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, string(out.Value))
+				return nil
+			},
+		}
+		testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}))
+
+		// Each compilation's outputs are written together, before its Teardown.
+		var runs []string
+		for i := 0; i < len(events); {
+			if strings.HasPrefix(events[i], "teardown ") {
+				i++
+				continue
+			}
+			sig := events[i][:1]
+			run := []string{sig + "1", sig + "2", sig + "3"}
+			if i+len(run) > len(events) {
+				t.Fatalf("OrderedSpillBytes %d: truncated outputs: %q", spill, events)
+			} else if err := testutil.DeepEqual(run, events[i:i+len(run)]); err != nil {
+				t.Fatalf("OrderedSpillBytes %d: outputs of %q are not grouped: %q", spill, sig, events)
+			}
+			i += len(run)
+			runs = append(runs, sig)
+			teardown := "teardown " + sig
+			for _, e := range events[:i] {
+				if e == teardown {
+					t.Errorf("OrderedSpillBytes %d: outputs of %q were written after its Teardown: %q", spill, sig, events)
+				}
+			}
+		}
+		sort.Strings(runs)
+		if err := testutil.DeepEqual([]string{"a", "b", "c"}, runs); err != nil {
+			t.Errorf("OrderedSpillBytes %d: compilations with outputs: %v", spill, err)
+		}
+	}
+}
+
+func TestDriverConcurrencyError(t *testing.T) {
+	q := &syncQueue{comps: comps("a", "b", "c", "d", "e", "f", "g", "h")}
+	var (
+		mu       sync.Mutex
+		analyzed int
+	)
+	d := &Driver{
+		Concurrency: 3,
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			mu.Lock()
+			analyzed++
+			mu.Unlock()
+			if req.Compilation.VName.Signature == "b" {
+				return errFromAnalysis
+			}
+			<-ctx.Done() // block until the failure cancels the run
+			return ctx.Err()
+		}),
+	}
+	if err := d.Run(context.Background(), q); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected error: %v; found: %v", errFromAnalysis, err)
+	}
+	if analyzed == 8 {
+		t.Errorf("Expected analysis to stop early; analyzed %d compilations", analyzed)
+	}
+}
+
+func TestDriverTeardownError(t *testing.T) {
+	errFromTeardown := errors.New("some random teardown error")
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a", "b", "c"),
+		Compilations: comps("target1", "target2"),
+	}
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		Context: testContext{
+			teardown: func(context.Context, Compilation) error { return errFromTeardown },
+		},
+	}
+	err := d.Run(context.Background(), m)
+	if err == nil {
+		t.Fatal("Expected teardown error but got none")
+	}
+	if !strings.Contains(err.Error(), errFromTeardown.Error()) {
+		t.Errorf("Error %q does not report the teardown failure %q", err, errFromTeardown)
+	}
+	if len(m.Requests) != 1 {
+		t.Errorf("Expected %d AnalysisRequests; found %v", 1, m.Requests)
+	}
+}
+
+func TestDriverTeardownErrorAfterAnalysisError(t *testing.T) {
+	m := &mock{
+		t:            t,
+		Outputs:      outs("a"),
+		Compilations: comps("target1"),
+		AnalyzeError: errFromAnalysis,
+	}
+	d := &Driver{
+		Analyzer:    m,
+		WriteOutput: m.out(),
+		Context: testContext{
+			teardown:      func(context.Context, Compilation) error { return errors.New("teardown failed") },
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	// The analysis error takes precedence; the teardown failure is only logged.
+	if err := d.Run(context.Background(), m); !errors.Is(err, errFromAnalysis) {
+		t.Errorf("Expected AnalysisError: %v; found: %v", errFromAnalysis, err)
+	}
+}
+
+func TestDriverAsyncTeardown(t *testing.T) {
+	errFromTeardown := errors.New("teardown failed")
+	release := make(chan struct{}) // closed once b is analyzed
+	var (
+		once     sync.Once
+		mu       sync.Mutex
+		torn     []string
+		analyzed []string
+	)
+	d := &Driver{
+		AsyncTeardown: true,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			sig := req.Compilation.VName.Signature
+			mu.Lock()
+			analyzed = append(analyzed, sig)
+			mu.Unlock()
+			if sig == "b" {
+				once.Do(func() { close(release) })
+			}
+			return nil
+		}),
+		Context: testContext{
+			teardown: func(ctx context.Context, cu Compilation) error {
+				sig := cu.Unit.VName.Signature
+				switch sig {
+				case "a":
+					// The worker must not wait for this teardown.
+					select {
+					case <-release:
+					case <-time.After(5 * time.Second):
+						t.Error("Teardown of a blocked the analysis of b")
+					}
+					if CompilationFromContext(ctx) != cu.Unit {
+						t.Error("The compilation was finished before its Teardown returned")
+					}
+				case "b":
+					return errFromTeardown
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				torn = append(torn, sig)
+				return nil
+			},
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b", "c")})
+	var terr *TeardownError
+	if !errors.As(err, &terr) || !errors.Is(err, errFromTeardown) || terr.Unit.VName.Signature != "b" {
+		t.Errorf("Run: got error %v, want a teardown error for b", err)
+	}
+	// The teardown error does not stop the run, which waits for every teardown.
+	if err := testutil.DeepEqual([]string{"a", "b", "c"}, analyzed); err != nil {
+		t.Errorf("Analyzed: %v", err)
+	}
+	sort.Strings(torn)
+	if err := testutil.DeepEqual([]string{"a", "c"}, torn); err != nil {
+		t.Errorf("Torn down: %v", err)
+	}
+	if stats.Succeeded != 3 || stats.TeardownFailed != 1 {
+		t.Errorf("Stats: got %d succeeded and %d teardowns failed, want 3 and 1", stats.Succeeded, stats.TeardownFailed)
+	}
+	if units := d.InProgress(); len(units) != 0 {
+		t.Errorf("InProgress after Run: got %v, want none", units)
+	}
+
+	// With ContinueOnError, the teardown error is reported among the failures.
+	d.ContinueOnError = true
+	err = d.Run(context.Background(), &syncQueue{comps: comps("b", "c")})
+	if merr, ok := err.(MultiError); !ok || len(merr) != 1 || !errors.Is(merr[0], errFromTeardown) {
+		t.Errorf("Run: got error %v, want a MultiError for the teardown of b", err)
+	}
+}
+
+func outs(vals ...string) (as []*apb.AnalysisOutput) {
+	for _, val := range vals {
+		as = append(as, &apb.AnalysisOutput{Value: []byte(val)})
+	}
+	return
+}
+
+func comps(sigs ...string) (cs []Compilation) {
+	for _, sig := range sigs {
+		cs = append(cs, Compilation{
+			Unit:       &apb.CompilationUnit{VName: &spb.VName{Signature: sig}},
+			Revision:   "12345",
+			UnitDigest: "digest:" + sig,
+			BuildID:    buildID,
+		})
+	}
+	return
+}
+
+func BenchmarkDriverRun(b *testing.B) {
+	const numUnits = 100000
+	units := make([]*apb.CompilationUnit, numUnits)
+	for i := range units {
+		units[i] = &apb.CompilationUnit{VName: &spb.VName{Signature: fmt.Sprint(i)}}
+	}
+	d := &Driver{
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error { return nil }),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.Run(context.Background(), SliceQueue(units)); err != nil {
+			b.Fatalf("Driver error: %v", err)
+		}
 	}
-	return
 }
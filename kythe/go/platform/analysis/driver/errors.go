@@ -0,0 +1,160 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+
+	"kythe.io/kythe/go/util/kytheuri"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A CompilationError records the failure of a single compilation.
+type CompilationError struct {
+	Unit *apb.CompilationUnit // the compilation that failed
+	Key  string               // the key of Unit, according to the driver's Keyer
+	Err  error                // the error reported for the compilation
+}
+
+func (e *CompilationError) Error() string {
+	return fmt.Sprintf("compilation %s: %v", unitName(e.Unit), e.Err)
+}
+
+// Unwrap returns the underlying error, for use with errors.Is and errors.As.
+func (e *CompilationError) Unwrap() error { return e.Err }
+
+// A QueueError reports a failure of a Queue's Next method.  It is not used for
+// the errors of compilations delivered by the queue, nor when Next returns the
+// error of its context.
+type QueueError struct {
+	Err error // the error reported by the queue
+}
+
+func (e *QueueError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error, for use with errors.Is and errors.As.
+func (e *QueueError) Unwrap() error { return e.Err }
+
+// A SetupError reports a failure of the Setup phase for a compilation.
+type SetupError struct {
+	Unit *apb.CompilationUnit
+	Err  error // the error reported by Setup
+}
+
+func (e *SetupError) Error() string { return "driver: analysis setup: " + e.Err.Error() }
+
+// Unwrap returns the underlying error, for use with errors.Is and errors.As.
+func (e *SetupError) Unwrap() error { return e.Err }
+
+// An AnalyzeError reports a failure to analyze a compilation, after any
+// retries.
+type AnalyzeError struct {
+	Unit *apb.CompilationUnit
+	Err  error // the error reported for the final attempt
+}
+
+func (e *AnalyzeError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error, for use with errors.Is and errors.As.
+func (e *AnalyzeError) Unwrap() error { return e.Err }
+
+// A TeardownError reports a failure of the Teardown phase for a compilation
+// whose analysis otherwise succeeded.
+type TeardownError struct {
+	Unit *apb.CompilationUnit
+	Err  error // the error reported by Teardown
+}
+
+func (e *TeardownError) Error() string { return "driver: analysis teardown: " + e.Err.Error() }
+
+// Unwrap returns the underlying error, for use with errors.Is and errors.As.
+func (e *TeardownError) Unwrap() error { return e.Err }
+
+// A ValidationError reports a compilation rejected by the structural check
+// enabled by a Driver's PreValidate option.
+type ValidationError struct {
+	Unit *apb.CompilationUnit
+	Err  error // the problem found; see ValidateUnit
+}
+
+func (e *ValidationError) Error() string { return "driver: invalid compilation: " + e.Err.Error() }
+
+// Unwrap returns the underlying error, for use with errors.Is and errors.As.
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// An UnhealthyError is returned by Driver.Run when a run is aborted because
+// the driver's MaxConsecutiveFailures was reached.
+type UnhealthyError struct {
+	Failures int               // the number of consecutive failures
+	Last     *CompilationError // the last of those failures
+}
+
+func (e *UnhealthyError) Error() string {
+	return fmt.Sprintf("driver: analyzer appears unhealthy: %d consecutive compilations failed; last: %v", e.Failures, e.Last)
+}
+
+// Unwrap returns the last failure, for use with errors.Is and errors.As.
+func (e *UnhealthyError) Unwrap() error { return e.Last }
+
+// A MultiError is returned by Driver.Run in ContinueOnError mode to report
+// every compilation that failed during the run.
+type MultiError []*CompilationError
+
+func (m MultiError) Error() string {
+	switch len(m) {
+	case 0:
+		return "no errors"
+	case 1:
+		return m[0].Error()
+	}
+	msgs := make([]string, len(m))
+	for i, e := range m {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("%d compilations failed: %s", len(m), strings.Join(msgs, "; "))
+}
+
+// unitName returns a human-readable name for unit based on its VName.
+func unitName(unit *apb.CompilationUnit) string {
+	if unit.GetVName() == nil {
+		return "<unknown>"
+	}
+	return kytheuri.FromVName(unit.GetVName()).String()
+}
+
+// A PanicError reports a panic recovered during the analysis of a compilation.
+type PanicError struct {
+	Value interface{} // the value passed to panic
+	Stack []byte      // the stack trace of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", e.Value, e.Stack)
+}
+
+// catch calls f, converting a panic into a *PanicError.
+func catch(f func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return f()
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// ErrFakeFailure is the error reported by a FakeAnalyzer for the compilations
+// it is configured to fail.
+var ErrFakeFailure = errors.New("driver: injected analysis failure")
+
+// A FakeAnalyzer is an analysis.CompilationAnalyzer that produces synthetic
+// outputs without examining its inputs, for testing and benchmarking drivers
+// and output sinks.  Its behavior depends only on its configuration and on
+// each compilation, so it is reproducible regardless of the order or
+// concurrency with which compilations are analyzed.
+type FakeAnalyzer struct {
+	Outputs   int           // the number of outputs per compilation
+	ValueSize int           // the minimum size of each output value, in bytes
+	Delay     time.Duration // if > 0, the time each analysis takes
+
+	// ErrorRate is the fraction of compilations, between 0 and 1, that fail
+	// with ErrFakeFailure.  Whether a compilation fails is determined by its
+	// CompilationKey, so the same compilations fail on every run.  A failing
+	// compilation produces no outputs.
+	ErrorRate float64
+}
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (a *FakeAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, f analysis.OutputFunc) error {
+	if a.Delay > 0 {
+		if err := sleep(ctx, a.Delay); err != nil {
+			return err
+		}
+	}
+	if a.ErrorRate > 0 {
+		if float64(keyHash(req.Compilation))/math.MaxUint64 < a.ErrorRate {
+			return errors.WithMessage(ErrFakeFailure, unitName(req.Compilation))
+		}
+	}
+
+	name := unitName(req.Compilation)
+	for i := 0; i < a.Outputs; i++ {
+		val := []byte(fmt.Sprintf("%s#%d", name, i))
+		if len(val) < a.ValueSize {
+			val = append(val, make([]byte, a.ValueSize-len(val))...)
+		}
+		if err := f(ctx, &apb.AnalysisOutput{Value: val}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
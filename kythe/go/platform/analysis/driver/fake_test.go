@@ -0,0 +1,90 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestFakeAnalyzer(t *testing.T) {
+	a := &FakeAnalyzer{Outputs: 3, ValueSize: 64}
+	var outs []*apb.AnalysisOutput
+	err := a.Analyze(context.Background(), &apb.AnalysisRequest{Compilation: comps("a")[0].Unit},
+		func(_ context.Context, out *apb.AnalysisOutput) error {
+			outs = append(outs, out)
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	if len(outs) != 3 {
+		t.Fatalf("Got %d outputs, want 3", len(outs))
+	}
+	for _, out := range outs {
+		if len(out.Value) != 64 {
+			t.Errorf("Output %q has size %d, want 64", out.Value, len(out.Value))
+		}
+	}
+}
+
+func TestFakeAnalyzerErrorRate(t *testing.T) {
+	failures := func(rate float64) map[string]bool {
+		a := &FakeAnalyzer{ErrorRate: rate}
+		failed := make(map[string]bool)
+		for i := 0; i < 200; i++ {
+			sig := fmt.Sprint(i)
+			err := a.Analyze(context.Background(), &apb.AnalysisRequest{Compilation: comps(sig)[0].Unit}, nil)
+			if err != nil {
+				if !errors.Is(err, ErrFakeFailure) {
+					t.Errorf("Analyze(%q): got %v, want %v", sig, err, ErrFakeFailure)
+				}
+				failed[sig] = true
+			}
+		}
+		return failed
+	}
+	if n := len(failures(0)); n != 0 {
+		t.Errorf("ErrorRate 0: %d failures, want 0", n)
+	}
+	if n := len(failures(1)); n != 200 {
+		t.Errorf("ErrorRate 1: %d failures, want 200", n)
+	}
+	half := failures(0.5)
+	if n := len(half); n < 60 || n > 140 {
+		t.Errorf("ErrorRate 0.5: %d failures of 200", n)
+	}
+	if err := testutil.DeepEqual(half, failures(0.5)); err != nil {
+		t.Errorf("ErrorRate 0.5: failures differ between runs: %v", err)
+	}
+}
+
+func TestFakeAnalyzerCancel(t *testing.T) {
+	a := &FakeAnalyzer{Outputs: 1, Delay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.Analyze(ctx, &apb.AnalysisRequest{Compilation: comps("a")[0].Unit}, nil); err != context.Canceled {
+		t.Errorf("Analyze: got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A GoldenCompare turns a Driver into a harness for regression tests of an
+// analyzer: rather than being written, the outputs of each compilation are
+// compared against an expected set, and the differences are reported.
+//
+// Outputs are compared by value, as sets, so neither their order nor
+// duplicates produce differences.
+type GoldenCompare struct {
+	// Expected returns the expected outputs of the compilation with the given
+	// key, according to the driver's Keyer.  If it reports an error, the
+	// compilation fails with that error.
+	Expected func(ctx context.Context, key string) ([]*apb.AnalysisOutput, error)
+
+	// Report is called for each compilation analyzed successfully whose
+	// outputs differ from those expected.  It may be called concurrently for
+	// different compilations.
+	Report func(context.Context, GoldenDiff)
+}
+
+// A GoldenDiff reports the differences between the outputs of a compilation
+// and those expected by a GoldenCompare.  Outputs within each list are sorted
+// by value.
+type GoldenDiff struct {
+	Unit    *apb.CompilationUnit
+	Key     string                // the key of Unit, according to the driver's Keyer
+	Added   []*apb.AnalysisOutput // outputs produced but not expected
+	Removed []*apb.AnalysisOutput // outputs expected but not produced
+}
+
+type goldenKey struct{}
+
+// goldenOutputs collects the outputs of a compilation under comparison.
+type goldenOutputs struct {
+	mu   sync.Mutex
+	outs []*apb.AnalysisOutput
+}
+
+func newGoldenOutputs() interface{} { return new(goldenOutputs) }
+
+// collectGolden records out as an output of the compilation of s.
+func collectGolden(s *unitScope, out *apb.AnalysisOutput) {
+	g := s.value(goldenKey{}, newGoldenOutputs).(*goldenOutputs)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.outs = append(g.outs, out)
+}
+
+// compareGolden compares the outputs collected for cu with those expected by
+// d.Golden, and reports any differences.
+func (r *runner) compareGolden(ctx context.Context, cu Compilation) error {
+	key := r.key(cu.Unit)
+	want, err := r.Golden.Expected(ctx, key)
+	if err != nil {
+		return err
+	}
+	var got []*apb.AnalysisOutput
+	if s := scopeFrom(ctx); s != nil {
+		g := s.value(goldenKey{}, newGoldenOutputs).(*goldenOutputs)
+		g.mu.Lock()
+		got = g.outs
+		g.mu.Unlock()
+	}
+	added, removed := outputDiff(got, want), outputDiff(want, got)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	r.stats.GoldenDiffs++
+	r.mu.Unlock()
+	if r.Golden.Report != nil {
+		r.Golden.Report(ctx, GoldenDiff{Unit: cu.Unit, Key: key, Added: added, Removed: removed})
+	}
+	return nil
+}
+
+// outputDiff returns the outputs of a whose values do not occur in b, without
+// duplicates and sorted by value.
+func outputDiff(a, b []*apb.AnalysisOutput) []*apb.AnalysisOutput {
+	in := make(map[string]bool, len(b))
+	for _, o := range b {
+		in[string(o.Value)] = true
+	}
+	var diff []*apb.AnalysisOutput
+	for _, o := range a {
+		if v := string(o.Value); !in[v] {
+			in[v] = true // report each value once
+			diff = append(diff, o)
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool { return string(diff[i].Value) < string(diff[j].Value) })
+	return diff
+}
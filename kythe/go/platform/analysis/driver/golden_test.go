@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestDriverGolden(t *testing.T) {
+	produced := map[string][]string{
+		"same":    {"b", "a", "a"},
+		"changed": {"a", "c", "d"},
+	}
+	golden := map[string][]string{
+		"same":    {"a", "b"},
+		"changed": {"a", "b", "c", "e"},
+	}
+	type diff struct {
+		Key            string
+		Added, Removed []string
+	}
+	var (
+		mu      sync.Mutex
+		diffs   []diff
+		written int
+	)
+	d := &Driver{
+		Concurrency: 2,
+		Keyer:       func(unit *apb.CompilationUnit) string { return unit.VName.Signature },
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			for _, v := range produced[req.Compilation.VName.Signature] {
+				if err := out(ctx, &apb.AnalysisOutput{Value: []byte(v)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+		WriteOutput: func(context.Context, *apb.AnalysisOutput) error { written++; return nil },
+		Golden: &GoldenCompare{
+			Expected: func(_ context.Context, key string) ([]*apb.AnalysisOutput, error) {
+				var outs []*apb.AnalysisOutput
+				for _, v := range golden[key] {
+					outs = append(outs, &apb.AnalysisOutput{Value: []byte(v)})
+				}
+				return outs, nil
+			},
+			Report: func(_ context.Context, d GoldenDiff) {
+				mu.Lock()
+				defer mu.Unlock()
+				diffs = append(diffs, diff{d.Key, values(d.Added), values(d.Removed)})
+			},
+		},
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("same", "changed")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+	want := []diff{{"changed", []string{"d"}, []string{"b", "e"}}}
+	if err := testutil.DeepEqual(want, diffs); err != nil {
+		t.Errorf("Diffs: %v", err)
+	}
+	if written != 0 {
+		t.Errorf("Got %d outputs written, want 0", written)
+	}
+	if stats.GoldenDiffs != 1 || stats.Outputs != 6 || stats.Succeeded != 2 {
+		t.Errorf("Stats: got %d diffs, %d outputs, and %d succeeded; want 1, 6, and 2",
+			stats.GoldenDiffs, stats.Outputs, stats.Succeeded)
+	}
+}
+
+func TestDriverGoldenError(t *testing.T) {
+	errNoGolden := errors.New("no golden outputs")
+	d := &Driver{
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error { return nil }),
+		Golden: &GoldenCompare{
+			Expected: func(context.Context, string) ([]*apb.AnalysisOutput, error) { return nil, errNoGolden },
+			Report:   func(context.Context, GoldenDiff) { t.Error("Unexpected call to Report") },
+		},
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a")}); !errors.Is(err, errNoGolden) {
+		t.Errorf("Run: got error %v, want %v", err, errNoGolden)
+	}
+}
+
+// values returns the values of outs as sorted strings.
+func values(outs []*apb.AnalysisOutput) []string {
+	var vs []string
+	for _, o := range outs {
+		vs = append(vs, string(o.Value))
+	}
+	sort.Strings(vs)
+	return vs
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// RunGroup behaves as Run, but runs the driver's workers as the goroutines of
+// an errgroup.Group, for callers who prefer the errgroup contract to reasoning
+// about the driver's own worker pool.  Max(d.Concurrency, 1) workers pull
+// compilations from queue; the first to return an error cancels the context
+// shared by the group, and RunGroup returns that error once every worker has
+// returned.  Compilations in flight on the other workers see their contexts
+// canceled, as they do with Run, and AbortedBy reports the error that caused
+// it.
+//
+// Which errors end the group is unchanged: if d.ContinueOnError is true,
+// compilations that fail are recorded and reported in a MultiError once the
+// queue is exhausted, and only errors of the queue end the group early.  A
+// panic in a worker ends the group, and is propagated from RunGroup once the
+// other workers have returned.
+func (d *Driver) RunGroup(ctx context.Context, queue Queue) error {
+	_, err := d.runWith(ctx, queue, (*runner).runGroup)
+	return err
+}
+
+// errPanicked is returned by a worker of a group that panicked.
+var errPanicked = errors.New("driver: worker panicked")
+
+// runGroup pulls compilations from the queue using the workers of an
+// errgroup.Group.
+func (r *runner) runGroup(ctx context.Context) error {
+	defer r.prefetch(ctx)()
+	g, gctx := errgroup.WithContext(ctx)
+	abort := new(abortState)
+	wctx := context.WithValue(gctx, abortKey{}, abort)
+
+	var (
+		once     sync.Once
+		mu       sync.Mutex
+		panicked interface{} // the first value recovered from a worker panic
+	)
+	workers := r.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		g.Go(func() (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					mu.Lock()
+					if panicked == nil {
+						panicked = v
+					}
+					mu.Unlock()
+					err = errPanicked
+				}
+			}()
+			err = r.work(wctx)
+			if err != nil && err != wctx.Err() {
+				once.Do(func() { abort.set(err) })
+			}
+			return err
+		})
+	}
+	err := g.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+	return err
+}
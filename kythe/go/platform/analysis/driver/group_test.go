@@ -0,0 +1,111 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestRunGroup(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		analyzed []string
+	)
+	d := &Driver{
+		Concurrency: 3,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			mu.Lock()
+			defer mu.Unlock()
+			analyzed = append(analyzed, req.Compilation.VName.Signature)
+			return nil
+		}),
+	}
+	testutil.FatalOnErrT(t, "RunGroup error: %v", d.RunGroup(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d", "e")}))
+	sort.Strings(analyzed)
+	if err := testutil.DeepEqual([]string{"a", "b", "c", "d", "e"}, analyzed); err != nil {
+		t.Errorf("Analyzed: %v", err)
+	}
+}
+
+func TestRunGroupFirstError(t *testing.T) {
+	started := make(chan struct{}, 2)
+	aborted := make(chan error, 2)
+	d := &Driver{
+		Concurrency: 3,
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			if req.Compilation.VName.Signature == "bad" {
+				<-started
+				<-started
+				return errFromAnalysis
+			}
+			started <- struct{}{}
+			select {
+			case <-ctx.Done():
+				aborted <- AbortedBy(ctx)
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return errors.New("not canceled")
+			}
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	err := d.RunGroup(context.Background(), &syncQueue{comps: comps("bad", "slow1", "slow2")})
+	var cerr *CompilationError
+	if !errors.As(err, &cerr) || cerr.Unit.VName.Signature != "bad" || !errors.Is(err, errFromAnalysis) {
+		t.Fatalf("RunGroup: got error %v, want the failure of bad", err)
+	}
+	// Both other workers have settled before RunGroup returned.
+	for i := 0; i < 2; i++ {
+		select {
+		case aerr := <-aborted:
+			if !errors.Is(aerr, errFromAnalysis) {
+				t.Errorf("AbortedBy: got %v, want the failure of bad", aerr)
+			}
+		default:
+			t.Fatal("RunGroup returned before the canceled compilations finished")
+		}
+	}
+}
+
+func TestRunGroupPanic(t *testing.T) {
+	d := &Driver{
+		Concurrency: 2,
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			panic("analyzer exploded")
+		}),
+	}
+	defer func() {
+		perr, ok := recover().(*PanicError)
+		if !ok || perr.Value != "analyzer exploded" {
+			t.Errorf("Got panic %v, want the analyzer's panic", perr)
+		}
+	}()
+	d.RunGroup(context.Background(), &syncQueue{comps: comps("a", "b")})
+	t.Error("RunGroup did not propagate the panic")
+}
@@ -0,0 +1,358 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package grpcout provides an analysis.OutputFunc that forwards the outputs of
+// a Driver's compilations to a remote collector over a client-streaming gRPC
+// method.
+package grpcout // import "kythe.io/kythe/go/platform/analysis/driver/grpcout"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"kythe.io/kythe/go/platform/analysis/driver"
+	"kythe.io/kythe/go/platform/analysis/driver/internal/grpcretry"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// DefaultRetry is the retry policy used by a Writer whose Options do not
+// specify one.
+var DefaultRetry = &driver.RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	Retryable:   Transient,
+}
+
+// Transient reports whether err is a gRPC error that may not recur on a new
+// stream: one with code Unavailable, Aborted, or ResourceExhausted.
+func Transient(err error) bool { return grpcretry.Transient(err) }
+
+// Options control the behavior of a Writer.  A nil *Options provides default
+// values.
+type Options struct {
+	// Retry determines which stream failures are retried, and how often.  A
+	// failed stream is replaced by a new one, on which every output of the
+	// compilation sent so far is sent again.  If nil, DefaultRetry is used.
+	Retry *driver.RetryPolicy
+
+	// CallOptions are passed to each call that opens a stream.
+	CallOptions []grpc.CallOption
+}
+
+// A StreamError reports that the stream for a compilation failed, and was not
+// or could no longer be retried.
+type StreamError struct {
+	Method   string
+	Attempts int   // the number of streams opened
+	Err      error // the error that ended the last stream
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("grpcout: stream to %s failed after %d attempts: %v", e.Method, e.Attempts, e.Err)
+}
+
+// Unwrap returns the underlying error, for use with errors.Is and errors.As.
+func (e *StreamError) Unwrap() error { return e.Err }
+
+// ErrAfterTeardown is reported by Write for an output of a compilation whose
+// Teardown has already closed its stream.
+var ErrAfterTeardown = errors.New("grpcout: output written after teardown")
+
+// errEarlyReply is reported when a collector ends a stream successfully
+// before the client has finished sending.
+var errEarlyReply = status.Error(codes.Aborted, "collector replied before the stream was closed")
+
+// A Writer sends outputs to a collector over a client-streaming gRPC method
+// that accepts kythe.proto.AnalysisOutput messages.  Each compilation has its
+// own stream, opened when the compilation writes its first output and closed
+// by Teardown, which waits for the collector's reply; the reply itself is
+// discarded.  A collector should commit the outputs of a stream only once the
+// client has closed it, since a stream that fails is replaced by a new one on
+// which the outputs already sent are sent again.
+//
+// Sending blocks while the stream's flow control window is full, so a
+// collector that falls behind slows the analyzers writing to it, and a Write
+// blocked this way returns early if its context ends.  A copy of each output
+// of a compilation is retained in memory until its stream is closed, so that
+// it can be replayed on a new stream; a compilation's stream thus costs memory
+// in proportion to the total size of its outputs.
+//
+// Compilations are told apart by their request IDs (see
+// driver.RequestIDFromContext); outputs written with a context that does not
+// belong to a compilation share a stream that is closed by Close.  If a
+// stream cannot be recovered, Write and Teardown report a *StreamError, which
+// fails the compilation.
+//
+// A Writer cannot serve a Driver whose OrderedOutput is true, since such a
+// driver writes the outputs of a compilation after its Teardown: Write
+// reports ErrAfterTeardown for an output of a compilation already torn down.
+type Writer struct {
+	ctx    context.Context
+	conn   grpc.ClientConnInterface
+	method string
+	retry  *driver.RetryPolicy
+	copts  []grpc.CallOption
+
+	mu      sync.Mutex
+	streams map[string]*stream         // by request ID
+	torn    map[string]context.Context // compilations torn down, by request ID
+	prune   int                        // the size of torn at which to prune it
+}
+
+// New returns a Writer that opens streams to the given method, of the form
+// "/package.Service/Method", on conn.  Streams are opened with ctx, which must
+// outlive every compilation whose outputs pass through the Writer.
+func New(ctx context.Context, conn grpc.ClientConnInterface, method string, opts *Options) *Writer {
+	w := &Writer{
+		ctx:     ctx,
+		conn:    conn,
+		method:  method,
+		retry:   DefaultRetry,
+		streams: make(map[string]*stream),
+		torn:    make(map[string]context.Context),
+		prune:   minPrune,
+	}
+	if opts != nil {
+		if opts.Retry != nil {
+			w.retry = opts.Retry
+		}
+		w.copts = opts.CallOptions
+	}
+	return w
+}
+
+var streamDesc = &grpc.StreamDesc{ClientStreams: true}
+
+// A stream carries the outputs of a single compilation.  Its fields, and the
+// Writer methods that take it, require mu to be held.
+type stream struct {
+	mu       sync.Mutex
+	sent     []*apb.AnalysisOutput // outputs accepted, replayed on a new stream
+	cs       grpc.ClientStream     // nil if no stream is open
+	cancel   context.CancelFunc    // cancels cs
+	attempts int                   // the number of streams opened
+	err      error                 // set once the stream has failed for good
+}
+
+// Write implements the analysis.OutputFunc interface, sending out on the
+// stream of the compilation to which ctx belongs.
+func (w *Writer) Write(ctx context.Context, out *apb.AnalysisOutput) error {
+	id := driver.RequestIDFromContext(ctx)
+	if id != "" && (driver.CompilationFromContext(ctx) == nil || w.tornDown(id)) {
+		return ErrAfterTeardown
+	}
+	s := w.stream(id, true)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	// The analyzer may reuse out once Write returns, so keep a copy.
+	s.sent = append(s.sent, proto.Clone(out).(*apb.AnalysisOutput))
+	return w.deliver(ctx, s, len(s.sent)-1, false)
+}
+
+// Teardown closes the stream of the compilation to which ctx belongs, if it
+// has one, and waits for the collector's reply.  It has the signature of a
+// Teardown function, for use with driver.WithTeardown or from the Teardown
+// method of a driver.Context.
+func (w *Writer) Teardown(ctx context.Context, _ driver.Compilation) error {
+	id := driver.RequestIDFromContext(ctx)
+	if id != "" {
+		w.markTornDown(ctx, id)
+	}
+	return w.flush(ctx, id)
+}
+
+// minPrune is the smallest size at which the set of compilations torn down is
+// pruned.
+const minPrune = 64
+
+// markTornDown records that the compilation with the given request ID, to
+// which ctx belongs, has been torn down.  The record is kept only while the
+// driver has yet to finish the compilation, after which CompilationFromContext
+// recognizes a late output on its own.
+func (w *Writer) markTornDown(ctx context.Context, id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.torn[id] = ctx
+	if len(w.torn) < w.prune {
+		return
+	}
+	for id, ctx := range w.torn {
+		if driver.CompilationFromContext(ctx) == nil {
+			delete(w.torn, id)
+		}
+	}
+	if w.prune = 2 * len(w.torn); w.prune < minPrune {
+		w.prune = minPrune
+	}
+}
+
+// tornDown reports whether the compilation with the given request ID is
+// recorded as torn down.
+func (w *Writer) tornDown(id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.torn[id]
+	return ok
+}
+
+// Close closes the streams that remain open, including the one shared by
+// outputs written outside any compilation, and reports the first error.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	var ids []string
+	for id := range w.streams {
+		ids = append(ids, id)
+	}
+	w.mu.Unlock()
+	var first error
+	for _, id := range ids {
+		if err := w.flush(w.ctx, id); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// stream returns the stream for the given request ID, creating it if create
+// is true.  It returns nil if there is no such stream.
+func (w *Writer) stream(id string, create bool) *stream {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.streams[id]
+	if s == nil && create {
+		s = new(stream)
+		w.streams[id] = s
+	}
+	return s
+}
+
+// flush closes the stream for the given request ID and forgets it.
+func (w *Writer) flush(ctx context.Context, id string) error {
+	w.mu.Lock()
+	s := w.streams[id]
+	delete(w.streams, id)
+	w.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.close()
+	if s.err != nil {
+		return s.err
+	}
+	return w.deliver(ctx, s, len(s.sent), true)
+}
+
+// deliver sends the outputs of s from index next onward on its stream,
+// opening a new stream if necessary, and if finish is true closes the stream
+// and waits for the reply.  If the stream fails with a retryable error, it is
+// replaced by a new one on which all the outputs of s are sent again.
+func (w *Writer) deliver(ctx context.Context, s *stream, next int, finish bool) error {
+	for {
+		var err error
+		if s.cs == nil {
+			if err = w.open(s); err == nil {
+				next = 0
+			}
+		}
+		if err == nil {
+			if err = w.send(ctx, s, next, finish); err == nil {
+				return nil
+			}
+		}
+		s.close()
+		if cerr := ctx.Err(); cerr != nil {
+			s.err = cerr
+			return cerr
+		}
+		if !grpcretry.Retryable(w.retry, s.attempts, err) {
+			s.err = &StreamError{Method: w.method, Attempts: s.attempts, Err: err}
+			return s.err
+		}
+		if err := w.retry.Wait(ctx, s.attempts); err != nil {
+			s.err = err
+			return err
+		}
+	}
+}
+
+// open opens a new stream for s.
+func (w *Writer) open(s *stream) error {
+	sctx, cancel := context.WithCancel(w.ctx)
+	s.attempts++
+	cs, err := w.conn.NewStream(sctx, streamDesc, w.method, w.copts...)
+	if err != nil {
+		cancel()
+		return err
+	}
+	s.cs, s.cancel = cs, cancel
+	return nil
+}
+
+// send sends the outputs of s from index next onward on its open stream, and
+// if finish is true closes the stream and waits for the reply.  The stream is
+// canceled if ctx ends first.
+func (w *Writer) send(ctx context.Context, s *stream, next int, finish bool) error {
+	defer grpcretry.Watch(ctx, s.cancel)()
+	for _, out := range s.sent[next:] {
+		if err := s.cs.SendMsg(out); err == io.EOF {
+			// The stream has ended; its status is reported by RecvMsg.
+			return replyError(s.cs.RecvMsg(new(empty.Empty)))
+		} else if err != nil {
+			return err
+		}
+	}
+	if !finish {
+		return nil
+	}
+	if err := s.cs.CloseSend(); err != nil {
+		return err
+	}
+	return s.cs.RecvMsg(new(empty.Empty))
+}
+
+// replyError returns the error to report for a stream that ended while its
+// client was sending, given the result of receiving its reply.
+func replyError(err error) error {
+	if err == nil {
+		return errEarlyReply
+	}
+	return err
+}
+
+// close cancels the open stream of s, if any.
+func (s *stream) close() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.cs, s.cancel = nil, nil
+}
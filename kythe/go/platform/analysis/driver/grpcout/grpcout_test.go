@@ -0,0 +1,294 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/platform/analysis/driver"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+const method = "/test.Collector/Write"
+
+// A collector is a client-streaming service that commits the values of the
+// outputs of each stream once the client closes it.
+type collector struct {
+	// If fail != nil, it is called after the nth message of each stream, with
+	// streams numbered from 1; if it returns an error, the stream fails.
+	fail func(stream, n int) error
+
+	mu        sync.Mutex
+	streams   int
+	committed [][]string
+}
+
+func (c *collector) write(_ interface{}, ss grpc.ServerStream) error {
+	c.mu.Lock()
+	c.streams++
+	id := c.streams
+	c.mu.Unlock()
+	var got []string
+	for {
+		var out apb.AnalysisOutput
+		if err := ss.RecvMsg(&out); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		got = append(got, string(out.Value))
+		if c.fail != nil {
+			if err := c.fail(id, len(got)); err != nil {
+				return err
+			}
+		}
+	}
+	c.mu.Lock()
+	c.committed = append(c.committed, got)
+	c.mu.Unlock()
+	return ss.SendMsg(&empty.Empty{})
+}
+
+// serve starts c on an in-memory listener, and returns a connection to it and
+// a function that stops the server.
+func serve(t *testing.T, c *collector) (*grpc.ClientConn, func()) {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Collector",
+		HandlerType: (*interface{})(nil),
+		Streams:     []grpc.StreamDesc{{StreamName: "Write", Handler: c.write, ClientStreams: true}},
+	}, c)
+	go srv.Serve(lis)
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure())
+	testutil.FatalOnErrT(t, "Dial: %v", err)
+	return conn, func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+// emitter is an analyzer that writes n outputs for each compilation, and
+// fails if writing any of them fails.
+type emitter int
+
+func (n emitter) Analyze(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+	for i := 0; i < int(n); i++ {
+		if err := out(ctx, &apb.AnalysisOutput{Value: []byte(fmt.Sprintf("%s%d", req.Compilation.VName.Signature, i))}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func run(t *testing.T, w *Writer, sigs ...string) error {
+	t.Helper()
+	var units []*apb.CompilationUnit
+	for _, sig := range sigs {
+		units = append(units, &apb.CompilationUnit{VName: &spb.VName{Signature: sig}})
+	}
+	d, err := driver.New(emitter(3), driver.SliceQueue(units),
+		driver.WithConcurrency(2), driver.WithOutput(w.Write), driver.WithTeardown(w.Teardown))
+	testutil.FatalOnErrT(t, "New: %v", err)
+	return d.Run(context.Background(), nil)
+}
+
+func sorted(batches [][]string) [][]string {
+	sort.Slice(batches, func(i, j int) bool { return batches[i][0] < batches[j][0] })
+	return batches
+}
+
+func TestWriter(t *testing.T) {
+	c := new(collector)
+	conn, stop := serve(t, c)
+	defer stop()
+	w := New(context.Background(), conn, method, nil)
+	testutil.FatalOnErrT(t, "Run: %v", run(t, w, "a", "b", "c"))
+	want := [][]string{{"a0", "a1", "a2"}, {"b0", "b1", "b2"}, {"c0", "c1", "c2"}}
+	if err := testutil.DeepEqual(want, sorted(c.committed)); err != nil {
+		t.Errorf("Committed outputs: %v", err)
+	}
+	if c.streams != 3 {
+		t.Errorf("Opened %d streams, want 3", c.streams)
+	}
+}
+
+func TestWriterRetry(t *testing.T) {
+	c := &collector{fail: func(stream, n int) error {
+		if stream == 1 && n == 2 {
+			return status.Error(codes.Unavailable, "collector restarting")
+		}
+		return nil
+	}}
+	conn, stop := serve(t, c)
+	defer stop()
+	w := New(context.Background(), conn, method, &Options{
+		Retry: &driver.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, Retryable: Transient},
+	})
+	testutil.FatalOnErrT(t, "Run: %v", run(t, w, "a"))
+	if err := testutil.DeepEqual([][]string{{"a0", "a1", "a2"}}, c.committed); err != nil {
+		t.Errorf("Committed outputs: %v", err)
+	}
+	if c.streams != 2 {
+		t.Errorf("Opened %d streams, want 2", c.streams)
+	}
+}
+
+func TestWriterBroken(t *testing.T) {
+	c := &collector{fail: func(stream, n int) error {
+		return status.Error(codes.InvalidArgument, "bad output")
+	}}
+	conn, stop := serve(t, c)
+	defer stop()
+	w := New(context.Background(), conn, method, nil)
+	err := run(t, w, "a")
+	var serr *StreamError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Run: got error %v, want a *StreamError", err)
+	}
+	if serr.Attempts != 1 || status.Code(serr.Err) != codes.InvalidArgument {
+		t.Errorf("Run: got %+v, want one attempt failing with InvalidArgument", serr)
+	}
+	if len(c.committed) != 0 {
+		t.Errorf("Committed outputs from a broken stream: %q", c.committed)
+	}
+}
+
+func TestWriterClose(t *testing.T) {
+	c := new(collector)
+	conn, stop := serve(t, c)
+	defer stop()
+	w := New(context.Background(), conn, method, nil)
+	for _, v := range []string{"x", "y"} {
+		testutil.FatalOnErrT(t, "Write: %v", w.Write(context.Background(), &apb.AnalysisOutput{Value: []byte(v)}))
+	}
+	if len(c.committed) != 0 {
+		t.Errorf("Outputs committed before Close: %q", c.committed)
+	}
+	testutil.FatalOnErrT(t, "Close: %v", w.Close())
+	if err := testutil.DeepEqual([][]string{{"x", "y"}}, c.committed); err != nil {
+		t.Errorf("Committed outputs: %v", err)
+	}
+}
+
+// A reuser is an analyzer that writes n outputs for each compilation, reusing
+// a single AnalysisOutput for all of them.
+type reuser int
+
+func (n reuser) Analyze(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+	o := new(apb.AnalysisOutput)
+	for i := 0; i < int(n); i++ {
+		o.Value = []byte(fmt.Sprintf("%s%d", req.Compilation.VName.Signature, i))
+		if err := out(ctx, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestWriterRetryReusedOutputs(t *testing.T) {
+	c := &collector{fail: func(stream, n int) error {
+		if stream == 1 && n == 3 {
+			return status.Error(codes.Unavailable, "collector restarting")
+		}
+		return nil
+	}}
+	conn, stop := serve(t, c)
+	defer stop()
+	w := New(context.Background(), conn, method, &Options{
+		Retry: &driver.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, Retryable: Transient},
+	})
+	d, err := driver.New(reuser(3), driver.SliceQueue([]*apb.CompilationUnit{{VName: &spb.VName{Signature: "a"}}}),
+		driver.WithOutput(w.Write), driver.WithTeardown(w.Teardown))
+	testutil.FatalOnErrT(t, "New: %v", err)
+	testutil.FatalOnErrT(t, "Run: %v", d.Run(context.Background(), nil))
+	if err := testutil.DeepEqual([][]string{{"a0", "a1", "a2"}}, c.committed); err != nil {
+		t.Errorf("Committed outputs: %v", err)
+	}
+}
+
+// A flakyConn is a connection whose first call to NewStream fails with
+// Unavailable.
+type flakyConn struct {
+	grpc.ClientConnInterface
+
+	mu     sync.Mutex
+	failed bool
+}
+
+func (f *flakyConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	f.mu.Lock()
+	fail := !f.failed
+	f.failed = true
+	f.mu.Unlock()
+	if fail {
+		return nil, status.Error(codes.Unavailable, "connecting")
+	}
+	return f.ClientConnInterface.NewStream(ctx, desc, method, opts...)
+}
+
+func TestWriterRetryOpen(t *testing.T) {
+	c := new(collector)
+	conn, stop := serve(t, c)
+	defer stop()
+	w := New(context.Background(), &flakyConn{ClientConnInterface: conn}, method, &Options{
+		Retry: &driver.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, Retryable: Transient},
+	})
+	testutil.FatalOnErrT(t, "Run: %v", run(t, w, "a"))
+	if err := testutil.DeepEqual([][]string{{"a0", "a1", "a2"}}, c.committed); err != nil {
+		t.Errorf("Committed outputs: %v", err)
+	}
+}
+
+func TestWriterAfterTeardown(t *testing.T) {
+	c := new(collector)
+	conn, stop := serve(t, c)
+	defer stop()
+	w := New(context.Background(), conn, method, nil)
+	d, err := driver.New(emitter(1), driver.SliceQueue([]*apb.CompilationUnit{{VName: &spb.VName{Signature: "a"}}}),
+		driver.WithOutput(w.Write), driver.WithTeardown(w.Teardown))
+	testutil.FatalOnErrT(t, "New: %v", err)
+	d.OrderedOutput = true // outputs are written after Teardown
+	if err := d.Run(context.Background(), nil); !errors.Is(err, ErrAfterTeardown) {
+		t.Errorf("Run: got error %v, want %v", err, ErrAfterTeardown)
+	}
+	testutil.FatalOnErrT(t, "Close: %v", w.Close())
+	if c.streams != 0 {
+		t.Errorf("Opened %d streams, want 0", c.streams)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package grpcqueue provides a driver.Queue that reads compilations from a
+// remote service over a server-streaming gRPC method.
+//
+// The service is expected to deliver its compilations in a fixed order, in
+// which each has a position counting from 0.  The client opens a stream by
+// sending a google.protobuf.UInt64Value holding the position from which to
+// resume, and the service replies with kythe.proto.AnalysisRequest messages
+// for the compilations from that position onward, ending the stream
+// successfully once it has no more.  If the service has an acknowledgement
+// method, the client calls it with a google.protobuf.UInt64Value holding the
+// position of each compilation it has finished, and expects a
+// google.protobuf.Empty in reply.
+package grpcqueue // import "kythe.io/kythe/go/platform/analysis/driver/grpcqueue"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc"
+
+	"kythe.io/kythe/go/platform/analysis/driver"
+	"kythe.io/kythe/go/platform/analysis/driver/internal/grpcretry"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// DefaultRetry is the retry policy used by a Queue whose Options do not
+// specify one.
+var DefaultRetry = &driver.RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	Retryable:   grpcretry.Transient,
+}
+
+// Options control the behavior of a Queue.  A nil *Options provides default
+// values.
+type Options struct {
+	// AckMethod is the method, of the form "/package.Service/Method", called
+	// to acknowledge each compilation.  If "", compilations are not
+	// acknowledged to the service, although a stream that is reopened still
+	// resumes after the compilations finished so far.
+	AckMethod string
+
+	// Retry determines which failures of a stream or an acknowledgement are
+	// retried, and how often.  A stream's attempts are counted from the last
+	// compilation it delivered.  If nil, DefaultRetry is used.
+	Retry *driver.RetryPolicy
+
+	// CallOptions are passed to each call the Queue makes.
+	CallOptions []grpc.CallOption
+}
+
+// A StreamError reports that a call to the service failed, and was not or
+// could no longer be retried.
+type StreamError struct {
+	Method   string
+	Attempts int   // the number of calls made
+	Err      error // the error that ended the last call
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("grpcqueue: call to %s failed after %d attempts: %v", e.Method, e.Attempts, e.Err)
+}
+
+// Unwrap returns the underlying error, for use with errors.Is and errors.As.
+func (e *StreamError) Unwrap() error { return e.Err }
+
+// A Queue is a driver.Queue that reads compilations from a server-streaming
+// gRPC method, as described in the package documentation.  It may be used by
+// a Driver with several workers.
+//
+// Delivery is at least once.  A compilation is acknowledged once the
+// CompilationFunc to which Next passes it returns nil; one for which it
+// reports an error is not acknowledged.  If a stream fails with a retryable
+// error, or the context passed to Next ends while it waits for a compilation,
+// the stream is abandoned and a new one is opened when it is next needed,
+// resuming from the first compilation not yet acknowledged.  Compilations the
+// Queue has already delivered, and which are acknowledged or still in
+// progress, are not delivered again; the others are.
+//
+// Once the service ends a stream successfully, Next reports
+// driver.ErrEndOfQueue.  If a stream cannot be recovered, Next reports a
+// *StreamError, as it does if a compilation cannot be acknowledged.
+type Queue struct {
+	ctx    context.Context
+	conn   grpc.ClientConnInterface
+	method string
+	ack    string
+	retry  *driver.RetryPolicy
+	copts  []grpc.CallOption
+
+	recv     sync.Mutex         // held while reading from the stream
+	cs       grpc.ClientStream  // nil if no stream is open
+	cancel   context.CancelFunc // cancels cs
+	next     uint64             // the position of the next compilation on cs
+	attempts int                // streams opened since a compilation was received
+	err      error              // set once the stream has ended for good
+
+	mu    sync.Mutex
+	base  uint64          // every compilation before base is acknowledged
+	acked map[uint64]bool // compilations after base that are acknowledged
+	busy  map[uint64]bool // compilations delivered and not yet finished
+}
+
+// New returns a Queue that opens streams to the given method, of the form
+// "/package.Service/Method", on conn.  Streams are opened with ctx, which must
+// outlive every call to Next.
+func New(ctx context.Context, conn grpc.ClientConnInterface, method string, opts *Options) *Queue {
+	q := &Queue{
+		ctx:    ctx,
+		conn:   conn,
+		method: method,
+		retry:  DefaultRetry,
+		acked:  make(map[uint64]bool),
+		busy:   make(map[uint64]bool),
+	}
+	if opts != nil {
+		if opts.Retry != nil {
+			q.retry = opts.Retry
+		}
+		q.ack = opts.AckMethod
+		q.copts = opts.CallOptions
+	}
+	return q
+}
+
+var streamDesc = &grpc.StreamDesc{ServerStreams: true}
+
+// Next implements the driver.Queue interface.
+func (q *Queue) Next(ctx context.Context, f driver.CompilationFunc) error {
+	pos, req, err := q.receive(ctx)
+	if err != nil {
+		return err
+	}
+	if err := f(ctx, driver.Compilation{
+		Unit:     req.Compilation,
+		Revision: req.Revision,
+		BuildID:  req.BuildId,
+	}); err != nil {
+		q.release(pos)
+		return err
+	}
+	return q.acknowledge(ctx, pos)
+}
+
+// Close abandons the open stream, if any.  Next must not be called after
+// Close.
+func (q *Queue) Close() error {
+	q.recv.Lock()
+	defer q.recv.Unlock()
+	q.close()
+	return nil
+}
+
+// receive returns the next compilation to deliver and its position, opening a
+// new stream if necessary.
+func (q *Queue) receive(ctx context.Context) (uint64, *apb.AnalysisRequest, error) {
+	q.recv.Lock()
+	defer q.recv.Unlock()
+	for q.err == nil {
+		req := new(apb.AnalysisRequest)
+		err := q.open()
+		if err == nil {
+			err = q.read(ctx, req)
+		}
+		if err == nil {
+			pos := q.next
+			q.next++
+			q.attempts = 0
+			if q.claim(pos) {
+				return pos, req, nil
+			}
+			continue // delivered before the stream was reopened
+		}
+		q.close()
+		if err == io.EOF {
+			q.err = driver.ErrEndOfQueue
+		} else if cerr := ctx.Err(); cerr != nil {
+			return 0, nil, cerr // a later call may resume
+		} else if !grpcretry.Retryable(q.retry, q.attempts, err) {
+			q.err = &StreamError{Method: q.method, Attempts: q.attempts, Err: err}
+		} else if err := q.retry.Wait(ctx, q.attempts); err != nil {
+			return 0, nil, err
+		}
+	}
+	return 0, nil, q.err
+}
+
+// open opens a new stream if none is open, resuming from the first
+// compilation not yet acknowledged.
+func (q *Queue) open() error {
+	if q.cs != nil {
+		return nil
+	}
+	q.mu.Lock()
+	from := q.base
+	q.mu.Unlock()
+
+	sctx, cancel := context.WithCancel(q.ctx)
+	q.attempts++
+	cs, err := q.conn.NewStream(sctx, streamDesc, q.method, q.copts...)
+	if err == nil {
+		err = cs.SendMsg(&wrappers.UInt64Value{Value: from})
+	}
+	if err == nil {
+		err = cs.CloseSend()
+	}
+	if err != nil {
+		cancel()
+		return err
+	}
+	q.cs, q.cancel, q.next = cs, cancel, from
+	return nil
+}
+
+// read receives the next message from the open stream into req.  The stream
+// is canceled if ctx ends first.
+func (q *Queue) read(ctx context.Context, req *apb.AnalysisRequest) error {
+	defer grpcretry.Watch(ctx, q.cancel)()
+	return q.cs.RecvMsg(req)
+}
+
+// close cancels the open stream, if any.
+func (q *Queue) close() {
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.cs, q.cancel = nil, nil
+}
+
+// claim marks the compilation at pos as in progress, and reports whether it
+// should be delivered: that is, whether it is neither acknowledged nor
+// already in progress.
+func (q *Queue) claim(pos uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if pos < q.base || q.acked[pos] || q.busy[pos] {
+		return false
+	}
+	q.busy[pos] = true
+	return true
+}
+
+// release marks the compilation at pos as no longer in progress, without
+// acknowledging it.
+func (q *Queue) release(pos uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.busy, pos)
+}
+
+// acknowledge acknowledges the compilation at pos to the service, if it has
+// an acknowledgement method, and records it as finished.
+func (q *Queue) acknowledge(ctx context.Context, pos uint64) error {
+	if q.ack != "" {
+		for attempts := 1; ; attempts++ {
+			err := q.conn.Invoke(ctx, q.ack, &wrappers.UInt64Value{Value: pos}, new(empty.Empty), q.copts...)
+			if err == nil {
+				break
+			} else if cerr := ctx.Err(); cerr != nil {
+				q.release(pos)
+				return cerr
+			} else if !grpcretry.Retryable(q.retry, attempts, err) {
+				q.release(pos)
+				return &StreamError{Method: q.ack, Attempts: attempts, Err: err}
+			} else if err := q.retry.Wait(ctx, attempts); err != nil {
+				q.release(pos)
+				return err
+			}
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.busy, pos)
+	q.acked[pos] = true
+	for q.acked[q.base] {
+		delete(q.acked, q.base)
+		q.base++
+	}
+	return nil
+}
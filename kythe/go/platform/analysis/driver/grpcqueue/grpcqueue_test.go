@@ -0,0 +1,250 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/platform/analysis/driver"
+	"kythe.io/kythe/go/platform/analysis/driver/grpcout"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+const (
+	method    = "/test.Source/Stream"
+	ackMethod = "/test.Source/Ack"
+)
+
+// A source is a server-streaming service that delivers a compilation for each
+// of its signatures, and records the acknowledgements it receives.
+type source struct {
+	sigs []string
+
+	// If fail != nil, it is called before each message of each stream is
+	// sent, with streams numbered from 1; if it returns an error, the stream
+	// fails.
+	fail func(stream int, pos uint64) error
+
+	mu    sync.Mutex
+	froms []uint64 // the position from which each stream resumed
+	acked []uint64
+}
+
+func (s *source) stream(_ interface{}, ss grpc.ServerStream) error {
+	var from wrappers.UInt64Value
+	if err := ss.RecvMsg(&from); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.froms = append(s.froms, from.Value)
+	id := len(s.froms)
+	s.mu.Unlock()
+	for pos := from.Value; pos < uint64(len(s.sigs)); pos++ {
+		if s.fail != nil {
+			if err := s.fail(id, pos); err != nil {
+				return err
+			}
+		}
+		req := &apb.AnalysisRequest{
+			Compilation: &apb.CompilationUnit{VName: &spb.VName{Signature: s.sigs[pos]}},
+			Revision:    fmt.Sprint(pos),
+		}
+		if err := ss.SendMsg(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *source) ack(_ interface{}, _ context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	var pos wrappers.UInt64Value
+	if err := dec(&pos); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acked = append(s.acked, pos.Value)
+	return &empty.Empty{}, nil
+}
+
+// serve starts s on an in-memory listener, and returns a connection to it and
+// a function that stops the server.
+func serve(t *testing.T, s *source) (*grpc.ClientConn, func()) {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Source",
+		HandlerType: (*interface{})(nil),
+		Methods:     []grpc.MethodDesc{{MethodName: "Ack", Handler: s.ack}},
+		Streams:     []grpc.StreamDesc{{StreamName: "Stream", Handler: s.stream, ServerStreams: true}},
+	}, s)
+	go srv.Serve(lis)
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure())
+	testutil.FatalOnErrT(t, "Dial: %v", err)
+	return conn, func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+// run analyzes the compilations of q with the given number of workers, and
+// returns the signatures analyzed, in sorted order.
+func run(t *testing.T, q *Queue, workers int) ([]string, error) {
+	t.Helper()
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	d, err := driver.New(analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, req.Compilation.VName.Signature)
+		return nil
+	}), q, driver.WithConcurrency(workers))
+	testutil.FatalOnErrT(t, "New: %v", err)
+	err = d.Run(context.Background(), nil)
+	sort.Strings(got)
+	return got, err
+}
+
+type analyzerFunc func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error
+
+func (f analyzerFunc) Analyze(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+	return f(ctx, req, out)
+}
+
+func sortedPositions(ps []uint64) []uint64 {
+	sort.Slice(ps, func(i, j int) bool { return ps[i] < ps[j] })
+	return ps
+}
+
+func TestQueue(t *testing.T) {
+	s := &source{sigs: []string{"a", "b", "c", "d"}}
+	conn, stop := serve(t, s)
+	defer stop()
+	q := New(context.Background(), conn, method, &Options{AckMethod: ackMethod})
+	defer q.Close()
+	got, err := run(t, q, 2)
+	testutil.FatalOnErrT(t, "Run: %v", err)
+	if err := testutil.DeepEqual(s.sigs, got); err != nil {
+		t.Errorf("Analyzed: %v", err)
+	}
+	if err := testutil.DeepEqual([]uint64{0, 1, 2, 3}, sortedPositions(s.acked)); err != nil {
+		t.Errorf("Acknowledged: %v", err)
+	}
+	if err := testutil.DeepEqual([]uint64{0}, s.froms); err != nil {
+		t.Errorf("Streams: %v", err)
+	}
+}
+
+func TestQueueResume(t *testing.T) {
+	s := &source{
+		sigs: []string{"a", "b", "c", "d"},
+		fail: func(stream int, pos uint64) error {
+			if stream == 1 && pos == 2 {
+				return status.Error(codes.Unavailable, "source restarting")
+			}
+			return nil
+		},
+	}
+	conn, stop := serve(t, s)
+	defer stop()
+	q := New(context.Background(), conn, method, &Options{
+		AckMethod: ackMethod,
+		Retry:     &driver.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, Retryable: grpcout.Transient},
+	})
+	defer q.Close()
+	got, err := run(t, q, 1)
+	testutil.FatalOnErrT(t, "Run: %v", err)
+	if err := testutil.DeepEqual(s.sigs, got); err != nil {
+		t.Errorf("Analyzed: %v", err)
+	}
+	// With a single worker, both compilations delivered by the first stream
+	// are acknowledged before it fails.
+	if err := testutil.DeepEqual([]uint64{0, 2}, s.froms); err != nil {
+		t.Errorf("Streams: %v", err)
+	}
+}
+
+func TestQueueBroken(t *testing.T) {
+	s := &source{
+		sigs: []string{"a"},
+		fail: func(int, uint64) error { return status.Error(codes.PermissionDenied, "go away") },
+	}
+	conn, stop := serve(t, s)
+	defer stop()
+	q := New(context.Background(), conn, method, nil)
+	defer q.Close()
+	_, err := run(t, q, 1)
+	var serr *StreamError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Run: got error %v, want a *StreamError", err)
+	}
+	if serr.Attempts != 1 || status.Code(serr.Err) != codes.PermissionDenied {
+		t.Errorf("Run: got %+v, want one attempt failing with PermissionDenied", serr)
+	}
+}
+
+func TestQueueUnacknowledged(t *testing.T) {
+	s := &source{sigs: []string{"a", "b"}}
+	conn, stop := serve(t, s)
+	defer stop()
+	q := New(context.Background(), conn, method, &Options{AckMethod: ackMethod})
+	defer q.Close()
+	ctx := context.Background()
+
+	errBad := errors.New("bad compilation")
+	if err := q.Next(ctx, func(context.Context, driver.Compilation) error { return errBad }); err != errBad {
+		t.Errorf("Next: got error %v, want %v", err, errBad)
+	}
+	var got []string
+	collect := func(_ context.Context, cu driver.Compilation) error {
+		got = append(got, cu.Unit.VName.Signature)
+		return nil
+	}
+	testutil.FatalOnErrT(t, "Next: %v", q.Next(ctx, collect))
+	if err := q.Next(ctx, collect); err != driver.ErrEndOfQueue {
+		t.Errorf("Next: got error %v, want %v", err, driver.ErrEndOfQueue)
+	}
+	if err := testutil.DeepEqual([]string{"b"}, got); err != nil {
+		t.Errorf("Delivered: %v", err)
+	}
+	if err := testutil.DeepEqual([]uint64{1}, s.acked); err != nil {
+		t.Errorf("Acknowledged: %v", err)
+	}
+}
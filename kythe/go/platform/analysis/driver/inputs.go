@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"sync"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A FetchTracker is an analysis.Fetcher that records the files fetched
+// through it, so that a Driver can report which required inputs of each
+// compilation its analyzer never read, and how many fetches and bytes each
+// compilation required.  To use it, pass the tracker to the
+// analyzer in place of the underlying fetcher, and set it as the TrackInputs
+// field of the Driver.
+//
+// Fetches carry no indication of the compilation they are made for, so each
+// fetch is credited to every compilation being analyzed at the time.  When
+// compilations are analyzed concurrently, an input may therefore be treated as
+// read by a compilation that did not read it, but an input that was read is
+// never reported as unread.  Likewise, the fetch counts of concurrent
+// compilations may overlap; the totals for a run count each fetch once.
+type FetchTracker struct {
+	Fetcher analysis.Fetcher
+
+	mu      sync.Mutex
+	active  map[*fetchSet]bool
+	fetches int   // total fetches
+	bytes   int64 // total bytes fetched
+}
+
+// NewFetchTracker returns a FetchTracker that delegates to f.
+func NewFetchTracker(f analysis.Fetcher) *FetchTracker { return &FetchTracker{Fetcher: f} }
+
+// Fetch implements the analysis.Fetcher interface.
+func (t *FetchTracker) Fetch(path, digest string) ([]byte, error) {
+	data, err := t.Fetcher.Fetch(path, digest)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fetches++
+	t.bytes += int64(len(data))
+	for s := range t.active {
+		s.add(path, digest, len(data))
+	}
+	return data, err
+}
+
+// totals returns the total number of fetches made through t, and the total
+// number of bytes they returned.  It returns zeroes for a nil tracker.
+func (t *FetchTracker) totals() (int, int64) {
+	if t == nil {
+		return 0, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.fetches, t.bytes
+}
+
+// begin starts recording fetches, until end is called on the result.  It is
+// safe to call on a nil tracker, in which case nothing is recorded.
+func (t *FetchTracker) begin() *fetchSet {
+	if t == nil {
+		return nil
+	}
+	s := &fetchSet{t: t, paths: make(map[string]bool), digests: make(map[string]bool)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active == nil {
+		t.active = make(map[*fetchSet]bool)
+	}
+	t.active[s] = true
+	return s
+}
+
+// A fetchSet records the paths and digests fetched while it is active.
+type fetchSet struct {
+	t       *FetchTracker
+	mu      sync.Mutex
+	paths   map[string]bool
+	digests map[string]bool
+	fetches int
+	bytes   int64
+}
+
+func (s *fetchSet) add(path, digest string, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches++
+	s.bytes += int64(size)
+	if digest != "" {
+		s.digests[digest] = true
+	} else if path != "" {
+		s.paths[path] = true
+	}
+}
+
+// end stops recording fetches to s.
+func (s *fetchSet) end() {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	delete(s.t.active, s)
+}
+
+// counts returns the number of fetches made while s was active, and the
+// number of bytes they returned.
+func (s *fetchSet) counts() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches, s.bytes
+}
+
+// unread returns the required inputs of unit that were not fetched while s
+// was active.  An input is considered fetched if its digest was requested, or
+// if its path was requested without a digest.
+func (s *fetchSet) unread(unit *apb.CompilationUnit) []*apb.CompilationUnit_FileInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unread []*apb.CompilationUnit_FileInput
+	for _, ri := range unit.GetRequiredInput() {
+		info := ri.GetInfo()
+		if !s.digests[info.GetDigest()] && !s.paths[info.GetPath()] {
+			unread = append(unread, ri)
+		}
+	}
+	return unread
+}
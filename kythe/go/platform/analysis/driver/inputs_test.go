@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+type fetcherFunc func(path, digest string) ([]byte, error)
+
+func (f fetcherFunc) Fetch(path, digest string) ([]byte, error) { return f(path, digest) }
+
+func TestFetchTracker(t *testing.T) {
+	tracker := NewFetchTracker(fetcherFunc(func(path, _ string) ([]byte, error) { return []byte(path), nil }))
+	unit := func(sig string) *apb.CompilationUnit {
+		u := validUnit(sig)
+		u.RequiredInput = []*apb.CompilationUnit_FileInput{
+			{Info: &apb.FileInfo{Path: "a.go", Digest: "da"}},
+			{Info: &apb.FileInfo{Path: "b.go", Digest: "db"}},
+			{Info: &apb.FileInfo{Path: "c.go", Digest: "dc"}},
+		}
+		return u
+	}
+
+	var unread []string
+	d := &Driver{
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			switch req.Compilation.VName.Signature {
+			case "some":
+				tracker.Fetch("a.go", "da")
+				tracker.Fetch("c.go", "") // by path alone
+			case "all":
+				for _, ri := range req.Compilation.RequiredInput {
+					tracker.Fetch(ri.Info.Path, ri.Info.Digest)
+				}
+			}
+			return nil
+		}),
+		TrackInputs: tracker,
+		UnreadInputs: func(_ context.Context, cu *apb.CompilationUnit, inputs []*apb.CompilationUnit_FileInput) {
+			for _, ri := range inputs {
+				unread = append(unread, cu.VName.Signature+":"+ri.Info.Path)
+			}
+		},
+	}
+	queue := SliceQueue([]*apb.CompilationUnit{unit("some"), unit("all"), unit("none")})
+	stats, err := d.RunWithStats(context.Background(), queue)
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+	want := []string{"some:b.go", "none:a.go", "none:b.go", "none:c.go"}
+	if err := testutil.DeepEqual(want, unread); err != nil {
+		t.Errorf("Unread inputs: %v", err)
+	}
+	if stats.UnreadInputs != len(want) {
+		t.Errorf("RunStats.UnreadInputs: got %d, want %d", stats.UnreadInputs, len(want))
+	}
+
+	// Fetches are passed through to the underlying fetcher.
+	if data, err := tracker.Fetch("a.go", "da"); err != nil || string(data) != "a.go" {
+		t.Errorf("Fetch: got (%q, %v), want (%q, nil)", data, err, "a.go")
+	}
+}
+
+func TestFetchTrackerCounts(t *testing.T) {
+	tracker := NewFetchTracker(fetcherFunc(func(path, _ string) ([]byte, error) { return []byte(path), nil }))
+	d := &Driver{
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			if req.Compilation.VName.Signature == "b" {
+				tracker.Fetch("one", "")
+				tracker.Fetch("three", "")
+			}
+			return nil
+		}),
+		TrackInputs: tracker,
+	}
+	type counts struct {
+		Fetches int
+		Bytes   int64
+	}
+	got := make(map[string]counts)
+	results := d.Results()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for res := range results {
+			got[res.Unit.VName.Signature] = counts{res.Fetches, res.FetchBytes}
+		}
+	}()
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	<-done
+
+	if err := testutil.DeepEqual(map[string]counts{"a": {0, 0}, "b": {2, 8}}, got); err != nil {
+		t.Errorf("Per-compilation fetches: %v", err)
+	}
+	if stats.Fetches != 2 || stats.FetchBytes != 8 {
+		t.Errorf("RunStats: got %d fetches of %d bytes, want 2 of 8", stats.Fetches, stats.FetchBytes)
+	}
+}
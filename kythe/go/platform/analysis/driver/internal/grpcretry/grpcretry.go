@@ -0,0 +1,65 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package grpcretry implements the retry logic shared by the gRPC clients of
+// the driver package.
+package grpcretry // import "kythe.io/kythe/go/platform/analysis/driver/internal/grpcretry"
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"kythe.io/kythe/go/platform/analysis/driver"
+)
+
+// Transient reports whether err is a gRPC error that may not recur on a new
+// stream: one with code Unavailable, Aborted, or ResourceExhausted.
+func Transient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// Retryable reports whether a call that failed with err after the given
+// number of attempts should be retried under p.
+func Retryable(p *driver.RetryPolicy, attempts int, err error) bool {
+	return p.Retryable != nil && attempts < p.MaxAttempts && p.Retryable(err)
+}
+
+// Watch calls cancel if ctx ends before the function it returns is called.
+// That function waits for the watch to end.
+func Watch(ctx context.Context, cancel func()) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcretry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"kythe.io/kythe/go/platform/analysis/driver"
+)
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{status.Error(codes.Unavailable, "gone"), true},
+		{status.Error(codes.Aborted, "aborted"), true},
+		{status.Error(codes.ResourceExhausted, "busy"), true},
+		{status.Error(codes.InvalidArgument, "bad"), false},
+		{errors.New("plain"), false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := Transient(test.err); got != test.want {
+			t.Errorf("Transient(%v): got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	p := &driver.RetryPolicy{MaxAttempts: 3, Retryable: Transient}
+	unavailable := status.Error(codes.Unavailable, "gone")
+	if !Retryable(p, 2, unavailable) {
+		t.Error("Retryable after 2 of 3 attempts: got false, want true")
+	}
+	if Retryable(p, 3, unavailable) {
+		t.Error("Retryable after 3 of 3 attempts: got true, want false")
+	}
+	if Retryable(p, 1, errors.New("plain")) {
+		t.Error("Retryable for a permanent error: got true, want false")
+	}
+	if Retryable(&driver.RetryPolicy{MaxAttempts: 3}, 1, unavailable) {
+		t.Error("Retryable with no Retryable function: got true, want false")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	called := make(chan struct{})
+	stop := Watch(ctx, func() { close(called) })
+	cancel()
+	<-called
+	stop()
+
+	// Once stopped, the watch does not cancel.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	Watch(ctx, func() { t.Error("Watch called cancel after it was stopped") })()
+	cancel()
+}
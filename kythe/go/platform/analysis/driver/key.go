@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// A Keyer returns a stable key identifying a compilation unit.  Features that
+// need to recognize the same compilation across runs, such as a Checkpoint,
+// a CachingAnalyzer, or a ShardQueue, identify compilations by their keys, so
+// two compilations with the same key are treated as one.  A Keyer must be
+// deterministic, and safe for concurrent use.
+type Keyer func(*apb.CompilationUnit) string
+
+// KeyOf is the default Keyer.  It returns the hex-encoded SHA-256 hash of the
+// following fields of unit, in order:
+//
+//   - the signature, corpus, root, path, and language of its VName;
+//   - the path and digest of each of its required inputs, in order;
+//   - each of its arguments, in order.
+//
+// No other field contributes to the key: compilations that differ only in,
+// for example, their working directory, environment, details, or the VNames
+// of their inputs share a key.  Each field is length-prefixed, so distinct
+// sequences of fields never produce the same encoding.
+func KeyOf(unit *apb.CompilationUnit) string {
+	h := sha256.New()
+	k := keyWriter{h: h}
+	k.vname(unit.GetVName())
+	k.count(len(unit.GetRequiredInput()))
+	for _, ri := range unit.GetRequiredInput() {
+		k.str(ri.GetInfo().GetPath())
+		k.str(ri.GetInfo().GetDigest())
+	}
+	k.count(len(unit.GetArgument()))
+	for _, arg := range unit.GetArgument() {
+		k.str(arg)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// A keyWriter writes length-prefixed fields to a hash.
+type keyWriter struct {
+	h   hash.Hash
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (k *keyWriter) count(n int) { k.h.Write(k.buf[:binary.PutUvarint(k.buf[:], uint64(n))]) }
+
+func (k *keyWriter) str(s string) {
+	k.count(len(s))
+	k.h.Write([]byte(s))
+}
+
+func (k *keyWriter) vname(v *spb.VName) {
+	k.str(v.GetSignature())
+	k.str(v.GetCorpus())
+	k.str(v.GetRoot())
+	k.str(v.GetPath())
+	k.str(v.GetLanguage())
+}
+
+// keyHash returns a stable 64-bit hash of unit, derived from its KeyOf key.
+func keyHash(unit *apb.CompilationUnit) uint64 {
+	sum, _ := hex.DecodeString(KeyOf(unit)[:16]) // KeyOf is always valid hex
+	return binary.BigEndian.Uint64(sum)
+}
+
+// key returns the key of unit according to d.Keyer, or KeyOf if it is nil.
+func (d *Driver) key(unit *apb.CompilationUnit) string {
+	if d.Keyer != nil {
+		return d.Keyer(unit)
+	}
+	return KeyOf(unit)
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	"github.com/golang/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+func TestKeyOf(t *testing.T) {
+	base := &apb.CompilationUnit{
+		VName: &spb.VName{Signature: "sig", Corpus: "corpus", Language: "go"},
+		RequiredInput: []*apb.CompilationUnit_FileInput{{
+			Info: &apb.FileInfo{Path: "a.go", Digest: "d1"},
+		}},
+		Argument: []string{"-x", "y"},
+	}
+	key := KeyOf(base)
+	if again := KeyOf(proto.Clone(base).(*apb.CompilationUnit)); again != key {
+		t.Errorf("KeyOf is unstable: %q != %q", again, key)
+	}
+
+	variant := func(f func(*apb.CompilationUnit)) *apb.CompilationUnit {
+		cu := proto.Clone(base).(*apb.CompilationUnit)
+		f(cu)
+		return cu
+	}
+	same := []*apb.CompilationUnit{
+		variant(func(cu *apb.CompilationUnit) { cu.WorkingDirectory = "/tmp" }),
+		variant(func(cu *apb.CompilationUnit) { cu.Environment = []*apb.CompilationUnit_Env{{Name: "X"}} }),
+		variant(func(cu *apb.CompilationUnit) { cu.RequiredInput[0].VName = &spb.VName{Path: "a.go"} }),
+	}
+	for _, cu := range same {
+		if got := KeyOf(cu); got != key {
+			t.Errorf("KeyOf(%v) = %q, want %q", cu, got, key)
+		}
+	}
+	different := []*apb.CompilationUnit{
+		variant(func(cu *apb.CompilationUnit) { cu.VName.Root = "root" }),
+		variant(func(cu *apb.CompilationUnit) { cu.RequiredInput[0].Info.Digest = "d2" }),
+		variant(func(cu *apb.CompilationUnit) { cu.RequiredInput[0].Info.Path = "b.go" }),
+		variant(func(cu *apb.CompilationUnit) { cu.Argument = []string{"-xy"} }),
+		variant(func(cu *apb.CompilationUnit) { cu.Argument = append(cu.Argument, "") }),
+	}
+	for _, cu := range different {
+		if got := KeyOf(cu); got == key {
+			t.Errorf("KeyOf(%v) = %q, want a different key", cu, got)
+		}
+	}
+}
+
+func TestDriverKeyer(t *testing.T) {
+	cp := &memCheckpoint{done: map[string]bool{"b": true}}
+	var analyzed []string
+	d := &Driver{
+		Checkpoint: cp,
+		Keyer:      func(cu *apb.CompilationUnit) string { return cu.VName.Signature },
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			analyzed = append(analyzed, req.Compilation.VName.Signature)
+			return nil
+		}),
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}))
+	if err := testutil.DeepEqual([]string{"a", "c"}, analyzed); err != nil {
+		t.Errorf("Analyzed the wrong compilations: %v", err)
+	}
+	if err := testutil.DeepEqual(map[string]bool{"a": true, "b": true, "c": true}, cp.done); err != nil {
+		t.Errorf("Checkpoint keys: %v", err)
+	}
+}
+
+func TestDriverSkipDuplicates(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		var analyzed []string
+		d := &Driver{
+			SkipDuplicates: skip,
+			Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+				analyzed = append(analyzed, req.Compilation.VName.Signature)
+				return nil
+			}),
+		}
+		// The second "a" is a distinct but identical unit.
+		stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b", "a")})
+		testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+		want, dups := []string{"a", "b", "a"}, 0
+		if skip {
+			want, dups = []string{"a", "b"}, 1
+		}
+		if err := testutil.DeepEqual(want, analyzed); err != nil {
+			t.Errorf("SkipDuplicates=%v: analyzed: %v", skip, err)
+		}
+		if stats.Duplicates != dups || stats.Skipped != dups {
+			t.Errorf("SkipDuplicates=%v: got %d duplicates, %d skipped; want %d", skip, stats.Duplicates, stats.Skipped, dups)
+		}
+	}
+}
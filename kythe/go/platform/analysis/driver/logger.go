@@ -0,0 +1,76 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// A Logger receives the log messages of a Driver.  Each message is followed
+// by alternating key/value pairs giving additional detail, for example:
+//
+//	logger.Warn(ctx, "analysis failed", "compilation", name, "error", err)
+//
+// The context is that of the compilation concerned, if any.
+type Logger interface {
+	Debug(ctx context.Context, msg string, kvs ...interface{})
+	Info(ctx context.Context, msg string, kvs ...interface{})
+	Warn(ctx context.Context, msg string, kvs ...interface{})
+}
+
+// StdLogger is a Logger that writes Info and Warn messages using the standard
+// log package.  Debug messages are discarded.  Messages logged for a
+// compilation include its request ID (see RequestIDFromContext).
+type StdLogger struct{}
+
+// Debug implements the Logger interface.  It does nothing.
+func (StdLogger) Debug(context.Context, string, ...interface{}) {}
+
+// Info implements the Logger interface.
+func (StdLogger) Info(ctx context.Context, msg string, kvs ...interface{}) {
+	log.Print(formatLog(msg, withRequestID(ctx, kvs)))
+}
+
+// Warn implements the Logger interface.
+func (StdLogger) Warn(ctx context.Context, msg string, kvs ...interface{}) {
+	log.Print("WARNING: " + formatLog(msg, withRequestID(ctx, kvs)))
+}
+
+// withRequestID appends the request ID carried by ctx, if any, to kvs.
+func withRequestID(ctx context.Context, kvs []interface{}) []interface{} {
+	if id := RequestIDFromContext(ctx); id != "" {
+		return append(kvs[:len(kvs):len(kvs)], "request_id", id)
+	}
+	return kvs
+}
+
+// formatLog renders msg and its key/value pairs as a single line.
+func formatLog(msg string, kvs []interface{}) string {
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for i := 0; i < len(kvs); i += 2 {
+		if i+1 < len(kvs) {
+			fmt.Fprintf(&sb, " %v=%v", kvs[i], kvs[i+1])
+		} else {
+			fmt.Fprintf(&sb, " %v", kvs[i])
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"expvar"
+	"time"
+)
+
+// Metrics receives measurements of a Driver's work, for export to a
+// monitoring system.  Each method is passed the language of the compilation
+// concerned, taken from its VName.  Methods may be called concurrently by the
+// driver's workers, and should be cheap.
+type Metrics interface {
+	IncStarted(lang string)   // analysis of a compilation began
+	IncSucceeded(lang string) // a compilation was analyzed successfully
+	IncFailed(lang string)    // a compilation failed
+	IncSkipped(lang string)   // a compilation was skipped without analysis
+	IncRetried(lang string)   // a failed analysis attempt is being retried
+
+	// ObserveAnalyzeDuration records the duration of a single call to the
+	// analyzer.
+	ObserveAnalyzeDuration(lang string, d time.Duration)
+
+	// AddOutputs records that n outputs were written.
+	AddOutputs(lang string, n int)
+}
+
+// NopMetrics is a Metrics that discards all measurements.  It is used by a
+// Driver with no Metrics.
+type NopMetrics struct{}
+
+func (NopMetrics) IncStarted(string)                            {}
+func (NopMetrics) IncSucceeded(string)                          {}
+func (NopMetrics) IncFailed(string)                             {}
+func (NopMetrics) IncSkipped(string)                            {}
+func (NopMetrics) IncRetried(string)                            {}
+func (NopMetrics) ObserveAnalyzeDuration(string, time.Duration) {}
+func (NopMetrics) AddOutputs(string, int)                       {}
+
+// ExpvarMetrics is a Metrics that publishes its measurements with the expvar
+// package, as a map from metric name to a map from language to value.  The
+// metrics are "started", "succeeded", "failed", "skipped", "retried",
+// "outputs", and "analyze_seconds".
+type ExpvarMetrics struct {
+	started, succeeded, failed, skipped, retried, outputs, seconds *expvar.Map
+}
+
+// NewExpvarMetrics returns an ExpvarMetrics published under the given name.
+// Like expvar.Publish, it panics if the name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	m := &ExpvarMetrics{
+		started:   new(expvar.Map).Init(),
+		succeeded: new(expvar.Map).Init(),
+		failed:    new(expvar.Map).Init(),
+		skipped:   new(expvar.Map).Init(),
+		retried:   new(expvar.Map).Init(),
+		outputs:   new(expvar.Map).Init(),
+		seconds:   new(expvar.Map).Init(),
+	}
+	top := expvar.NewMap(name)
+	top.Set("started", m.started)
+	top.Set("succeeded", m.succeeded)
+	top.Set("failed", m.failed)
+	top.Set("skipped", m.skipped)
+	top.Set("retried", m.retried)
+	top.Set("outputs", m.outputs)
+	top.Set("analyze_seconds", m.seconds)
+	return m
+}
+
+func (m *ExpvarMetrics) IncStarted(lang string)   { m.started.Add(lang, 1) }
+func (m *ExpvarMetrics) IncSucceeded(lang string) { m.succeeded.Add(lang, 1) }
+func (m *ExpvarMetrics) IncFailed(lang string)    { m.failed.Add(lang, 1) }
+func (m *ExpvarMetrics) IncSkipped(lang string)   { m.skipped.Add(lang, 1) }
+func (m *ExpvarMetrics) IncRetried(lang string)   { m.retried.Add(lang, 1) }
+
+func (m *ExpvarMetrics) ObserveAnalyzeDuration(lang string, d time.Duration) {
+	m.seconds.AddFloat(lang, d.Seconds())
+}
+
+func (m *ExpvarMetrics) AddOutputs(lang string, n int) { m.outputs.Add(lang, int64(n)) }
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// expvarRuns counts the runs of TestExpvarMetrics, each of which publishes its
+// metrics under a new name, since expvar does not allow a name to be reused.
+var expvarRuns int
+
+func TestExpvarMetrics(t *testing.T) {
+	expvarRuns++
+	name := fmt.Sprintf("kythe_driver_test_%d", expvarRuns)
+	attempts := make(map[string]int)
+	d := &Driver{
+		Metrics:         NewExpvarMetrics(name),
+		ContinueOnError: true,
+		Filter:          func(cu *apb.CompilationUnit) bool { return cu.VName.Signature != "skip" },
+		Retry: &RetryPolicy{
+			MaxAttempts: 2,
+			Retryable:   func(err error) bool { return err == errTransient },
+		},
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			sig := req.Compilation.VName.Signature
+			attempts[sig]++
+			switch {
+			case sig == "flaky" && attempts[sig] == 1:
+				return errTransient
+			case sig == "bad":
+				return errFromAnalysis
+			}
+			return out(ctx, &apb.AnalysisOutput{Value: []byte(sig)})
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+		Logger: new(testLogger),
+	}
+	cs := comps("a", "flaky", "bad", "skip")
+	for _, c := range cs {
+		c.Unit.VName.Language = "go"
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: cs}); err == nil {
+		t.Error("Expected error from Run but got none")
+	}
+
+	var got map[string]map[string]float64
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &got); err != nil {
+		t.Fatalf("Decoding metrics: %v", err)
+	}
+	if secs := got["analyze_seconds"]["go"]; secs <= 0 || secs > time.Minute.Seconds() {
+		t.Errorf("Unexpected analyze_seconds: %v", secs)
+	}
+	delete(got, "analyze_seconds")
+	want := map[string]map[string]float64{
+		"started":   {"go": 3},
+		"succeeded": {"go": 2},
+		"failed":    {"go": 1},
+		"skipped":   {"go": 1},
+		"retried":   {"go": 1},
+		"outputs":   {"go": 2},
+	}
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("Unexpected metrics: %v", err)
+	}
+}
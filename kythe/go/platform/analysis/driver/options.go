@@ -0,0 +1,144 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// An Option configures a Driver constructed by New.
+type Option func(*Driver)
+
+// New returns a Driver that sends the compilations from q to analyzer,
+// configured by the given options.  It reports an error if analyzer or q is
+// nil.  Run the resulting driver by calling its Run method with a nil queue.
+func New(analyzer analysis.CompilationAnalyzer, q Queue, opts ...Option) (*Driver, error) {
+	if analyzer == nil {
+		return nil, errors.New("driver: nil analyzer")
+	} else if q == nil {
+		return nil, errors.New("driver: nil queue")
+	}
+	d := &Driver{Analyzer: analyzer, Compilations: q}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d, nil
+}
+
+// WithTimeout sets the per-compilation analysis timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(d *Driver) { d.Timeout = timeout }
+}
+
+// WithConcurrency sets the number of compilations analyzed in parallel.
+func WithConcurrency(n int) Option {
+	return func(d *Driver) { d.Concurrency = n }
+}
+
+// WithFileDataService sets the address of the file data service passed to
+// the analyzer.
+func WithFileDataService(addr string) Option {
+	return func(d *Driver) { d.FileDataService = addr }
+}
+
+// WithOutput sets the function that receives analysis outputs.
+func WithOutput(out analysis.OutputFunc) Option {
+	return func(d *Driver) { d.WriteOutput = out }
+}
+
+// WithCompilationContext ensures that the context passed to the output
+// function identifies the compilation that produced each output, for use with
+// CompilationFromContext.
+func WithCompilationContext() Option {
+	return func(d *Driver) { d.CompilationContext = true }
+}
+
+// WithKeyer sets the function that identifies compilations for the driver's
+// Checkpoint.
+func WithKeyer(k Keyer) Option {
+	return func(d *Driver) { d.Keyer = k }
+}
+
+// WithContext sets the callbacks invoked during analysis.  It replaces any
+// functions set by WithSetup, WithTransform, or WithTeardown.
+func WithContext(c Context) Option {
+	return func(d *Driver) { d.Context = c }
+}
+
+// WithSetup sets the function invoked before each compilation is analyzed.
+func WithSetup(setup func(context.Context, Compilation) error) Option {
+	return func(d *Driver) { d.funcContext().setup = setup }
+}
+
+// WithTransform sets the function invoked after Setup to replace the
+// compilation unit sent to the analyzer; see Transformer.
+func WithTransform(transform func(context.Context, Compilation) (*apb.CompilationUnit, error)) Option {
+	return func(d *Driver) { d.funcContext().transform = transform }
+}
+
+// WithTeardown sets the function invoked after each compilation is analyzed.
+func WithTeardown(teardown func(context.Context, Compilation) error) Option {
+	return func(d *Driver) { d.funcContext().teardown = teardown }
+}
+
+// funcContext returns the driver's Context as a *funcContext, replacing any
+// other kind of Context.
+func (d *Driver) funcContext() *funcContext {
+	fc, ok := d.Context.(*funcContext)
+	if !ok {
+		fc = new(funcContext)
+		d.Context = fc
+	}
+	return fc
+}
+
+// A funcContext implements the Context interface with optional functions.
+// Analysis errors are passed through unchanged.
+type funcContext struct {
+	setup     func(context.Context, Compilation) error
+	transform func(context.Context, Compilation) (*apb.CompilationUnit, error)
+	teardown  func(context.Context, Compilation) error
+}
+
+func (f *funcContext) Setup(ctx context.Context, unit Compilation) error {
+	if f.setup != nil {
+		return f.setup(ctx, unit)
+	}
+	return nil
+}
+
+func (f *funcContext) Transform(ctx context.Context, unit Compilation) (*apb.CompilationUnit, error) {
+	if f.transform != nil {
+		return f.transform(ctx, unit)
+	}
+	return nil, nil
+}
+
+func (f *funcContext) Teardown(ctx context.Context, unit Compilation) error {
+	if f.teardown != nil {
+		return f.teardown(ctx, unit)
+	}
+	return nil
+}
+
+func (f *funcContext) AnalysisError(_ context.Context, _ Compilation, err error) error { return err }
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+func TestNewInvalid(t *testing.T) {
+	noop := analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error { return nil })
+	if d, err := New(nil, &syncQueue{}); err == nil {
+		t.Errorf("New with nil analyzer: got %+v, want error", d)
+	}
+	if d, err := New(noop, nil); err == nil {
+		t.Errorf("New with nil queue: got %+v, want error", d)
+	}
+}
+
+func TestNew(t *testing.T) {
+	var setups, teardowns, outputs int
+	var fds string
+	d, err := New(analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+		fds = req.FileDataService
+		return out(ctx, &apb.AnalysisOutput{})
+	}), &syncQueue{comps: comps("a", "b")},
+		WithTimeout(time.Minute),
+		WithConcurrency(2),
+		WithFileDataService("fds:1234"),
+		WithSetup(func(context.Context, Compilation) error { setups++; return nil }),
+		WithTeardown(func(context.Context, Compilation) error { teardowns++; return nil }),
+		WithOutput(func(context.Context, *apb.AnalysisOutput) error { outputs++; return nil }),
+		WithCompilationContext(),
+	)
+	testutil.FatalOnErrT(t, "New error: %v", err)
+	if d.Timeout != time.Minute || d.Concurrency != 2 || !d.CompilationContext {
+		t.Errorf("Options not applied: %+v", d)
+	}
+
+	d.Concurrency = 1 // keep the counters simple
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), nil))
+	if setups != 2 || teardowns != 2 || outputs != 2 {
+		t.Errorf("Expected 2 setups, teardowns, and outputs; found %d, %d, %d", setups, teardowns, outputs)
+	}
+	if fds != "fds:1234" {
+		t.Errorf("FileDataService: got %q, want %q", fds, "fds:1234")
+	}
+}
+
+func TestWithTransform(t *testing.T) {
+	var analyzed, tornDown []string
+	errFromTransform := errors.New("bad unit")
+	d, err := New(analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+		analyzed = append(analyzed, req.Compilation.VName.Signature)
+		return nil
+	}), &syncQueue{comps: comps("a", "keep", "bad")},
+		WithTransform(func(_ context.Context, cu Compilation) (*apb.CompilationUnit, error) {
+			switch sig := cu.Unit.VName.Signature; sig {
+			case "keep":
+				return nil, nil
+			case "bad":
+				return nil, errFromTransform
+			default:
+				return &apb.CompilationUnit{VName: &spb.VName{Signature: sig + "'"}}, nil
+			}
+		}),
+		WithTeardown(func(_ context.Context, cu Compilation) error {
+			tornDown = append(tornDown, cu.Unit.VName.Signature)
+			return nil
+		}),
+	)
+	testutil.FatalOnErrT(t, "New error: %v", err)
+
+	var serr *SetupError
+	if err := d.Run(context.Background(), nil); !errors.As(err, &serr) || !errors.Is(err, errFromTransform) {
+		t.Errorf("Run: got error %v, want a *SetupError wrapping %v", err, errFromTransform)
+	}
+	if err := testutil.DeepEqual([]string{"a'", "keep"}, analyzed); err != nil {
+		t.Errorf("Unexpected compilations analyzed: %v", err)
+	}
+	// The replacement is torn down, and Teardown follows a failed Transform.
+	if err := testutil.DeepEqual([]string{"a'", "keep", "bad"}, tornDown); err != nil {
+		t.Errorf("Unexpected compilations torn down: %v", err)
+	}
+}
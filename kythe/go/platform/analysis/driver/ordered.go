@@ -0,0 +1,204 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"kythe.io/kythe/go/platform/delimited"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// An orderer releases the outputs of compilations in the order in which the
+// compilations were received from the queue.  Each compilation is assigned a
+// buffer by start; once finish has been called for a buffer and for all the
+// buffers assigned before it, its contents are written.
+type orderer struct {
+	write func(context.Context, *apb.AnalysisOutput) error
+	spill int // if > 0, the number of bytes after which a buffer is spilled
+
+	mu    sync.Mutex
+	seq   int                   // the sequence number of the next buffer
+	next  int                   // the sequence number of the next buffer to flush
+	ready map[int]*outputBuffer // finished buffers waiting for their turn
+	err   error                 // the first error from write
+}
+
+func newOrderer(spill int, write func(context.Context, *apb.AnalysisOutput) error) *orderer {
+	return &orderer{write: write, spill: spill, ready: make(map[int]*outputBuffer)}
+}
+
+// start returns a new buffer, ordered after all those previously returned.
+func (o *orderer) start() *outputBuffer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	b := &outputBuffer{seq: o.seq, spill: o.spill}
+	o.seq++
+	return b
+}
+
+// finish marks b as complete and writes every buffer whose turn has come.
+// The outputs of b are written using ctx for cancellation and uctx, the
+// context of the compilation that produced them, for values.  It returns the
+// first error reported by the underlying output, after which the contents of
+// any remaining buffers are discarded.
+func (o *orderer) finish(ctx, uctx context.Context, b *outputBuffer) error {
+	b.close(uctx)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ready[b.seq] = b
+	for {
+		b, ok := o.ready[o.next]
+		if !ok {
+			return o.err
+		}
+		delete(o.ready, o.next)
+		o.next++
+		if o.err == nil {
+			o.err = b.flush(ctx, o.write)
+		}
+		b.discard()
+		if s := scopeFrom(b.uctx); s != nil {
+			s.finish()
+		}
+	}
+}
+
+// An outputBuffer holds the outputs of a single compilation.  Outputs are
+// kept in memory until their total size exceeds the spill threshold, after
+// which they are moved to a temporary file.
+type outputBuffer struct {
+	seq   int
+	spill int
+
+	mu     sync.Mutex
+	uctx   context.Context // the context of the compilation, set by close
+	outs   []*apb.AnalysisOutput
+	size   int           // the total size of outs, in bytes
+	file   *os.File      // the spill file, or nil
+	w      *bufio.Writer // buffers writes to file
+	closed bool
+	err    error // the first error writing to file
+}
+
+// add appends a copy of out to b.
+func (b *outputBuffer) add(out *apb.AnalysisOutput) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("driver: output after the compilation was finished")
+	} else if b.err != nil {
+		return b.err
+	}
+	if b.file != nil {
+		b.err = b.putLocked(out)
+		return b.err
+	}
+	b.outs = append(b.outs, proto.Clone(out).(*apb.AnalysisOutput))
+	b.size += len(out.Value)
+	if b.spill > 0 && b.size > b.spill {
+		b.err = b.spillLocked()
+	}
+	return b.err
+}
+
+// spillLocked moves the buffered outputs of b to a new temporary file.
+func (b *outputBuffer) spillLocked() error {
+	f, err := ioutil.TempFile("", "kythe-driver-outputs")
+	if err != nil {
+		return errors.WithMessage(err, "driver: spilling outputs")
+	}
+	b.file, b.w = f, bufio.NewWriter(f)
+	for _, out := range b.outs {
+		if err := b.putLocked(out); err != nil {
+			return err
+		}
+	}
+	b.outs, b.size = nil, 0
+	return nil
+}
+
+func (b *outputBuffer) putLocked(out *apb.AnalysisOutput) error {
+	return errors.WithMessage(delimited.NewWriter(b.w).PutProto(out), "driver: spilling outputs")
+}
+
+// close prevents further outputs from being added to b, and records uctx,
+// the context of the compilation that produced them.
+func (b *outputBuffer) close(uctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.uctx = uctx
+}
+
+// flush passes the contents of b to write, in the order they were added.  The
+// context passed to write has the cancellation of ctx and the values of the
+// compilation's context.
+func (b *outputBuffer) flush(ctx context.Context, write func(context.Context, *apb.AnalysisOutput) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ctx = withValues(ctx, b.uctx)
+	if b.err != nil {
+		return b.err
+	} else if b.file == nil {
+		for _, out := range b.outs {
+			if err := write(ctx, out); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := b.w.Flush(); err != nil {
+		return errors.WithMessage(err, "driver: spilling outputs")
+	} else if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return errors.WithMessage(err, "driver: reading spilled outputs")
+	}
+	rd := delimited.NewReader(b.file)
+	for {
+		var out apb.AnalysisOutput
+		if err := rd.NextProto(&out); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.WithMessage(err, "driver: reading spilled outputs")
+		}
+		if err := write(ctx, &out); err != nil {
+			return err
+		}
+	}
+}
+
+// discard releases the contents of b.
+func (b *outputBuffer) discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.outs = nil
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file, b.w = nil, nil
+	}
+}
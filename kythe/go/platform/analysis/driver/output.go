@@ -0,0 +1,334 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// Deduplicate returns an OutputFunc that forwards to out each output whose
+// value is not identical to one already seen for the same compilation.
+// Outputs are compared by the SHA-256 digest of their values; outputs that
+// carry a final result are always forwarded.
+//
+// The set of outputs seen is scoped to the compilation whose context is
+// passed to the OutputFunc by the analyzer, so memory is bounded by the size
+// of the largest compilation.  If the context does not belong to a Driver
+// compilation, outputs are deduplicated over the lifetime of the OutputFunc.
+func Deduplicate(out analysis.OutputFunc) analysis.OutputFunc {
+	return DeduplicateBy(out, func(o *apb.AnalysisOutput) string {
+		sum := sha256.Sum256(o.Value)
+		return string(sum[:])
+	})
+}
+
+// DeduplicateBy behaves as Deduplicate, but considers two outputs to be
+// duplicates if key returns the same string for both.  This permits partial
+// deduplication, for example by comparing only part of a serialized entry.
+func DeduplicateBy(out analysis.OutputFunc, key func(*apb.AnalysisOutput) string) analysis.OutputFunc {
+	d := &dedup{out: out, key: key}
+	return d.write
+}
+
+type dedup struct {
+	out analysis.OutputFunc
+	key func(*apb.AnalysisOutput) string
+
+	global *keySet // used for outputs outside any compilation scope
+	once   sync.Once
+}
+
+type keySet struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// add adds key to the set, reporting whether it was not already present.
+func (k *keySet) add(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.seen[key] {
+		return false
+	}
+	k.seen[key] = true
+	return true
+}
+
+func newKeySet() interface{} { return &keySet{seen: make(map[string]bool)} }
+
+func (d *dedup) write(ctx context.Context, o *apb.AnalysisOutput) error {
+	if o.FinalResult != nil {
+		return d.out(ctx, o)
+	}
+	var set *keySet
+	if s := scopeFrom(ctx); s != nil {
+		set = s.value(d, newKeySet).(*keySet)
+	} else {
+		d.once.Do(func() { d.global = newKeySet().(*keySet) })
+		set = d.global
+	}
+	if !set.add(d.key(o)) {
+		return nil
+	}
+	return d.out(ctx, o)
+}
+
+// A ChannelSink passes outputs to an OutputFunc from a fixed number of
+// consumer goroutines, each fed by a bounded buffer.  Its Write method is an
+// OutputFunc that blocks while the buffer it feeds is full, so that a slow
+// consumer applies backpressure to the analyzer rather than letting outputs
+// accumulate in memory.
+//
+// All the outputs of a single compilation are handled by the same consumer,
+// in the order they were written; outputs of different compilations may be
+// consumed in any order relative to each other.  Outputs written with a
+// context that does not belong to a Driver compilation are all handled by one
+// consumer.
+type ChannelSink struct {
+	write analysis.OutputFunc
+	chans []chan sinkItem
+	wg    sync.WaitGroup
+	next  uint32 // the next consumer to assign to a compilation
+
+	mu     sync.RWMutex // held for writing to close the channels
+	closed bool
+
+	errMu sync.Mutex
+	err   error // the first error reported by write
+}
+
+type sinkItem struct {
+	ctx context.Context
+	out *apb.AnalysisOutput
+}
+
+// NewChannelSink returns a ChannelSink that passes outputs to write from the
+// given number of consumers, each buffering up to buffer outputs.  Values of
+// consumers < 1 are treated as 1, and values of buffer < 0 as 0.  The caller
+// must Close the sink when the outputs are complete.
+func NewChannelSink(write analysis.OutputFunc, buffer, consumers int) *ChannelSink {
+	if consumers < 1 {
+		consumers = 1
+	}
+	if buffer < 0 {
+		buffer = 0
+	}
+	s := &ChannelSink{write: write, chans: make([]chan sinkItem, consumers)}
+	for i := range s.chans {
+		ch := make(chan sinkItem, buffer)
+		s.chans[i] = ch
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for item := range ch {
+				if s.failed() {
+					continue // drain, so that writers are not blocked
+				}
+				if err := s.write(item.ctx, item.out); err != nil {
+					s.fail(err)
+				}
+			}
+		}()
+	}
+	return s
+}
+
+// errSinkClosed is returned by Write after the sink is closed.
+var errSinkClosed = errors.New("driver: write to closed ChannelSink")
+
+// Write queues out for a consumer, blocking until there is room for it or ctx
+// ends.  Once a consumer has reported an error, Write returns that error.
+// The consumer is passed a context carrying the values of ctx, but not its
+// deadline or cancellation.
+func (s *ChannelSink) Write(ctx context.Context, out *apb.AnalysisOutput) error {
+	if err := s.firstErr(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errSinkClosed
+	}
+	select {
+	case s.chans[s.consumer(ctx)] <- sinkItem{ctx: detach(ctx), out: out}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// consumer returns the index of the consumer for outputs written with ctx.
+func (s *ChannelSink) consumer(ctx context.Context) int {
+	scope := scopeFrom(ctx)
+	if scope == nil || len(s.chans) == 1 {
+		return 0
+	}
+	return scope.value(s, func() interface{} {
+		return int(atomic.AddUint32(&s.next, 1)) % len(s.chans)
+	}).(int)
+}
+
+// Close waits for the outputs already written to be consumed, and returns
+// the first error reported by a consumer, if any.
+func (s *ChannelSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		for _, ch := range s.chans {
+			close(ch)
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return s.firstErr()
+}
+
+func (s *ChannelSink) fail(err error) {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *ChannelSink) firstErr() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+func (s *ChannelSink) failed() bool { return s.firstErr() != nil }
+
+// A TeePolicy determines how a Tee handles the failure of one of its sinks.
+type TeePolicy int
+
+const (
+	// TeeFailFast returns the first error reported by a sink for an output,
+	// without passing the output to the remaining sinks.
+	TeeFailFast TeePolicy = iota
+
+	// TeeBestEffort records the first error reported by each sink and stops
+	// writing to that sink, while continuing to feed the others.  An error is
+	// returned only once every sink has failed.
+	TeeBestEffort
+)
+
+// A SinkError reports the failure of one of the sinks of a Tee.
+type SinkError struct {
+	Sink int   // the index of the sink among those passed to NewTee
+	Err  error // the error reported by the sink
+}
+
+func (e *SinkError) Error() string { return fmt.Sprintf("driver: output sink %d: %v", e.Sink, e.Err) }
+
+// Unwrap returns the underlying error, for use with errors.Is and errors.As.
+func (e *SinkError) Unwrap() error { return e.Err }
+
+// TeeOutput returns an OutputFunc that passes each output to every one of the
+// given sinks, stopping at the first error; see Tee.
+func TeeOutput(sinks ...analysis.OutputFunc) analysis.OutputFunc {
+	return NewTee(TeeFailFast, sinks...).Write
+}
+
+// A Tee passes each output to several sinks, for example to write outputs to
+// disk while also aggregating metrics about them.  The sinks are called in
+// the order they were given, one at a time, and each output is passed to each
+// sink before the next output is written.  A slow sink therefore delays all
+// the others; to decouple a sink, pass the Write method of a ChannelSink
+// feeding it.  Write is safe for concurrent use if each of the sinks is.
+type Tee struct {
+	sinks  []analysis.OutputFunc
+	policy TeePolicy
+
+	mu     sync.Mutex
+	failed []bool       // whether each sink has reported an error
+	errs   []*SinkError // the first error of each failed sink, in order
+}
+
+// NewTee returns a Tee that passes outputs to sinks, handling their errors
+// according to policy.
+func NewTee(policy TeePolicy, sinks ...analysis.OutputFunc) *Tee {
+	return &Tee{sinks: sinks, policy: policy, failed: make([]bool, len(sinks))}
+}
+
+// Write passes out to each of the sinks of t.  Under TeeFailFast, it returns
+// a *SinkError for the first sink that fails.  Under TeeBestEffort, sinks
+// that have failed are skipped, and it returns the first *SinkError recorded
+// only once no healthy sinks remain.
+func (t *Tee) Write(ctx context.Context, out *apb.AnalysisOutput) error {
+	for i, sink := range t.sinks {
+		if t.policy == TeeBestEffort && t.sinkFailed(i) {
+			continue
+		}
+		if err := sink(ctx, out); err != nil {
+			serr := t.fail(i, err)
+			if t.policy != TeeBestEffort {
+				return serr
+			}
+		}
+	}
+	if t.policy == TeeBestEffort {
+		return t.exhausted()
+	}
+	return nil
+}
+
+// Errors returns the first error reported by each sink that has failed, in
+// the order the sinks failed.
+func (t *Tee) Errors() []*SinkError {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*SinkError(nil), t.errs...)
+}
+
+// fail records that sink i reported err, returning the error for the sink.
+func (t *Tee) fail(i int, err error) *SinkError {
+	serr := &SinkError{Sink: i, Err: err}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.failed[i] {
+		t.failed[i] = true
+		t.errs = append(t.errs, serr)
+	}
+	return serr
+}
+
+func (t *Tee) sinkFailed(i int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failed[i]
+}
+
+// exhausted returns the first error recorded if every sink has failed, or
+// nil.
+func (t *Tee) exhausted() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.sinks) == 0 || len(t.errs) < len(t.sinks) {
+		return nil
+	}
+	return t.errs[0]
+}
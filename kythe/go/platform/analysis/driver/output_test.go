@@ -0,0 +1,210 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestDeduplicate(t *testing.T) {
+	var got []string
+	d := &Driver{
+		Analyzer:    emitter(nil, "a", "b", "a", "c", "b"),
+		WriteOutput: Deduplicate(collect(&got)),
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("x", "y")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	// Duplicates are suppressed within, but not across, compilations.
+	checkSigs(t, got, "a", "b", "c", "a", "b", "c")
+	if stats.Outputs != 10 || stats.OutputBytes != 10 {
+		t.Errorf("Unexpected output stats: %+v", stats)
+	}
+}
+
+func TestDeduplicateBy(t *testing.T) {
+	var got []string
+	out := DeduplicateBy(collect(&got), func(o *apb.AnalysisOutput) string {
+		return string(o.Value[:1])
+	})
+	for _, o := range outs("apple", "avocado", "banana", "apricot") {
+		if err := out(context.Background(), o); err != nil {
+			t.Fatalf("Output failed: %v", err)
+		}
+	}
+	checkSigs(t, got, "apple", "banana")
+}
+
+func TestDeduplicateFinalResult(t *testing.T) {
+	var n int
+	out := Deduplicate(analysis.OutputFunc(func(context.Context, *apb.AnalysisOutput) error {
+		n++
+		return nil
+	}))
+	final := &apb.AnalysisOutput{FinalResult: &apb.AnalysisResult{}}
+	for i := 0; i < 2; i++ {
+		if err := out(context.Background(), final); err != nil {
+			t.Fatalf("Output failed: %v", err)
+		}
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 final results forwarded; found %d", n)
+	}
+}
+
+func TestChannelSink(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got = make(map[string][]string) // compilation → outputs
+	)
+	sink := NewChannelSink(func(ctx context.Context, o *apb.AnalysisOutput) error {
+		mu.Lock()
+		defer mu.Unlock()
+		id := RequestIDFromContext(ctx)
+		got[id] = append(got[id], string(o.Value))
+		return nil
+	}, 2, 3)
+	d := &Driver{
+		Concurrency: 4,
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			for i := 0; i < 20; i++ {
+				if err := out(ctx, &apb.AnalysisOutput{Value: []byte(fmt.Sprintf("%s%02d", req.Compilation.VName.Signature, i))}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+		WriteOutput: sink.Write,
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d", "e", "f")}))
+	testutil.FatalOnErrT(t, "Close error: %v", sink.Close())
+
+	if len(got) != 6 {
+		t.Errorf("Got outputs for %d compilations, want 6", len(got))
+	}
+	for id, vals := range got {
+		if len(vals) != 20 || !sort.StringsAreSorted(vals) {
+			t.Errorf("Compilation %s: outputs out of order or missing: %q", id, vals)
+		}
+	}
+	if err := sink.Write(context.Background(), outs("late")[0]); err == nil {
+		t.Error("Write after Close succeeded unexpectedly")
+	}
+}
+
+func TestChannelSinkBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	sink := NewChannelSink(func(context.Context, *apb.AnalysisOutput) error {
+		<-release
+		return nil
+	}, 1, 1)
+
+	// The first output is held by the consumer and the second is buffered, so
+	// the third must block.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var err error
+	for _, o := range outs("a", "b", "c") {
+		if err = sink.Write(ctx, o); err != nil {
+			break
+		}
+	}
+	if err != context.DeadlineExceeded {
+		t.Errorf("Write to full sink: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	testutil.FatalOnErrT(t, "Close error: %v", sink.Close())
+}
+
+func TestChannelSinkError(t *testing.T) {
+	errFromSink := errors.New("sink failed")
+	sink := NewChannelSink(func(context.Context, *apb.AnalysisOutput) error { return errFromSink }, 0, 2)
+	if err := sink.Write(context.Background(), outs("a")[0]); err != nil {
+		t.Errorf("First write failed: %v", err)
+	}
+	if err := sink.Close(); err != errFromSink {
+		t.Errorf("Close: got %v, want %v", err, errFromSink)
+	}
+}
+
+func TestTee(t *testing.T) {
+	errFromSink := errors.New("sink failed")
+	for _, test := range []struct {
+		policy   TeePolicy
+		wantGood []string // outputs received by the healthy sink
+		wantBad  []string // outputs passed to the failing sink
+		wantErr  []bool   // whether each write fails
+	}{
+		{TeeFailFast, []string{"a", "c"}, []string{"a", "b", "c"}, []bool{false, true, false}},
+		{TeeBestEffort, []string{"a", "b", "c"}, []string{"a", "b"}, []bool{false, false, false}},
+	} {
+		var good, bad []string
+		tee := NewTee(test.policy,
+			func(_ context.Context, o *apb.AnalysisOutput) error {
+				bad = append(bad, string(o.Value))
+				if string(o.Value) == "b" {
+					return errFromSink
+				}
+				return nil
+			},
+			func(_ context.Context, o *apb.AnalysisOutput) error {
+				good = append(good, string(o.Value))
+				return nil
+			})
+		for i, o := range outs("a", "b", "c") {
+			err := tee.Write(context.Background(), o)
+			if gotErr := err != nil; gotErr != test.wantErr[i] {
+				t.Errorf("Policy %d: Write(%q): got error %v, want error %v", test.policy, o.Value, err, test.wantErr[i])
+			}
+			var serr *SinkError
+			if err != nil && (!errors.As(err, &serr) || serr.Sink != 0 || !errors.Is(err, errFromSink)) {
+				t.Errorf("Policy %d: Write(%q): got %v, want an error for sink 0", test.policy, o.Value, err)
+			}
+		}
+		if err := testutil.DeepEqual(test.wantGood, good); err != nil {
+			t.Errorf("Policy %d: healthy sink: %v", test.policy, err)
+		}
+		if err := testutil.DeepEqual(test.wantBad, bad); err != nil {
+			t.Errorf("Policy %d: failing sink: %v", test.policy, err)
+		}
+		if errs := tee.Errors(); len(errs) != 1 || errs[0].Sink != 0 || errs[0].Err != errFromSink {
+			t.Errorf("Policy %d: Errors: got %v, want the error of sink 0", test.policy, errs)
+		}
+	}
+}
+
+func TestTeeAllSinksFailed(t *testing.T) {
+	errFromSink := errors.New("sink failed")
+	fail := func(context.Context, *apb.AnalysisOutput) error { return errFromSink }
+	tee := NewTee(TeeBestEffort, fail, fail)
+	if err := tee.Write(context.Background(), outs("a")[0]); !errors.Is(err, errFromSink) {
+		t.Errorf("Write with every sink failed: got %v, want %v", err, errFromSink)
+	}
+	if err := TeeOutput()(context.Background(), outs("a")[0]); err != nil {
+		t.Errorf("Write to no sinks: %v", err)
+	}
+}
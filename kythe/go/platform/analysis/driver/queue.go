@@ -0,0 +1,614 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A ChannelQueue is a Queue that delivers the compilation units received from
+// a channel.  The queue ends when the channel is closed and drained.  It is
+// safe for concurrent use.
+type ChannelQueue <-chan *apb.CompilationUnit
+
+// Next implements the Queue interface.  A call to Next blocked waiting for the
+// channel returns ctx.Err() if ctx ends first.
+func (q ChannelQueue) Next(ctx context.Context, f CompilationFunc) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case unit, ok := <-q:
+		if !ok {
+			return ErrEndOfQueue
+		}
+		return f(ctx, Compilation{Unit: unit})
+	}
+}
+
+// SliceQueue returns a Queue that delivers the given compilation units in
+// order.  The result is a Sizer, and is safe for concurrent use.
+func SliceQueue(units []*apb.CompilationUnit) Queue { return &sliceQueue{units: units} }
+
+type sliceQueue struct {
+	mu    sync.Mutex
+	units []*apb.CompilationUnit
+}
+
+// Next implements the Queue interface.
+func (q *sliceQueue) Next(ctx context.Context, f CompilationFunc) error {
+	q.mu.Lock()
+	if len(q.units) == 0 {
+		q.mu.Unlock()
+		return ErrEndOfQueue
+	}
+	unit := q.units[0]
+	q.units = q.units[1:]
+	q.mu.Unlock()
+	return f(ctx, Compilation{Unit: unit})
+}
+
+// Remaining implements the Sizer interface.
+func (q *sliceQueue) Remaining() (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.units), true
+}
+
+// MultiQueue returns a Queue that delivers the compilations from each of the
+// given queues in turn, advancing to the next queue when the current one
+// reports ErrEndOfQueue.  Any other error from a queue is returned at once.
+// The result is safe for concurrent use if each of the queues is.
+func MultiQueue(queues ...Queue) Queue { return &multiQueue{queues: queues} }
+
+type multiQueue struct {
+	mu     sync.Mutex
+	queues []Queue
+	index  int // the index of the current queue
+}
+
+// Next implements the Queue interface.
+func (m *multiQueue) Next(ctx context.Context, f CompilationFunc) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		i := m.index
+		m.mu.Unlock()
+		if i >= len(m.queues) {
+			return ErrEndOfQueue
+		}
+
+		err := m.queues[i].Next(ctx, f)
+		if err != ErrEndOfQueue {
+			return err
+		}
+		m.mu.Lock()
+		if m.index == i {
+			m.index++
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Peekable returns a Peeker that delivers the compilations from q, buffering
+// at most one compilation to support Peek.  If q is already a Peeker, it is
+// returned unchanged.  The result is safe for concurrent use if q is.
+func Peekable(q Queue) Peeker {
+	if p, ok := q.(Peeker); ok {
+		return p
+	}
+	return &peekQueue{queue: q}
+}
+
+type peekQueue struct {
+	queue Queue
+
+	mu   sync.Mutex
+	next *Compilation // if non-nil, the compilation returned by Peek
+}
+
+// Peek implements the Peeker interface.
+func (p *peekQueue) Peek(ctx context.Context) (Compilation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next == nil {
+		if err := p.queue.Next(ctx, func(_ context.Context, cu Compilation) error {
+			p.next = &cu
+			return nil
+		}); err != nil {
+			return Compilation{}, err
+		}
+	}
+	return *p.next, nil
+}
+
+// Remaining implements the Sizer interface, if the underlying queue does.
+func (p *peekQueue) Remaining() (int, bool) {
+	s, ok := p.queue.(Sizer)
+	if !ok {
+		return 0, false
+	}
+	n, ok := s.Remaining()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok && p.next != nil {
+		n++
+	}
+	return n, ok
+}
+
+// Next implements the Queue interface.
+func (p *peekQueue) Next(ctx context.Context, f CompilationFunc) error {
+	p.mu.Lock()
+	next := p.next
+	p.next = nil
+	p.mu.Unlock()
+	if next == nil {
+		return p.queue.Next(ctx, f)
+	}
+	return f(ctx, *next)
+}
+
+// Remaining implements the Sizer interface.  The size is known only if each
+// of the queues not yet exhausted is a Sizer that knows its size.
+func (m *multiQueue) Remaining() (int, bool) {
+	m.mu.Lock()
+	i := m.index
+	m.mu.Unlock()
+	var total int
+	for _, q := range m.queues[i:] {
+		s, ok := q.(Sizer)
+		if !ok {
+			return 0, false
+		}
+		n, ok := s.Remaining()
+		if !ok {
+			return 0, false
+		}
+		total += n
+	}
+	return total, true
+}
+
+// ShardQueue returns a Queue that delivers only those compilations from q that
+// belong to shard index of count, so that count runs, each given a different
+// index in 0 <= index < count, together process every compilation of a queue
+// exactly once.  A compilation is assigned to a shard by its KeyOf key,
+// so the assignment does not depend on the order in which compilations are
+// read, or on which other compilations are present.  The result is safe for
+// concurrent use if q is.  ShardQueue panics if index or count is invalid.
+//
+// If q is a Sizer, so is the result, but since the shard of a compilation is
+// not known until it is read, its size is an estimate: the remaining
+// compilations of q divided evenly among the shards.
+func ShardQueue(q Queue, index, count int) Queue {
+	if count <= 0 || index < 0 || index >= count {
+		panic(fmt.Sprintf("driver: invalid shard %d of %d", index, count))
+	}
+	return &shardQueue{queue: q, index: uint64(index), count: uint64(count)}
+}
+
+type shardQueue struct {
+	queue        Queue
+	index, count uint64
+}
+
+// Next implements the Queue interface.
+func (s *shardQueue) Next(ctx context.Context, f CompilationFunc) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var mine bool
+		if err := s.queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
+			if mine = keyHash(cu.Unit)%s.count == s.index; !mine {
+				return nil
+			}
+			return f(ctx, cu)
+		}); err != nil || mine {
+			return err
+		}
+	}
+}
+
+// Remaining implements the Sizer interface, if the underlying queue does.
+func (s *shardQueue) Remaining() (int, bool) {
+	if sz, ok := s.queue.(Sizer); ok {
+		n, ok := sz.Remaining()
+		return int((uint64(n) + s.count - 1) / s.count), ok
+	}
+	return 0, false
+}
+
+// Cancelable returns a Queue that delivers the compilations from q, but whose
+// Next returns ctx.Err() as soon as ctx ends, even if q does not honor
+// cancellation.  The result is safe for concurrent use if q is, and is a Sizer
+// if q is.
+//
+// Each call to Next runs the Next method of q in a new goroutine.  If ctx ends
+// before q delivers a compilation, that goroutine is abandoned, and lingers
+// until the blocked call to q returns.  A compilation q delivers after that is
+// dropped: it is not passed to f, and q receives ctx.Err() from its callback.
+// Once f has been called, Next waits for it to return, as f is expected to
+// honor ctx itself.
+func Cancelable(q Queue) Queue { return &cancelableQueue{queue: q} }
+
+type cancelableQueue struct{ queue Queue }
+
+// Next implements the Queue interface.
+func (c *cancelableQueue) Next(ctx context.Context, f CompilationFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var (
+		mu        sync.Mutex
+		called    bool // whether f has been called
+		abandoned bool // whether Next has returned without waiting
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
+			mu.Lock()
+			if abandoned {
+				mu.Unlock()
+				return ctx.Err()
+			}
+			called = true
+			mu.Unlock()
+			return f(ctx, cu)
+		})
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	mu.Lock()
+	if called {
+		mu.Unlock()
+		return <-done
+	}
+	abandoned = true
+	mu.Unlock()
+	return ctx.Err()
+}
+
+// Remaining implements the Sizer interface, if the underlying queue does.
+func (c *cancelableQueue) Remaining() (int, bool) {
+	if sz, ok := c.queue.(Sizer); ok {
+		return sz.Remaining()
+	}
+	return 0, false
+}
+
+// ObservedQueue returns a Queue that delivers the compilations from q, and logs
+// each of them to logger, for example to debug a run that behaves
+// differently from one time to the next.  When q delivers a compilation, an
+// Info message gives its name, its key according to KeyOf, its language, the
+// number of its required inputs, and how long q took to deliver it; when the
+// callback returns, another gives how long it took and its error, if any.
+// A call to Next that delivers no compilation is logged with its error.  If
+// logger is nil, StdLogger is used.
+//
+// The results of q and of the callback are returned unchanged.  The result is
+// safe for concurrent use if q is, and is a Sizer if q is.
+func ObservedQueue(q Queue, logger Logger) Queue {
+	if logger == nil {
+		logger = StdLogger{}
+	}
+	return &observedQueue{queue: q, log: logger}
+}
+
+type observedQueue struct {
+	queue Queue
+	log   Logger
+}
+
+// Next implements the Queue interface.
+func (o *observedQueue) Next(ctx context.Context, f CompilationFunc) error {
+	start := time.Now()
+	var called bool
+	err := o.queue.Next(ctx, func(ctx context.Context, cu Compilation) error {
+		called = true
+		name := unitName(cu.Unit)
+		o.log.Info(ctx, "compilation dequeued",
+			"compilation", name,
+			"key", KeyOf(cu.Unit),
+			"language", cu.Unit.GetVName().GetLanguage(),
+			"inputs", len(cu.Unit.GetRequiredInput()),
+			"wait", time.Since(start))
+		begin := time.Now()
+		err := f(ctx, cu)
+		kvs := []interface{}{"compilation", name, "elapsed", time.Since(begin)}
+		if err != nil {
+			kvs = append(kvs, "error", err)
+		}
+		o.log.Info(ctx, "compilation handled", kvs...)
+		return err
+	})
+	if !called {
+		o.log.Info(ctx, "queue delivered no compilation", "wait", time.Since(start), "error", err)
+	}
+	return err
+}
+
+// Remaining implements the Sizer interface, if the underlying queue does.
+func (o *observedQueue) Remaining() (int, bool) {
+	if sz, ok := o.queue.(Sizer); ok {
+		return sz.Remaining()
+	}
+	return 0, false
+}
+
+// MaxStreamRecord is the largest encoded compilation a StreamQueue will read.
+// A longer record is treated as corrupt framing.
+const MaxStreamRecord = 1 << 30
+
+// StreamQueue returns a Queue that reads compilation units from r, each
+// encoded as a varint length followed by the wire encoding of a
+// CompilationUnit, as written by the delimited package.  The queue ends with
+// ErrEndOfQueue when r reports io.EOF at a record boundary.  A truncated or
+// oversized record ends the queue with an error.  The result is safe for
+// concurrent use.
+//
+// A call to Next blocked reading from r returns ctx.Err() if ctx ends first.
+// The read continues in the background, and the compilation it produces is
+// delivered by the following call to Next.
+func StreamQueue(r io.Reader) Queue {
+	q := &streamQueue{
+		rd:  bufio.NewReader(r),
+		sem: make(chan struct{}, 1),
+	}
+	q.sem <- struct{}{}
+	return q
+}
+
+type streamQueue struct {
+	sem     chan struct{} // holds a token when no Next is in progress
+	rd      *bufio.Reader
+	pending chan streamRecord // if non-nil, a read is in progress
+	err     error             // if non-nil, the error that ended the stream
+}
+
+type streamRecord struct {
+	unit *apb.CompilationUnit
+	err  error
+}
+
+// Next implements the Queue interface.
+func (q *streamQueue) Next(ctx context.Context, f CompilationFunc) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-q.sem:
+	}
+	if q.err != nil {
+		q.sem <- struct{}{}
+		return q.err
+	}
+	if q.pending == nil {
+		q.pending = make(chan streamRecord, 1)
+		go func(ch chan<- streamRecord) {
+			unit, err := q.read()
+			ch <- streamRecord{unit, err}
+		}(q.pending)
+	}
+
+	var rec streamRecord
+	select {
+	case <-ctx.Done():
+		q.sem <- struct{}{}
+		return ctx.Err()
+	case rec = <-q.pending:
+		q.pending = nil
+	}
+	if _, ok := rec.err.(framingError); ok || rec.err == ErrEndOfQueue {
+		q.err = rec.err
+	}
+	q.sem <- struct{}{}
+	if rec.err != nil {
+		return rec.err
+	}
+	return f(ctx, Compilation{Unit: rec.unit})
+}
+
+// Remaining implements the Sizer interface.  The size of a stream is not
+// known in advance.
+func (q *streamQueue) Remaining() (int, bool) { return 0, false }
+
+// A Decompressor returns a reader of the decompressed contents of r, for use
+// with CompressedStreamQueue.
+type Decompressor func(r io.Reader) (io.Reader, error)
+
+// GzipDecompressor is a Decompressor for gzip streams, including streams of
+// several concatenated gzip members.
+func GzipDecompressor(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// CompressedStreamQueue returns a queue like StreamQueue, reading from the
+// contents of r as decompressed by dec.  If dec is nil, the compression is
+// detected from the first bytes of the stream: gzip is decompressed with
+// GzipDecompressor, and a stream with no recognized header is read as is.
+// Other formats, such as zstd, need a Decompressor from a suitable library.
+//
+// Nothing is read from r until the first call to Next.  An error from the
+// decompressor, including one caused by a truncated or corrupt stream, ends
+// the queue with an error saying so.
+func CompressedStreamQueue(r io.Reader, dec Decompressor) Queue {
+	return StreamQueue(&decompressReader{src: bufio.NewReader(r), dec: dec})
+}
+
+// A decompressReader reads the decompressed contents of a stream, choosing
+// its decompressor on the first call to Read.
+type decompressReader struct {
+	src *bufio.Reader
+	dec Decompressor // if nil, detect the compression
+	r   io.Reader    // the decompressed stream, once chosen
+	err error        // a sticky error from choosing or reading r
+}
+
+// Read implements io.Reader.  Errors other than io.EOF are reported as
+// decompression errors, as is a panic in the decompressor.
+func (d *decompressReader) Read(p []byte) (n int, err error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			n, err = 0, errors.Errorf("driver: decompressing compilation stream: panic: %v", v)
+		}
+		if err != nil && err != io.EOF {
+			d.err = err
+		}
+	}()
+	if d.r == nil {
+		if d.r, err = d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = d.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = errors.WithMessage(err, "driver: decompressing compilation stream")
+	}
+	return n, err
+}
+
+// open returns the decompressed stream, detecting its compression if d.dec is
+// nil.
+func (d *decompressReader) open() (io.Reader, error) {
+	dec := d.dec
+	if dec == nil {
+		head, err := d.src.Peek(len(zstdMagic))
+		if err != nil && err != io.EOF {
+			return nil, errors.WithMessage(err, "driver: reading compilation stream")
+		}
+		switch {
+		case bytes.HasPrefix(head, gzipMagic):
+			dec = GzipDecompressor
+		case bytes.HasPrefix(head, zstdMagic):
+			return nil, errors.New("driver: compilation stream is zstd-compressed; a Decompressor is required")
+		default:
+			return d.src, nil
+		}
+	}
+	r, err := dec(d.src)
+	if err == io.EOF {
+		return nil, errors.New("driver: decompressing compilation stream: truncated header")
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "driver: decompressing compilation stream")
+	}
+	return r, nil
+}
+
+// A framingError reports a record that cannot be delimited, after which the
+// stream cannot be resynchronized.
+type framingError struct{ error }
+
+// read reads the next compilation from the stream.
+func (q *streamQueue) read() (*apb.CompilationUnit, error) {
+	size, err := binary.ReadUvarint(q.rd)
+	if err == io.EOF {
+		return nil, ErrEndOfQueue
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, framingError{errors.New("driver: truncated compilation record length")}
+	} else if err != nil {
+		return nil, framingError{errors.WithMessage(err, "driver: reading compilation record")}
+	}
+	if size > MaxStreamRecord {
+		return nil, framingError{errors.Errorf("driver: compilation record too large (%d bytes)", size)}
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(q.rd, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, framingError{errors.Errorf("driver: truncated compilation record (want %d bytes)", size)}
+	} else if err != nil {
+		return nil, framingError{errors.WithMessage(err, "driver: reading compilation record")}
+	}
+	var unit apb.CompilationUnit
+	if err := proto.Unmarshal(buf, &unit); err != nil {
+		return nil, errors.WithMessage(err, "driver: decoding compilation record")
+	}
+	return &unit, nil
+}
+
+// A prefetchQueue is a Queue that delivers compilations read ahead from
+// another queue by a background goroutine.
+type prefetchQueue struct {
+	units chan Compilation
+	done  chan struct{} // closed when the background goroutine exits
+	err   error         // the error that ended the underlying queue
+}
+
+// newPrefetchQueue starts reading up to n compilations ahead from q until it
+// ends or ctx is canceled.  Compilations buffered when ctx ends are dropped.
+func newPrefetchQueue(ctx context.Context, q Queue, n int) *prefetchQueue {
+	p := &prefetchQueue{
+		units: make(chan Compilation, n),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		defer close(p.units)
+		for {
+			if err := q.Next(ctx, func(ctx context.Context, cu Compilation) error {
+				select {
+				case p.units <- cu:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}); err != nil {
+				p.err = err
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Next implements the Queue interface.
+func (p *prefetchQueue) Next(ctx context.Context, f CompilationFunc) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case cu, ok := <-p.units:
+		if !ok {
+			return p.err
+		}
+		return f(ctx, cu)
+	}
+}
+
+// wait blocks until the background goroutine has exited.
+func (p *prefetchQueue) wait() { <-p.done }
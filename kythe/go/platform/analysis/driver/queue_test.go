@@ -0,0 +1,511 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// drain reads all the compilations from q, returning their signatures.
+func drain(ctx context.Context, q Queue) ([]string, error) {
+	var sigs []string
+	for {
+		err := q.Next(ctx, func(_ context.Context, cu Compilation) error {
+			sigs = append(sigs, cu.Unit.GetVName().GetSignature())
+			return nil
+		})
+		if err == ErrEndOfQueue {
+			return sigs, nil
+		} else if err != nil {
+			return sigs, err
+		}
+	}
+}
+
+func units(sigs ...string) (us []*apb.CompilationUnit) {
+	for _, sig := range sigs {
+		us = append(us, &apb.CompilationUnit{VName: &spb.VName{Signature: sig}})
+	}
+	return
+}
+
+func checkSigs(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("Got compilations %q, want %q", got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("Got compilations %q, want %q", got, want)
+			return
+		}
+	}
+}
+
+func TestChannelQueue(t *testing.T) {
+	ch := make(chan *apb.CompilationUnit)
+	go func() {
+		defer close(ch)
+		for _, u := range units("a", "b", "c") {
+			ch <- u
+		}
+	}()
+	sigs, err := drain(context.Background(), ChannelQueue(ch))
+	if err != nil {
+		t.Fatalf("Queue error: %v", err)
+	}
+	checkSigs(t, sigs, "a", "b", "c")
+}
+
+func TestChannelQueueCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	q := ChannelQueue(make(chan *apb.CompilationUnit)) // never delivers
+	if err := q.Next(ctx, func(context.Context, Compilation) error {
+		t.Error("Unexpected compilation")
+		return nil
+	}); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v; found %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestSliceQueue(t *testing.T) {
+	q := SliceQueue(units("a", "b", "c"))
+	if n, ok := q.(Sizer).Remaining(); n != 3 || !ok {
+		t.Errorf("Remaining: got (%d, %v), want (3, true)", n, ok)
+	}
+	sigs, err := drain(context.Background(), q)
+	if err != nil {
+		t.Errorf("Slice queue failed: %v", err)
+	}
+	checkSigs(t, sigs, "a", "b", "c")
+	if n, ok := q.(Sizer).Remaining(); n != 0 || !ok {
+		t.Errorf("Remaining after drain: got (%d, %v), want (0, true)", n, ok)
+	}
+}
+
+func TestMultiQueue(t *testing.T) {
+	mq := MultiQueue(
+		&syncQueue{comps: comps("a", "b")},
+		&syncQueue{},
+		&syncQueue{comps: comps("c")},
+	)
+	sigs, err := drain(context.Background(), mq)
+	if err != nil {
+		t.Fatalf("Queue error: %v", err)
+	}
+	checkSigs(t, sigs, "a", "b", "c")
+}
+
+func TestMultiQueueError(t *testing.T) {
+	errFromQueue := errors.New("bad queue")
+	mq := MultiQueue(
+		&syncQueue{comps: comps("a")},
+		queueFunc(func(context.Context, CompilationFunc) error { return errFromQueue }),
+		&syncQueue{comps: comps("b")},
+	)
+	sigs, err := drain(context.Background(), mq)
+	if err != errFromQueue {
+		t.Errorf("Expected error %v; found %v", errFromQueue, err)
+	}
+	checkSigs(t, sigs, "a")
+}
+
+func TestMultiQueueCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mq := MultiQueue(
+		queueFunc(func(context.Context, CompilationFunc) error {
+			cancel()
+			return ErrEndOfQueue
+		}),
+		&syncQueue{comps: comps("a")},
+	)
+	if sigs, err := drain(ctx, mq); err != context.Canceled {
+		t.Errorf("Expected %v; found %v (compilations %q)", context.Canceled, err, sigs)
+	}
+}
+
+func TestPrefetchQueue(t *testing.T) {
+	errFromQueue := errors.New("bad queue")
+	inner := MultiQueue(
+		&syncQueue{comps: comps("a", "b", "c")},
+		queueFunc(func(context.Context, CompilationFunc) error { return errFromQueue }),
+	)
+	p := newPrefetchQueue(context.Background(), inner, 2)
+	defer p.wait()
+
+	// The compilations read before the error are delivered first.
+	sigs, err := drain(context.Background(), p)
+	if err != errFromQueue {
+		t.Errorf("Expected error %v; found %v", errFromQueue, err)
+	}
+	checkSigs(t, sigs, "a", "b", "c")
+}
+
+func TestPrefetchQueueCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	var reads int
+	// An infinite queue.
+	inner := queueFunc(func(ctx context.Context, f CompilationFunc) error {
+		mu.Lock()
+		reads++
+		mu.Unlock()
+		return f(ctx, Compilation{Unit: &apb.CompilationUnit{}})
+	})
+	p := newPrefetchQueue(ctx, inner, 3)
+	if err := p.Next(ctx, func(context.Context, Compilation) error { return nil }); err != nil {
+		t.Errorf("Next failed: %v", err)
+	}
+	cancel()
+	p.wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if reads > 5 { // 1 consumed + 3 buffered + 1 blocked
+		t.Errorf("Prefetch read too far ahead: %d reads", reads)
+	}
+}
+
+func encodeUnits(t *testing.T, sigs ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := delimited.NewWriter(&buf)
+	for _, unit := range units(sigs...) {
+		if err := w.PutProto(unit); err != nil {
+			t.Fatalf("Encoding unit: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestStreamQueue(t *testing.T) {
+	q := StreamQueue(bytes.NewReader(encodeUnits(t, "a", "b", "c")))
+	sigs, err := drain(context.Background(), q)
+	if err != nil {
+		t.Errorf("Stream queue failed: %v", err)
+	}
+	checkSigs(t, sigs, "a", "b", "c")
+
+	// The end of the stream is sticky.
+	if err := q.Next(context.Background(), nil); err != ErrEndOfQueue {
+		t.Errorf("Next after end: got %v, want %v", err, ErrEndOfQueue)
+	}
+}
+
+func TestStreamQueueTruncated(t *testing.T) {
+	data := encodeUnits(t, "a", "b")
+	q := StreamQueue(bytes.NewReader(data[:len(data)-1]))
+	sigs, err := drain(context.Background(), q)
+	if err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("Stream queue: got error %v, want truncated record", err)
+	}
+	checkSigs(t, sigs, "a")
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Compressing: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Compressing: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressedStreamQueue(t *testing.T) {
+	plain := encodeUnits(t, "a", "b", "c")
+	tests := []struct {
+		desc string
+		data []byte
+		dec  Decompressor
+	}{
+		{"detected gzip", gzipped(t, plain), nil},
+		{"explicit gzip", gzipped(t, plain), GzipDecompressor},
+		{"uncompressed", plain, nil},
+		{"custom", plain, func(r io.Reader) (io.Reader, error) { return r, nil }},
+	}
+	for _, test := range tests {
+		sigs, err := drain(context.Background(), CompressedStreamQueue(bytes.NewReader(test.data), test.dec))
+		if err != nil {
+			t.Errorf("%s: stream queue failed: %v", test.desc, err)
+		}
+		checkSigs(t, sigs, "a", "b", "c")
+	}
+}
+
+func TestCompressedStreamQueueCorrupt(t *testing.T) {
+	data := gzipped(t, encodeUnits(t, "a", "b", "c"))
+	corrupt := append([]byte(nil), data...)
+	for i := 12; i < len(corrupt)-8; i++ {
+		corrupt[i] ^= 0xff
+	}
+	tests := []struct {
+		desc, want string
+		data       []byte
+		dec        Decompressor
+	}{
+		{"truncated", "decompressing", data[:len(data)-4], nil},
+		{"corrupt", "decompressing", corrupt, nil},
+		{"header only", "decompressing", data[:2], GzipDecompressor},
+		{"zstd", "zstd", []byte{0x28, 0xb5, 0x2f, 0xfd, 0}, nil},
+		{"panic", "panic", data, func(io.Reader) (io.Reader, error) { return panicReader{}, nil }},
+	}
+	for _, test := range tests {
+		_, err := drain(context.Background(), CompressedStreamQueue(bytes.NewReader(test.data), test.dec))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want one mentioning %q", test.desc, err, test.want)
+		}
+	}
+}
+
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error) { panic("bad input") }
+
+func TestStreamQueueCancel(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	q := StreamQueue(pr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Next(ctx, nil); err != context.DeadlineExceeded {
+		t.Errorf("Next with blocked reader: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The abandoned read delivers its compilation to the next call.
+	go pw.Write(encodeUnits(t, "a"))
+	var got []string
+	if err := q.Next(context.Background(), func(_ context.Context, cu Compilation) error {
+		got = append(got, cu.Unit.GetVName().GetSignature())
+		return nil
+	}); err != nil {
+		t.Errorf("Next after cancel failed: %v", err)
+	}
+	checkSigs(t, got, "a")
+}
+
+func TestPeekable(t *testing.T) {
+	ctx := context.Background()
+	q := Peekable(&syncQueue{comps: comps("a", "b")})
+	if Peekable(q) != q {
+		t.Error("Peekable did not return an existing Peeker unchanged")
+	}
+
+	for i := 0; i < 2; i++ {
+		cu, err := q.Peek(ctx)
+		if err != nil {
+			t.Fatalf("Peek failed: %v", err)
+		}
+		checkSigs(t, []string{cu.Unit.GetVName().GetSignature()}, "a")
+	}
+	sigs, err := drain(ctx, q)
+	if err != nil {
+		t.Errorf("Draining peekable queue failed: %v", err)
+	}
+	checkSigs(t, sigs, "a", "b")
+	if _, err := q.Peek(ctx); err != ErrEndOfQueue {
+		t.Errorf("Peek at end: got %v, want %v", err, ErrEndOfQueue)
+	}
+}
+
+func TestShardQueue(t *testing.T) {
+	var sigs []string
+	for i := 0; i < 20; i++ {
+		sigs = append(sigs, fmt.Sprint("cu", i))
+	}
+	reversed := make([]string, len(sigs))
+	for i, sig := range sigs {
+		reversed[len(sigs)-1-i] = sig
+	}
+
+	const shards = 3
+	owner := make(map[string]int)
+	for i := 0; i < shards; i++ {
+		got, err := drain(context.Background(), ShardQueue(SliceQueue(units(sigs...)), i, shards))
+		if err != nil {
+			t.Fatalf("Shard %d failed: %v", i, err)
+		}
+		if len(got) == 0 || len(got) == len(sigs) {
+			t.Errorf("Shard %d received %d of %d compilations", i, len(got), len(sigs))
+		}
+		for _, sig := range got {
+			if j, ok := owner[sig]; ok {
+				t.Errorf("Compilation %q delivered to shards %d and %d", sig, j, i)
+			}
+			owner[sig] = i
+		}
+
+		// The assignment does not depend on the order of the queue.
+		again, err := drain(context.Background(), ShardQueue(SliceQueue(units(reversed...)), i, shards))
+		if err != nil {
+			t.Fatalf("Shard %d failed: %v", i, err)
+		}
+		sort.Strings(got)
+		sort.Strings(again)
+		if err := testutil.DeepEqual(got, again); err != nil {
+			t.Errorf("Shard %d differs for a reordered queue: %v", i, err)
+		}
+	}
+	if len(owner) != len(sigs) {
+		t.Errorf("Shards received %d distinct compilations, want %d", len(owner), len(sigs))
+	}
+}
+
+func TestCancelable(t *testing.T) {
+	sigs, err := drain(context.Background(), Cancelable(SliceQueue(units("a", "b"))))
+	if err != nil {
+		t.Fatalf("Queue error: %v", err)
+	}
+	checkSigs(t, sigs, "a", "b")
+
+	// A queue that ignores its context and blocks until released.
+	release := make(chan struct{})
+	returned := make(chan error, 1)
+	blocked := queueFunc(func(ctx context.Context, f CompilationFunc) error {
+		<-release
+		err := f(ctx, Compilation{Unit: units("late")[0]})
+		returned <- err
+		return err
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Cancelable(blocked).Next(ctx, func(context.Context, Compilation) error {
+		t.Error("Unexpected compilation")
+		return nil
+	}); err != context.DeadlineExceeded {
+		t.Errorf("Next with blocked queue: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A compilation delivered once Next has returned is dropped.
+	close(release)
+	if err := <-returned; err != context.DeadlineExceeded {
+		t.Errorf("Callback after cancel: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCancelableWaitsForCallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var finished bool
+	err := Cancelable(SliceQueue(units("a"))).Next(ctx, func(context.Context, Compilation) error {
+		cancel()
+		time.Sleep(5 * time.Millisecond)
+		finished = true
+		return nil
+	})
+	if err != nil || !finished {
+		t.Errorf("Next returned %v before its callback finished", err)
+	}
+}
+
+func TestObservedQueue(t *testing.T) {
+	logger := new(testLogger)
+	q := ObservedQueue(SliceQueue(units("a", "b")), logger)
+	errBad := errors.New("bad compilation")
+	if err := q.Next(context.Background(), func(context.Context, Compilation) error { return errBad }); err != errBad {
+		t.Errorf("Next: got error %v, want %v", err, errBad)
+	}
+	sigs, err := drain(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Queue error: %v", err)
+	}
+	checkSigs(t, sigs, "b")
+
+	if len(logger.infos) != 5 {
+		t.Fatalf("Got messages %q, want 5", logger.infos)
+	}
+	checks := []struct {
+		msg  string
+		want []string
+	}{
+		{logger.infos[0], []string{"compilation dequeued", "#a", "key=" + KeyOf(units("a")[0]), "inputs=0", "wait="}},
+		{logger.infos[1], []string{"compilation handled", "#a", "elapsed=", "error=bad compilation"}},
+		{logger.infos[2], []string{"compilation dequeued", "#b"}},
+		{logger.infos[3], []string{"compilation handled", "#b"}},
+		{logger.infos[4], []string{"no compilation", "error=" + ErrEndOfQueue.Error()}},
+	}
+	for _, c := range checks {
+		for _, w := range c.want {
+			if !strings.Contains(c.msg, w) {
+				t.Errorf("Message %q does not contain %q", c.msg, w)
+			}
+		}
+	}
+	if strings.Contains(logger.infos[3], "error=") {
+		t.Errorf("Unexpected error in %q", logger.infos[3])
+	}
+}
+
+func TestQueueRemaining(t *testing.T) {
+	tests := []struct {
+		desc  string
+		q     Queue
+		n     int
+		known bool
+	}{
+		{"stream", StreamQueue(bytes.NewReader(nil)), 0, false},
+		{"channel", ChannelQueue(nil), 0, false},
+		{"multi", MultiQueue(&syncQueue{comps: comps("a")}, &syncQueue{comps: comps("b", "c")}), 3, true},
+		{"multi unknown", MultiQueue(&syncQueue{comps: comps("a")}, StreamQueue(bytes.NewReader(nil))), 0, false},
+		{"peekable", Peekable(&syncQueue{comps: comps("a", "b")}), 2, true},
+		{"shard", ShardQueue(&syncQueue{comps: comps("a", "b", "c")}, 0, 2), 2, true},
+		{"shard unknown", ShardQueue(ChannelQueue(nil), 0, 2), 0, false},
+		{"cancelable", Cancelable(&syncQueue{comps: comps("a", "b")}), 2, true},
+		{"observed", ObservedQueue(&syncQueue{comps: comps("a", "b")}, new(testLogger)), 2, true},
+	}
+	for _, test := range tests {
+		var n int
+		var known bool
+		if s, ok := test.q.(Sizer); ok {
+			n, known = s.Remaining()
+		}
+		if n != test.n || known != test.known {
+			t.Errorf("%s: Remaining: got (%d, %v), want (%d, %v)", test.desc, n, known, test.n, test.known)
+		}
+	}
+
+	// A compilation buffered by Peek is still counted.
+	q := Peekable(&syncQueue{comps: comps("a", "b")})
+	if _, err := q.Peek(context.Background()); err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if n, _ := q.(Sizer).Remaining(); n != 2 {
+		t.Errorf("Remaining after Peek: got %d, want 2", n)
+	}
+}
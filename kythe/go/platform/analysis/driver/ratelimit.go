@@ -0,0 +1,114 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A RateLimit bounds the rate at which a Driver sends requests to its
+// analyzer, using a token bucket shared by all the driver's workers.
+type RateLimit struct {
+	PerSecond float64 // the sustained rate of requests permitted
+	Burst     int     // the maximum burst of requests; if < 1, 1 is used
+}
+
+// A limiter implements a token bucket.
+type limiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time // when tokens was last updated
+}
+
+func newLimiter(r *RateLimit) *limiter {
+	if r == nil {
+		return nil
+	}
+	burst := float64(r.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{rate: r.PerSecond, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until a token is available or ctx ends, and reports whether it
+// had to wait.  A nil *limiter never waits.
+func (l *limiter) wait(ctx context.Context) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens-- // reserve a token, which may be repaid in the future
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return false, nil
+	}
+	if err := sleep(ctx, delay); err != nil {
+		l.mu.Lock()
+		l.tokens++ // return the unused reservation
+		l.mu.Unlock()
+		return true, err
+	}
+	return true, nil
+}
+
+// A spacer enforces a minimum interval between the starts of successive
+// events.
+type spacer struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time // the earliest permitted start of the next event
+}
+
+func newSpacer(interval time.Duration) *spacer {
+	if interval <= 0 {
+		return nil
+	}
+	return &spacer{interval: interval}
+}
+
+// wait blocks until the next event may start or ctx ends.  A nil *spacer
+// never waits.  An event whose wait is abandoned still counts as having
+// started.
+func (s *spacer) wait(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	now := time.Now()
+	start := s.next
+	if start.Before(now) {
+		start = now
+	}
+	s.next = start.Add(s.interval)
+	s.mu.Unlock()
+	return sleep(ctx, start.Sub(now))
+}
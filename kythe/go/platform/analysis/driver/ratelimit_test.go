@@ -0,0 +1,91 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestLimiterCancel(t *testing.T) {
+	l := newLimiter(&RateLimit{PerSecond: 0.001}) // one token, refilled slowly
+	if waited, err := l.wait(context.Background()); waited || err != nil {
+		t.Fatalf("First wait: got (%v, %v), want (false, nil)", waited, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := l.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Second wait: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDriverRateLimit(t *testing.T) {
+	d := &Driver{
+		Concurrency: 2,
+		RateLimit:   &RateLimit{PerSecond: 200, Burst: 2},
+		Analyzer:    emitter(nil),
+	}
+	start := time.Now()
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d", "e", "f")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+	// The first two requests use the burst; the remaining four wait about 5ms
+	// each for tokens.
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("Run finished too quickly for the rate limit: %v", elapsed)
+	}
+	if stats.RateLimitWaits < 3 {
+		t.Errorf("Expected at least 3 rate limit waits; found %d", stats.RateLimitWaits)
+	}
+}
+
+func TestSpacerCancel(t *testing.T) {
+	s := newSpacer(time.Hour)
+	testutil.FatalOnErrT(t, "First wait: %v", s.wait(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := s.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Second wait: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDriverMinInterval(t *testing.T) {
+	var starts []time.Time
+	d := &Driver{
+		MinInterval: 10 * time.Millisecond,
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			starts = append(starts, time.Now())
+			return nil
+		}),
+	}
+	begin := time.Now()
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d")}))
+
+	// The gaps between successive starts vary with scheduling, but each start
+	// is no earlier than its slot.
+	for i, start := range starts {
+		if want := time.Duration(i) * d.MinInterval; start.Sub(begin) < want {
+			t.Errorf("Analysis %d started %v into the run, want at least %v", i, start.Sub(begin), want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"sync"
+	"time"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A CompilationResult describes the outcome of a single compilation processed
+// by a run; see Driver.Results.
+type CompilationResult struct {
+	Unit     *apb.CompilationUnit
+	Key      string        // the key of Unit, according to the driver's Keyer
+	Err      error         // nil if the compilation succeeded
+	Duration time.Duration // time spent in Analyze
+	Outputs  int           // outputs written
+	Empty    bool          // whether the compilation succeeded with no outputs
+	Retries  int           // analyses retried in place; see RetryPolicy
+
+	// QueueWait is the time the worker spent in the queue's Next method
+	// before the compilation was delivered.  It is small when compilations
+	// are prefetched, or when the analyzer rather than the queue limits the
+	// run.
+	QueueWait time.Duration
+
+	// If the driver tracks inputs, Fetches and FetchBytes report the files
+	// fetched while the compilation was analyzed; see Driver.TrackInputs.
+	Fetches    int
+	FetchBytes int64
+}
+
+// DefaultResultsBuffer is the capacity of the channel returned by
+// Driver.Results if ResultsBuffer is 0.
+const DefaultResultsBuffer = 256
+
+// Results returns a channel that receives a CompilationResult for each
+// compilation finished by the next run of d, in the order they finish, and is
+// closed when that run returns.  Skipped and invalid compilations are not
+// reported.  Results must be called before Run; each call after a run has
+// started prepares a new channel for the run that follows.
+//
+// The channel has a capacity of d.ResultsBuffer.  Publishing never blocks the
+// workers: if the channel is full, the oldest buffered result is discarded to
+// make room for each new one, and RunStats.ResultsDropped counts the results
+// discarded.
+func (d *Driver) Results() <-chan CompilationResult {
+	d.resultsMu.Lock()
+	defer d.resultsMu.Unlock()
+	if d.results == nil {
+		n := d.ResultsBuffer
+		if n <= 0 {
+			n = DefaultResultsBuffer
+		}
+		d.results = &resultStream{ch: make(chan CompilationResult, n)}
+	}
+	return d.results.ch
+}
+
+// takeResults returns the stream prepared by Results for a new run, or nil.
+func (d *Driver) takeResults() *resultStream {
+	d.resultsMu.Lock()
+	defer d.resultsMu.Unlock()
+	s := d.results
+	d.results = nil
+	return s
+}
+
+// A resultStream publishes the results of a run to a channel.
+type resultStream struct {
+	mu      sync.Mutex
+	ch      chan CompilationResult
+	dropped int
+}
+
+// publish sends res, discarding the oldest buffered result if the channel is
+// full.  It is a no-op if s is nil.
+func (s *resultStream) publish(res CompilationResult) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		select {
+		case s.ch <- res:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+			s.dropped++
+		default: // the consumer made room
+		}
+	}
+}
+
+// close closes the channel, and returns the number of results discarded.  It
+// returns 0 if s is nil.
+func (s *resultStream) close() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.ch)
+	return s.dropped
+}
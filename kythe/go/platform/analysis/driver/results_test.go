@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestDriverResults(t *testing.T) {
+	d := &Driver{
+		ContinueOnError: true,
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			if req.Compilation.VName.Signature == "b" {
+				return errFromAnalysis
+			}
+			return out(ctx, &apb.AnalysisOutput{Value: []byte("x")})
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	results := d.Results()
+	type result struct {
+		Sig     string
+		Failed  bool
+		Outputs int
+	}
+	done := make(chan []result)
+	go func() {
+		var got []result
+		for res := range results {
+			if res.Key != KeyOf(res.Unit) {
+				t.Errorf("Result for %q has key %q, want %q", res.Unit.VName.Signature, res.Key, KeyOf(res.Unit))
+			}
+			got = append(got, result{res.Unit.VName.Signature, res.Err != nil, res.Outputs})
+		}
+		done <- got
+	}()
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a", "b", "c")}); err == nil {
+		t.Error("Driver succeeded, want an error for b")
+	}
+	want := []result{{"a", false, 1}, {"b", true, 0}, {"c", false, 1}}
+	if err := testutil.DeepEqual(want, <-done); err != nil {
+		t.Errorf("Results: %v", err)
+	}
+}
+
+func TestDriverResultsDropOldest(t *testing.T) {
+	d := &Driver{
+		Analyzer:      analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error { return nil }),
+		ResultsBuffer: 2,
+	}
+	results := d.Results()
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d", "e")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+	var got []string
+	for res := range results {
+		got = append(got, res.Unit.VName.Signature)
+	}
+	if err := testutil.DeepEqual([]string{"d", "e"}, got); err != nil {
+		t.Errorf("Results: %v", err)
+	}
+	if stats.ResultsDropped != 3 {
+		t.Errorf("Got %d results dropped, want 3", stats.ResultsDropped)
+	}
+}
+
+func TestDriverResultsClosedOnError(t *testing.T) {
+	d := &Driver{} // no analyzer
+	results := d.Results()
+	if err := d.Run(context.Background(), &syncQueue{}); err == nil {
+		t.Fatal("Driver succeeded, want a configuration error")
+	}
+	if _, ok := <-results; ok {
+		t.Error("Results channel received a value, want it closed")
+	}
+	if d.Results() == results {
+		t.Error("Results returned the channel of a finished run")
+	}
+}
+
+func TestDriverQueueWait(t *testing.T) {
+	const wait = 20 * time.Millisecond
+	q := &syncQueue{comps: comps("a", "b")}
+	slow := queueFunc(func(ctx context.Context, f CompilationFunc) error {
+		time.Sleep(wait)
+		return q.Next(ctx, f)
+	})
+	d := &Driver{
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		}),
+	}
+	results := d.Results()
+	stats, err := d.RunWithStats(context.Background(), slow)
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	var n int
+	for res := range results {
+		n++
+		if res.QueueWait < wait {
+			t.Errorf("Result for %s: got queue wait %v, want at least %v", res.Key, res.QueueWait, wait)
+		}
+		if res.Duration <= 0 || res.Duration >= res.QueueWait {
+			t.Errorf("Result for %s: got analysis time %v, want less than the queue wait %v", res.Key, res.Duration, res.QueueWait)
+		}
+	}
+	if n != 2 {
+		t.Errorf("Got %d results, want 2", n)
+	}
+	// The wait for the end of the queue is not attributed to a compilation.
+	if stats.QueueWaitTime < 2*wait || stats.QueueWaitTime >= stats.WallTime {
+		t.Errorf("Stats: got queue wait %v and wall time %v, want a queue wait of at least %v", stats.QueueWaitTime, stats.WallTime, 2*wait)
+	}
+}
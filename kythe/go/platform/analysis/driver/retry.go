@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"math"
+	"time"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A RetryPolicy controls how a Driver retries analyses that fail with a
+// transient error.  Retries are delayed with exponential backoff, starting at
+// BaseDelay and doubling after each failed attempt, up to MaxDelay if it is
+// set or else the largest time.Duration.
+//
+// While a RetryPolicy is in effect, the outputs of each analysis attempt are
+// buffered in memory and passed to the driver's WriteOutput only once the
+// attempt succeeds; the outputs of a failed attempt are discarded.  This
+// ensures a retried compilation does not emit the same outputs twice.
+type RetryPolicy struct {
+	MaxAttempts int           // maximum attempts per compilation, including the first
+	BaseDelay   time.Duration // delay before the first retry
+	MaxDelay    time.Duration // if positive, the maximum delay between attempts
+
+	// Retryable reports whether err is a transient error for which the
+	// analysis should be retried.  If nil, no errors are retried.
+	Retryable func(err error) bool
+
+	// If TeardownBetweenAttempts is true, Teardown is invoked after each failed
+	// attempt and Setup is invoked again before the next one.  Otherwise, Setup
+	// and Teardown are each invoked once per compilation.
+	TeardownBetweenAttempts bool
+
+	// If OnRetry != nil, it is called before each retry in place, after the
+	// delay has been chosen and before it begins, with the number of the
+	// attempt that failed (counting from 1) and its error.  If OnRetry returns
+	// an error, the compilation is not retried, and fails with that error.
+	OnRetry func(ctx context.Context, unit *apb.CompilationUnit, attempt int, err error, delay time.Duration) error
+
+	// If Requeue is true and the driver's queue is a Requeuer, a compilation
+	// that fails with a retryable error is handed back to the queue to be
+	// analyzed again later, instead of being retried in place.  A compilation
+	// is requeued at most MaxAttempts-1 times per run, counting by its key, and
+	// then fails.  A requeued compilation is torn down, is not counted as
+	// processed, and does not count toward the driver's Limit; it is counted
+	// in RunStats.Requeued.
+	Requeue bool
+}
+
+// enabled reports whether p may retry any analysis.
+func (p *RetryPolicy) enabled() bool {
+	return p != nil && p.MaxAttempts > 1 && p.Retryable != nil
+}
+
+// retryable reports whether an analysis that failed with err on the given
+// attempt (counting from 1) should be retried.
+func (p *RetryPolicy) retryable(attempt int, err error) bool {
+	return err != nil && p.enabled() && attempt < p.MaxAttempts && p.Retryable(err)
+}
+
+// Delay returns the backoff delay following the given failed attempt,
+// counting from 1.
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt; i++ {
+		if d > math.MaxInt64/2 {
+			d = math.MaxInt64 // doubling would overflow
+			break
+		}
+		d *= 2
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// Wait blocks for the backoff delay following the given failed attempt, or
+// until ctx ends, returning ctx.Err() in the latter case.
+func (p *RetryPolicy) Wait(ctx context.Context, attempt int) error {
+	return sleep(ctx, p.Delay(attempt))
+}
+
+// sleep blocks for d or until ctx ends, returning ctx.Err() in the latter case.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,334 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+var errTransient = errors.New("transient analysis error")
+
+func isTransient(err error) bool { return err == errTransient }
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for i, want := range []time.Duration{1, 2, 4, 5, 5} {
+		attempt := i + 1
+		if got := p.Delay(attempt); got != want*time.Second {
+			t.Errorf("Delay(%d): got %v, want %v", attempt, got, want*time.Second)
+		}
+	}
+}
+
+func TestRetryPolicyDelayCapped(t *testing.T) {
+	// A BaseDelay beyond MaxDelay is capped from the first retry on.
+	p := &RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Second}
+	for _, attempt := range []int{1, 2, 100} {
+		if got := p.Delay(attempt); got != time.Second {
+			t.Errorf("Delay(%d): got %v, want %v", attempt, got, time.Second)
+		}
+	}
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: time.Millisecond}
+	if err := p.Wait(context.Background(), 1); err != nil {
+		t.Errorf("Wait: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.BaseDelay = time.Hour
+	if err := p.Wait(ctx, 1); err != context.Canceled {
+		t.Errorf("Wait with a canceled context: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRetryPolicyDelayUnbounded(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: time.Second}
+	if got, want := p.Delay(10), 512*time.Second; got != want {
+		t.Errorf("Delay(10): got %v, want %v", got, want)
+	}
+	for _, attempt := range []int{40, 64, 100} {
+		if got := p.Delay(attempt); got != math.MaxInt64 {
+			t.Errorf("Delay(%d): got %v, want %v", attempt, got, time.Duration(math.MaxInt64))
+		}
+	}
+}
+
+func TestDriverRetry(t *testing.T) {
+	attempts := make(map[string]int)
+	var written []string
+	var setups, teardowns int
+	d := &Driver{
+		Retry: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Retryable: isTransient},
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			sig := req.Compilation.VName.Signature
+			attempts[sig]++
+			if err := out(ctx, &apb.AnalysisOutput{Value: []byte(sig)}); err != nil {
+				return err
+			}
+			if sig == "flaky" && attempts[sig] < 3 {
+				return errTransient
+			}
+			return nil
+		}),
+		WriteOutput: func(_ context.Context, out *apb.AnalysisOutput) error {
+			written = append(written, string(out.Value))
+			return nil
+		},
+		Context: testContext{
+			setup:         func(context.Context, Compilation) error { setups++; return nil },
+			teardown:      func(context.Context, Compilation) error { teardowns++; return nil },
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("flaky", "ok")}); err != nil {
+		t.Fatalf("Driver error: %v", err)
+	}
+	if attempts["flaky"] != 3 || attempts["ok"] != 1 {
+		t.Errorf("Unexpected attempt counts: %v", attempts)
+	}
+	// Outputs from failed attempts must be discarded.
+	if len(written) != 2 || written[0] != "flaky" || written[1] != "ok" {
+		t.Errorf("Unexpected outputs: %q", written)
+	}
+	if setups != 2 || teardowns != 2 {
+		t.Errorf("Expected 2 calls each to Setup and Teardown; found %d, %d", setups, teardowns)
+	}
+}
+
+func TestDriverRetryExhausted(t *testing.T) {
+	var attempts, setups, teardowns int
+	d := &Driver{
+		Retry: &RetryPolicy{
+			MaxAttempts:             2,
+			Retryable:               isTransient,
+			TeardownBetweenAttempts: true,
+		},
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			attempts++
+			return errTransient
+		}),
+		Context: testContext{
+			setup:         func(context.Context, Compilation) error { setups++; return nil },
+			teardown:      func(context.Context, Compilation) error { teardowns++; return nil },
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("bad")}); !errors.Is(err, errTransient) {
+		t.Errorf("Expected error %v; found %v", errTransient, err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts; found %d", attempts)
+	}
+	if setups != 2 || teardowns != 2 {
+		t.Errorf("Expected 2 calls each to Setup and Teardown; found %d, %d", setups, teardowns)
+	}
+}
+
+func TestDriverOnRetry(t *testing.T) {
+	type retry struct {
+		Sig     string
+		Attempt int
+		Delay   time.Duration
+	}
+	errAbort := errors.New("retries abandoned")
+	attempts := make(map[string]int)
+	var retries []retry
+	d := &Driver{
+		ContinueOnError: true,
+		Retry: &RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Millisecond,
+			Retryable:   isTransient,
+			OnRetry: func(_ context.Context, unit *apb.CompilationUnit, attempt int, err error, delay time.Duration) error {
+				if err != errTransient {
+					t.Errorf("OnRetry(%q): got error %v, want %v", unit.VName.Signature, err, errTransient)
+				}
+				retries = append(retries, retry{unit.VName.Signature, attempt, delay})
+				if unit.VName.Signature == "doomed" {
+					return errAbort
+				}
+				return nil
+			},
+		},
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			sig := req.Compilation.VName.Signature
+			attempts[sig]++
+			if sig == "doomed" || sig == "flaky" && attempts[sig] < 3 {
+				return errTransient
+			}
+			return nil
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	results := d.Results()
+	err := d.Run(context.Background(), &syncQueue{comps: comps("flaky", "doomed", "ok")})
+	if merr, ok := err.(MultiError); !ok || len(merr) != 1 || !errors.Is(merr[0], errAbort) {
+		t.Errorf("Run: got error %v, want %v for doomed", err, errAbort)
+	}
+	want := []retry{{"flaky", 1, time.Millisecond}, {"flaky", 2, 2 * time.Millisecond}, {"doomed", 1, time.Millisecond}}
+	if err := testutil.DeepEqual(want, retries); err != nil {
+		t.Errorf("Retries: %v", err)
+	}
+	if attempts["doomed"] != 1 {
+		t.Errorf("Got %d attempts for doomed, want 1", attempts["doomed"])
+	}
+	got := make(map[string]int)
+	for res := range results {
+		got[res.Unit.VName.Signature] = res.Retries
+	}
+	if err := testutil.DeepEqual(map[string]int{"flaky": 2, "doomed": 0, "ok": 0}, got); err != nil {
+		t.Errorf("Result retry counts: %v", err)
+	}
+}
+
+// busyError is an analysis.RetryAfter error.
+type busyError time.Duration
+
+func (e busyError) Error() string             { return "analyzer busy" }
+func (e busyError) RetryAfter() time.Duration { return time.Duration(e) }
+
+func TestDriverRetryAfter(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	var (
+		mu     sync.Mutex
+		failAt time.Time
+		starts []time.Time
+		calls  = make(map[string]int)
+	)
+	d := &Driver{
+		Concurrency: 3,
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			sig := req.Compilation.VName.Signature
+			mu.Lock()
+			now := time.Now()
+			starts = append(starts, now)
+			calls[sig]++
+			first := sig == "a" && calls[sig] == 1
+			if first {
+				failAt = now
+			}
+			mu.Unlock()
+			if first {
+				return fmt.Errorf("wrapped: %w", busyError(delay))
+			}
+			time.Sleep(5 * time.Millisecond)
+			return nil
+		}),
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("a", "b", "c", "d", "e", "f", "g", "h")})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+
+	if calls["a"] != 2 {
+		t.Errorf("Got %d calls for a, want 2", calls["a"])
+	}
+	if stats.RetriedAfter != 1 || stats.Succeeded != 8 {
+		t.Errorf("Stats: got %d retried after and %d succeeded, want 1 and 8", stats.RetriedAfter, stats.Succeeded)
+	}
+	// Allow the failing worker some time to start the backoff; after that, no
+	// worker starts an analysis until the delay has passed.
+	for _, start := range starts {
+		if since := start.Sub(failAt); since > 20*time.Millisecond && since < delay {
+			t.Errorf("An analysis started %v after the analyzer asked for a %v delay", since, delay)
+		}
+	}
+}
+
+func TestDriverMaxRetryAfter(t *testing.T) {
+	var calls int
+	d := &Driver{
+		MaxRetryAfter: 2,
+		Analyzer: analyzerFunc(func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error {
+			calls++
+			return busyError(time.Millisecond)
+		}),
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: comps("a")}); err == nil {
+		t.Error("Driver succeeded, want an error")
+	}
+	if calls != 3 {
+		t.Errorf("Got %d calls, want 3", calls)
+	}
+}
+
+// A requeueQueue is a syncQueue that is also a Requeuer.
+type requeueQueue struct{ syncQueue }
+
+// Requeue implements the Requeuer interface.
+func (q *requeueQueue) Requeue(_ context.Context, cu Compilation) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.comps = append(q.comps, cu)
+	return nil
+}
+
+func TestDriverRequeue(t *testing.T) {
+	tests := []struct {
+		failures     int // failures of a before it succeeds
+		wantAnalyzed []string
+		wantRequeued int
+		wantErr      bool
+	}{
+		{0, []string{"a", "b"}, 0, false},
+		{2, []string{"a", "b", "a", "a"}, 2, false},
+		{5, []string{"a", "b", "a", "a"}, 2, true}, // MaxAttempts reached
+	}
+	for _, test := range tests {
+		var (
+			analyzed []string
+			calls    int // calls for a
+		)
+		d := &Driver{
+			Retry: &RetryPolicy{MaxAttempts: 3, Retryable: isTransient, Requeue: true},
+			Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+				sig := req.Compilation.VName.Signature
+				analyzed = append(analyzed, sig)
+				if sig == "a" {
+					if calls++; calls <= test.failures {
+						return errTransient
+					}
+				}
+				return nil
+			}),
+		}
+		q := &requeueQueue{syncQueue{comps: comps("a", "b")}}
+		stats, err := d.RunWithStats(context.Background(), q)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("%d failures: got error %v, want error %v", test.failures, err, test.wantErr)
+		}
+		if err := testutil.DeepEqual(test.wantAnalyzed, analyzed); err != nil {
+			t.Errorf("%d failures: analyzed: %v", test.failures, err)
+		}
+		if stats.Requeued != test.wantRequeued {
+			t.Errorf("%d failures: got %d requeued, want %d", test.failures, stats.Requeued, test.wantRequeued)
+		}
+	}
+}
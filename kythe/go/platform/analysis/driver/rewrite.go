@@ -0,0 +1,184 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"path"
+	"regexp"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// A RewriteRule replaces each match of Pattern with Replacement, as by the
+// ReplaceAllString method of regexp.Regexp, so Replacement may refer to parts
+// of the match with $1 or ${name}.
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// NewRewriteRule returns a RewriteRule that replaces matches of the regular
+// expression pattern with replacement.
+func NewRewriteRule(pattern, replacement string) (RewriteRule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return RewriteRule{}, err
+	}
+	return RewriteRule{Pattern: re, Replacement: replacement}, nil
+}
+
+// An ArgumentRewriter rewrites the arguments of compilation units before they
+// are analyzed, for example to strip a machine-specific path.  Each of its
+// rules is applied in turn to every argument.  Its Transform method may be
+// installed with WithTransform, or called from the Transform method of a
+// Context that does other work.
+type ArgumentRewriter struct {
+	Rules []RewriteRule
+
+	// If WorkingDirectory is true, the rules are also applied to the working
+	// directory of each unit.  If Environment is true, they are also applied
+	// to the values, but not the names, of its environment variables.
+	WorkingDirectory bool
+	Environment      bool
+}
+
+// Transform returns the unit of cu with its arguments rewritten, or nil if no
+// rule changed it.  The unit of cu is not modified.
+func (a *ArgumentRewriter) Transform(_ context.Context, cu Compilation) (*apb.CompilationUnit, error) {
+	return a.Rewrite(cu.Unit), nil
+}
+
+// Rewrite returns a copy of unit with its arguments rewritten, or nil if no
+// rule changed it.  The copy is shallow: it shares all the fields of unit
+// except those rewritten.
+func (a *ArgumentRewriter) Rewrite(unit *apb.CompilationUnit) *apb.CompilationUnit {
+	var cp *apb.CompilationUnit
+	clone := func() {
+		if cp == nil {
+			c := *unit
+			cp = &c
+		}
+	}
+	var args []string
+	for i, arg := range unit.GetArgument() {
+		if s := a.apply(arg); s != arg {
+			if args == nil {
+				args = append([]string(nil), unit.Argument...)
+			}
+			args[i] = s
+		}
+	}
+	if args != nil {
+		clone()
+		cp.Argument = args
+	}
+	if a.WorkingDirectory {
+		if s := a.apply(unit.GetWorkingDirectory()); s != unit.GetWorkingDirectory() {
+			clone()
+			cp.WorkingDirectory = s
+		}
+	}
+	if a.Environment {
+		var envs []*apb.CompilationUnit_Env
+		for i, env := range unit.GetEnvironment() {
+			if s := a.apply(env.GetValue()); s != env.GetValue() {
+				if envs == nil {
+					envs = append([]*apb.CompilationUnit_Env(nil), unit.Environment...)
+				}
+				envs[i] = &apb.CompilationUnit_Env{Name: env.Name, Value: s}
+			}
+		}
+		if envs != nil {
+			clone()
+			cp.Environment = envs
+		}
+	}
+	return cp
+}
+
+// apply returns s with each of the rules of a applied in turn.
+func (a *ArgumentRewriter) apply(s string) string {
+	for _, r := range a.Rules {
+		s = r.Pattern.ReplaceAllString(s, r.Replacement)
+	}
+	return s
+}
+
+// An InputFilter removes required inputs from compilation units before they
+// are analyzed, leaving the rest of each unit intact.  It is meant for fault
+// isolation: analyzing a compilation with a subset of its inputs, for example
+// to bisect for the input that makes the analyzer crash.  An analyzer is
+// expected to fail for a unit lacking inputs it needs; that is the point.
+// Its Transform method may be installed with WithTransform, or called from
+// the Transform method of a Context that does other work.
+type InputFilter struct {
+	// Keep reports whether an input should be kept.  If nil, all inputs are
+	// kept.
+	Keep func(*apb.CompilationUnit_FileInput) bool
+}
+
+// Transform returns the unit of cu with the inputs Keep rejects removed, or
+// nil if it keeps them all.  The unit of cu is not modified.
+func (f *InputFilter) Transform(_ context.Context, cu Compilation) (*apb.CompilationUnit, error) {
+	return f.Filter(cu.Unit), nil
+}
+
+// Filter returns a copy of unit without the inputs Keep rejects, or nil if it
+// keeps them all.  The copy is shallow: it shares all the fields of unit
+// except its required inputs.
+func (f *InputFilter) Filter(unit *apb.CompilationUnit) *apb.CompilationUnit {
+	if f.Keep == nil {
+		return nil
+	}
+	var kept []*apb.CompilationUnit_FileInput
+	for _, in := range unit.GetRequiredInput() {
+		if f.Keep(in) {
+			kept = append(kept, in)
+		}
+	}
+	if len(kept) == len(unit.GetRequiredInput()) {
+		return nil
+	}
+	cp := *unit
+	cp.RequiredInput = kept
+	return &cp
+}
+
+// MatchInputPath returns a predicate, for use as the Keep function of an
+// InputFilter, that reports whether the path of an input matches pattern, as
+// by path.Match.  It reports an error if pattern is malformed.
+func MatchInputPath(pattern string) (func(*apb.CompilationUnit_FileInput) bool, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return func(in *apb.CompilationUnit_FileInput) bool {
+		ok, _ := path.Match(pattern, in.GetInfo().GetPath())
+		return ok
+	}, nil
+}
+
+// MatchInputDigest returns a predicate, for use as the Keep function of an
+// InputFilter, that reports whether the digest of an input is one of those
+// given.
+func MatchInputDigest(digests ...string) func(*apb.CompilationUnit_FileInput) bool {
+	set := make(map[string]bool, len(digests))
+	for _, d := range digests {
+		set[d] = true
+	}
+	return func(in *apb.CompilationUnit_FileInput) bool { return set[in.GetInfo().GetDigest()] }
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestArgumentRewriter(t *testing.T) {
+	home, err := NewRewriteRule(`^/home/[^/]+/`, "/src/")
+	testutil.FatalOnErrT(t, "NewRewriteRule: %v", err)
+	flag, err := NewRewriteRule(`^-I(.*)$`, "-isystem$1")
+	testutil.FatalOnErrT(t, "NewRewriteRule: %v", err)
+	unit := &apb.CompilationUnit{
+		Argument:         []string{"cc", "-I/home/alice/include", "/home/alice/a.c"},
+		WorkingDirectory: "/home/alice/work",
+		Environment:      []*apb.CompilationUnit_Env{{Name: "PATH", Value: "/bin"}, {Name: "HOME", Value: "/home/alice/"}},
+	}
+	orig := *unit
+
+	a := &ArgumentRewriter{Rules: []RewriteRule{home, flag}}
+	got := a.Rewrite(unit)
+	want := []string{"cc", "-isystem/home/alice/include", "/src/a.c"}
+	if err := testutil.DeepEqual(want, got.GetArgument()); err != nil {
+		t.Errorf("Arguments: %v", err)
+	}
+	if got.WorkingDirectory != unit.WorkingDirectory || got.Environment[1].Value != "/home/alice/" {
+		t.Errorf("Unexpected rewrite without WorkingDirectory or Environment: %+v", got)
+	}
+
+	a.WorkingDirectory, a.Environment = true, true
+	got = a.Rewrite(unit)
+	if got.WorkingDirectory != "/src/work" {
+		t.Errorf("WorkingDirectory: got %q, want %q", got.WorkingDirectory, "/src/work")
+	}
+	wantEnv := []*apb.CompilationUnit_Env{{Name: "PATH", Value: "/bin"}, {Name: "HOME", Value: "/src/"}}
+	if err := testutil.DeepEqual(wantEnv, got.Environment); err != nil {
+		t.Errorf("Environment: %v", err)
+	}
+
+	// The original unit is unchanged.
+	if err := testutil.DeepEqual(&orig, unit); err != nil {
+		t.Errorf("Original unit was modified: %v", err)
+	}
+	if err := testutil.DeepEqual([]string{"cc", "-I/home/alice/include", "/home/alice/a.c"}, unit.Argument); err != nil {
+		t.Errorf("Original arguments were modified: %v", err)
+	}
+	if unit.Environment[1].Value != "/home/alice/" {
+		t.Errorf("Original environment was modified: %+v", unit.Environment[1])
+	}
+
+	if got := (&ArgumentRewriter{Rules: []RewriteRule{home}}).Rewrite(&apb.CompilationUnit{Argument: []string{"cc"}}); got != nil {
+		t.Errorf("Rewrite of an unmatched unit: got %+v, want nil", got)
+	}
+	if _, err := NewRewriteRule(`(`, ""); err == nil {
+		t.Error("NewRewriteRule accepted an invalid pattern")
+	}
+}
+
+func TestArgumentRewriterTransform(t *testing.T) {
+	rule, err := NewRewriteRule(`^/tmp/[0-9]+/`, "")
+	testutil.FatalOnErrT(t, "NewRewriteRule: %v", err)
+	var got [][]string
+	d := &Driver{
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			got = append(got, req.Compilation.Argument)
+			return nil
+		}),
+	}
+	WithTransform((&ArgumentRewriter{Rules: []RewriteRule{rule}}).Transform)(d)
+	cs := comps("a", "b")
+	cs[0].Unit.Argument = []string{"/tmp/123/a.go"}
+	cs[1].Unit.Argument = []string{"b.go"}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: cs}))
+	if err := testutil.DeepEqual([][]string{{"a.go"}, {"b.go"}}, got); err != nil {
+		t.Errorf("Analyzed arguments: %v", err)
+	}
+}
+
+func TestInputFilter(t *testing.T) {
+	input := func(path, digest string) *apb.CompilationUnit_FileInput {
+		return &apb.CompilationUnit_FileInput{Info: &apb.FileInfo{Path: path, Digest: digest}}
+	}
+	unit := &apb.CompilationUnit{
+		RequiredInput: []*apb.CompilationUnit_FileInput{input("src/a.go", "1"), input("src/b.go", "2"), input("lib/c.a", "3")},
+		SourceFile:    []string{"src/a.go", "src/b.go"},
+	}
+	paths := func(unit *apb.CompilationUnit) []string {
+		var ps []string
+		for _, in := range unit.GetRequiredInput() {
+			ps = append(ps, in.Info.Path)
+		}
+		return ps
+	}
+
+	src, err := MatchInputPath("src/*.go")
+	testutil.FatalOnErrT(t, "MatchInputPath: %v", err)
+	got := (&InputFilter{Keep: src}).Filter(unit)
+	if err := testutil.DeepEqual([]string{"src/a.go", "src/b.go"}, paths(got)); err != nil {
+		t.Errorf("Filtered by path: %v", err)
+	}
+	got = (&InputFilter{Keep: MatchInputDigest("1", "3")}).Filter(unit)
+	if err := testutil.DeepEqual([]string{"src/a.go", "lib/c.a"}, paths(got)); err != nil {
+		t.Errorf("Filtered by digest: %v", err)
+	}
+	if err := testutil.DeepEqual(unit.SourceFile, got.SourceFile); err != nil {
+		t.Errorf("Source files: %v", err)
+	}
+	if n := len(unit.RequiredInput); n != 3 {
+		t.Errorf("Original unit has %d inputs, want 3", n)
+	}
+
+	all, err := MatchInputPath("*/*")
+	testutil.FatalOnErrT(t, "MatchInputPath: %v", err)
+	if got := (&InputFilter{Keep: all}).Filter(unit); got != nil {
+		t.Errorf("Filter keeping every input: got %+v, want nil", got)
+	}
+	if _, err := MatchInputPath("["); err == nil {
+		t.Error("MatchInputPath accepted an invalid pattern")
+	}
+}
+
+func TestInputFilterTransform(t *testing.T) {
+	var got []int
+	d := &Driver{
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			got = append(got, len(req.Compilation.RequiredInput))
+			return nil
+		}),
+	}
+	WithTransform((&InputFilter{Keep: MatchInputDigest("keep")}).Transform)(d)
+	cs := comps("a")
+	cs[0].Unit.RequiredInput = []*apb.CompilationUnit_FileInput{
+		{Info: &apb.FileInfo{Digest: "keep"}},
+		{Info: &apb.FileInfo{Digest: "drop"}},
+	}
+	testutil.FatalOnErrT(t, "Driver error: %v", d.Run(context.Background(), &syncQueue{comps: cs}))
+	if err := testutil.DeepEqual([]int{1}, got); err != nil {
+		t.Errorf("Analyzed inputs: %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// RunStats summarizes the work done by a single run of a Driver.
+type RunStats struct {
+	DryRun bool // whether the run was a dry run, without analysis; see Driver.DryRun
+
+	Compilations int // compilations processed, whether or not they succeeded
+	Succeeded    int // compilations analyzed successfully
+	Failed       int // compilations whose setup, analysis, or teardown failed
+	Skipped      int // compilations skipped by Filter, Checkpoint, ErrSkipCompilation, sampling, or as duplicates
+	Invalid      int // compilations skipped because they failed validation
+
+	// Total is the number of compilations in the queue when the run began,
+	// bounded by the driver's Limit, if the queue is a Sizer that knows its
+	// size; otherwise it is 0.
+	Total int
+
+	Outputs     int   // outputs passed to WriteOutput
+	OutputBytes int64 // total size of the output values passed to WriteOutput
+	FetchBytes  int64 // total size of the files fetched, if the driver tracks inputs
+
+	WallTime    time.Duration // elapsed time for the whole run
+	AnalyzeTime time.Duration // total time spent in Analyze, summed over workers
+
+	// QueueWaitTime is the total time spent in the queue's Next method
+	// waiting for the compilations received, summed over workers.  Compared
+	// with AnalyzeTime, it shows whether a run is limited by its queue or by
+	// its analyzer.
+	QueueWaitTime time.Duration
+
+	RateLimitWaits int // requests delayed by the driver's RateLimit
+	OutputLimited  int // compilations that exceeded the driver's MaxOutputEntries
+	EmptyOutput    int // compilations analyzed successfully without any outputs
+	UnreadInputs   int // required inputs not fetched, if the driver tracks inputs
+	Fetches        int // files fetched, if the driver tracks inputs
+	Duplicates     int // compilations skipped as duplicates; see Driver.SkipDuplicates
+	SampledOut     int // compilations skipped by sampling; see Driver.Sample
+	RetriedAfter   int // analyses retried at the analyzer's request; see Driver.MaxRetryAfter
+	Requeued       int // compilations handed back to the queue; see RetryPolicy.Requeue
+	StoppedEarly   int // compilations stopped by the driver's OutputPredicate
+	Partial        int // compilations that timed out, keeping their outputs
+	Normalized     int // compilations whose VNames were changed; see Driver.NormalizeVNames
+	GoldenDiffs    int // compilations whose outputs differed from those expected; see Driver.Golden
+	TeardownFailed int // asynchronous teardowns that failed; see Driver.AsyncTeardown
+
+	// OutOfBudget reports whether the run ended early because too little
+	// time remained before its deadline; see Driver.MinRemainingForNext.  If
+	// the queue knew its size, Unstarted is the number of compilations left
+	// unread as a result.
+	OutOfBudget bool
+	Unstarted   int
+
+	ResultsDropped int // results discarded because the Results channel was full
+
+	// StopReason is the message of the error wrapping analysis.ErrStopDriver
+	// with which the analyzer stopped the run, if it did.
+	StopReason string
+
+	// SampleSeed is the seed that chose the compilations analyzed, if the
+	// driver analyzed only a sample of them; see Driver.Sample.
+	SampleSeed int64
+
+	// Slowest lists the compilations that took the longest to analyze, in
+	// decreasing order of analysis time.  At most MaxSlowest are retained.
+	Slowest []CompilationTime
+
+	// Languages breaks down the compilation counts by the language of each
+	// compilation's VName.
+	Languages map[string]LanguageStats
+
+	// Diagnostics counts the diagnostics reported by the analyzer, by the
+	// name of their severity; see Diagnoser.
+	Diagnostics map[string]int
+
+	// FailedUnits names the compilations that failed, in the order they
+	// finished.
+	FailedUnits []string
+
+	// FailedKeys holds the keys assigned by the driver's Keyer to the
+	// compilations that failed, in the same order as FailedUnits.  Unlike the
+	// names, the keys identify the compilations exactly, so a later run can
+	// select them again, for example with a Filter.
+	FailedKeys []string
+}
+
+// MaxSlowest is the maximum number of compilations recorded in the Slowest
+// field of RunStats.
+const MaxSlowest = 10
+
+// A CompilationTime records the time spent analyzing a compilation.
+type CompilationTime struct {
+	Unit *apb.CompilationUnit
+	Time time.Duration
+}
+
+// LanguageStats records the compilation counts for a single language.
+type LanguageStats struct {
+	Compilations int `json:"compilations"`
+	Succeeded    int `json:"succeeded"`
+	Failed       int `json:"failed"`
+}
+
+// add records the result of processing unit, whose key is key.
+func (s *RunStats) add(unit *apb.CompilationUnit, key string, err error) {
+	lang := s.Languages[unit.GetVName().GetLanguage()]
+	s.Compilations++
+	lang.Compilations++
+	if err == nil {
+		s.Succeeded++
+		lang.Succeeded++
+	} else {
+		s.Failed++
+		lang.Failed++
+		s.FailedUnits = append(s.FailedUnits, unitName(unit))
+		s.FailedKeys = append(s.FailedKeys, key)
+	}
+	s.Languages[unit.GetVName().GetLanguage()] = lang
+}
+
+// received returns the number of compilations received from the queue.
+func (s *RunStats) received() int { return s.Compilations + s.Skipped + s.Invalid }
+
+// addTime records that unit took d to analyze.
+func (s *RunStats) addTime(unit *apb.CompilationUnit, d time.Duration) {
+	if len(s.Slowest) == MaxSlowest && d <= s.Slowest[MaxSlowest-1].Time {
+		return
+	}
+	i := sort.Search(len(s.Slowest), func(i int) bool { return s.Slowest[i].Time < d })
+	s.Slowest = append(s.Slowest, CompilationTime{})
+	copy(s.Slowest[i+1:], s.Slowest[i:])
+	s.Slowest[i] = CompilationTime{Unit: unit, Time: d}
+	if len(s.Slowest) > MaxSlowest {
+		s.Slowest = s.Slowest[:MaxSlowest]
+	}
+}
+
+// runSummary is the JSON form of a RunStats.
+type runSummary struct {
+	DryRun         bool                     `json:"dry_run,omitempty"`
+	Compilations   int                      `json:"compilations"`
+	Succeeded      int                      `json:"succeeded"`
+	Failed         int                      `json:"failed"`
+	Skipped        int                      `json:"skipped"`
+	Invalid        int                      `json:"invalid"`
+	Total          int                      `json:"total,omitempty"`
+	Outputs        int                      `json:"outputs"`
+	OutputBytes    int64                    `json:"output_bytes"`
+	OutputLimited  int                      `json:"output_limited,omitempty"`
+	EmptyOutput    int                      `json:"empty_output,omitempty"`
+	RateLimitWaits int                      `json:"rate_limit_waits,omitempty"`
+	UnreadInputs   int                      `json:"unread_inputs,omitempty"`
+	Fetches        int                      `json:"fetches,omitempty"`
+	Duplicates     int                      `json:"duplicates,omitempty"`
+	SampledOut     int                      `json:"sampled_out,omitempty"`
+	SampleSeed     int64                    `json:"sample_seed,omitempty"`
+	RetriedAfter   int                      `json:"retried_after,omitempty"`
+	Requeued       int                      `json:"requeued,omitempty"`
+	FetchBytes     int64                    `json:"fetch_bytes,omitempty"`
+	StoppedEarly   int                      `json:"stopped_early,omitempty"`
+	Partial        int                      `json:"partial,omitempty"`
+	Normalized     int                      `json:"normalized,omitempty"`
+	GoldenDiffs    int                      `json:"golden_diffs,omitempty"`
+	TeardownFailed int                      `json:"teardown_failed,omitempty"`
+	OutOfBudget    bool                     `json:"out_of_budget,omitempty"`
+	Unstarted      int                      `json:"unstarted,omitempty"`
+	ResultsDropped int                      `json:"results_dropped,omitempty"`
+	StopReason     string                   `json:"stop_reason,omitempty"`
+	WallSeconds    float64                  `json:"wall_seconds"`
+	AnalyzeSeconds float64                  `json:"analyze_seconds"`
+	QueueSeconds   float64                  `json:"queue_wait_seconds"`
+	Languages      map[string]LanguageStats `json:"languages,omitempty"`
+	Diagnostics    map[string]int           `json:"diagnostics,omitempty"`
+	Slowest        []slowSummary            `json:"slowest,omitempty"`
+	FailedUnits    []string                 `json:"failed_units,omitempty"`
+	FailedKeys     []string                 `json:"failed_keys,omitempty"`
+}
+
+type slowSummary struct {
+	Unit    string  `json:"unit"`
+	Seconds float64 `json:"seconds"`
+}
+
+// WriteJSON writes a JSON summary of s to w.  The output is stable: the same
+// statistics always produce the same bytes, with languages and failed
+// compilations in sorted order, so that summaries can be compared with diff.
+func (s RunStats) WriteJSON(w io.Writer) error {
+	sum := runSummary{
+		DryRun:         s.DryRun,
+		Compilations:   s.Compilations,
+		Succeeded:      s.Succeeded,
+		Failed:         s.Failed,
+		Skipped:        s.Skipped,
+		Invalid:        s.Invalid,
+		Total:          s.Total,
+		Outputs:        s.Outputs,
+		OutputBytes:    s.OutputBytes,
+		OutputLimited:  s.OutputLimited,
+		EmptyOutput:    s.EmptyOutput,
+		RateLimitWaits: s.RateLimitWaits,
+		UnreadInputs:   s.UnreadInputs,
+		Fetches:        s.Fetches,
+		Duplicates:     s.Duplicates,
+		SampledOut:     s.SampledOut,
+		SampleSeed:     s.SampleSeed,
+		RetriedAfter:   s.RetriedAfter,
+		Requeued:       s.Requeued,
+		FetchBytes:     s.FetchBytes,
+		StoppedEarly:   s.StoppedEarly,
+		Partial:        s.Partial,
+		Normalized:     s.Normalized,
+		GoldenDiffs:    s.GoldenDiffs,
+		TeardownFailed: s.TeardownFailed,
+		OutOfBudget:    s.OutOfBudget,
+		Unstarted:      s.Unstarted,
+		ResultsDropped: s.ResultsDropped,
+		StopReason:     s.StopReason,
+		WallSeconds:    s.WallTime.Seconds(),
+		AnalyzeSeconds: s.AnalyzeTime.Seconds(),
+		QueueSeconds:   s.QueueWaitTime.Seconds(),
+		Languages:      s.Languages,
+		Diagnostics:    s.Diagnostics,
+		FailedUnits:    append([]string(nil), s.FailedUnits...),
+		FailedKeys:     append([]string(nil), s.FailedKeys...),
+	}
+	sort.Strings(sum.FailedUnits)
+	sort.Strings(sum.FailedKeys)
+	for _, ct := range s.Slowest {
+		sum.Slowest = append(sum.Slowest, slowSummary{Unit: unitName(ct.Unit), Seconds: ct.Time.Seconds()})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sum)
+}
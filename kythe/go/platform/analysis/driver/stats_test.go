@@ -0,0 +1,138 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+func TestSlowest(t *testing.T) {
+	var s RunStats
+	var want []time.Duration
+	for i := 1; i <= 2*MaxSlowest; i++ {
+		// Interleave short and long times.
+		d := time.Duration(i)
+		if i%2 == 0 {
+			d += 100
+		}
+		s.addTime(nil, d)
+	}
+	for i := 2 * MaxSlowest; len(want) < MaxSlowest; i -= 2 {
+		want = append(want, time.Duration(i)+100)
+	}
+	if len(s.Slowest) != MaxSlowest {
+		t.Fatalf("Got %d slowest, want %d", len(s.Slowest), MaxSlowest)
+	}
+	for i, ct := range s.Slowest {
+		if ct.Time != want[i] {
+			t.Errorf("Slowest[%d]: got %v, want %v", i, ct.Time, want[i])
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	s := RunStats{Languages: make(map[string]LanguageStats), WallTime: 3 * time.Second}
+	for _, cu := range comps("z", "a", "b") {
+		cu.Unit.VName.Language = "go"
+		var err error
+		if cu.Unit.VName.Signature != "b" {
+			err = errors.New("failed")
+		}
+		s.add(cu.Unit, "key:"+cu.Unit.VName.Signature, err)
+		s.addTime(cu.Unit, 500*time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	const want = `{
+  "compilations": 3,
+  "succeeded": 1,
+  "failed": 2,
+  "skipped": 0,
+  "invalid": 0,
+  "outputs": 0,
+  "output_bytes": 0,
+  "wall_seconds": 3,
+  "analyze_seconds": 0,
+  "queue_wait_seconds": 0,
+  "languages": {
+    "go": {
+      "compilations": 3,
+      "succeeded": 1,
+      "failed": 2
+    }
+  },
+  "slowest": [
+    {
+      "unit": "kythe:?lang=go#z",
+      "seconds": 0.5
+    },
+    {
+      "unit": "kythe:?lang=go#a",
+      "seconds": 0.5
+    },
+    {
+      "unit": "kythe:?lang=go#b",
+      "seconds": 0.5
+    }
+  ],
+  "failed_units": [
+    "kythe:?lang=go#a",
+    "kythe:?lang=go#z"
+  ],
+  "failed_keys": [
+    "key:a",
+    "key:z"
+  ]
+}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("WriteJSON: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFailedKeys(t *testing.T) {
+	d := &Driver{
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			if req.Compilation.VName.Signature != "ok" {
+				return errors.New("failed")
+			}
+			return nil
+		}),
+		Keyer:           func(unit *apb.CompilationUnit) string { return "key:" + unit.VName.Signature },
+		ContinueOnError: true,
+		WriteOutput:     func(context.Context, *apb.AnalysisOutput) error { return nil },
+	}
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: comps("bad1", "ok", "bad2")})
+	if err == nil {
+		t.Fatal("Driver succeeded with failing compilations")
+	}
+	if err := testutil.DeepEqual([]string{"key:bad1", "key:bad2"}, stats.FailedKeys); err != nil {
+		t.Errorf("FailedKeys: %v", err)
+	}
+}
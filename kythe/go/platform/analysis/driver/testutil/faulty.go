@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package testutil provides support for testing code that uses the analysis
+// driver, including queues that misbehave on a reproducible schedule.
+package testutil // import "kythe.io/kythe/go/platform/analysis/driver/testutil"
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"kythe.io/kythe/go/platform/analysis/driver"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// ErrInjected is the error reported by a FaultyQueue for an injected failure,
+// unless Faults.Err is set.
+var ErrInjected = errors.New("testutil: injected queue failure")
+
+// Faults describes the misbehavior of a FaultyQueue.  Random choices are made
+// from a source seeded with Seed, so that a given Faults produces the same
+// schedule of faults on each run.  The schedule is a function of the order of
+// calls to Next; with concurrent callers that order may vary.
+type Faults struct {
+	Seed int64
+
+	// If MaxDelay > 0, each call to Next is delayed by a random duration of
+	// less than MaxDelay before reading from the underlying queue.
+	MaxDelay time.Duration
+
+	// ErrorAt lists the calls to Next, numbered from 1, that fail without
+	// reading from the underlying queue.  In addition, a fraction ErrorRate
+	// of the remaining calls fail at random.
+	ErrorAt   []int
+	ErrorRate float64
+
+	// Err is the error returned by failing calls.  If nil, ErrInjected is
+	// used.
+	Err error
+
+	// A fraction CorruptRate of the compilations delivered are damaged before
+	// they are passed on: a copy of the compilation has its VName, its
+	// required inputs, or its source files removed, chosen at random.
+	CorruptRate float64
+}
+
+// FaultyQueue returns a driver.Queue that delivers the compilations of inner,
+// subject to the faults described by f.  The result is safe for concurrent use
+// if inner is.
+func FaultyQueue(inner driver.Queue, f Faults) driver.Queue {
+	q := &faultyQueue{inner: inner, f: f, rng: rand.New(rand.NewSource(f.Seed)), errorAt: make(map[int]bool)}
+	for _, n := range f.ErrorAt {
+		q.errorAt[n] = true
+	}
+	return q
+}
+
+type faultyQueue struct {
+	inner   driver.Queue
+	f       Faults
+	errorAt map[int]bool
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	calls int
+}
+
+// A plan records the faults chosen for a single call to Next.
+type plan struct {
+	delay   time.Duration
+	fail    bool
+	corrupt int // 0 for none, or 1-3 naming the damage done
+}
+
+func (q *faultyQueue) plan() plan {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.calls++
+	var p plan
+	if q.f.MaxDelay > 0 {
+		p.delay = time.Duration(q.rng.Int63n(int64(q.f.MaxDelay)))
+	}
+	fail := q.rng.Float64() < q.f.ErrorRate // drawn even if unused, to keep the schedule fixed
+	p.fail = fail || q.errorAt[q.calls]
+	if q.rng.Float64() < q.f.CorruptRate {
+		p.corrupt = 1 + q.rng.Intn(3)
+	}
+	return p
+}
+
+// Next implements the driver.Queue interface.
+func (q *faultyQueue) Next(ctx context.Context, f driver.CompilationFunc) error {
+	p := q.plan()
+	if p.delay > 0 {
+		t := time.NewTimer(p.delay)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	if p.fail {
+		if q.f.Err != nil {
+			return q.f.Err
+		}
+		return ErrInjected
+	}
+	return q.inner.Next(ctx, func(ctx context.Context, cu driver.Compilation) error {
+		if p.corrupt != 0 {
+			cu.Unit = corrupt(cu.Unit, p.corrupt)
+		}
+		return f(ctx, cu)
+	})
+}
+
+// corrupt returns a damaged copy of unit.
+func corrupt(unit *apb.CompilationUnit, damage int) *apb.CompilationUnit {
+	unit = proto.Clone(unit).(*apb.CompilationUnit)
+	switch damage {
+	case 1:
+		unit.VName = nil
+	case 2:
+		unit.RequiredInput = nil
+	default:
+		unit.SourceFile = nil
+	}
+	return unit
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package testutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/platform/analysis/driver"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+func units(n int) []*apb.CompilationUnit {
+	var us []*apb.CompilationUnit
+	for i := 0; i < n; i++ {
+		us = append(us, &apb.CompilationUnit{
+			VName:         &spb.VName{Signature: fmt.Sprint(i), Language: "go"},
+			SourceFile:    []string{"a.go"},
+			RequiredInput: []*apb.CompilationUnit_FileInput{{Info: &apb.FileInfo{Path: "a.go", Digest: "d"}}},
+		})
+	}
+	return us
+}
+
+// trace reads q to the end, recording for each call to Next the signature of
+// the compilation delivered, "invalid" for a corrupt one, or "error".
+func trace(q driver.Queue) []string {
+	var calls []string
+	for {
+		err := q.Next(context.Background(), func(_ context.Context, cu driver.Compilation) error {
+			if driver.ValidateUnit(cu.Unit) != nil {
+				calls = append(calls, "invalid")
+			} else {
+				calls = append(calls, cu.Unit.VName.Signature)
+			}
+			return nil
+		})
+		if err == driver.ErrEndOfQueue {
+			return calls
+		} else if err != nil {
+			calls = append(calls, "error")
+		}
+	}
+}
+
+func TestFaultyQueueErrorAt(t *testing.T) {
+	got := trace(FaultyQueue(driver.SliceQueue(units(3)), Faults{ErrorAt: []int{2, 3}}))
+	want := []string{"0", "error", "error", "1", "2"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Calls: got %q, want %q", got, want)
+	}
+}
+
+func TestFaultyQueueReproducible(t *testing.T) {
+	f := Faults{Seed: 7, ErrorRate: 0.3, CorruptRate: 0.3}
+	first := trace(FaultyQueue(driver.SliceQueue(units(20)), f))
+	again := trace(FaultyQueue(driver.SliceQueue(units(20)), f))
+	if fmt.Sprint(first) != fmt.Sprint(again) {
+		t.Errorf("Schedules differ:\n%q\n%q", first, again)
+	}
+	var errs, invalid int
+	for _, c := range first {
+		switch c {
+		case "error":
+			errs++
+		case "invalid":
+			invalid++
+		}
+	}
+	if errs == 0 || invalid == 0 {
+		t.Errorf("Got %d errors and %d corrupt compilations, want some of each: %q", errs, invalid, first)
+	}
+}
+
+func TestFaultyQueueCorruptCopies(t *testing.T) {
+	us := units(5)
+	trace(FaultyQueue(driver.SliceQueue(us), Faults{CorruptRate: 1}))
+	for _, u := range us {
+		if err := driver.ValidateUnit(u); err != nil {
+			t.Errorf("Original compilation was modified: %v", err)
+		}
+	}
+}
+
+// A blockingAnalyzer blocks the analysis of compilation "0" until its context
+// ends, recording the reason, and fails compilation "1" with errBroken.
+type blockingAnalyzer struct {
+	started chan struct{} // closed once the analysis of "0" has begun
+	aborted chan error    // receives driver.AbortedBy for "0"
+}
+
+var errBroken = errors.New("broken compilation")
+
+func (b blockingAnalyzer) Analyze(ctx context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+	switch req.Compilation.VName.Signature {
+	case "0":
+		close(b.started)
+		<-ctx.Done()
+		b.aborted <- driver.AbortedBy(ctx)
+		return ctx.Err()
+	case "1":
+		<-b.started
+		return errBroken
+	}
+	return nil
+}
+
+func TestFaultyQueueAbort(t *testing.T) {
+	us := units(6)
+	b := blockingAnalyzer{started: make(chan struct{}), aborted: make(chan error, 1)}
+	d := &driver.Driver{Analyzer: b, Concurrency: 2}
+	err := d.Run(context.Background(), FaultyQueue(driver.SliceQueue(us), Faults{Seed: 3, MaxDelay: 2 * time.Millisecond}))
+
+	var cerr *driver.CompilationError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Run: got error %v, want a *driver.CompilationError", err)
+	}
+	if got := cerr.Unit.VName.Signature; got != "1" {
+		t.Errorf("Run: error names compilation %q, want %q", got, "1")
+	}
+	if want := driver.KeyOf(us[1]); cerr.Key != want {
+		t.Errorf("Run: error has key %q, want %q", cerr.Key, want)
+	}
+	if !errors.Is(err, errBroken) {
+		t.Errorf("Run: got error %v, want %v", err, errBroken)
+	}
+	if reason := <-b.aborted; reason != err {
+		t.Errorf("AbortedBy: got %v, want %v", reason, err)
+	}
+}
+
+func TestFaultyQueueCanceled(t *testing.T) {
+	b := blockingAnalyzer{started: make(chan struct{}), aborted: make(chan error, 1)}
+	d := &driver.Driver{Analyzer: b, Concurrency: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-b.started
+		cancel()
+	}()
+	// Compilation "1" is absent, so only the external cancellation ends "0".
+	us := units(1)
+	err := d.Run(ctx, FaultyQueue(driver.SliceQueue(us), Faults{Seed: 3, MaxDelay: 2 * time.Millisecond}))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Run: got error %v, want %v", err, context.Canceled)
+	}
+	if reason := <-b.aborted; reason != nil {
+		t.Errorf("AbortedBy: got %v, want nil", reason)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+
+	"kythe.io/kythe/go/platform/analysis"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// TracerName is the instrumentation name a Driver passes to its
+// TracerProvider.
+const TracerName = "kythe.io/kythe/go/platform/analysis/driver"
+
+// A TracerProvider supplies the Tracer with which a Driver records spans.  The
+// tracing interfaces are deliberately small, so that they can be adapted to a
+// tracing system such as OpenTelemetry without the driver depending on it.
+type TracerProvider interface {
+	Tracer(name string) Tracer
+}
+
+// A Tracer starts spans.
+type Tracer interface {
+	// Start starts a span with the given name and attributes as a child of
+	// any span carried by ctx, and returns a context carrying the new span.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// A Span records a single operation.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// An Attribute is a key/value pair attached to a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Names of the attributes the driver attaches to a compilation span.
+const (
+	AttrLanguage  = "kythe.language"
+	AttrCorpus    = "kythe.corpus"
+	AttrPath      = "kythe.path"
+	AttrSignature = "kythe.signature"
+	AttrOutputs   = "kythe.outputs" // the number of outputs written
+)
+
+// noEnd is the function returned by traceUnit when tracing is disabled.
+func noEnd(error) {}
+
+// traceUnit starts a span for the compilation cu, if tracing is enabled, and
+// returns a function that ends it, given the result of the compilation.
+func (r *runner) traceUnit(ctx context.Context, cu Compilation) (context.Context, func(error)) {
+	if r.tracer == nil {
+		return ctx, noEnd
+	}
+	v := cu.Unit.GetVName()
+	ctx, span := r.tracer.Start(ctx, v.GetLanguage()+"/"+v.GetCorpus(),
+		Attribute{AttrLanguage, v.GetLanguage()},
+		Attribute{AttrCorpus, v.GetCorpus()},
+		Attribute{AttrPath, v.GetPath()},
+		Attribute{AttrSignature, v.GetSignature()},
+	)
+	return ctx, func(err error) {
+		if s := scopeFrom(ctx); s != nil {
+			span.SetAttributes(Attribute{AttrOutputs, s.outputCount()})
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+}
+
+// traced calls f in a child span with the given name, if tracing is enabled.
+func (r *runner) traced(ctx context.Context, name string, f func(context.Context) error) error {
+	if r.tracer == nil {
+		return f(ctx)
+	}
+	ctx, span := r.tracer.Start(ctx, name)
+	defer span.End()
+	err := f(ctx)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+// setupSpan invokes Setup for cu in a span.
+func (r *runner) setupSpan(ctx context.Context, cu Compilation) error {
+	return r.traced(ctx, "Setup", func(ctx context.Context) error { return r.setup(ctx, cu) })
+}
+
+// teardownSpan invokes Teardown for cu in a span.
+func (r *runner) teardownSpan(ctx context.Context, cu Compilation) error {
+	return r.traced(ctx, "Teardown", func(ctx context.Context) error { return r.teardown(ctx, cu) })
+}
+
+// analyzeSpan sends req to the analyzer in a span.
+func (r *runner) analyzeSpan(ctx context.Context, req *apb.AnalysisRequest, write analysis.OutputFunc) error {
+	return r.traced(ctx, "Analyze", func(ctx context.Context) error { return r.analyzeUnit(ctx, req, write) })
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// testTracer records its spans as strings, in the order they end.
+type testTracer struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+func (t *testTracer) Tracer(string) Tracer { return t }
+
+type spanKey struct{}
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	if parent, ok := ctx.Value(spanKey{}).(*testSpan); ok {
+		name = parent.name + ">" + name
+	}
+	s := &testSpan{t: t, name: name, attrs: attrs}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+type testSpan struct {
+	t     *testTracer
+	name  string
+	attrs []Attribute
+	err   error
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) { s.attrs = append(s.attrs, attrs...) }
+func (s *testSpan) RecordError(err error)            { s.err = err }
+
+func (s *testSpan) End() {
+	var parts []string
+	for _, a := range s.attrs {
+		parts = append(parts, fmt.Sprintf("%s=%v", a.Key, a.Value))
+	}
+	desc := s.name
+	if len(parts) != 0 {
+		desc += " " + strings.Join(parts, " ")
+	}
+	if s.err != nil {
+		desc += " error"
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.t.spans = append(s.t.spans, desc)
+}
+
+func TestDriverTracing(t *testing.T) {
+	tracer := new(testTracer)
+	d := &Driver{
+		TracerProvider:  tracer,
+		ContinueOnError: true,
+		Analyzer: analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+			if req.Compilation.VName.Signature == "b" {
+				return errFromAnalysis
+			}
+			return out(ctx, &apb.AnalysisOutput{Value: []byte("v")})
+		}),
+		Context: testContext{
+			analysisError: func(_ context.Context, _ Compilation, err error) error { return err },
+		},
+	}
+	cs := comps("a", "b")
+	for _, c := range cs {
+		c.Unit.VName.Language = "go"
+		c.Unit.VName.Corpus = "kythe"
+	}
+	if err := d.Run(context.Background(), &syncQueue{comps: cs}); err == nil {
+		t.Error("Expected error from Run but got none")
+	}
+
+	const attrs = " kythe.language=go kythe.corpus=kythe kythe.path="
+	want := []string{
+		"go/kythe>Setup",
+		"go/kythe>Analyze",
+		"go/kythe>Teardown",
+		"go/kythe" + attrs + " kythe.signature=a kythe.outputs=1",
+		"go/kythe>Setup",
+		"go/kythe>Analyze error",
+		"go/kythe>Teardown",
+		"go/kythe" + attrs + " kythe.signature=b kythe.outputs=0 error",
+	}
+	if err := testutil.DeepEqual(want, tracer.spans); err != nil {
+		t.Errorf("Unexpected spans: %v", err)
+	}
+}
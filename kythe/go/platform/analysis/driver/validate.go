@@ -0,0 +1,53 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// ValidateUnit performs a structural check of unit, reporting an error that
+// describes the first problem found, if any.  It checks that the unit has a
+// VName with a language, at least one source file and required input, and
+// that each required input has a path and a digest.  It does not check that
+// the inputs are available.
+func ValidateUnit(unit *apb.CompilationUnit) error {
+	switch {
+	case unit == nil:
+		return errors.New("missing compilation unit")
+	case unit.GetVName() == nil:
+		return errors.New("missing VName")
+	case unit.GetVName().GetLanguage() == "":
+		return errors.New("missing language")
+	case len(unit.SourceFile) == 0:
+		return errors.New("no source files")
+	case len(unit.RequiredInput) == 0:
+		return errors.New("no required inputs")
+	}
+	for i, ri := range unit.RequiredInput {
+		switch info := ri.GetInfo(); {
+		case info.GetPath() == "":
+			return fmt.Errorf("required input %d has no path", i)
+		case info.GetDigest() == "":
+			return fmt.Errorf("required input %q has no digest", info.GetPath())
+		}
+	}
+	return nil
+}
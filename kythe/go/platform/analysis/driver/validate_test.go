@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// validUnit returns a compilation that passes ValidateUnit.
+func validUnit(sig string) *apb.CompilationUnit {
+	return &apb.CompilationUnit{
+		VName:      &spb.VName{Signature: sig, Language: "go"},
+		SourceFile: []string{"a.go"},
+		RequiredInput: []*apb.CompilationUnit_FileInput{{
+			Info: &apb.FileInfo{Path: "a.go", Digest: "1234"},
+		}},
+	}
+}
+
+func TestValidateUnit(t *testing.T) {
+	tests := []struct {
+		desc   string
+		edit   func(*apb.CompilationUnit)
+		reason string // empty if valid
+	}{
+		{"valid", func(*apb.CompilationUnit) {}, ""},
+		{"no vname", func(u *apb.CompilationUnit) { u.VName = nil }, "missing VName"},
+		{"no language", func(u *apb.CompilationUnit) { u.VName.Language = "" }, "missing language"},
+		{"no sources", func(u *apb.CompilationUnit) { u.SourceFile = nil }, "no source files"},
+		{"no inputs", func(u *apb.CompilationUnit) { u.RequiredInput = nil }, "no required inputs"},
+		{"no path", func(u *apb.CompilationUnit) { u.RequiredInput[0].Info.Path = "" }, "has no path"},
+		{"no digest", func(u *apb.CompilationUnit) { u.RequiredInput[0].Info.Digest = "" }, "has no digest"},
+	}
+	for _, test := range tests {
+		unit := validUnit("x")
+		test.edit(unit)
+		err := ValidateUnit(unit)
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.desc, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("%s: got error %v, want %q", test.desc, err, test.reason)
+		}
+	}
+}
+
+func TestDriverPreValidate(t *testing.T) {
+	invalid := validUnit("bad")
+	invalid.SourceFile = nil
+	queue := func() Queue { return SliceQueue([]*apb.CompilationUnit{validUnit("a"), invalid, validUnit("b")}) }
+
+	d := &Driver{
+		PreValidate:     true,
+		ContinueOnError: true,
+		Analyzer:        emitter(nil),
+		Logger:          new(testLogger),
+	}
+	stats, err := d.RunWithStats(context.Background(), queue())
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	if stats.Succeeded != 2 || stats.Invalid != 1 || stats.Failed != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	d.ContinueOnError = false
+	var verr *ValidationError
+	if err := d.Run(context.Background(), queue()); !errors.As(err, &verr) {
+		t.Errorf("Run: got error %v, want a *ValidationError", err)
+	} else if verr.Unit != invalid || !strings.Contains(err.Error(), "no source files") {
+		t.Errorf("Run: unexpected validation error: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// A VNameNormalizer canonicalizes the VNames of compilation units before they
+// are analyzed, so that inconsistently extracted units do not produce graph
+// nodes that differ only in spelling.  It normalizes the VName of each unit
+// and of each of its required inputs:
+//
+//   - trailing slashes are removed from the corpus and root;
+//   - an empty corpus is replaced by DefaultCorpus;
+//   - a non-empty path is cleaned, as by path.Clean;
+//   - the language is lowercased.
+//
+// The signature is left unchanged.  A VNameNormalizer may be installed as
+// the driver's NormalizeVNames, which counts the units it changes, or its
+// Transform method may be installed with WithTransform.
+type VNameNormalizer struct {
+	DefaultCorpus string // the corpus of VNames that have none, if non-empty
+
+	// If Rewrite != nil, it is called with a copy of each VName after the
+	// rules above are applied, and may modify it further.
+	Rewrite func(*spb.VName)
+}
+
+// Transform returns the unit of cu with its VNames normalized, or nil if none
+// changed.  The unit of cu is not modified.
+func (n *VNameNormalizer) Transform(_ context.Context, cu Compilation) (*apb.CompilationUnit, error) {
+	return n.Normalize(cu.Unit), nil
+}
+
+// Normalize returns a copy of unit with its VNames normalized, or nil if none
+// changed.  The copy is shallow: it shares all the fields of unit except
+// those normalized.
+func (n *VNameNormalizer) Normalize(unit *apb.CompilationUnit) *apb.CompilationUnit {
+	var cp *apb.CompilationUnit
+	if v := n.NormalizeVName(unit.GetVName()); v != unit.GetVName() {
+		c := *unit
+		cp = &c
+		cp.VName = v
+	}
+	var inputs []*apb.CompilationUnit_FileInput
+	for i, ri := range unit.GetRequiredInput() {
+		if v := n.NormalizeVName(ri.GetVName()); v != ri.GetVName() {
+			if inputs == nil {
+				inputs = append([]*apb.CompilationUnit_FileInput(nil), unit.RequiredInput...)
+			}
+			fi := *ri
+			fi.VName = v
+			inputs[i] = &fi
+		}
+	}
+	if inputs != nil {
+		if cp == nil {
+			c := *unit
+			cp = &c
+		}
+		cp.RequiredInput = inputs
+	}
+	return cp
+}
+
+// NormalizeVName returns a normalized copy of v, or v itself if it is nil or
+// already normalized.
+func (n *VNameNormalizer) NormalizeVName(v *spb.VName) *spb.VName {
+	if v == nil {
+		return nil
+	}
+	norm := *v
+	norm.Corpus = strings.TrimRight(norm.Corpus, "/")
+	if norm.Corpus == "" {
+		norm.Corpus = n.DefaultCorpus
+	}
+	norm.Root = strings.TrimRight(norm.Root, "/")
+	if norm.Path != "" {
+		norm.Path = path.Clean(norm.Path)
+	}
+	norm.Language = strings.ToLower(norm.Language)
+	if n.Rewrite != nil {
+		n.Rewrite(&norm)
+	}
+	if proto.Equal(&norm, v) {
+		return v
+	}
+	return &norm
+}
+
+// normalize returns cu with its VNames normalized by d.NormalizeVNames, if
+// set, counting the compilation in RunStats.Normalized the first time any
+// changed.
+func (r *runner) normalize(ctx context.Context, cu Compilation) Compilation {
+	if r.NormalizeVNames == nil {
+		return cu
+	}
+	unit := r.NormalizeVNames.Normalize(cu.Unit)
+	if unit == nil {
+		return cu
+	}
+	cu.Unit = unit
+	if s := scopeFrom(ctx); s == nil || s.markNormalized() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.stats.Normalized++
+	}
+	return cu
+}
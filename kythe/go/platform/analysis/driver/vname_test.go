@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/test/testutil"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+func TestNormalizeVName(t *testing.T) {
+	n := &VNameNormalizer{DefaultCorpus: "kythe"}
+	tests := []struct {
+		in, want *spb.VName
+	}{
+		{nil, nil},
+		{&spb.VName{Corpus: "c", Path: "a/b.go", Language: "go"}, nil},
+		{&spb.VName{Corpus: "c//", Root: "out/", Path: "a/b.go", Language: "go"},
+			&spb.VName{Corpus: "c", Root: "out", Path: "a/b.go", Language: "go"}},
+		{&spb.VName{Path: "./a//b/../c.go", Language: "Go"},
+			&spb.VName{Corpus: "kythe", Path: "a/c.go", Language: "go"}},
+		{&spb.VName{Signature: "Sig/", Corpus: "/", Language: "C++"},
+			&spb.VName{Signature: "Sig/", Corpus: "kythe", Language: "c++"}},
+	}
+	for _, test := range tests {
+		got := n.NormalizeVName(test.in)
+		if test.want == nil {
+			if got != test.in {
+				t.Errorf("NormalizeVName(%+v): got %+v, want it unchanged", test.in, got)
+			}
+			continue
+		}
+		if err := testutil.DeepEqual(test.want, got); err != nil {
+			t.Errorf("NormalizeVName(%+v): %v", test.in, err)
+		}
+	}
+
+	n.Rewrite = func(v *spb.VName) { v.Root = "" }
+	if got := n.NormalizeVName(&spb.VName{Corpus: "c", Root: "out"}); got.Root != "" {
+		t.Errorf("NormalizeVName with Rewrite: got root %q, want none", got.Root)
+	}
+}
+
+func TestVNameNormalizer(t *testing.T) {
+	unit := &apb.CompilationUnit{
+		VName: &spb.VName{Corpus: "c/", Language: "go"},
+		RequiredInput: []*apb.CompilationUnit_FileInput{
+			{VName: &spb.VName{Corpus: "c", Path: "a.go"}},
+			{VName: &spb.VName{Path: "./b.go"}},
+		},
+	}
+	orig := *unit
+	origInput := *unit.RequiredInput[1]
+
+	n := &VNameNormalizer{DefaultCorpus: "c"}
+	got := n.Normalize(unit)
+	if err := testutil.DeepEqual(&spb.VName{Corpus: "c", Language: "go"}, got.GetVName()); err != nil {
+		t.Errorf("Unit VName: %v", err)
+	}
+	if got.RequiredInput[0] != unit.RequiredInput[0] {
+		t.Error("A normalized required input was copied")
+	}
+	if err := testutil.DeepEqual(&spb.VName{Corpus: "c", Path: "b.go"}, got.RequiredInput[1].VName); err != nil {
+		t.Errorf("Required input VName: %v", err)
+	}
+
+	// The original unit is unchanged.
+	if err := testutil.DeepEqual(&orig, unit); err != nil {
+		t.Errorf("Original unit was modified: %v", err)
+	}
+	if err := testutil.DeepEqual(&origInput, unit.RequiredInput[1]); err != nil {
+		t.Errorf("Original required input was modified: %v", err)
+	}
+
+	if got := n.Normalize(got); got != nil {
+		t.Errorf("Normalize of a normalized unit: got %+v, want nil", got)
+	}
+}
+
+func TestDriverNormalizeVNames(t *testing.T) {
+	var got []*spb.VName
+	d := &Driver{
+		NormalizeVNames: &VNameNormalizer{DefaultCorpus: "kythe"},
+		Analyzer: analyzerFunc(func(_ context.Context, req *apb.AnalysisRequest, _ analysis.OutputFunc) error {
+			got = append(got, req.Compilation.VName)
+			return nil
+		}),
+	}
+	cs := comps("a", "b")
+	cs[0].Unit.VName.Corpus = "kythe"
+	stats, err := d.RunWithStats(context.Background(), &syncQueue{comps: cs})
+	testutil.FatalOnErrT(t, "Driver error: %v", err)
+	want := []*spb.VName{{Signature: "a", Corpus: "kythe"}, {Signature: "b", Corpus: "kythe"}}
+	if err := testutil.DeepEqual(want, got); err != nil {
+		t.Errorf("Analyzed VNames: %v", err)
+	}
+	if stats.Normalized != 1 {
+		t.Errorf("Got %d normalized compilations, want 1", stats.Normalized)
+	}
+}
@@ -0,0 +1,270 @@
+/*
+ * Copyright 2015 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package local
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"sync"
+
+	"kythe.io/kythe/go/platform/analysis/driver"
+	"kythe.io/kythe/go/platform/kzip"
+	"kythe.io/kythe/go/platform/vfs"
+
+	"github.com/golang/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// An ArchiveQueue is a driver.Queue reading compilations from a tar archive,
+// optionally compressed with gzip, or a zip archive.  Any entry in a
+// directory named "units" holds a CompilationUnit in protobuf wire format,
+// and any entry in a directory named "files" holds the contents of a file,
+// named by its digest.  As in a kzip, these directories may share a common
+// root directory.  Other entries are ignored.
+//
+// The archive is read when the queue is constructed.  Its analysis.Fetcher
+// interface serves the files of the archive by digest, to any of its
+// compilations.  The files of a zip archive are read on demand; those of a
+// tar archive are held in memory.  An ArchiveQueue is safe for concurrent use.
+type ArchiveQueue struct {
+	revision string
+
+	mu    sync.Mutex
+	units []*apb.CompilationUnit // units waiting to be delivered
+
+	files  map[string]func() ([]byte, error) // by digest
+	closer io.Closer                         // nil if nothing remains open
+}
+
+// NewArchiveQueue returns a new ArchiveQueue over the archive at path, which
+// is opened with vfs.  The archive's format is determined from its contents
+// rather than its name.  If opts.SkipBadFiles is true, unit entries that
+// cannot be decoded are logged and skipped; otherwise they are reported as
+// errors, as are archives that are corrupt or of an unknown format.
+func NewArchiveQueue(ctx context.Context, path string, opts *Options) (*ArchiveQueue, error) {
+	f, err := vfs.Open(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("opening archive %q: %v", path, err)
+	}
+	q := &ArchiveQueue{revision: opts.revision(), files: make(map[string]func() ([]byte, error))}
+	if err := q.load(f, opts.skipBadFiles()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading archive %q: %v", path, err)
+	}
+	if q.closer == nil {
+		f.Close()
+	}
+	return q, nil
+}
+
+var (
+	gzipHeader  = []byte{0x1f, 0x8b}
+	zipHeader   = []byte("PK\x03\x04")
+	emptyZip    = []byte("PK\x05\x06")
+	tarMagic    = []byte("ustar")
+	tarMagicOff = 257
+)
+
+// load reads the units and indexes the files of the archive in f.  If the
+// archive is read on demand, q.closer is set to f.
+func (q *ArchiveQueue) load(f io.ReadCloser, skipBad bool) (err error) {
+	defer func() {
+		// The decoders should report corrupt data as errors, but an archive
+		// that causes one to panic must not take down the process.
+		if v := recover(); v != nil {
+			err = fmt.Errorf("corrupt archive: %v", v)
+		}
+	}()
+	br := bufio.NewReader(f)
+	head, _ := br.Peek(tarMagicOff + len(tarMagic)) // a short read leaves a shorter head
+	switch {
+	case bytes.HasPrefix(head, gzipHeader):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return q.loadTar(tar.NewReader(gz), skipBad)
+	case bytes.HasPrefix(head, zipHeader), bytes.HasPrefix(head, emptyZip):
+		return q.loadZip(f, br, skipBad)
+	case len(head) > tarMagicOff && bytes.HasPrefix(head[tarMagicOff:], tarMagic):
+		return q.loadTar(tar.NewReader(br), skipBad)
+	}
+	return fmt.Errorf("unknown archive format")
+}
+
+// loadTar reads the entries of a tar archive.
+func (q *ArchiveQueue) loadTar(tr *tar.Reader, skipBad bool) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		kind, name := archiveEntry(hdr.Name)
+		if kind == "" {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("reading %q: %v", hdr.Name, err)
+		}
+		if err := q.add(kind, name, hdr.Name, func() ([]byte, error) { return data, nil }, skipBad); err != nil {
+			return err
+		}
+	}
+}
+
+// loadZip reads the entries of a zip archive from f, or from the rest of br
+// if f does not support random access.
+func (q *ArchiveQueue) loadZip(f io.ReadCloser, br io.Reader, skipBad bool) error {
+	var (
+		ra   io.ReaderAt
+		size int64
+	)
+	if kf, ok := f.(kzip.File); ok {
+		n, err := kf.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		ra, size = kf, n
+		q.closer = f
+	} else {
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		ra, size = bytes.NewReader(data), int64(len(data))
+	}
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		kind, name := archiveEntry(zf.Name)
+		if kind == "" {
+			continue
+		}
+		zf := zf
+		if err := q.add(kind, name, zf.Name, func() ([]byte, error) { return readZipFile(zf) }, skipBad); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readZipFile(zf *zip.File) ([]byte, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// archiveEntry classifies the archive entry with the given name, returning
+// "units" or "files" and the base name of the entry, or "" if the entry is to
+// be ignored.
+func archiveEntry(name string) (kind, base string) {
+	dir, base := path.Split(path.Clean(name))
+	switch kind := path.Base(dir); kind {
+	case "units", "files":
+		return kind, base
+	}
+	return "", ""
+}
+
+// add records the entry read by open, with the given kind and base name.
+func (q *ArchiveQueue) add(kind, base, name string, open func() ([]byte, error), skipBad bool) error {
+	if kind == "files" {
+		q.files[base] = open
+		return nil
+	}
+	data, err := open()
+	if err == nil {
+		unit := new(apb.CompilationUnit)
+		if err = proto.Unmarshal(data, unit); err == nil {
+			q.units = append(q.units, unit)
+			return nil
+		}
+	}
+	if skipBad {
+		log.Printf("Warning: Skipped undecodable compilation %q: %v", name, err)
+		return nil
+	}
+	return fmt.Errorf("decoding compilation %q: %v", name, err)
+}
+
+// Next implements the driver.Queue interface.
+func (q *ArchiveQueue) Next(ctx context.Context, f driver.CompilationFunc) error {
+	q.mu.Lock()
+	if len(q.units) == 0 {
+		q.mu.Unlock()
+		return driver.ErrEndOfQueue
+	}
+	next := q.units[0]
+	q.units = q.units[1:]
+	q.mu.Unlock()
+	return f(ctx, driver.Compilation{Unit: next, Revision: q.revision})
+}
+
+// Remaining implements the driver.Sizer interface.
+func (q *ArchiveQueue) Remaining() (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.units), true
+}
+
+// Fetch implements the analysis.Fetcher interface.  Files are found by
+// digest; the path is ignored.
+func (q *ArchiveQueue) Fetch(path, digest string) ([]byte, error) {
+	open, ok := q.files[digest]
+	if !ok {
+		return nil, fmt.Errorf("file %q (digest %q) not found in archive", path, digest)
+	}
+	return open()
+}
+
+// Close releases the archive, if it is still open.  Fetch fails once the
+// queue is closed, unless the archive's files are held in memory.
+func (q *ArchiveQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closer == nil {
+		return nil
+	}
+	err := q.closer.Close()
+	q.closer = nil
+	return err
+}
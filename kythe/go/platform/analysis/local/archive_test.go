@@ -0,0 +1,215 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package local
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis/driver"
+	"kythe.io/kythe/go/test/testutil"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// An entry is a named entry of a test archive.
+type entry struct {
+	name string
+	data []byte
+}
+
+// unitEntries returns the entries of an archive holding a unit for each of
+// sigs and its required input, beneath the given root.
+func unitEntries(t *testing.T, root string, sigs ...string) []entry {
+	t.Helper()
+	var es []entry
+	for _, sig := range sigs {
+		rec, err := proto.Marshal(unit(sig))
+		testutil.FatalOnErrT(t, "Marshaling unit: %v", err)
+		es = append(es,
+			entry{root + "units/" + sig, rec},
+			entry{root + "files/" + digest(sig), []byte(sig)})
+	}
+	return es
+}
+
+func tarArchive(t *testing.T, es []entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range es {
+		testutil.FatalOnErrT(t, "Writing tar header: %v", tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Mode:     0644,
+			Size:     int64(len(e.data)),
+			Typeflag: tar.TypeReg,
+		}))
+		_, err := tw.Write(e.data)
+		testutil.FatalOnErrT(t, "Writing tar entry: %v", err)
+	}
+	testutil.FatalOnErrT(t, "Closing tar: %v", tw.Close())
+	return buf.Bytes()
+}
+
+func tgzArchive(t *testing.T, es []entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(tarArchive(t, es))
+	testutil.FatalOnErrT(t, "Writing gzip: %v", err)
+	testutil.FatalOnErrT(t, "Closing gzip: %v", gz.Close())
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, es []entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range es {
+		w, err := zw.Create(e.name)
+		testutil.FatalOnErrT(t, "Creating zip entry: %v", err)
+		_, err = w.Write(e.data)
+		testutil.FatalOnErrT(t, "Writing zip entry: %v", err)
+	}
+	testutil.FatalOnErrT(t, "Closing zip: %v", zw.Close())
+	return buf.Bytes()
+}
+
+// openArchive writes data to a file in dir and opens an ArchiveQueue on it.
+func openArchive(t *testing.T, dir string, data []byte, opts *Options) (*ArchiveQueue, error) {
+	t.Helper()
+	path := filepath.Join(dir, "archive")
+	testutil.FatalOnErrT(t, "Writing archive: %v", ioutil.WriteFile(path, data, 0644))
+	return NewArchiveQueue(context.Background(), path, opts)
+}
+
+// drainArchive returns the signatures of the compilations in q, checking
+// that Fetch serves the input of each.
+func drainArchive(t *testing.T, q *ArchiveQueue) []string {
+	t.Helper()
+	var got []string
+	for {
+		err := q.Next(context.Background(), func(_ context.Context, cu driver.Compilation) error {
+			sig := cu.Unit.VName.Signature
+			data, err := q.Fetch(sig+".txt", digest(sig))
+			if err != nil {
+				t.Errorf("Fetch input of %q: %v", sig, err)
+			} else if string(data) != sig {
+				t.Errorf("Fetch input of %q: got %q", sig, data)
+			}
+			got = append(got, sig)
+			return nil
+		})
+		if err == driver.ErrEndOfQueue {
+			break
+		}
+		testutil.FatalOnErrT(t, "Next: %v", err)
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestArchiveQueue(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	es := append(unitEntries(t, "root/", "a", "b"), entry{"root/README", []byte("ignored")})
+	tests := []struct {
+		format string
+		data   []byte
+	}{
+		{"tar", tarArchive(t, es)},
+		{"tar.gz", tgzArchive(t, es)},
+		{"zip", zipArchive(t, es)},
+	}
+	for _, test := range tests {
+		q, err := openArchive(t, dir, test.data, &Options{Revision: "r1"})
+		if err != nil {
+			t.Errorf("NewArchiveQueue(%s): %v", test.format, err)
+			continue
+		}
+		if n, ok := q.Remaining(); n != 2 || !ok {
+			t.Errorf("Remaining(%s): got (%d, %v), want (2, true)", test.format, n, ok)
+		}
+		if err := testutil.DeepEqual([]string{"a", "b"}, drainArchive(t, q)); err != nil {
+			t.Errorf("Compilations(%s): %v", test.format, err)
+		}
+		if _, err := q.Fetch("c.txt", digest("c")); err == nil {
+			t.Errorf("Fetch(%s) of a missing file succeeded", test.format)
+		}
+		testutil.FatalOnErrT(t, "Close: %v", q.Close())
+	}
+}
+
+func TestArchiveQueueRevision(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	q, err := openArchive(t, dir, zipArchive(t, unitEntries(t, "", "a")), &Options{Revision: "r1"})
+	testutil.FatalOnErrT(t, "NewArchiveQueue: %v", err)
+	defer q.Close()
+	testutil.FatalOnErrT(t, "Next: %v", q.Next(context.Background(), func(_ context.Context, cu driver.Compilation) error {
+		if cu.Revision != "r1" {
+			t.Errorf("Revision: got %q, want %q", cu.Revision, "r1")
+		}
+		return nil
+	}))
+}
+
+func TestArchiveQueueCorrupt(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	zipData := zipArchive(t, unitEntries(t, "", "a"))
+	tests := []struct {
+		desc string
+		data []byte
+	}{
+		{"unknown format", []byte("not an archive")},
+		{"truncated zip", zipData[:len(zipData)/2]},
+		{"corrupt gzip", []byte("\x1f\x8bnot really gzip")},
+		{"truncated tar.gz", tgzArchive(t, unitEntries(t, "", "a"))[:20]},
+	}
+	for _, test := range tests {
+		if q, err := openArchive(t, dir, test.data, nil); err == nil {
+			q.Close()
+			t.Errorf("NewArchiveQueue(%s) succeeded, want an error", test.desc)
+		}
+	}
+}
+
+func TestArchiveQueueSkipBadFiles(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	es := append(unitEntries(t, "", "a"), entry{"units/bad", []byte("\xff\xff not a unit")})
+	data := tarArchive(t, es)
+
+	if q, err := openArchive(t, dir, data, nil); err == nil {
+		q.Close()
+		t.Error("NewArchiveQueue succeeded with an undecodable unit")
+	}
+	q, err := openArchive(t, dir, data, &Options{SkipBadFiles: true})
+	testutil.FatalOnErrT(t, "NewArchiveQueue with SkipBadFiles: %v", err)
+	defer q.Close()
+	if err := testutil.DeepEqual([]string{"a"}, drainArchive(t, q)); err != nil {
+		t.Errorf("Compilations: %v", err)
+	}
+}
@@ -18,26 +18,39 @@
 package local // import "kythe.io/kythe/go/platform/analysis/local"
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
 	"kythe.io/kythe/go/platform/analysis"
 	"kythe.io/kythe/go/platform/analysis/driver"
+	"kythe.io/kythe/go/platform/delimited"
 	"kythe.io/kythe/go/platform/kindex"
 	"kythe.io/kythe/go/platform/kzip"
 	"kythe.io/kythe/go/platform/vfs"
 
+	"github.com/golang/protobuf/proto"
+
 	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
 )
 
 // Options control the behaviour of a FileQueue.
 type Options struct {
 	// The revision marker to attribute to each compilation.
 	Revision string
+
+	// If true, input files that cannot be read are logged and skipped rather
+	// than reported as errors by the queue.
+	SkipBadFiles bool
 }
 
 func (o *Options) revision() string {
@@ -47,6 +60,8 @@ func (o *Options) revision() string {
 	return o.Revision
 }
 
+func (o *Options) skipBadFiles() bool { return o != nil && o.SkipBadFiles }
+
 // A FileQueue is a driver.Queue reading each compilation from a sequence of
 // .kzip and .kindex files.  On each call to the driver.CompilationFunc, the
 // FileQueue's analysis.Fetcher interface exposes the current file's contents.
@@ -55,6 +70,9 @@ type FileQueue struct {
 	paths    []string               // the paths of kindex files to read
 	units    []*apb.CompilationUnit // units waiting to be delivered
 	revision string                 // revision marker for each compilation
+	skipBad  bool                   // skip unreadable input files
+	counts   []int                  // unit counts for paths, once computed; nil if unknown
+	counted  bool                   // whether counts has been computed
 
 	fetcher analysis.Fetcher
 	closer  io.Closer
@@ -66,6 +84,7 @@ func NewFileQueue(paths []string, opts *Options) *FileQueue {
 	return &FileQueue{
 		paths:    paths,
 		revision: opts.revision(),
+		skipBad:  opts.skipBadFiles(),
 	}
 }
 
@@ -82,38 +101,11 @@ func (q *FileQueue) Next(ctx context.Context, f driver.CompilationFunc) error {
 
 		path := q.paths[q.index]
 		q.index++
-		switch filepath.Ext(path) {
-		case ".kindex":
-			cu, err := kindex.Open(ctx, path)
-			if err != nil {
-				return fmt.Errorf("opening kindex file %q: %v", path, err)
-			}
-			q.fetcher = cu
-			q.closer = nil // nothing to close in this case
-			q.units = append(q.units, cu.Proto)
-		case ".kzip":
-			f, err := vfs.Open(ctx, path)
-			if err != nil {
-				return fmt.Errorf("opening kzip file %q: %v", path, err)
-			}
-			rc, ok := f.(kzip.File)
-			if !ok {
-				f.Close()
-				return fmt.Errorf("reader %T does not implement kzip.File", rc)
-			}
-			if err := kzip.Scan(rc, func(r *kzip.Reader, unit *kzip.Unit) error {
-				q.fetcher = kzipFetcher{r}
-				q.units = append(q.units, unit.Proto)
-				return nil
-			}); err != nil {
-				f.Close()
-				return fmt.Errorf("scanning kzip %q: %v", path, err)
+		if err := q.load(ctx, path); err != nil {
+			if !q.skipBad {
+				return err
 			}
-			q.closer = f
-
-		default:
-			log.Printf("Warning: Skipped unknown file kind: %q", path)
-			continue
+			log.Printf("Warning: Skipped unreadable file: %v", err)
 		}
 	}
 
@@ -126,6 +118,106 @@ func (q *FileQueue) Next(ctx context.Context, f driver.CompilationFunc) error {
 	})
 }
 
+// Remaining implements the driver.Sizer interface.  The first call counts the
+// compilations in each input file, reading only the central directory of
+// each .kzip and closing it again, and the counts are kept for later calls.
+// The size is unknown if a file cannot be counted, unless SkipBadFiles is
+// set, in which case the file counts as empty.
+func (q *FileQueue) Remaining() (int, bool) {
+	if !q.counted {
+		q.counted = true
+		counts := make([]int, len(q.paths))
+		for i, path := range q.paths {
+			n, err := countUnits(context.Background(), path)
+			if err != nil && !q.skipBad {
+				return 0, false
+			}
+			counts[i] = n
+		}
+		q.counts = counts
+	}
+	if q.counts == nil {
+		return 0, false
+	}
+	n := len(q.units)
+	for _, c := range q.counts[q.index:] {
+		n += c
+	}
+	return n, true
+}
+
+// countUnits returns the number of compilations in the file at path.
+func countUnits(ctx context.Context, path string) (int, error) {
+	switch filepath.Ext(path) {
+	case ".kindex":
+		return 1, nil
+	case ".kzip":
+		f, err := vfs.Open(ctx, path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		rc, ok := f.(kzip.File)
+		if !ok {
+			return 0, fmt.Errorf("reader %T does not implement kzip.File", f)
+		}
+		size, err := rc.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		r, err := kzip.NewReader(rc, size)
+		if err != nil {
+			return 0, err
+		}
+		return r.NumUnits(), nil
+	}
+	return 0, nil
+}
+
+// load reads the compilations from the file at path into the queue.
+func (q *FileQueue) load(ctx context.Context, path string) error {
+	switch filepath.Ext(path) {
+	case ".kindex":
+		cu, err := kindex.Open(ctx, path)
+		if err != nil {
+			return fmt.Errorf("opening kindex file %q: %v", path, err)
+		}
+		q.fetcher = cu
+		q.closer = nil // nothing to close in this case
+		q.units = append(q.units, cu.Proto)
+	case ".kzip":
+		f, err := vfs.Open(ctx, path)
+		if err != nil {
+			return fmt.Errorf("opening kzip file %q: %v", path, err)
+		}
+		rc, ok := f.(kzip.File)
+		if !ok {
+			f.Close()
+			return fmt.Errorf("reader %T does not implement kzip.File", rc)
+		}
+		// Nothing is taken from the file unless it is scanned completely.
+		var (
+			fetcher analysis.Fetcher
+			units   []*apb.CompilationUnit
+		)
+		if err := kzip.Scan(rc, func(r *kzip.Reader, unit *kzip.Unit) error {
+			fetcher = kzipFetcher{r}
+			units = append(units, unit.Proto)
+			return nil
+		}); err != nil {
+			f.Close()
+			return fmt.Errorf("scanning kzip %q: %v", path, err)
+		}
+		q.fetcher = fetcher
+		q.units = append(q.units, units...)
+		q.closer = f
+
+	default:
+		log.Printf("Warning: Skipped unknown file kind: %q", path)
+	}
+	return nil
+}
+
 // Fetch implements the analysis.Fetcher interface by delegating to the
 // currently-active input file. Only files in the current archive will be
 // accessible for a given invocation of Fetch.
@@ -136,7 +228,464 @@ func (q *FileQueue) Fetch(path, digest string) ([]byte, error) {
 	return q.fetcher.Fetch(path, digest)
 }
 
+// Close releases the input file currently open, if any.  Calling Next after
+// Close continues with the next input file.
+func (q *FileQueue) Close() error {
+	q.units = nil
+	if q.closer == nil {
+		return nil
+	}
+	err := q.closer.Close()
+	q.closer = nil
+	return err
+}
+
 type kzipFetcher struct{ r *kzip.Reader }
 
 // Fetch implements the required method of analysis.Fetcher.
 func (k kzipFetcher) Fetch(_, digest string) ([]byte, error) { return k.r.ReadAll(digest) }
+
+// A KzipDirQueue is a driver.Queue reading each compilation from the .kzip
+// files found beneath a directory.  The directory is not read until the first
+// call to Next; other files in the directory are ignored.  An entry beneath
+// the directory that cannot be read ends the walk with an error, unless
+// SkipBadFiles is set, in which case it is logged and skipped.  Like a
+// FileQueue, its analysis.Fetcher interface serves file contents from the
+// kzip holding the current compilation.
+type KzipDirQueue struct {
+	dir  string
+	opts *Options
+	q    *FileQueue // populated on the first call to Next or Remaining
+	err  error      // the error reading the directory, if any
+}
+
+// NewKzipDirQueue returns a new KzipDirQueue over the .kzip files in dir.
+func NewKzipDirQueue(dir string, opts *Options) *KzipDirQueue {
+	return &KzipDirQueue{dir: dir, opts: opts}
+}
+
+// Next implements the driver.Queue interface.
+func (k *KzipDirQueue) Next(ctx context.Context, f driver.CompilationFunc) error {
+	if err := k.init(ctx); err != nil {
+		return err
+	}
+	return k.q.Next(ctx, f)
+}
+
+// Remaining implements the driver.Sizer interface.  If the directory has not
+// yet been read, Remaining reads it; the .kzip files are then counted as by a
+// FileQueue.
+func (k *KzipDirQueue) Remaining() (int, bool) {
+	if err := k.init(context.Background()); err != nil {
+		return 0, false
+	}
+	return k.q.Remaining()
+}
+
+// init populates k.q from the directory, if that has not already been done.
+func (k *KzipDirQueue) init(ctx context.Context) error {
+	if k.q != nil || k.err != nil {
+		return k.err
+	}
+	var paths []string
+	if err := vfs.Walk(ctx, k.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == k.dir || !k.opts.skipBadFiles() {
+				return err
+			}
+			log.Printf("Warning: Skipped unreadable entry: %v", err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if !info.IsDir() && filepath.Ext(path) == ".kzip" {
+			paths = append(paths, path)
+		}
+		return nil
+	}); err != nil {
+		k.err = fmt.Errorf("reading kzip directory %q: %v", k.dir, err)
+		return k.err
+	}
+	k.q = NewFileQueue(paths, k.opts)
+	return nil
+}
+
+// Fetch implements the analysis.Fetcher interface.
+func (k *KzipDirQueue) Fetch(path, digest string) ([]byte, error) {
+	if k.q == nil {
+		return nil, errors.New("no data source available")
+	}
+	return k.q.Fetch(path, digest)
+}
+
+// Close releases the input file currently open, if any.
+func (k *KzipDirQueue) Close() error {
+	if k.q == nil {
+		return nil
+	}
+	return k.q.Close()
+}
+
+// DefaultChunkSize is the default maximum size of the file entries in which a
+// KzipWriter stores its outputs.
+const DefaultChunkSize = 32 << 20
+
+// OutputIndexLanguage is the language of the compilation record in which a
+// KzipWriter indexes the file entries holding its outputs.  Each required
+// input of the record is one such entry, with a path of the form
+// "outputs/00000000" giving its position among them.
+const OutputIndexLanguage = "kythe_analysis_outputs"
+
+// outputChunkPath returns the path under which the index of a KzipWriter
+// records the chunk at index i.
+func outputChunkPath(i int) string { return fmt.Sprintf("outputs/%08d", i) }
+
+// A KzipWriter stores analysis outputs in a .kzip archive.  Outputs are
+// encoded as length-delimited AnalysisOutput messages and stored in file
+// entries of the archive holding at most about chunkSize bytes each.  When
+// the KzipWriter is closed, it adds a compilation record with language
+// OutputIndexLanguage listing those entries, by which ReadKzipOutputs finds
+// them.  Its Write method is an analysis.OutputFunc and is safe for
+// concurrent use.
+type KzipWriter struct {
+	w         *kzip.Writer
+	chunkSize int
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	chunks  []string // digests of the chunks written so far
+	entries int
+	size    int64
+}
+
+// NewKzipWriter returns a KzipWriter that writes a .kzip archive to w, which
+// is closed when the KzipWriter is closed.  If chunkSize <= 0, a default of
+// DefaultChunkSize is used.
+func NewKzipWriter(w io.WriteCloser, chunkSize int) (*KzipWriter, error) {
+	kw, err := kzip.NewWriteCloser(w)
+	if err != nil {
+		return nil, err
+	}
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &KzipWriter{w: kw, chunkSize: chunkSize}, nil
+}
+
+// Write adds out to the archive.  It satisfies analysis.OutputFunc.
+func (k *KzipWriter) Write(_ context.Context, out *apb.AnalysisOutput) error {
+	rec, err := proto.Marshal(out)
+	if err != nil {
+		return fmt.Errorf("marshaling output: %v", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := delimited.NewWriter(&k.buf).Put(rec); err != nil {
+		return err
+	}
+	k.entries++
+	k.size += int64(len(rec))
+	if k.buf.Len() >= k.chunkSize {
+		return k.flushLocked()
+	}
+	return nil
+}
+
+// Flush writes any buffered outputs to the archive.  It is suitable for use
+// from a driver.Context's Teardown method.
+func (k *KzipWriter) Flush() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.flushLocked()
+}
+
+func (k *KzipWriter) flushLocked() error {
+	if k.buf.Len() == 0 {
+		return nil
+	}
+	digest, err := k.w.AddFile(&k.buf)
+	if err != nil {
+		return fmt.Errorf("writing output chunk: %v", err)
+	}
+	k.buf.Reset()
+	k.chunks = append(k.chunks, digest)
+	return nil
+}
+
+// Close flushes any buffered outputs, adds the index of the outputs to the
+// archive, and closes the archive.
+func (k *KzipWriter) Close() error {
+	ferr := k.Flush()
+	if ferr == nil {
+		ferr = k.writeIndex()
+	}
+	if err := k.w.Close(); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// writeIndex adds the compilation record indexing the chunks of k.
+func (k *KzipWriter) writeIndex() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	index := &apb.CompilationUnit{VName: &spb.VName{Language: OutputIndexLanguage}}
+	for i, digest := range k.chunks {
+		index.RequiredInput = append(index.RequiredInput, &apb.CompilationUnit_FileInput{
+			Info: &apb.FileInfo{Path: outputChunkPath(i), Digest: digest},
+		})
+	}
+	if _, err := k.w.AddUnit(index, nil); err != nil {
+		return fmt.Errorf("writing output index: %v", err)
+	}
+	return nil
+}
+
+// ReadKzipOutputs calls f with each output stored in r by a KzipWriter, in
+// the order they were written, and reports the first error it returns.  It
+// reports an error if r holds no index of outputs.
+func ReadKzipOutputs(r *kzip.Reader, f func(*apb.AnalysisOutput) error) error {
+	var index *apb.CompilationUnit
+	if err := r.Scan(func(u *kzip.Unit) error {
+		if u.Proto.GetVName().GetLanguage() == OutputIndexLanguage {
+			index = u.Proto
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("reading output index: %v", err)
+	} else if index == nil {
+		return errors.New("archive has no output index")
+	}
+	chunks := append([]*apb.CompilationUnit_FileInput(nil), index.RequiredInput...)
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].GetInfo().GetPath() < chunks[j].GetInfo().GetPath()
+	})
+	for _, chunk := range chunks {
+		data, err := r.ReadAll(chunk.GetInfo().GetDigest())
+		if err != nil {
+			return fmt.Errorf("reading output chunk %q: %v", chunk.GetInfo().GetPath(), err)
+		}
+		rd := delimited.NewReader(bytes.NewReader(data))
+		for {
+			out := new(apb.AnalysisOutput)
+			if err := rd.NextProto(out); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("decoding output chunk %q: %v", chunk.GetInfo().GetPath(), err)
+			}
+			if err := f(out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Entries returns the number of outputs written.
+func (k *KzipWriter) Entries() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.entries
+}
+
+// Bytes returns the total encoded size of the outputs written.
+func (k *KzipWriter) Bytes() int64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.size
+}
+
+// Chunks returns the digests of the file entries holding the outputs that
+// have been flushed to the archive, in the order they were written.
+func (k *KzipWriter) Chunks() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]string(nil), k.chunks...)
+}
+
+// A DeadLetterKzip records failed compilations in a .kzip archive, so that
+// they can be reanalyzed later, for example with a FileQueue.  If it has an
+// analysis.Fetcher, the required inputs of each compilation are copied into
+// the archive too; otherwise only the compilation records are stored.  If it
+// has an error log, a line giving the digest of each compilation stored and
+// the error that caused it to fail is written there.
+//
+// Its DeadLetter method is suitable for use as a driver.Driver's DeadLetter
+// hook, and is safe for concurrent use.
+type DeadLetterKzip struct {
+	w       *kzip.Writer
+	fetcher analysis.Fetcher
+	errLog  io.Writer
+
+	mu    sync.Mutex
+	units int
+}
+
+// NewDeadLetterKzip returns a DeadLetterKzip that writes a .kzip archive to w,
+// which is closed when the DeadLetterKzip is closed.  Either of fetcher and
+// errLog may be nil.
+func NewDeadLetterKzip(w io.WriteCloser, fetcher analysis.Fetcher, errLog io.Writer) (*DeadLetterKzip, error) {
+	kw, err := kzip.NewWriteCloser(w)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterKzip{w: kw, fetcher: fetcher, errLog: errLog}, nil
+}
+
+// DeadLetter adds unit, which failed with the given error, to the archive.
+func (d *DeadLetterKzip) DeadLetter(_ context.Context, unit *apb.CompilationUnit, failure error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fetcher != nil {
+		for _, ri := range unit.RequiredInput {
+			info := ri.GetInfo()
+			data, err := d.fetcher.Fetch(info.GetPath(), info.GetDigest())
+			if err != nil {
+				return fmt.Errorf("fetching input %q: %v", info.GetPath(), err)
+			}
+			if _, err := d.w.AddFile(bytes.NewReader(data)); err != nil {
+				return fmt.Errorf("writing input %q: %v", info.GetPath(), err)
+			}
+		}
+	}
+	digest, err := d.w.AddUnit(unit, nil)
+	if err == kzip.ErrUnitExists {
+		return nil // already recorded
+	} else if err != nil {
+		return fmt.Errorf("writing compilation: %v", err)
+	}
+	d.units++
+	if d.errLog != nil {
+		if _, err := fmt.Fprintf(d.errLog, "%s\t%v\n", digest, failure); err != nil {
+			return fmt.Errorf("writing error log: %v", err)
+		}
+	}
+	return nil
+}
+
+// Units returns the number of compilations recorded.
+func (d *DeadLetterKzip) Units() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.units
+}
+
+// Close closes the archive.
+func (d *DeadLetterKzip) Close() error { return d.w.Close() }
+
+// A Config describes a local analysis for Run: the compilations to analyze,
+// the analyzer to send them to, and where to store the results.
+type Config struct {
+	Analyzer analysis.CompilationAnalyzer // required
+
+	// The compilations to analyze are read from Queue, if it is non-nil, or
+	// else from the .kzip files beneath KzipDir, read with QueueOptions.
+	// Run does not close a Queue provided by the caller.
+	Queue        driver.Queue
+	KzipDir      string
+	QueueOptions *Options
+
+	FileDataService string // the file data service passed to the analyzer
+
+	// The outputs are written to a .kzip archive at Output, as a KzipWriter
+	// does, in chunks of at most ChunkSize bytes.  Output is required, and
+	// must not be beneath KzipDir.
+	Output    string
+	ChunkSize int
+
+	// If Summary != nil, a JSON summary of the run is written to it when the
+	// run ends, whether or not it succeeded.
+	Summary io.Writer
+
+	// Options configure the underlying driver further.  Since the queues
+	// of this package serve their files to one compilation at a time, Run
+	// rejects options that would analyze compilations from such a queue
+	// concurrently or prefetch them.  It cannot see through a queue that
+	// wraps one of them, such as a driver.ShardQueue, so the caller must not
+	// set such options for one.  Run also rejects options that set the
+	// driver's WriteOutput, since the outputs go to Output.
+	Options []driver.Option
+}
+
+// sequential reports whether q serves the files of one compilation at a time,
+// so that its compilations must be analyzed in turn.
+func sequential(q driver.Queue) bool {
+	switch q.(type) {
+	case *FileQueue, *KzipDirQueue:
+		return true
+	}
+	return false
+}
+
+// beneath reports whether path is dir or a path beneath it.
+func beneath(path, dir string) bool {
+	if p, err := filepath.Abs(path); err == nil {
+		path = p
+	}
+	if d, err := filepath.Abs(dir); err == nil {
+		dir = d
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Run analyzes the compilations described by cfg, storing the outputs in the
+// archive at cfg.Output, and returns the statistics for the run.  Whatever
+// the outcome, the queue Run opens and the output archive are closed before
+// it returns.  Programs that need more control should use a driver.Driver
+// directly.
+func Run(ctx context.Context, cfg *Config) (stats driver.RunStats, err error) {
+	q := cfg.Queue
+	if q == nil {
+		if cfg.KzipDir == "" {
+			return stats, errors.New("no queue or kzip directory specified")
+		}
+		dq := NewKzipDirQueue(cfg.KzipDir, cfg.QueueOptions)
+		defer func() {
+			if cerr := dq.Close(); err == nil && cerr != nil {
+				err = fmt.Errorf("closing queue: %v", cerr)
+			}
+		}()
+		q = dq
+	}
+	if cfg.Output == "" {
+		return stats, errors.New("no output specified")
+	} else if cfg.Queue == nil && beneath(cfg.Output, cfg.KzipDir) {
+		return stats, fmt.Errorf("output %q is beneath kzip directory %q", cfg.Output, cfg.KzipDir)
+	}
+
+	opts := append([]driver.Option{driver.WithFileDataService(cfg.FileDataService)}, cfg.Options...)
+	d, err := driver.New(cfg.Analyzer, q, opts...)
+	if err != nil {
+		return stats, err
+	}
+	if sequential(q) && (d.Concurrency > 1 || d.Prefetch > 0) {
+		return stats, errors.New("the queue does not support concurrency or prefetching")
+	} else if d.WriteOutput != nil {
+		return stats, errors.New("the options must not set the output")
+	}
+	f, err := vfs.Create(ctx, cfg.Output)
+	if err != nil {
+		return stats, fmt.Errorf("creating output: %v", err)
+	}
+	out, err := NewKzipWriter(f, cfg.ChunkSize)
+	if err != nil {
+		f.Close()
+		return stats, fmt.Errorf("creating output: %v", err)
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("closing output: %v", cerr)
+		}
+	}()
+	d.WriteOutput = out.Write
+
+	stats, err = d.RunWithStats(ctx, nil)
+	if cfg.Summary != nil {
+		if serr := stats.WriteJSON(cfg.Summary); err == nil && serr != nil {
+			err = fmt.Errorf("writing summary: %v", serr)
+		}
+	}
+	return stats, err
+}
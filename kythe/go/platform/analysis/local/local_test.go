@@ -0,0 +1,593 @@
+/*
+ * Copyright 2020 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package local
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"kythe.io/kythe/go/platform/analysis"
+	"kythe.io/kythe/go/platform/analysis/driver"
+	"kythe.io/kythe/go/platform/kzip"
+	"kythe.io/kythe/go/platform/vfs"
+	"kythe.io/kythe/go/test/testutil"
+
+	"github.com/golang/protobuf/proto"
+
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// tempDir returns a new temporary directory and a function that removes it.
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "local")
+	testutil.FatalOnErrT(t, "Creating temp dir: %v", err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// unit returns a compilation with the given signature, whose one required
+// input has the signature as its contents.
+func unit(sig string) *apb.CompilationUnit {
+	return &apb.CompilationUnit{
+		VName: &spb.VName{Signature: sig},
+		RequiredInput: []*apb.CompilationUnit_FileInput{{
+			Info: &apb.FileInfo{Path: sig + ".txt", Digest: digest(sig)},
+		}},
+	}
+}
+
+// digest returns the kzip digest of the file "data".
+func digest(data string) string {
+	w, err := kzip.NewWriter(ioutil.Discard)
+	if err != nil {
+		panic(err)
+	}
+	d, err := w.AddFile(strings.NewReader(data))
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// writeKzip writes a .kzip at path holding a unit for each of sigs and its
+// required input.
+func writeKzip(t *testing.T, path string, sigs ...string) {
+	t.Helper()
+	f, err := os.Create(path)
+	testutil.FatalOnErrT(t, "Creating kzip: %v", err)
+	w, err := kzip.NewWriteCloser(f)
+	testutil.FatalOnErrT(t, "Creating kzip writer: %v", err)
+	for _, sig := range sigs {
+		_, err := w.AddFile(strings.NewReader(sig))
+		testutil.FatalOnErrT(t, "Adding file: %v", err)
+		_, err = w.AddUnit(unit(sig), nil)
+		testutil.FatalOnErrT(t, "Adding unit: %v", err)
+	}
+	testutil.FatalOnErrT(t, "Closing kzip: %v", w.Close())
+}
+
+// openKzip returns a reader for the .kzip at path.
+func openKzip(t *testing.T, path string) *kzip.Reader {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	testutil.FatalOnErrT(t, "Reading kzip: %v", err)
+	r, err := kzip.NewReader(bytes.NewReader(data), int64(len(data)))
+	testutil.FatalOnErrT(t, "Opening kzip: %v", err)
+	return r
+}
+
+// readOutputs returns the values of the outputs stored in the .kzip at path.
+func readOutputs(t *testing.T, path string) []string {
+	t.Helper()
+	var got []string
+	testutil.FatalOnErrT(t, "ReadKzipOutputs: %v", ReadKzipOutputs(openKzip(t, path), func(out *apb.AnalysisOutput) error {
+		got = append(got, string(out.Value))
+		return nil
+	}))
+	return got
+}
+
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestKzipDirQueue(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	testutil.FatalOnErrT(t, "Creating subdir: %v", os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	writeKzip(t, filepath.Join(dir, "one.kzip"), "a", "b")
+	writeKzip(t, filepath.Join(dir, "sub", "two.kzip"), "c")
+	testutil.FatalOnErrT(t, "Writing other file: %v", ioutil.WriteFile(filepath.Join(dir, "other.txt"), []byte("x"), 0644))
+
+	q := NewKzipDirQueue(dir, &Options{Revision: "r1"})
+	defer q.Close()
+	if _, err := q.Fetch("a.txt", digest("a")); err == nil {
+		t.Error("Fetch before Next succeeded")
+	}
+	if n, ok := q.Remaining(); n != 3 || !ok {
+		t.Errorf("Remaining before Next: got (%d, %v), want (3, true)", n, ok)
+	}
+	ctx := context.Background()
+	var got []string
+	for {
+		err := q.Next(ctx, func(_ context.Context, cu driver.Compilation) error {
+			sig := cu.Unit.VName.Signature
+			if cu.Revision != "r1" {
+				t.Errorf("Revision of %q: got %q, want %q", sig, cu.Revision, "r1")
+			}
+			data, err := q.Fetch(sig+".txt", digest(sig))
+			if err != nil {
+				t.Errorf("Fetch input of %q: %v", sig, err)
+			} else if string(data) != sig {
+				t.Errorf("Fetch input of %q: got %q", sig, data)
+			}
+			got = append(got, sig)
+			return nil
+		})
+		if err == driver.ErrEndOfQueue {
+			break
+		}
+		testutil.FatalOnErrT(t, "Next: %v", err)
+	}
+	sort.Strings(got)
+	if err := testutil.DeepEqual([]string{"a", "b", "c"}, got); err != nil {
+		t.Errorf("Compilations: %v", err)
+	}
+}
+
+func TestFileQueueRemaining(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	one, two := filepath.Join(dir, "one.kzip"), filepath.Join(dir, "two.kzip")
+	writeKzip(t, one, "a")
+	writeKzip(t, two, "b", "c")
+
+	q := NewFileQueue([]string{one, two}, nil)
+	defer q.Close()
+	next := func() {
+		t.Helper()
+		testutil.FatalOnErrT(t, "Next: %v", q.Next(context.Background(), func(context.Context, driver.Compilation) error { return nil }))
+	}
+	check := func(wantN int, wantOK bool) {
+		t.Helper()
+		if n, ok := q.Remaining(); n != wantN || ok != wantOK {
+			t.Errorf("Remaining: got (%d, %v), want (%d, %v)", n, ok, wantN, wantOK)
+		}
+	}
+	check(3, true)
+	next()
+	check(2, true)
+	next()
+	check(1, true)
+	next()
+	check(0, true)
+}
+
+func TestFileQueueRemainingUnreadable(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	good, missing := filepath.Join(dir, "good.kzip"), filepath.Join(dir, "missing.kzip")
+	writeKzip(t, good, "a", "b")
+
+	if n, ok := NewFileQueue([]string{good, missing}, nil).Remaining(); ok {
+		t.Errorf("Remaining: got (%d, true), want an unknown size", n)
+	}
+	// Under SkipBadFiles the unreadable file is skipped, so it counts as empty.
+	if n, ok := NewFileQueue([]string{good, missing}, &Options{SkipBadFiles: true}).Remaining(); n != 2 || !ok {
+		t.Errorf("Remaining with SkipBadFiles: got (%d, %v), want (2, true)", n, ok)
+	}
+}
+
+// writeTruncatedKzip writes a .kzip at path holding a readable unit for sig,
+// with its required input, followed by a unit record cut short.
+func writeTruncatedKzip(t *testing.T, path, sig string) {
+	t.Helper()
+	rec, err := proto.Marshal(&apb.IndexedCompilation{Unit: unit(sig)})
+	testutil.FatalOnErrT(t, "Marshaling unit: %v", err)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range []struct {
+		name string
+		data []byte
+	}{
+		{"root/", nil},
+		{"root/files/" + digest(sig), []byte(sig)},
+		{"root/pbunits/0", rec},
+		{"root/pbunits/1", rec[:len(rec)/2]},
+	} {
+		w, err := zw.Create(e.name)
+		testutil.FatalOnErrT(t, "Creating zip entry: %v", err)
+		_, err = w.Write(e.data)
+		testutil.FatalOnErrT(t, "Writing zip entry: %v", err)
+	}
+	testutil.FatalOnErrT(t, "Closing zip: %v", zw.Close())
+	testutil.FatalOnErrT(t, "Writing kzip: %v", ioutil.WriteFile(path, buf.Bytes(), 0644))
+}
+
+func TestFileQueueTruncated(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	bad, good := filepath.Join(dir, "bad.kzip"), filepath.Join(dir, "good.kzip")
+	writeTruncatedKzip(t, bad, "a")
+	writeKzip(t, good, "b")
+
+	ctx := context.Background()
+	q := NewFileQueue([]string{bad, good}, nil)
+	if err := q.Next(ctx, func(context.Context, driver.Compilation) error { return nil }); err == nil {
+		t.Error("Next succeeded on a truncated kzip")
+	}
+	q.Close()
+
+	// With SkipBadFiles, none of the units of the truncated kzip are
+	// delivered, and those of the next file can be fetched.
+	q = NewFileQueue([]string{bad, good}, &Options{SkipBadFiles: true})
+	defer q.Close()
+	var got []string
+	for {
+		err := q.Next(ctx, func(_ context.Context, cu driver.Compilation) error {
+			sig := cu.Unit.VName.Signature
+			got = append(got, sig)
+			if _, err := q.Fetch(sig+".txt", digest(sig)); err != nil {
+				t.Errorf("Fetch input of %q: %v", sig, err)
+			}
+			return nil
+		})
+		if err == driver.ErrEndOfQueue {
+			break
+		}
+		testutil.FatalOnErrT(t, "Next: %v", err)
+	}
+	if err := testutil.DeepEqual([]string{"b"}, got); err != nil {
+		t.Errorf("Compilations: %v", err)
+	}
+}
+
+func TestKzipDirQueueMissing(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	q := NewKzipDirQueue(filepath.Join(dir, "missing"), nil)
+	if err := q.Next(context.Background(), func(context.Context, driver.Compilation) error {
+		t.Error("Unexpected compilation")
+		return nil
+	}); err == nil || err == driver.ErrEndOfQueue {
+		t.Errorf("Next: got %v, want an error reading the directory", err)
+	}
+}
+
+// badDirFS is a vfs.Interface whose walks report an error for the directory
+// named bad instead of entering it.
+type badDirFS struct {
+	vfs.LocalFS
+	bad string
+}
+
+// Walk implements part of the vfs.Interface interface.
+func (b badDirFS) Walk(ctx context.Context, root string, walkFn filepath.WalkFunc) error {
+	return b.LocalFS.Walk(ctx, root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && path == b.bad {
+			return walkFn(path, info, os.ErrPermission)
+		}
+		return walkFn(path, info, err)
+	})
+}
+
+func TestKzipDirQueueUnreadable(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	bad := filepath.Join(dir, "bad")
+	testutil.FatalOnErrT(t, "Creating subdir: %v", os.Mkdir(bad, 0755))
+	writeKzip(t, filepath.Join(bad, "hidden.kzip"), "b")
+	writeKzip(t, filepath.Join(dir, "one.kzip"), "a")
+	defer func(fs vfs.Interface) { vfs.Default = fs }(vfs.Default)
+	vfs.Default = badDirFS{bad: bad}
+
+	ctx := context.Background()
+	discard := func(context.Context, driver.Compilation) error { return nil }
+	if err := NewKzipDirQueue(dir, nil).Next(ctx, discard); err == nil || err == driver.ErrEndOfQueue {
+		t.Errorf("Next: got %v, want an error reading the directory", err)
+	}
+
+	q := NewKzipDirQueue(dir, &Options{SkipBadFiles: true})
+	defer q.Close()
+	var got []string
+	for {
+		err := q.Next(ctx, func(_ context.Context, cu driver.Compilation) error {
+			got = append(got, cu.Unit.VName.Signature)
+			return nil
+		})
+		if err == driver.ErrEndOfQueue {
+			break
+		}
+		testutil.FatalOnErrT(t, "Next: %v", err)
+	}
+	if err := testutil.DeepEqual([]string{"a"}, got); err != nil {
+		t.Errorf("Compilations: %v", err)
+	}
+}
+
+func TestKzipWriter(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "out.kzip")
+	f, err := os.Create(path)
+	testutil.FatalOnErrT(t, "Creating output: %v", err)
+
+	// Repeated values make chunks with identical contents, which the archive
+	// stores only once.
+	w, err := NewKzipWriter(f, 8)
+	testutil.FatalOnErrT(t, "NewKzipWriter: %v", err)
+	var want []string
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprintf("value-%d", i%3), "same-value")
+	}
+	ctx := context.Background()
+	for _, v := range want {
+		testutil.FatalOnErrT(t, "Write: %v", w.Write(ctx, &apb.AnalysisOutput{Value: []byte(v)}))
+	}
+	testutil.FatalOnErrT(t, "Close: %v", w.Close())
+
+	if n := w.Entries(); n != len(want) {
+		t.Errorf("Entries: got %d, want %d", n, len(want))
+	}
+	if n := len(w.Chunks()); n != len(want) {
+		t.Errorf("Chunks: got %d, want %d", n, len(want))
+	}
+	if err := testutil.DeepEqual(want, readOutputs(t, path)); err != nil {
+		t.Errorf("Outputs: %v", err)
+	}
+}
+
+func TestKzipWriterChunks(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewKzipWriter(nopCloser{buf}, 0)
+	testutil.FatalOnErrT(t, "NewKzipWriter: %v", err)
+	ctx := context.Background()
+	for _, v := range []string{"a", "b"} {
+		testutil.FatalOnErrT(t, "Write: %v", w.Write(ctx, &apb.AnalysisOutput{Value: []byte(v)}))
+	}
+	testutil.FatalOnErrT(t, "Flush: %v", w.Flush())
+	testutil.FatalOnErrT(t, "Write: %v", w.Write(ctx, &apb.AnalysisOutput{Value: []byte("c")}))
+	testutil.FatalOnErrT(t, "Close: %v", w.Close())
+	if n := len(w.Chunks()); n != 2 {
+		t.Errorf("Chunks: got %d, want 2", n)
+	}
+
+	r, err := kzip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	testutil.FatalOnErrT(t, "Opening kzip: %v", err)
+	var got []string
+	testutil.FatalOnErrT(t, "ReadKzipOutputs: %v", ReadKzipOutputs(r, func(out *apb.AnalysisOutput) error {
+		got = append(got, string(out.Value))
+		return nil
+	}))
+	if err := testutil.DeepEqual([]string{"a", "b", "c"}, got); err != nil {
+		t.Errorf("Outputs: %v", err)
+	}
+}
+
+func TestReadKzipOutputsNoIndex(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "in.kzip")
+	writeKzip(t, path, "a")
+	if err := ReadKzipOutputs(openKzip(t, path), func(*apb.AnalysisOutput) error { return nil }); err == nil {
+		t.Error("ReadKzipOutputs succeeded on an archive with no output index")
+	}
+}
+
+type mapFetcher map[string]string
+
+// Fetch implements the analysis.Fetcher interface.
+func (m mapFetcher) Fetch(path, _ string) ([]byte, error) {
+	if data, ok := m[path]; ok {
+		return []byte(data), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func TestDeadLetterKzip(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "dead.kzip")
+	f, err := os.Create(path)
+	testutil.FatalOnErrT(t, "Creating archive: %v", err)
+	var errLog bytes.Buffer
+	d, err := NewDeadLetterKzip(f, mapFetcher{"a.txt": "a", "b.txt": "b"}, &errLog)
+	testutil.FatalOnErrT(t, "NewDeadLetterKzip: %v", err)
+
+	ctx := context.Background()
+	failure := errors.New("analysis failed")
+	for _, sig := range []string{"a", "b", "a"} {
+		testutil.FatalOnErrT(t, "DeadLetter: %v", d.DeadLetter(ctx, unit(sig), failure))
+	}
+	if err := d.DeadLetter(ctx, unit("c"), failure); err == nil {
+		t.Error("DeadLetter succeeded with an unfetchable input")
+	}
+	if n := d.Units(); n != 2 {
+		t.Errorf("Units: got %d, want 2", n)
+	}
+	testutil.FatalOnErrT(t, "Close: %v", d.Close())
+
+	r := openKzip(t, path)
+	var got, digests []string
+	testutil.FatalOnErrT(t, "Scan: %v", r.Scan(func(u *kzip.Unit) error {
+		sig := u.Proto.VName.Signature
+		got = append(got, sig)
+		digests = append(digests, u.Digest)
+		data, err := r.ReadAll(digest(sig))
+		if err != nil {
+			t.Errorf("Reading input of %q: %v", sig, err)
+		} else if string(data) != sig {
+			t.Errorf("Input of %q: got %q", sig, data)
+		}
+		return nil
+	}))
+	sort.Strings(got)
+	if err := testutil.DeepEqual([]string{"a", "b"}, got); err != nil {
+		t.Errorf("Compilations: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(errLog.String()), "\n")
+	sort.Strings(lines)
+	sort.Strings(digests)
+	var want []string
+	for _, digest := range digests {
+		want = append(want, digest+"\t"+failure.Error())
+	}
+	if err := testutil.DeepEqual(want, lines); err != nil {
+		t.Errorf("Error log: %v", err)
+	}
+}
+
+// sigAnalyzer writes the signature of each compilation as its output, and
+// fails compilations whose signature is "bad".
+var sigAnalyzer = analyzerFunc(func(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+	sig := req.Compilation.VName.Signature
+	if sig == "bad" {
+		return errors.New("bad compilation")
+	}
+	return out(ctx, &apb.AnalysisOutput{Value: []byte(sig)})
+})
+
+type analyzerFunc func(context.Context, *apb.AnalysisRequest, analysis.OutputFunc) error
+
+// Analyze implements the analysis.CompilationAnalyzer interface.
+func (f analyzerFunc) Analyze(ctx context.Context, req *apb.AnalysisRequest, out analysis.OutputFunc) error {
+	return f(ctx, req, out)
+}
+
+func TestRun(t *testing.T) {
+	in, cleanup := tempDir(t)
+	defer cleanup()
+	outDir, cleanupOut := tempDir(t)
+	defer cleanupOut()
+	writeKzip(t, filepath.Join(in, "one.kzip"), "a", "b")
+	writeKzip(t, filepath.Join(in, "two.kzip"), "c")
+
+	output := filepath.Join(outDir, "out.kzip")
+	var summary bytes.Buffer
+	stats, err := Run(context.Background(), &Config{
+		Analyzer: sigAnalyzer,
+		KzipDir:  in,
+		Output:   output,
+		Summary:  &summary,
+	})
+	testutil.FatalOnErrT(t, "Run: %v", err)
+	if stats.Compilations != 3 || stats.Failed != 0 || stats.Total != 3 {
+		t.Errorf("Stats: got %d compilations of %d, %d failed; want 3 of 3, 0", stats.Compilations, stats.Total, stats.Failed)
+	}
+	var sum struct{ Compilations int }
+	if err := json.Unmarshal(summary.Bytes(), &sum); err != nil {
+		t.Errorf("Decoding summary: %v", err)
+	} else if sum.Compilations != 3 {
+		t.Errorf("Summary: got %d compilations, want 3", sum.Compilations)
+	}
+	got := readOutputs(t, output)
+	sort.Strings(got)
+	if err := testutil.DeepEqual([]string{"a", "b", "c"}, got); err != nil {
+		t.Errorf("Outputs: %v", err)
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	in, cleanup := tempDir(t)
+	defer cleanup()
+	outDir, cleanupOut := tempDir(t)
+	defer cleanupOut()
+	writeKzip(t, filepath.Join(in, "in.kzip"), "a", "bad")
+
+	output := filepath.Join(outDir, "out.kzip")
+	stats, err := Run(context.Background(), &Config{
+		Analyzer: sigAnalyzer,
+		KzipDir:  in,
+		Output:   output,
+	})
+	if err == nil {
+		t.Error("Run succeeded, want a failure")
+	}
+	if stats.Failed != 1 {
+		t.Errorf("Stats: got %d failed, want 1", stats.Failed)
+	}
+	// The output archive is closed, with its index, even though the run failed.
+	openKzip(t, output)
+}
+
+func TestRunOptions(t *testing.T) {
+	outDir, cleanup := tempDir(t)
+	defer cleanup()
+	tests := []struct {
+		desc string
+		cfg  Config
+	}{
+		{"no queue", Config{Output: filepath.Join(outDir, "out.kzip")}},
+		{"no output", Config{KzipDir: outDir}},
+		{"concurrency", Config{
+			KzipDir: outDir,
+			Output:  filepath.Join(outDir, "out.kzip"),
+			Options: []driver.Option{driver.WithConcurrency(2)},
+		}},
+		{"output beneath the kzip directory", Config{
+			KzipDir: outDir,
+			Output:  filepath.Join(outDir, "out.kzip"),
+		}},
+		{"output option", Config{
+			Queue:   NewFileQueue(nil, nil),
+			Output:  filepath.Join(outDir, "out.kzip"),
+			Options: []driver.Option{driver.WithOutput(func(context.Context, *apb.AnalysisOutput) error { return nil })},
+		}},
+		{"prefetch", Config{
+			Queue:   NewFileQueue(nil, nil),
+			Output:  filepath.Join(outDir, "out.kzip"),
+			Options: []driver.Option{func(d *driver.Driver) { d.Prefetch = 1 }},
+		}},
+	}
+	for _, test := range tests {
+		test.cfg.Analyzer = sigAnalyzer
+		if _, err := Run(context.Background(), &test.cfg); err == nil {
+			t.Errorf("Run with %s: succeeded, want an error", test.desc)
+		}
+	}
+}
+
+func TestBeneath(t *testing.T) {
+	tests := []struct {
+		path, dir string
+		want      bool
+	}{
+		{"/a/b/out.kzip", "/a/b", true},
+		{"/a/b/c/out.kzip", "/a/b/", true},
+		{"/a/b", "/a/b", true},
+		{"/a/bc/out.kzip", "/a/b", false},
+		{"/a/out.kzip", "/a/b", false},
+		{"/a/b/../out.kzip", "/a/b", false},
+	}
+	for _, test := range tests {
+		if got := beneath(test.path, test.dir); got != test.want {
+			t.Errorf("beneath(%q, %q): got %v, want %v", test.path, test.dir, got, test.want)
+		}
+	}
+}
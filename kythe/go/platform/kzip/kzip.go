@@ -350,6 +350,13 @@ func (r *Reader) canonicalUnits() (string, []*zip.File) {
 	return prefix, res
 }
 
+// NumUnits reports the number of compilation records stored in the archive,
+// without reading them.
+func (r *Reader) NumUnits() int {
+	_, units := r.canonicalUnits()
+	return len(units)
+}
+
 // Scan scans all the compilations stored in the archive, and invokes f for
 // each compilation record. If f reports an error, the scan is terminated and
 // that error is propagated to the caller of Scan.  At most 1 invocation of f
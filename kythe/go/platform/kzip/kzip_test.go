@@ -137,6 +137,10 @@ func testRoundTrip(encoding kzip.Encoding, t *testing.T) {
 		}
 	}
 
+	if n := r.NumUnits(); n != 1 {
+		t.Errorf("NumUnits: got %d, want 1", n)
+	}
+
 	// Verify that scanning works.
 	ok := false
 	if err := r.Scan(func(u *kzip.Unit) error {